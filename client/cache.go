@@ -0,0 +1,197 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Cache is a near cache: it keeps the values of the keys read with Get on
+// the client side and serves them again without a round trip, until the
+// server reports that they changed.
+//
+// It uses two connections, like Redis clients do with CLIENT TRACKING
+// REDIRECT: one for commands, whose reads the server tracks, and one on
+// which a goroutine receives the invalidation messages. If the invalidation
+// connection fails, the cache is emptied and Get reads from the server.
+//
+// Like Client, a Cache must not be used by several goroutines at once.
+type Cache struct {
+	client        *Client
+	invalidations *Client
+
+	mu     sync.Mutex
+	values map[string]interface{}
+	// reading holds the keys Get is reading from the server, false once they
+	// were invalidated, so that a value changed while being read isn't kept
+	reading map[string]bool
+	// err is why the invalidation connection stopped, after which nothing
+	// is cached
+	err error
+}
+
+// NewCache connects a near cache to the server. With no prefixes, the keys
+// read with Get are tracked; otherwise the server reports every change to
+// keys starting with one of prefixes (BCAST mode), whether they were read
+// or not.
+func NewCache(host, port string, prefixes ...string) (*Cache, error) {
+	invalidations, err := NewClient(host, port)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := invalidations.Hello(3); err != nil {
+		invalidations.Close()
+		return nil, err
+	}
+	id, err := invalidations.SendCommand([]string{"CLIENT", "ID"})
+	if err != nil {
+		invalidations.Close()
+		return nil, err
+	}
+
+	client, err := NewClient(host, port)
+	if err != nil {
+		invalidations.Close()
+		return nil, err
+	}
+	command := []string{"CLIENT", "TRACKING", "ON", "REDIRECT", strconv.FormatInt(id.(int64), 10)}
+	if len(prefixes) > 0 {
+		command = append(command, "BCAST")
+		for _, prefix := range prefixes {
+			command = append(command, "PREFIX", prefix)
+		}
+	}
+	if _, err := client.SendCommand(command); err != nil {
+		client.Close()
+		invalidations.Close()
+		return nil, err
+	}
+
+	c := &Cache{
+		client:        client,
+		invalidations: invalidations,
+		values:        make(map[string]interface{}),
+		reading:       make(map[string]bool),
+	}
+	go c.readInvalidations()
+	return c, nil
+}
+
+// Close closes both connections
+func (c *Cache) Close() error {
+	err := c.client.Close()
+	c.invalidations.Close()
+	return err
+}
+
+// Get returns the value of key, from the cache if it holds it. A missing key
+// is returned as "", like Client.Get does, and cached as well.
+func (c *Cache) Get(key string) (string, error) {
+	c.mu.Lock()
+	value, cached := c.values[key]
+	if !cached {
+		c.reading[key] = true
+	}
+	c.mu.Unlock()
+
+	if !cached {
+		var err error
+		value, err = c.client.SendCommand([]string{"GET", key})
+
+		c.mu.Lock()
+		if err == nil && c.reading[key] && c.err == nil {
+			c.values[key] = value
+		}
+		delete(c.reading, key)
+		c.mu.Unlock()
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if value == nil {
+		return "", nil
+	}
+	return value.(string), nil
+}
+
+// Do sends any other command, uncached. Its arguments are dropped from the
+// cache first, so that the connection reads its own writes without waiting
+// for their invalidation.
+func (c *Cache) Do(command []string) (interface{}, error) {
+	c.mu.Lock()
+	for _, arg := range command {
+		c.drop(arg)
+	}
+	c.mu.Unlock()
+
+	return c.client.SendCommand(command)
+}
+
+// Len returns the number of keys cached
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.values)
+}
+
+// Err returns why the cache stopped caching, or nil while it works
+func (c *Cache) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// drop removes key from the cache. Callers must hold the mutex.
+func (c *Cache) drop(key string) {
+	delete(c.values, key)
+	if _, ok := c.reading[key]; ok {
+		c.reading[key] = false
+	}
+}
+
+// readInvalidations applies the invalidation messages of the server until
+// the invalidation connection fails
+func (c *Cache) readInvalidations() {
+	for {
+		reply, err := c.invalidations.readResponse()
+		if err != nil {
+			c.stop(err)
+			return
+		}
+		push, ok := reply.(Push)
+		if !ok || len(push) != 2 || push[0] != "invalidate" {
+			c.stop(fmt.Errorf("unexpected message on the invalidation connection: %v", reply))
+			return
+		}
+
+		keys, _ := push[1].([]interface{})
+		c.mu.Lock()
+		if keys == nil {
+			// Every key was flushed
+			c.values = make(map[string]interface{})
+			for key := range c.reading {
+				c.reading[key] = false
+			}
+		}
+		for _, key := range keys {
+			if key, ok := key.(string); ok {
+				c.drop(key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// stop empties the cache for good once invalidations can't be received
+func (c *Cache) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	c.values = make(map[string]interface{})
+	for key := range c.reading {
+		c.reading[key] = false
+	}
+}
@@ -2,9 +2,14 @@ package client
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -13,10 +18,25 @@ type Client struct {
 	conn   net.Conn
 	reader *bufio.Reader
 	writer *bufio.Writer
+	// pushes holds the push messages read while waiting for a reply, until
+	// Receive returns them
+	pushes []Push
+}
+
+// Push is an out-of-band message a RESP3 server sends, such as a published
+// message, which is not the reply to a command
+type Push []interface{}
+
+// ReplyError is an error reply of the server. Inside arrays, such as the
+// reply of EXEC, it is returned as an element instead of failing the read.
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
 }
 
 func NewClient(host, port string) (*Client, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
 	if err != nil {
 		return nil, err
 	}
@@ -43,6 +63,8 @@ func (c *Client) SendCommand(command []string) (interface{}, error) {
 		// Check if it's a known command
 		knownCommands := map[string]bool{
 			"PING": true, "ECHO": true, "FLUSHALL": true, "DBSIZE": true,
+			"INFO": true, "FT._LIST": true, "MULTI": true, "EXEC": true,
+			"DISCARD": true, "UNWATCH": true,
 		}
 
 		if !knownCommands[cmd] {
@@ -51,23 +73,49 @@ func (c *Client) SendCommand(command []string) (interface{}, error) {
 		}
 	}
 
-	// Build RESP array
-	resp := fmt.Sprintf("*%d\r\n", len(command))
-	for _, arg := range command {
-		resp += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
-	}
-
-	_, err := c.writer.WriteString(resp)
-	if err != nil {
+	if err := c.writeCommand(command); err != nil {
 		return nil, err
 	}
-	err = c.writer.Flush()
-	if err != nil {
+	if err := c.writer.Flush(); err != nil {
 		return nil, err
 	}
 
-	return c.readResponse()
+	return c.readReply()
 }
+
+// readReply reads the reply to a command, setting aside the push messages
+// that arrive first
+func (c *Client) readReply() (interface{}, error) {
+	for {
+		reply, err := c.readResponse()
+		if push, ok := reply.(Push); ok && err == nil {
+			c.pushes = append(c.pushes, push)
+			continue
+		}
+		return reply, err
+	}
+}
+
+// writeCommand buffers a command as a RESP array. Arguments are written as
+// they are so binary values (including CRLF) survive the round trip.
+func (c *Client) writeCommand(command []string) error {
+	if _, err := fmt.Fprintf(c.writer, "*%d\r\n", len(command)); err != nil {
+		return err
+	}
+	for _, arg := range command {
+		if _, err := fmt.Fprintf(c.writer, "$%d\r\n", len(arg)); err != nil {
+			return err
+		}
+		if _, err := c.writer.WriteString(arg); err != nil {
+			return err
+		}
+		if _, err := c.writer.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Client) readResponse() (interface{}, error) {
 	line, err := c.reader.ReadString('\n')
 	if err != nil {
@@ -84,7 +132,7 @@ func (c *Client) readResponse() (interface{}, error) {
 	case '+': // Simple string
 		return line[1:], nil
 	case '-': // Error
-		return nil, fmt.Errorf(line[1:])
+		return nil, ReplyError(line[1:])
 	case ':': // Integer
 		return strconv.ParseInt(line[1:], 10, 64)
 	case '$': // Bulk string
@@ -97,7 +145,7 @@ func (c *Client) readResponse() (interface{}, error) {
 		}
 
 		data := make([]byte, length+2) // +2 for \r\n
-		_, err = c.reader.Read(data)
+		_, err = io.ReadFull(c.reader, data)
 		if err != nil {
 			return nil, err
 		}
@@ -111,20 +159,116 @@ func (c *Client) readResponse() (interface{}, error) {
 			return nil, nil // Null array
 		}
 
-		array := make([]interface{}, length)
-		for i := 0; i < length; i++ {
-			item, err := c.readResponse()
-			if err != nil {
-				return nil, err
-			}
-			array[i] = item
+		return c.readElements(length)
+	case '_': // Null
+		return nil, nil
+	case ',': // Double
+		switch line[1:] {
+		case "inf":
+			return math.Inf(1), nil
+		case "-inf":
+			return math.Inf(-1), nil
+		case "nan":
+			return math.NaN(), nil
 		}
-		return array, nil
+		return strconv.ParseFloat(line[1:], 64)
+	case '#': // Boolean
+		return line[1:] == "t", nil
+	case '(': // Big number
+		n, ok := new(big.Int).SetString(line[1:], 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid big number: %s", line[1:])
+		}
+		return n, nil
+	case '!', '=': // Blob error, verbatim string
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		if line[0] == '!' {
+			return nil, ReplyError(data[:length])
+		}
+		// The text follows its format, such as "txt:"
+		if length < 4 {
+			return nil, fmt.Errorf("invalid verbatim string")
+		}
+		return string(data[4:length]), nil
+	case '~', '>': // Set, push
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		elements, err := c.readElements(length)
+		if line[0] == '>' && err == nil {
+			return Push(elements), nil
+		}
+		return elements, err
+	case '%', '|': // Map, attribute
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		pairs, err := c.readElements(2 * length)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] == '|' {
+			// Attributes describe the reply that follows; it is all we return
+			return c.readResponse()
+		}
+		m := make(map[string]interface{}, length)
+		for i := 0; i < len(pairs); i += 2 {
+			m[fmt.Sprint(pairs[i])] = pairs[i+1]
+		}
+		return m, nil
 	default:
 		return nil, fmt.Errorf("unknown response type: %s", line)
 	}
 }
 
+// readElements reads the n values of an aggregate. An error reply among them
+// is returned as an element.
+func (c *Client) readElements(n int) ([]interface{}, error) {
+	elements := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		item, err := c.readResponse()
+		var replyErr ReplyError
+		if errors.As(err, &replyErr) {
+			elements[i] = replyErr
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = item
+	}
+	return elements, nil
+}
+
+// Hello switches the connection to RESP2 or RESP3 and returns what the
+// server says about itself. Over RESP3 maps are returned as
+// map[string]interface{}, sets as []interface{}, doubles as float64,
+// booleans as bool and big numbers as *big.Int.
+func (c *Client) Hello(protocol int) (map[string]interface{}, error) {
+	result, err := c.SendCommand([]string{"HELLO", strconv.Itoa(protocol)})
+	if err != nil {
+		return nil, err
+	}
+	if pairs, ok := result.([]interface{}); ok {
+		// A RESP2 reply is a flat array of keys and values
+		m := make(map[string]interface{}, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			m[fmt.Sprint(pairs[i])] = pairs[i+1]
+		}
+		return m, nil
+	}
+	return result.(map[string]interface{}), nil
+}
+
 // Convenience methods
 func (c *Client) Set(key, value string) (string, error) {
 	result, err := c.SendCommand([]string{"SET", key, value})
@@ -182,6 +326,9 @@ func (c *Client) Ping() (string, error) {
 	return result.(string), nil
 }
 
+// subscribeCommands switch the CLI to printing pushed messages
+var subscribeCommands = map[string]bool{"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true}
+
 // Interactive CLI
 func (c *Client) StartCLI() {
 	fmt.Println("Connected to Redis server. Type commands or 'quit' to exit.")
@@ -202,7 +349,21 @@ func (c *Client) StartCLI() {
 		}
 
 		// Parse command
-		parts := strings.Fields(input)
+		parts, err := SplitArgs(input)
+		if err != nil {
+			fmt.Printf("(error) %v\n", err)
+			continue
+		}
+
+		// A subscribed connection only receives messages from now on
+		if len(parts) > 1 && subscribeCommands[strings.ToUpper(parts[0])] {
+			if err := c.sendPubSub(strings.ToUpper(parts[0]), parts[1:]); err != nil {
+				fmt.Printf("(error) %v\n", err)
+				continue
+			}
+			c.readMessages()
+			return
+		}
 		result, err := c.SendCommand(parts)
 		if err != nil {
 			fmt.Printf("(error) %v\n", err)
@@ -212,7 +373,7 @@ func (c *Client) StartCLI() {
 		// Pretty print result
 		switch v := result.(type) {
 		case string:
-			fmt.Printf("\"%s\"\n", v)
+			fmt.Println(strconv.Quote(v))
 		case int64:
 			fmt.Printf("(integer) %d\n", v)
 		case []interface{}:
@@ -223,6 +384,24 @@ func (c *Client) StartCLI() {
 					fmt.Printf("%d) %v\n", i+1, item)
 				}
 			}
+		case map[string]interface{}:
+			if len(v) == 0 {
+				fmt.Println("(empty hash)")
+			}
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for i, key := range keys {
+				fmt.Printf("%d# %q => %v\n", i+1, key, v[key])
+			}
+		case float64:
+			fmt.Printf("(double) %v\n", v)
+		case bool:
+			fmt.Printf("(%v)\n", v)
+		case *big.Int:
+			fmt.Printf("(big number) %s\n", v)
 		case nil:
 			fmt.Println("(nil)")
 		default:
@@ -230,3 +409,103 @@ func (c *Client) StartCLI() {
 		}
 	}
 }
+
+// SplitArgs splits a command line into arguments the way redis-cli does.
+// Double quoted arguments may contain escapes (\n, \r, \t, \b, \a, \\, \" and
+// \xHH), so arbitrary bytes such as CRLF can be typed; single quoted arguments
+// are taken literally except for \'.
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var current []byte
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			if inDouble {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced quotes in request")
+				}
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(b))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				case line[i] == '"':
+					// The closing quote must be followed by a space or the end
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				default:
+					current = append(current, line[i])
+				}
+			} else if inSingle {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced quotes in request")
+				}
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					current = append(current, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				default:
+					current = append(current, line[i])
+				}
+			} else {
+				if i >= len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					current = append(current, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+
+		args = append(args, string(current))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
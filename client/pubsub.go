@@ -0,0 +1,175 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Message is a message published on a channel the client subscribed to.
+// Pattern is set when it arrived through a pattern subscription, and Shard
+// when it was published on a shard channel.
+type Message struct {
+	Pattern string
+	Channel string
+	Payload string
+	Shard   bool
+}
+
+// Subscription confirms a subscribe or unsubscribe: Kind is the command,
+// such as "subscribe", and Count the number of subscriptions the connection
+// holds afterwards
+type Subscription struct {
+	Kind    string
+	Channel string
+	Count   int64
+}
+
+// Publish posts message on channel and returns the number of subscribers it
+// was delivered to
+func (c *Client) Publish(channel, message string) (int64, error) {
+	result, err := c.SendCommand([]string{"PUBLISH", channel, message})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+// SPublish posts message on a shard channel and returns the number of
+// subscribers it was delivered to
+func (c *Client) SPublish(channel, message string) (int64, error) {
+	result, err := c.SendCommand([]string{"SPUBLISH", channel, message})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+// Subscribe subscribes the connection to channels. The server confirms each
+// channel with a Subscription read by Receive. Once subscribed, the
+// connection only accepts (un)subscribe commands and PING until it
+// unsubscribes from everything.
+func (c *Client) Subscribe(channels ...string) error {
+	return c.sendPubSub("SUBSCRIBE", channels)
+}
+
+// PSubscribe subscribes the connection to the channels matching patterns
+func (c *Client) PSubscribe(patterns ...string) error {
+	return c.sendPubSub("PSUBSCRIBE", patterns)
+}
+
+// Unsubscribe unsubscribes from channels, or from every channel if none are
+// given
+func (c *Client) Unsubscribe(channels ...string) error {
+	return c.sendPubSub("UNSUBSCRIBE", channels)
+}
+
+// PUnsubscribe unsubscribes from patterns, or from every pattern if none are
+// given
+func (c *Client) PUnsubscribe(patterns ...string) error {
+	return c.sendPubSub("PUNSUBSCRIBE", patterns)
+}
+
+// SSubscribe subscribes the connection to shard channels, which must all
+// hash to the same slot
+func (c *Client) SSubscribe(channels ...string) error {
+	return c.sendPubSub("SSUBSCRIBE", channels)
+}
+
+// SUnsubscribe unsubscribes from shard channels, or from every shard channel
+// if none are given
+func (c *Client) SUnsubscribe(channels ...string) error {
+	return c.sendPubSub("SUNSUBSCRIBE", channels)
+}
+
+// sendPubSub sends a (un)subscribe command without waiting for the replies,
+// which may arrive interleaved with messages
+func (c *Client) sendPubSub(command string, names []string) error {
+	if err := c.writeCommand(append([]string{command}, names...)); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// Receive waits for what the server pushes to a subscribed connection next:
+// a Message, or a Subscription confirming a (un)subscribe
+func (c *Client) Receive() (interface{}, error) {
+	var reply interface{}
+	if len(c.pushes) > 0 {
+		reply, c.pushes = c.pushes[0], c.pushes[1:]
+	} else {
+		var err error
+		if reply, err = c.readResponse(); err != nil {
+			return nil, err
+		}
+	}
+	// RESP3 sends pushes, RESP2 arrays
+	if p, isPush := reply.(Push); isPush {
+		reply = []interface{}(p)
+	}
+	push, ok := reply.([]interface{})
+	if !ok || len(push) < 3 {
+		return nil, fmt.Errorf("unexpected push: %v", reply)
+	}
+
+	kind, _ := push[0].(string)
+	switch kind = strings.ToLower(kind); kind {
+	case "message", "smessage":
+		channel, _ := push[1].(string)
+		payload, _ := push[2].(string)
+		return Message{Channel: channel, Payload: payload, Shard: kind == "smessage"}, nil
+	case "pmessage":
+		if len(push) != 4 {
+			return nil, fmt.Errorf("unexpected push: %v", reply)
+		}
+		pattern, _ := push[1].(string)
+		channel, _ := push[2].(string)
+		payload, _ := push[3].(string)
+		return Message{Pattern: pattern, Channel: channel, Payload: payload}, nil
+	case "subscribe", "psubscribe", "ssubscribe", "unsubscribe", "punsubscribe", "sunsubscribe":
+		channel, _ := push[1].(string)
+		count, _ := push[2].(int64)
+		return Subscription{Kind: kind, Channel: channel, Count: count}, nil
+	default:
+		return nil, fmt.Errorf("unexpected push: %v", reply)
+	}
+}
+
+// ReceiveMessage waits for the next published message, skipping
+// subscription confirmations
+func (c *Client) ReceiveMessage() (Message, error) {
+	for {
+		push, err := c.Receive()
+		if err != nil {
+			return Message{}, err
+		}
+		if msg, ok := push.(Message); ok {
+			return msg, nil
+		}
+	}
+}
+
+// readMessages prints what a subscribed connection receives, the way
+// redis-cli does, until the connection fails
+func (c *Client) readMessages() {
+	fmt.Println("Reading messages... (press Ctrl-C to quit)")
+	for {
+		push, err := c.Receive()
+		if err != nil {
+			fmt.Printf("(error) %v\n", err)
+			return
+		}
+		switch v := push.(type) {
+		case Message:
+			switch {
+			case v.Shard:
+				fmt.Printf("1) \"smessage\"\n2) %q\n3) %q\n", v.Channel, v.Payload)
+			case v.Pattern != "":
+				fmt.Printf("1) \"pmessage\"\n2) %q\n3) %q\n4) %q\n", v.Pattern, v.Channel, v.Payload)
+			default:
+				fmt.Printf("1) \"message\"\n2) %q\n3) %q\n", v.Channel, v.Payload)
+			}
+		case Subscription:
+			fmt.Printf("1) %q\n2) %q\n3) (integer) %d\n", v.Kind, v.Channel, v.Count)
+		}
+	}
+}
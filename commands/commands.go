@@ -2,23 +2,155 @@ package commands
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"Memora/pubsub"
+	"Memora/search"
 	"Memora/store"
 )
 
 type CommandHandler struct {
-	store *store.DataStore
+	store     *store.DataStore
+	indexes   *search.Registry
+	scripts   *scripting
+	functions *functionRegistry
+	hub       *pubsub.Hub
+
+	// exclusive lets a transaction run with no other command interleaved:
+	// commands hold it for reading, and Atomically for writing
+	exclusive sync.RWMutex
 }
 
 func NewCommandHandler(store *store.DataStore) *CommandHandler {
-	return &CommandHandler{store: store}
+	// Search indexes follow every hash write through the store's observer
+	indexes := search.NewRegistry()
+	store.SetHashObserver(indexes)
+
+	return &CommandHandler{
+		store:     store,
+		indexes:   indexes,
+		scripts:   newScripting(),
+		functions: newFunctionRegistry(),
+		hub:       pubsub.NewHub(),
+	}
 }
 
 func (h *CommandHandler) HandleCommand(command []string) interface{} {
+	return h.HandleCommandAs(0, command)
+}
+
+// HandleCommandAs runs command like HandleCommand, attributing the keys it
+// writes to the client with ID writer (see store.SetWriter), unless writer
+// is 0. Such a write runs with no other command interleaved, so that no
+// other client's write is attributed to it.
+func (h *CommandHandler) HandleCommandAs(writer int64, command []string) interface{} {
+	if len(command) == 0 {
+		return nil
+	}
+
+	name := strings.ToUpper(command[0])
+	switch name {
+	case "SCRIPT", "FUNCTION":
+		// SCRIPT KILL and FUNCTION KILL must get through while a script
+		// holds the lock
+		if len(command) == 2 && strings.EqualFold(command[1], "KILL") {
+			return h.killScript()
+		}
+	}
+
+	// A script runs with no other command interleaved
+	script := name == "EVAL" || name == "EVALSHA" || name == "FCALL" || name == "FCALL_RO"
+	if script || writer != 0 && writeCommands[name] {
+		var reply interface{}
+		if !h.Atomically(func(run func(command []string) interface{}) {
+			h.store.SetWriter(writer)
+			defer h.store.SetWriter(0)
+			reply = run(command)
+		}) {
+			return BusyReply
+		}
+		return reply
+	}
+
+	if !h.lock(true) {
+		return BusyReply
+	}
+	defer h.exclusive.RUnlock()
+
+	return h.dispatch(command)
+}
+
+// Atomically calls fn while no other command runs. fn executes commands with
+// run, which must not be used once fn has returned. It returns false without
+// calling fn if a script is busy.
+func (h *CommandHandler) Atomically(fn func(run func(command []string) interface{})) bool {
+	if !h.lock(false) {
+		return false
+	}
+	defer h.exclusive.Unlock()
+
+	fn(h.dispatch)
+	return true
+}
+
+// Snapshot takes a snapshot of the store while no other command runs, like
+// EXEC runs a transaction, so that it never holds half of a transaction or
+// script. It returns false if a script is busy.
+func (h *CommandHandler) Snapshot() (store.Snapshot, bool) {
+	var snapshot store.Snapshot
+	ok := h.Atomically(func(func(command []string) interface{}) {
+		snapshot = h.store.Snapshot()
+	})
+	return snapshot, ok
+}
+
+// busyPoll is how often a command waiting for the exclusive lock checks
+// whether the script holding it has become busy
+const busyPoll = 10 * time.Millisecond
+
+// lock takes the exclusive lock, for reading if shared is set. Like in Redis,
+// a script running past lua-time-limit isn't aborted, but the commands
+// waiting for it give up: lock then returns false, and they reply BUSY.
+func (h *CommandHandler) lock(shared bool) bool {
+	try, acquire, release := h.exclusive.TryLock, h.exclusive.Lock, h.exclusive.Unlock
+	if shared {
+		try, acquire, release = h.exclusive.TryRLock, h.exclusive.RLock, h.exclusive.RUnlock
+	}
+	if try() {
+		return true
+	}
+
+	acquired := make(chan struct{}, 1)
+	go func() {
+		acquire()
+		acquired <- struct{}{}
+	}()
+	ticker := time.NewTicker(busyPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-acquired:
+			return true
+		case <-ticker.C:
+			if h.scripts.busy() {
+				// The lock can't be abandoned while being acquired, so it is
+				// released as soon as it is
+				go func() {
+					<-acquired
+					release()
+				}()
+				return false
+			}
+		}
+	}
+}
+
+func (h *CommandHandler) dispatch(command []string) interface{} {
 	if len(command) == 0 {
 		return nil
 	}
@@ -26,6 +158,12 @@ func (h *CommandHandler) HandleCommand(command []string) interface{} {
 	cmd := strings.ToUpper(command[0])
 	args := command[1:]
 
+	if denyOOM[cmd] {
+		if err := h.store.FreeMemoryIfNeeded(); err != nil {
+			return ErrorReply(err.Error())
+		}
+	}
+
 	switch cmd {
 	// String commands
 	case "SET":
@@ -39,13 +177,65 @@ func (h *CommandHandler) HandleCommand(command []string) interface{} {
 	case "KEYS":
 		return h.handleKeys(args)
 	case "TTL":
-		return h.handleTTL(args)
+		return h.handleTTL(args, "ttl", time.Second, false)
+	case "PTTL":
+		return h.handleTTL(args, "pttl", time.Millisecond, false)
+	case "EXPIRETIME":
+		return h.handleTTL(args, "expiretime", time.Second, true)
+	case "PEXPIRETIME":
+		return h.handleTTL(args, "pexpiretime", time.Millisecond, true)
 	case "EXPIRE":
-		return h.handleExpire(args)
+		return h.handleExpire(args, "expire", time.Second, false)
+	case "PEXPIRE":
+		return h.handleExpire(args, "pexpire", time.Millisecond, false)
+	case "EXPIREAT":
+		return h.handleExpire(args, "expireat", time.Second, true)
+	case "PEXPIREAT":
+		return h.handleExpire(args, "pexpireat", time.Millisecond, true)
+	case "PERSIST":
+		return h.handlePersist(args)
+	case "OBJECT":
+		return h.handleObject(args)
+	case "SCAN":
+		return h.handleScan(args)
 	case "INCR":
 		return h.handleIncr(args)
 	case "DECR":
 		return h.handleDecr(args)
+	case "INCRBY":
+		return h.handleIncrBy(args)
+	case "DECRBY":
+		return h.handleDecrBy(args)
+	case "INCRBYFLOAT":
+		return h.handleIncrByFloat(args)
+	case "SETNX":
+		return h.handleSetNX(args)
+	case "SETEX":
+		return h.handleSetEx(args, "setex", "EX")
+	case "PSETEX":
+		return h.handleSetEx(args, "psetex", "PX")
+	case "MSET":
+		return h.handleMSet(args, false)
+	case "MSETNX":
+		return h.handleMSet(args, true)
+	case "MGET":
+		return h.handleMGet(args)
+	case "GETSET":
+		return h.handleGetSet(args)
+	case "GETDEL":
+		return h.handleGetDel(args)
+	case "GETEX":
+		return h.handleGetEx(args)
+	case "APPEND":
+		return h.handleAppend(args)
+	case "STRLEN":
+		return h.handleStrLen(args)
+	case "GETRANGE":
+		return h.handleGetRange(args)
+	case "SETRANGE":
+		return h.handleSetRange(args)
+	case "LCS":
+		return h.handleLCS(args)
 
 	// List commands
 	case "LPUSH":
@@ -68,6 +258,8 @@ func (h *CommandHandler) HandleCommand(command []string) interface{} {
 		return h.handleSMembers(args)
 	case "SISMEMBER":
 		return h.handleSIsMember(args)
+	case "SSCAN":
+		return h.handleSScan(args)
 
 	// Hash commands
 	case "HSET":
@@ -82,6 +274,42 @@ func (h *CommandHandler) HandleCommand(command []string) interface{} {
 		return h.handleHKeys(args)
 	case "HVALS":
 		return h.handleHVals(args)
+	case "HMGET":
+		return h.handleHMGet(args)
+	case "HEXISTS":
+		return h.handleHExists(args)
+	case "HLEN":
+		return h.handleHLen(args)
+	case "HSETNX":
+		return h.handleHSetNX(args)
+	case "HINCRBY":
+		return h.handleHIncrBy(args)
+	case "HINCRBYFLOAT":
+		return h.handleHIncrByFloat(args)
+	case "HSTRLEN":
+		return h.handleHStrLen(args)
+	case "HRANDFIELD":
+		return h.handleHRandField(args)
+	case "HSCAN":
+		return h.handleHScan(args)
+	case "HEXPIRE":
+		return h.handleHExpire(args, "hexpire", time.Second, false)
+	case "HPEXPIRE":
+		return h.handleHExpire(args, "hpexpire", time.Millisecond, false)
+	case "HEXPIREAT":
+		return h.handleHExpire(args, "hexpireat", time.Second, true)
+	case "HPEXPIREAT":
+		return h.handleHExpire(args, "hpexpireat", time.Millisecond, true)
+	case "HTTL":
+		return h.handleHTTL(args, "httl", time.Second, false)
+	case "HPTTL":
+		return h.handleHTTL(args, "hpttl", time.Millisecond, false)
+	case "HEXPIRETIME":
+		return h.handleHTTL(args, "hexpiretime", time.Second, true)
+	case "HPEXPIRETIME":
+		return h.handleHTTL(args, "hpexpiretime", time.Millisecond, true)
+	case "HPERSIST":
+		return h.handleHPersist(args)
 
 	// Server commands
 	case "PING":
@@ -94,10 +322,52 @@ func (h *CommandHandler) HandleCommand(command []string) interface{} {
 		return h.handleDBSize(args)
 	case "COMMAND":
 		return "OK" // Basic command support
+	case "CONFIG":
+		return h.handleConfig(args)
+	case "INFO":
+		return h.handleInfo(args)
+	case "MEMORY":
+		return h.handleMemory(args)
+
+	// Scripting commands
+	case "EVAL":
+		return h.handleEval(args, false)
+	case "EVALSHA":
+		return h.handleEval(args, true)
+	case "SCRIPT":
+		return h.handleScript(args)
+	case "FUNCTION":
+		return h.handleFunction(args)
+	case "FCALL":
+		return h.handleFcall(args, false)
+	case "FCALL_RO":
+		return h.handleFcall(args, true)
+
+	// Pub/Sub commands
+	case "PUBLISH":
+		return h.handlePublish(args)
+	case "SPUBLISH":
+		return h.handleSPublish(args)
+	case "PUBSUB":
+		return h.handlePubsub(args)
+
+	// Search commands
+	case "FT.CREATE":
+		return h.handleFTCreate(args)
+	case "FT.SEARCH":
+		return h.handleFTSearch(args)
+	case "FT.DROPINDEX":
+		return h.handleFTDropIndex(args)
+	case "FT.INFO":
+		return h.handleFTInfo(args)
+	case "FT._LIST":
+		return h.handleFTList(args)
 
 	// Sort commands
 	case "ZRANGEBYLEX":
 		return h.handleZRANGEBYLEX(args)
+	case "ZSCAN":
+		return h.handleZScan(args)
 
 	default:
 		// If it's not a recognized command, treat it as GET
@@ -112,51 +382,119 @@ func (h *CommandHandler) HandleCommand(command []string) interface{} {
 // String command handlers
 func (h *CommandHandler) handleSet(args []string) interface{} {
 	if len(args) < 2 {
-		return "ERR wrong number of arguments for 'set' command"
+		return ErrorReply("ERR wrong number of arguments for 'set' command")
 	}
 
 	key := args[0]
-	value := args[1]
-	var ttl time.Duration
-
-	// Handle SET key value EX seconds or PX milliseconds
-	if len(args) > 3 {
-		option := strings.ToUpper(args[2])
-		if option == "EX" {
-			seconds, err := strconv.Atoi(args[3])
-			if err != nil {
-				return "ERR invalid expire time in 'set' command"
+	value := []byte(args[1])
+
+	// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds |
+	//   EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+	var opts store.SetOptions
+	expireSet := false
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			if opts.XX {
+				return ErrorReply("ERR syntax error")
 			}
-			ttl = time.Duration(seconds) * time.Second
-		} else if option == "PX" {
-			millis, err := strconv.Atoi(args[3])
-			if err != nil {
-				return "ERR invalid expire time in 'set' command"
+			opts.NX = true
+		case "XX":
+			if opts.NX {
+				return ErrorReply("ERR syntax error")
+			}
+			opts.XX = true
+		case "GET":
+			opts.Get = true
+		case "KEEPTTL":
+			if expireSet {
+				return ErrorReply("ERR syntax error")
+			}
+			opts.KeepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireSet || opts.KeepTTL || i+1 >= len(args) {
+				return ErrorReply("ERR syntax error")
+			}
+			i++
+			expiration, errMsg := parseExpiration(args[i], option, "set")
+			if errMsg != "" {
+				return errMsg
 			}
-			ttl = time.Duration(millis) * time.Millisecond
+			opts.Expiration = expiration
+			expireSet = true
+		default:
+			return ErrorReply("ERR syntax error")
 		}
 	}
 
-	h.store.Set(key, value, ttl)
+	old, existed, written, err := h.store.SetWithOptions(key, value, opts)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	if opts.Get {
+		if !existed {
+			return nil
+		}
+		return old
+	}
+	if !written {
+		return nil
+	}
 	return "OK"
 }
 
+// parseExpiration converts the argument of an EX, PX, EXAT or PXAT option
+// into an absolute Unix nano timestamp
+func parseExpiration(arg, option, name string) (int64, ErrorReply) {
+	amount, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, "ERR value is not an integer or out of range"
+	}
+
+	unit := time.Second
+	if option == "PX" || option == "PXAT" {
+		unit = time.Millisecond
+	}
+	absolute := option == "EXAT" || option == "PXAT"
+
+	if amount <= 0 {
+		return 0, ErrorReply(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+	}
+	expiration, ok := absoluteExpiration(amount, unit, absolute)
+	if !ok {
+		return 0, ErrorReply(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+	}
+	return expiration, ""
+}
+
+// absoluteExpiration turns amount units (relative to now, or since the Unix
+// epoch when absolute is set) into a Unix nano timestamp, reporting overflow
+func absoluteExpiration(amount int64, unit time.Duration, absolute bool) (int64, bool) {
+	if amount > math.MaxInt64/int64(unit) || amount < math.MinInt64/int64(unit) {
+		return 0, false
+	}
+
+	at := amount * int64(unit)
+	if !absolute {
+		now := time.Now().UnixNano()
+		if at > math.MaxInt64-now {
+			return 0, false
+		}
+		at += now
+	}
+	return at, true
+}
+
 func (h *CommandHandler) handleGet(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'get' command"
+		return ErrorReply("ERR wrong number of arguments for 'get' command")
 	}
 
 	value, exists := h.store.Get(args[0])
 	if !exists {
 		return nil
 	}
-
-	// Convert to string if it's stored as string
-	if str, ok := value.(string); ok {
-		return str
-	}
-
-	return fmt.Sprintf("%v", value)
+	return value
 }
 
 func (h *CommandHandler) handleDel(args []string) interface{} {
@@ -189,7 +527,7 @@ func (h *CommandHandler) handleExists(args []string) interface{} {
 
 func (h *CommandHandler) handleKeys(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'keys' command"
+		return ErrorReply("ERR wrong number of arguments for 'keys' command")
 	}
 
 	pattern := args[0]
@@ -205,118 +543,614 @@ func (h *CommandHandler) handleKeys(args []string) interface{} {
 	return result
 }
 
-func (h *CommandHandler) handleTTL(args []string) interface{} {
+// handleScan implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (h *CommandHandler) handleScan(args []string) interface{} {
+	if len(args) < 1 {
+		return ErrorReply("ERR wrong number of arguments for 'scan' command")
+	}
+
+	cursor, pattern, count, valueType, errReply := parseScanArgs(args, true)
+	if errReply != "" {
+		return errReply
+	}
+
+	next, keys, err := h.store.Scan(cursor, pattern, count, valueType)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+
+	result := make([]interface{}, len(keys))
+	for i, key := range keys {
+		result[i] = key
+	}
+	return []interface{}{strconv.FormatUint(next, 10), result}
+}
+
+// parseScanArgs parses the cursor and options shared by the SCAN family. The
+// TYPE option is only accepted when allowType is set.
+func parseScanArgs(args []string, allowType bool) (uint64, string, int, string, ErrorReply) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, "", 0, "", "ERR invalid cursor"
+	}
+
+	pattern := "*"
+	count := 10
+	valueType := ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return 0, "", 0, "", "ERR syntax error"
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return 0, "", 0, "", "ERR value is not an integer or out of range"
+			}
+			if count < 1 {
+				return 0, "", 0, "", "ERR syntax error"
+			}
+		case "TYPE":
+			if !allowType {
+				return 0, "", 0, "", "ERR syntax error"
+			}
+			valueType = strings.ToLower(args[i+1])
+		default:
+			return 0, "", 0, "", "ERR syntax error"
+		}
+	}
+	return cursor, pattern, count, valueType, ""
+}
+
+// handleTTL implements TTL and PTTL, or EXPIRETIME and PEXPIRETIME when
+// absolute is set: <cmd> key. Keys without an expiration reply -1 and
+// missing keys -2.
+func (h *CommandHandler) handleTTL(args []string, name string, unit time.Duration, absolute bool) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'ttl' command"
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
 	}
 
-	return h.store.TTL(args[0])
+	expiration := h.store.ExpireTime(args[0])
+	switch {
+	case expiration < 0:
+		return expiration
+	case absolute:
+		return expiration / int64(unit)
+	default:
+		remaining := max(expiration-time.Now().UnixNano(), 0)
+		return (remaining + int64(unit)/2) / int64(unit)
+	}
 }
 
-func (h *CommandHandler) handleExpire(args []string) interface{} {
-	if len(args) != 2 {
-		return "ERR wrong number of arguments for 'expire' command"
+// handleExpire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT:
+// <cmd> key time [NX|XX|GT|LT]. A time that is already past deletes the key.
+func (h *CommandHandler) handleExpire(args []string, name string, unit time.Duration, absolute bool) interface{} {
+	if len(args) < 2 || len(args) > 3 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
 	}
 
-	key := args[0]
-	seconds, err := strconv.Atoi(args[1])
+	amount, err := strconv.ParseInt(args[1], 10, 64)
 	if err != nil {
-		return 0
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+
+	cond := store.ExpireAlways
+	if len(args) == 3 {
+		c, ok := parseExpireCondition(args[2])
+		if !ok {
+			return ErrorReply(fmt.Sprintf("ERR Unsupported option %s", args[2]))
+		}
+		cond = c
 	}
 
-	ttl := time.Duration(seconds) * time.Second
-	if h.store.Expire(key, ttl) {
+	at, ok := absoluteExpiration(amount, unit, absolute)
+	if !ok {
+		return ErrorReply(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+	}
+	if h.store.ExpireAt(args[0], at, cond) {
 		return 1
 	}
 	return 0
 }
 
-func (h *CommandHandler) handleIncr(args []string) interface{} {
+func (h *CommandHandler) handlePersist(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'incr' command"
+		return ErrorReply("ERR wrong number of arguments for 'persist' command")
 	}
 
-	key := args[0]
-	value, exists := h.store.Get(key)
-	if !exists {
-		h.store.Set(key, "1", 0)
+	if h.store.Persist(args[0]) {
 		return 1
 	}
+	return 0
+}
 
-	strValue, ok := value.(string)
-	if !ok {
-		return "ERR value is not an integer or out of range"
+// handleObject implements OBJECT ENCODING/IDLETIME/FREQ/HELP. Both
+// LRU and LFU metadata are always tracked, so unlike Redis IDLETIME and FREQ
+// work whatever the eviction policy.
+func (h *CommandHandler) handleObject(args []string) interface{} {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'object' command")
 	}
 
-	num, err := strconv.Atoi(strValue)
-	if err != nil {
-		return "ERR value is not an integer or out of range"
+	subcommand := strings.ToUpper(args[0])
+	if subcommand == "HELP" {
+		return []interface{}{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is",
+			"    proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"HELP",
+			"    Print this help.",
+		}
+	}
+	known := subcommand == "ENCODING" || subcommand == "IDLETIME" || subcommand == "FREQ"
+	if !known || len(args) != 2 {
+		return ErrorReply(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try OBJECT HELP.", args[0]))
 	}
 
-	num++
-	h.store.Set(key, strconv.Itoa(num), 0)
-	return num
+	info, exists := h.store.Object(args[1])
+	if !exists {
+		return nil
+	}
+
+	switch subcommand {
+	case "ENCODING":
+		return []byte(info.Encoding)
+	case "IDLETIME":
+		return int64(info.Idle / time.Second)
+	default:
+		return int64(info.Freq)
+	}
+}
+
+func (h *CommandHandler) handleIncr(args []string) interface{} {
+	if len(args) != 1 {
+		return ErrorReply("ERR wrong number of arguments for 'incr' command")
+	}
+
+	return h.incrBy(args[0], 1)
 }
 
 func (h *CommandHandler) handleDecr(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'decr' command"
+		return ErrorReply("ERR wrong number of arguments for 'decr' command")
 	}
 
-	key := args[0]
-	value, exists := h.store.Get(key)
+	return h.incrBy(args[0], -1)
+}
+
+func (h *CommandHandler) handleIncrBy(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'incrby' command")
+	}
+
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+
+	return h.incrBy(args[0], delta)
+}
+
+func (h *CommandHandler) handleDecrBy(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'decrby' command")
+	}
+
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	if delta == math.MinInt64 {
+		return ErrorReply("ERR decrement would overflow")
+	}
+
+	return h.incrBy(args[0], -delta)
+}
+
+func (h *CommandHandler) incrBy(key string, delta int64) interface{} {
+	result, err := h.store.IncrBy(key, delta)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	return result
+}
+
+func (h *CommandHandler) handleIncrByFloat(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'incrbyfloat' command")
+	}
+
+	delta, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return ErrorReply("ERR value is not a valid float")
+	}
+
+	result, err := h.store.IncrByFloat(args[0], delta)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	return []byte(strconv.FormatFloat(result, 'f', -1, 64))
+}
+
+func (h *CommandHandler) handleSetNX(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'setnx' command")
+	}
+
+	if _, _, written, _ := h.store.SetWithOptions(args[0], []byte(args[1]), store.SetOptions{NX: true}); written {
+		return 1
+	}
+	return 0
+}
+
+// handleSetEx implements SETEX (seconds) and PSETEX (milliseconds)
+func (h *CommandHandler) handleSetEx(args []string, name string, option string) interface{} {
+	if len(args) != 3 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+	}
+
+	expiration, errMsg := parseExpiration(args[1], option, name)
+	if errMsg != "" {
+		return errMsg
+	}
+
+	h.store.SetWithOptions(args[0], []byte(args[2]), store.SetOptions{Expiration: expiration})
+	return "OK"
+}
+
+// handleMSet implements MSET and MSETNX
+func (h *CommandHandler) handleMSet(args []string, nx bool) interface{} {
+	if len(args) == 0 || len(args)%2 != 0 {
+		if nx {
+			return ErrorReply("ERR wrong number of arguments for 'msetnx' command")
+		}
+		return ErrorReply("ERR wrong number of arguments for 'mset' command")
+	}
+
+	keys := make([]string, 0, len(args)/2)
+	values := make([][]byte, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+		values = append(values, []byte(args[i+1]))
+	}
+
+	written := h.store.MSet(keys, values, nx)
+	if !nx {
+		return "OK"
+	}
+	if written {
+		return 1
+	}
+	return 0
+}
+
+func (h *CommandHandler) handleMGet(args []string) interface{} {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'mget' command")
+	}
+
+	return h.store.MGet(args...)
+}
+
+func (h *CommandHandler) handleGetSet(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'getset' command")
+	}
+
+	old, existed, _, err := h.store.SetWithOptions(args[0], []byte(args[1]), store.SetOptions{Get: true})
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	if !existed {
+		return nil
+	}
+	return old
+}
+
+func (h *CommandHandler) handleGetDel(args []string) interface{} {
+	if len(args) != 1 {
+		return ErrorReply("ERR wrong number of arguments for 'getdel' command")
+	}
+
+	value, exists, err := h.store.GetDel(args[0])
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
 	if !exists {
-		h.store.Set(key, "-1", 0)
-		return -1
+		return nil
 	}
+	return value
+}
 
-	strValue, ok := value.(string)
-	if !ok {
-		return "ERR value is not an integer or out of range"
+func (h *CommandHandler) handleGetEx(args []string) interface{} {
+	if len(args) < 1 {
+		return ErrorReply("ERR wrong number of arguments for 'getex' command")
+	}
+
+	// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+	//   PXAT unix-time-milliseconds | PERSIST]
+	update := false
+	var expiration int64
+	if len(args) > 1 {
+		option := strings.ToUpper(args[1])
+		switch {
+		case option == "PERSIST" && len(args) == 2:
+			update = true
+		case (option == "EX" || option == "PX" || option == "EXAT" || option == "PXAT") && len(args) == 3:
+			at, errMsg := parseExpiration(args[2], option, "getex")
+			if errMsg != "" {
+				return errMsg
+			}
+			update = true
+			expiration = at
+		default:
+			return ErrorReply("ERR syntax error")
+		}
+	}
+
+	value, exists, err := h.store.GetEx(args[0], update, expiration)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	if !exists {
+		return nil
+	}
+	return value
+}
+
+func (h *CommandHandler) handleAppend(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'append' command")
+	}
+
+	length, err := h.store.Append(args[0], []byte(args[1]))
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	return length
+}
+
+func (h *CommandHandler) handleStrLen(args []string) interface{} {
+	if len(args) != 1 {
+		return ErrorReply("ERR wrong number of arguments for 'strlen' command")
+	}
+
+	value, _ := h.store.Get(args[0])
+	return len(value)
+}
+
+func (h *CommandHandler) handleGetRange(args []string) interface{} {
+	if len(args) != 3 {
+		return ErrorReply("ERR wrong number of arguments for 'getrange' command")
+	}
+
+	start, err1 := strconv.Atoi(args[1])
+	end, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+
+	str, _ := h.store.Get(args[0])
+
+	// Negative offsets count from the end of the string
+	if start < 0 && end < 0 && start > end {
+		return []byte{}
+	}
+	if start < 0 {
+		start += len(str)
+	}
+	if end < 0 {
+		end += len(str)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= len(str) {
+		end = len(str) - 1
+	}
+	if start > end || len(str) == 0 {
+		return []byte{}
+	}
+	return str[start : end+1]
+}
+
+// maxStringSize is the largest string value SETRANGE may produce (512 MB)
+const maxStringSize = 512 * 1024 * 1024
+
+func (h *CommandHandler) handleSetRange(args []string) interface{} {
+	if len(args) != 3 {
+		return ErrorReply("ERR wrong number of arguments for 'setrange' command")
+	}
+
+	offset, err := strconv.Atoi(args[1])
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	if offset < 0 {
+		return ErrorReply("ERR offset is out of range")
+	}
+	// Compared this way round so a huge offset can't overflow
+	if offset > maxStringSize-len(args[2]) {
+		return ErrorReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
 	}
 
-	num, err := strconv.Atoi(strValue)
+	length, err := h.store.SetRange(args[0], offset, []byte(args[2]))
 	if err != nil {
-		return "ERR value is not an integer or out of range"
+		return ErrorReply(err.Error())
+	}
+	return length
+}
+
+func (h *CommandHandler) handleLCS(args []string) interface{} {
+	if len(args) < 2 {
+		return ErrorReply("ERR wrong number of arguments for 'lcs' command")
+	}
+
+	// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN min-match-len] [WITHMATCHLEN]
+	getLen, getIdx, withMatchLen := false, false, false
+	minMatchLen := 0
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 >= len(args) {
+				return ErrorReply("ERR syntax error")
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				return ErrorReply("ERR value is not an integer or out of range")
+			}
+			if n > 0 {
+				minMatchLen = n
+			}
+		default:
+			return ErrorReply("ERR syntax error")
+		}
+	}
+	if getLen && getIdx {
+		return ErrorReply("ERR If you want both the length and indexes, please just use IDX.")
+	}
+
+	a, _ := h.store.Get(args[0])
+	b, _ := h.store.Get(args[1])
+	// Like Redis, refuse a table of lengths bigger than proto-max-bulk-len
+	if (len(a)+1)*(len(b)+1) > maxStringSize/4 {
+		return ErrorReply("ERR String too long for LCS")
 	}
 
-	num--
-	h.store.Set(key, strconv.Itoa(num), 0)
-	return num
+	lcs, matches := longestCommonSubsequence(a, b)
+	if getLen {
+		return len(lcs)
+	}
+	if !getIdx {
+		return lcs
+	}
+
+	matchList := make([]interface{}, 0, len(matches))
+	for _, m := range matches {
+		if m.length < minMatchLen {
+			continue
+		}
+		item := []interface{}{
+			[]interface{}{m.aStart, m.aStart + m.length - 1},
+			[]interface{}{m.bStart, m.bStart + m.length - 1},
+		}
+		if withMatchLen {
+			item = append(item, m.length)
+		}
+		matchList = append(matchList, item)
+	}
+	return []interface{}{"matches", matchList, "len", len(lcs)}
+}
+
+type lcsMatch struct {
+	aStart, bStart, length int
+}
+
+// longestCommonSubsequence returns the LCS of a and b together with the
+// contiguous ranges that make it up, reported from the end of the strings
+// backwards like Redis does.
+func longestCommonSubsequence(a, b []byte) ([]byte, []lcsMatch) {
+	// dp[i*width+j] is the LCS length of a[:i] and b[:j]
+	width := len(b) + 1
+	dp := make([]uint32, (len(a)+1)*width)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				dp[i*width+j] = dp[(i-1)*width+j-1] + 1
+			} else {
+				dp[i*width+j] = max(dp[(i-1)*width+j], dp[i*width+j-1])
+			}
+		}
+	}
+
+	result := make([]byte, dp[len(dp)-1])
+	matches := make([]lcsMatch, 0)
+	idx := len(result)
+	var current *lcsMatch
+
+	for i, j := len(a), len(b); i > 0 && j > 0; {
+		if a[i-1] == b[j-1] {
+			idx--
+			result[idx] = a[i-1]
+			if current != nil && current.aStart == i && current.bStart == j {
+				current.aStart--
+				current.bStart--
+				current.length++
+			} else {
+				matches = append(matches, lcsMatch{aStart: i - 1, bStart: j - 1, length: 1})
+				current = &matches[len(matches)-1]
+			}
+			i--
+			j--
+		} else if dp[(i-1)*width+j] >= dp[i*width+j-1] {
+			i--
+		} else {
+			j--
+		}
+	}
+
+	return result, matches
 }
 
 // List command handlers
 func (h *CommandHandler) handleLPush(args []string) interface{} {
 	if len(args) < 2 {
-		return "ERR wrong number of arguments for 'lpush' command"
+		return ErrorReply("ERR wrong number of arguments for 'lpush' command")
 	}
 
 	key := args[0]
-	values := make([]interface{}, len(args)-1)
+	values := make([][]byte, len(args)-1)
 	for i, arg := range args[1:] {
-		values[i] = arg
+		values[i] = []byte(arg)
 	}
 
-	return h.store.LPush(key, values...)
+	length, err := h.store.LPush(key, values...)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	return length
 }
 
 func (h *CommandHandler) handleRPush(args []string) interface{} {
 	if len(args) < 2 {
-		return "ERR wrong number of arguments for 'rpush' command"
+		return ErrorReply("ERR wrong number of arguments for 'rpush' command")
 	}
 
 	key := args[0]
-	values := make([]interface{}, len(args)-1)
+	values := make([][]byte, len(args)-1)
 	for i, arg := range args[1:] {
-		values[i] = arg
+		values[i] = []byte(arg)
 	}
 
-	return h.store.RPush(key, values...)
+	length, err := h.store.RPush(key, values...)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	return length
 }
 
 func (h *CommandHandler) handleLPop(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'lpop' command"
+		return ErrorReply("ERR wrong number of arguments for 'lpop' command")
 	}
 
 	return h.store.LPop(args[0])
@@ -324,7 +1158,7 @@ func (h *CommandHandler) handleLPop(args []string) interface{} {
 
 func (h *CommandHandler) handleRPop(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'rpop' command"
+		return ErrorReply("ERR wrong number of arguments for 'rpop' command")
 	}
 
 	return h.store.RPop(args[0])
@@ -332,7 +1166,7 @@ func (h *CommandHandler) handleRPop(args []string) interface{} {
 
 func (h *CommandHandler) handleLLen(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'llen' command"
+		return ErrorReply("ERR wrong number of arguments for 'llen' command")
 	}
 
 	return h.store.LLen(args[0])
@@ -341,27 +1175,31 @@ func (h *CommandHandler) handleLLen(args []string) interface{} {
 // Set command handlers
 func (h *CommandHandler) handleSAdd(args []string) interface{} {
 	if len(args) < 2 {
-		return "ERR wrong number of arguments for 'sadd' command"
+		return ErrorReply("ERR wrong number of arguments for 'sadd' command")
 	}
 
 	key := args[0]
-	members := make([]interface{}, len(args)-1)
+	members := make([][]byte, len(args)-1)
 	for i, arg := range args[1:] {
-		members[i] = arg
+		members[i] = []byte(arg)
 	}
 
-	return h.store.SAdd(key, members...)
+	added, err := h.store.SAdd(key, members...)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	return added
 }
 
 func (h *CommandHandler) handleSRem(args []string) interface{} {
 	if len(args) < 2 {
-		return "ERR wrong number of arguments for 'srem' command"
+		return ErrorReply("ERR wrong number of arguments for 'srem' command")
 	}
 
 	key := args[0]
-	members := make([]interface{}, len(args)-1)
+	members := make([][]byte, len(args)-1)
 	for i, arg := range args[1:] {
-		members[i] = arg
+		members[i] = []byte(arg)
 	}
 
 	return h.store.SRem(key, members...)
@@ -369,31 +1207,50 @@ func (h *CommandHandler) handleSRem(args []string) interface{} {
 
 func (h *CommandHandler) handleSMembers(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'smembers' command"
+		return ErrorReply("ERR wrong number of arguments for 'smembers' command")
 	}
 
 	members := h.store.SMembers(args[0])
-	if members == nil {
-		return []interface{}{}
+	result := make(Set, len(members))
+	for i, member := range members {
+		result[i] = member
 	}
-	return members
+	return result
 }
 
 func (h *CommandHandler) handleSIsMember(args []string) interface{} {
 	if len(args) != 2 {
-		return "ERR wrong number of arguments for 'sismember' command"
+		return ErrorReply("ERR wrong number of arguments for 'sismember' command")
 	}
 
-	if h.store.SIsMember(args[0], args[1]) {
+	if h.store.SIsMember(args[0], []byte(args[1])) {
 		return 1
 	}
 	return 0
 }
 
+func (h *CommandHandler) handleSScan(args []string) interface{} {
+	if len(args) < 2 {
+		return ErrorReply("ERR wrong number of arguments for 'sscan' command")
+	}
+
+	cursor, pattern, count, _, errReply := parseScanArgs(args[1:], false)
+	if errReply != "" {
+		return errReply
+	}
+
+	next, members := h.store.SScan(args[0], cursor, pattern, count)
+	result := make([]interface{}, len(members))
+	for i, member := range members {
+		result[i] = member
+	}
+	return []interface{}{strconv.FormatUint(next, 10), result}
+}
+
 // Hash command handlers
 func (h *CommandHandler) handleHSet(args []string) interface{} {
 	if len(args) < 3 || len(args)%2 != 1 {
-		return "ERR wrong number of arguments for 'hset' command"
+		return ErrorReply("ERR wrong number of arguments for 'hset' command")
 	}
 
 	key := args[0]
@@ -401,8 +1258,12 @@ func (h *CommandHandler) handleHSet(args []string) interface{} {
 
 	for i := 1; i < len(args); i += 2 {
 		field := args[i]
-		value := args[i+1]
-		if h.store.HSet(key, field, value) {
+		value := []byte(args[i+1])
+		created, err := h.store.HSet(key, field, value)
+		if err != nil {
+			return ErrorReply(err.Error())
+		}
+		if created {
 			added++
 		}
 	}
@@ -412,7 +1273,7 @@ func (h *CommandHandler) handleHSet(args []string) interface{} {
 
 func (h *CommandHandler) handleHGet(args []string) interface{} {
 	if len(args) != 2 {
-		return "ERR wrong number of arguments for 'hget' command"
+		return ErrorReply("ERR wrong number of arguments for 'hget' command")
 	}
 
 	return h.store.HGet(args[0], args[1])
@@ -420,7 +1281,7 @@ func (h *CommandHandler) handleHGet(args []string) interface{} {
 
 func (h *CommandHandler) handleHDel(args []string) interface{} {
 	if len(args) < 2 {
-		return "ERR wrong number of arguments for 'hdel' command"
+		return ErrorReply("ERR wrong number of arguments for 'hdel' command")
 	}
 
 	return h.store.HDel(args[0], args[1:]...)
@@ -428,15 +1289,11 @@ func (h *CommandHandler) handleHDel(args []string) interface{} {
 
 func (h *CommandHandler) handleHGetAll(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'hgetall' command"
+		return ErrorReply("ERR wrong number of arguments for 'hgetall' command")
 	}
 
 	hash := h.store.HGetAll(args[0])
-	if hash == nil {
-		return []interface{}{}
-	}
-
-	result := make([]interface{}, 0, len(hash)*2)
+	result := make(Map, 0, len(hash)*2)
 	for field, value := range hash {
 		result = append(result, field, value)
 	}
@@ -445,7 +1302,7 @@ func (h *CommandHandler) handleHGetAll(args []string) interface{} {
 
 func (h *CommandHandler) handleHKeys(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'hkeys' command"
+		return ErrorReply("ERR wrong number of arguments for 'hkeys' command")
 	}
 
 	hash := h.store.HGetAll(args[0])
@@ -462,7 +1319,7 @@ func (h *CommandHandler) handleHKeys(args []string) interface{} {
 
 func (h *CommandHandler) handleHVals(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'hvals' command"
+		return ErrorReply("ERR wrong number of arguments for 'hvals' command")
 	}
 
 	hash := h.store.HGetAll(args[0])
@@ -477,12 +1334,286 @@ func (h *CommandHandler) handleHVals(args []string) interface{} {
 	return values
 }
 
+func (h *CommandHandler) handleHMGet(args []string) interface{} {
+	if len(args) < 2 {
+		return ErrorReply("ERR wrong number of arguments for 'hmget' command")
+	}
+
+	return h.store.HMGet(args[0], args[1:]...)
+}
+
+func (h *CommandHandler) handleHExists(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'hexists' command")
+	}
+
+	if h.store.HExists(args[0], args[1]) {
+		return 1
+	}
+	return 0
+}
+
+func (h *CommandHandler) handleHLen(args []string) interface{} {
+	if len(args) != 1 {
+		return ErrorReply("ERR wrong number of arguments for 'hlen' command")
+	}
+
+	return h.store.HLen(args[0])
+}
+
+func (h *CommandHandler) handleHSetNX(args []string) interface{} {
+	if len(args) != 3 {
+		return ErrorReply("ERR wrong number of arguments for 'hsetnx' command")
+	}
+
+	set, err := h.store.HSetNX(args[0], args[1], []byte(args[2]))
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	if set {
+		return 1
+	}
+	return 0
+}
+
+func (h *CommandHandler) handleHIncrBy(args []string) interface{} {
+	if len(args) != 3 {
+		return ErrorReply("ERR wrong number of arguments for 'hincrby' command")
+	}
+
+	increment, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+
+	result, err := h.store.HIncrBy(args[0], args[1], increment)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	return result
+}
+
+func (h *CommandHandler) handleHIncrByFloat(args []string) interface{} {
+	if len(args) != 3 {
+		return ErrorReply("ERR wrong number of arguments for 'hincrbyfloat' command")
+	}
+
+	increment, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || math.IsNaN(increment) || math.IsInf(increment, 0) {
+		return ErrorReply("ERR value is not a valid float")
+	}
+
+	result, err := h.store.HIncrByFloat(args[0], args[1], increment)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	return []byte(strconv.FormatFloat(result, 'f', -1, 64))
+}
+
+func (h *CommandHandler) handleHStrLen(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'hstrlen' command")
+	}
+
+	return h.store.HStrLen(args[0], args[1])
+}
+
+// maxRandomCount bounds the negative count of HRANDFIELD, which repeats
+// fields as often as asked: the reply is built in memory, so an absurd count
+// would exhaust it
+const maxRandomCount = 1 << 24
+
+func (h *CommandHandler) handleHRandField(args []string) interface{} {
+	if len(args) < 1 || len(args) > 3 {
+		return ErrorReply("ERR wrong number of arguments for 'hrandfield' command")
+	}
+
+	key := args[0]
+
+	// HRANDFIELD key returns a single field, or nil for a missing key
+	if len(args) == 1 {
+		fields := h.store.HRandField(key, 1)
+		if len(fields) == 0 {
+			return nil
+		}
+		return []byte(fields[0])
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	if count < -maxRandomCount {
+		return ErrorReply("ERR value is out of range")
+	}
+
+	withValues := false
+	if len(args) == 3 {
+		if strings.ToUpper(args[2]) != "WITHVALUES" {
+			return ErrorReply("ERR syntax error")
+		}
+		withValues = true
+	}
+
+	fields := h.store.HRandField(key, count)
+	result := make([]interface{}, 0, len(fields))
+	if !withValues {
+		for _, field := range fields {
+			result = append(result, field)
+		}
+		return result
+	}
+
+	values := h.store.HMGet(key, fields...)
+	for i, field := range fields {
+		result = append(result, field, values[i])
+	}
+	return result
+}
+
+func (h *CommandHandler) handleHScan(args []string) interface{} {
+	if len(args) < 2 {
+		return ErrorReply("ERR wrong number of arguments for 'hscan' command")
+	}
+
+	cursor, pattern, count, _, errReply := parseScanArgs(args[1:], false)
+	if errReply != "" {
+		return errReply
+	}
+
+	next, items := h.store.HScan(args[0], cursor, pattern, count)
+	return []interface{}{strconv.FormatUint(next, 10), items}
+}
+
+// handleHExpire implements HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT:
+// <cmd> key time [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func (h *CommandHandler) handleHExpire(args []string, name string, unit time.Duration, absolute bool) interface{} {
+	if len(args) < 5 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+	}
+
+	key := args[0]
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	if amount < 0 {
+		return ErrorReply(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+	}
+
+	rest := args[2:]
+	cond := store.ExpireAlways
+	if c, ok := parseExpireCondition(rest[0]); ok {
+		cond = c
+		rest = rest[1:]
+	}
+
+	fields, errMsg := parseFieldsArgument(rest)
+	if errMsg != "" {
+		return errMsg
+	}
+
+	at, ok := absoluteExpiration(amount, unit, absolute)
+	if !ok {
+		return ErrorReply(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+	}
+
+	codes := h.store.HExpire(key, at, cond, fields...)
+	result := make([]interface{}, len(codes))
+	for i, code := range codes {
+		result[i] = code
+	}
+	return result
+}
+
+// handleHTTL implements HTTL and HPTTL, or HEXPIRETIME and HPEXPIRETIME when
+// absolute is set: <cmd> key FIELDS numfields field [field ...]
+func (h *CommandHandler) handleHTTL(args []string, name string, unit time.Duration, absolute bool) interface{} {
+	if len(args) < 3 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+	}
+
+	fields, errMsg := parseFieldsArgument(args[1:])
+	if errMsg != "" {
+		return errMsg
+	}
+
+	now := time.Now().UnixNano()
+	expirations := h.store.HExpireTime(args[0], fields...)
+	result := make([]interface{}, len(expirations))
+	for i, expiration := range expirations {
+		switch {
+		case expiration < 0:
+			result[i] = expiration
+		case absolute:
+			result[i] = expiration / int64(unit)
+		default:
+			remaining := expiration - now
+			if remaining < 0 {
+				remaining = 0
+			}
+			result[i] = (remaining + int64(unit)/2) / int64(unit)
+		}
+	}
+	return result
+}
+
+func (h *CommandHandler) handleHPersist(args []string) interface{} {
+	if len(args) < 3 {
+		return ErrorReply("ERR wrong number of arguments for 'hpersist' command")
+	}
+
+	fields, errMsg := parseFieldsArgument(args[1:])
+	if errMsg != "" {
+		return errMsg
+	}
+
+	codes := h.store.HPersist(args[0], fields...)
+	result := make([]interface{}, len(codes))
+	for i, code := range codes {
+		result[i] = code
+	}
+	return result
+}
+
+func parseExpireCondition(arg string) (store.ExpireCondition, bool) {
+	switch strings.ToUpper(arg) {
+	case "NX":
+		return store.ExpireNX, true
+	case "XX":
+		return store.ExpireXX, true
+	case "GT":
+		return store.ExpireGT, true
+	case "LT":
+		return store.ExpireLT, true
+	}
+	return store.ExpireAlways, false
+}
+
+// parseFieldsArgument parses the "FIELDS numfields field [field ...]" tail of
+// the hash field expiration commands
+func parseFieldsArgument(args []string) ([]string, ErrorReply) {
+	if len(args) < 2 || strings.ToUpper(args[0]) != "FIELDS" {
+		return nil, "ERR mandatory argument FIELDS is missing or not at the right position"
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count <= 0 {
+		return nil, "ERR Parameter `numFields` should be greater than 0"
+	}
+	if count != len(args)-2 {
+		return nil, "ERR The `numfields` parameter must match the number of arguments"
+	}
+
+	return args[2:], ""
+}
+
 // Server command handlers
 func (h *CommandHandler) handleEcho(args []string) interface{} {
 	if len(args) != 1 {
-		return "ERR wrong number of arguments for 'echo' command"
+		return ErrorReply("ERR wrong number of arguments for 'echo' command")
 	}
-	return args[0]
+	return []byte(args[0])
 }
 
 func (h *CommandHandler) handleFlushAll(args []string) interface{} {
@@ -497,25 +1628,17 @@ func (h *CommandHandler) handleDBSize(args []string) interface{} {
 
 func (h *CommandHandler) handleZRANGEBYLEX(args []string) interface{} {
 	if len(args) != 2 {
-		return "ERR wrong number of arguments for 'ZRANGEBYLEX' command"
+		return ErrorReply("ERR wrong number of arguments for 'ZRANGEBYLEX' command")
 	}
 
 	key := args[0]
 	order := args[1] // "I" for increasing, "D" for decreasing
 
-	// Get members (assumed to return []interface{})
-	membersIface := h.store.SMembers(key)
-	if membersIface == nil {
-		return []interface{}{}
-	}
-
-	// Convert []interface{} to []string
-	members := make([]string, 0, len(membersIface))
-	for _, v := range membersIface {
-		str, ok := v.(string)
-		if ok {
-			members = append(members, str)
-		}
+	// Convert [][]byte to []string
+	rawMembers := h.store.SMembers(key)
+	members := make([]string, 0, len(rawMembers))
+	for _, v := range rawMembers {
+		members = append(members, string(v))
 	}
 
 	// Sort members
@@ -525,7 +1648,7 @@ func (h *CommandHandler) handleZRANGEBYLEX(args []string) interface{} {
 	case "D":
 		sort.Sort(sort.Reverse(sort.StringSlice(members)))
 	default:
-		return "ERR invalid sort order; use 'I' or 'D'"
+		return ErrorReply("ERR invalid sort order; use 'I' or 'D'")
 	}
 
 	// Convert back to []interface{}
@@ -536,3 +1659,24 @@ func (h *CommandHandler) handleZRANGEBYLEX(args []string) interface{} {
 
 	return result
 }
+
+// handleZScan iterates a sorted set. There is no sorted set type yet: like
+// ZRANGEBYLEX, it reads a set as a sorted set whose members all have a score
+// of 0.
+func (h *CommandHandler) handleZScan(args []string) interface{} {
+	if len(args) < 2 {
+		return ErrorReply("ERR wrong number of arguments for 'zscan' command")
+	}
+
+	cursor, pattern, count, _, errReply := parseScanArgs(args[1:], false)
+	if errReply != "" {
+		return errReply
+	}
+
+	next, members := h.store.SScan(args[0], cursor, pattern, count)
+	result := make([]interface{}, 0, 2*len(members))
+	for _, member := range members {
+		result = append(result, member, []byte("0"))
+	}
+	return []interface{}{strconv.FormatUint(next, 10), result}
+}
@@ -0,0 +1,428 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"Memora/store"
+)
+
+func newTestHandler() *CommandHandler {
+	return NewCommandHandler(store.NewDataStore())
+}
+
+func TestHRandFieldCounts(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"HSET", "h", "a", "1", "b", "2", "c", "3"})
+
+	tests := []struct {
+		name   string
+		args   []string
+		length int
+		err    bool
+	}{
+		{"distinct", []string{"5"}, 3, false},
+		{"zero", []string{"0"}, 0, false},
+		{"repeated", []string{"-5"}, 5, false},
+		{"with values", []string{"-4", "WITHVALUES"}, 8, false},
+		{"min int64", []string{strconv.FormatInt(-1<<63, 10)}, 0, true},
+		{"min int64 with values", []string{strconv.FormatInt(-1<<63, 10), "WITHVALUES"}, 0, true},
+		{"huge negative", []string{strconv.FormatInt(-1<<62, 10)}, 0, true},
+		{"above the limit", []string{strconv.Itoa(-maxRandomCount - 1)}, 0, true},
+		{"not an integer", []string{"x"}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := h.HandleCommand(append([]string{"HRANDFIELD", "h"}, tt.args...))
+			if tt.err {
+				if _, ok := reply.(ErrorReply); !ok {
+					t.Fatalf("got %v, want an error", reply)
+				}
+				return
+			}
+			elements, ok := reply.([]interface{})
+			if !ok || len(elements) != tt.length {
+				t.Fatalf("got %v, want %d elements", reply, tt.length)
+			}
+		})
+	}
+}
+
+func TestHRandFieldMissingKey(t *testing.T) {
+	h := newTestHandler()
+	if reply := h.HandleCommand([]string{"HRANDFIELD", "missing", "-3"}); len(reply.([]interface{})) != 0 {
+		t.Fatalf("got %v, want an empty array", reply)
+	}
+}
+
+func TestSetRangeOffsets(t *testing.T) {
+	h := newTestHandler()
+
+	tests := []struct {
+		offset string
+		want   interface{}
+	}{
+		{"0", int64(3)},
+		{"5", int64(8)},
+		{strconv.Itoa(maxStringSize - 2), ErrorReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")},
+		{strconv.FormatInt(1<<63-1, 10), ErrorReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")},
+		{"-1", ErrorReply("ERR offset is out of range")},
+	}
+	for _, tt := range tests {
+		reply := h.HandleCommand([]string{"SETRANGE", "s", tt.offset, "abc"})
+		if n, ok := reply.(int); ok {
+			reply = int64(n)
+		}
+		if reply != tt.want {
+			t.Errorf("SETRANGE s %s abc = %v, want %v", tt.offset, reply, tt.want)
+		}
+	}
+}
+
+func TestSetReplacesEveryType(t *testing.T) {
+	const wrongType = ErrorReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+	tests := []struct {
+		setup   []string
+		command []string
+		want    interface{}
+		get     interface{}
+	}{
+		{[]string{"RPUSH", "k", "x"}, []string{"SET", "k", "v", "NX"}, nil, nil},
+		{[]string{"SADD", "k", "x"}, []string{"SET", "k", "v", "XX"}, "OK", []byte("v")},
+		{[]string{"HSET", "k", "f", "x"}, []string{"SET", "k", "v"}, "OK", []byte("v")},
+		{[]string{"RPUSH", "k", "x"}, []string{"SET", "k", "v", "GET"}, wrongType, nil},
+		{[]string{"RPUSH", "k", "x"}, []string{"GETSET", "k", "v"}, wrongType, nil},
+		{[]string{"RPUSH", "k", "x"}, []string{"SETNX", "k", "v"}, int64(0), nil},
+		{[]string{"RPUSH", "k", "x"}, []string{"MSET", "k", "v"}, "OK", []byte("v")},
+		{[]string{"SET", "k", "old"}, []string{"GETSET", "k", "v"}, []byte("old"), []byte("v")},
+	}
+	for _, tt := range tests {
+		h := newTestHandler()
+		h.HandleCommand(tt.setup)
+		reply := h.HandleCommand(tt.command)
+		if n, ok := reply.(int); ok {
+			reply = int64(n)
+		}
+		if fmt.Sprint(reply) != fmt.Sprint(tt.want) {
+			t.Errorf("%v after %v = %v, want %v", tt.command, tt.setup, reply, tt.want)
+		}
+		if get := h.HandleCommand([]string{"GET", "k"}); fmt.Sprint(get) != fmt.Sprint(tt.get) {
+			t.Errorf("GET k after %v = %v, want %v", tt.command, get, tt.get)
+		}
+		// A key replaced by a string is gone from the table of its old type
+		if tt.get != nil && tt.setup[0] != "SET" {
+			if n := h.HandleCommand([]string{"EXISTS", "k"}); fmt.Sprint(n) != "1" {
+				t.Errorf("EXISTS k after %v = %v, want 1", tt.command, n)
+			}
+			if n := h.HandleCommand([]string{"LLEN", "k"}); fmt.Sprint(n) != "0" {
+				t.Errorf("LLEN k after %v = %v, want 0", tt.command, n)
+			}
+		}
+	}
+}
+
+func TestStringCommandsRejectOtherTypes(t *testing.T) {
+	const wrongType = ErrorReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+	commands := [][]string{
+		{"INCR", "k"},
+		{"DECRBY", "k", "2"},
+		{"INCRBYFLOAT", "k", "1.5"},
+		{"APPEND", "k", "x"},
+		{"SETRANGE", "k", "0", "x"},
+		{"SETRANGE", "k", "0", ""},
+		{"GETDEL", "k"},
+		{"GETEX", "k", "PERSIST"},
+	}
+	for _, setup := range [][]string{{"RPUSH", "k", "a"}, {"SADD", "k", "a"}, {"HSET", "k", "f", "a"}} {
+		for _, command := range commands {
+			h := newTestHandler()
+			h.HandleCommand(setup)
+			if reply := h.HandleCommand(command); reply != wrongType {
+				t.Errorf("%v after %v = %v, want WRONGTYPE", command, setup, reply)
+			}
+			if n := h.HandleCommand([]string{"EXISTS", "k"}); fmt.Sprint(n) != "1" {
+				t.Errorf("EXISTS k after %v = %v, want 1", command, n)
+			}
+		}
+	}
+}
+
+func TestCollectionWritesRejectOtherTypes(t *testing.T) {
+	const wrongType = ErrorReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+	tests := []struct {
+		setup   []string
+		command []string
+	}{
+		{[]string{"SET", "k", "v"}, []string{"LPUSH", "k", "a"}},
+		{[]string{"SADD", "k", "v"}, []string{"RPUSH", "k", "a"}},
+		{[]string{"SET", "k", "v"}, []string{"SADD", "k", "a"}},
+		{[]string{"HSET", "k", "f", "v"}, []string{"SADD", "k", "a"}},
+		{[]string{"SET", "k", "v"}, []string{"HSET", "k", "f", "a"}},
+		{[]string{"RPUSH", "k", "v"}, []string{"HSET", "k", "f", "a", "g", "b"}},
+		{[]string{"SADD", "k", "v"}, []string{"HSETNX", "k", "f", "a"}},
+		{[]string{"SET", "k", "v"}, []string{"HINCRBY", "k", "f", "1"}},
+		{[]string{"RPUSH", "k", "v"}, []string{"HINCRBYFLOAT", "k", "f", "1.5"}},
+	}
+	for _, tt := range tests {
+		h := newTestHandler()
+		h.HandleCommand(tt.setup)
+		if reply := h.HandleCommand(tt.command); reply != wrongType {
+			t.Errorf("%v after %v = %v, want WRONGTYPE", tt.command, tt.setup, reply)
+		}
+		// The key keeps the value it was created with
+		read := readBack[tt.setup[0]]
+		if reply := h.HandleCommand(read.command); fmt.Sprint(reply) != fmt.Sprint(read.want) {
+			t.Errorf("%v after %v = %v, want %v", read.command, tt.command, reply, read.want)
+		}
+	}
+}
+
+// readBack maps the command that created k with the value v to one reading
+// it back
+var readBack = map[string]struct {
+	command []string
+	want    interface{}
+}{
+	"SET":   {[]string{"GET", "k"}, []byte("v")},
+	"RPUSH": {[]string{"LPOP", "k"}, []byte("v")},
+	"SADD":  {[]string{"SMEMBERS", "k"}, []interface{}{[]byte("v")}},
+	"HSET":  {[]string{"HGET", "k", "f"}, []byte("v")},
+}
+
+func TestHashFieldExpiration(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   []string
+		command []string
+		want    string
+		check   []string
+		checked string
+	}{
+		{"set", nil, []string{"HEXPIRE", "h", "100", "FIELDS", "2", "f", "missing"}, "[1 -2]",
+			[]string{"HTTL", "h", "FIELDS", "2", "f", "g"}, "[100 -1]"},
+		{"NX without ttl", nil, []string{"HEXPIRE", "h", "100", "NX", "FIELDS", "1", "f"}, "[1]", nil, ""},
+		{"NX with ttl", []string{"HEXPIRE", "h", "100", "FIELDS", "1", "f"},
+			[]string{"HEXPIRE", "h", "200", "NX", "FIELDS", "1", "f"}, "[0]",
+			[]string{"HTTL", "h", "FIELDS", "1", "f"}, "[100]"},
+		{"XX without ttl", nil, []string{"HEXPIRE", "h", "100", "XX", "FIELDS", "1", "f"}, "[0]",
+			[]string{"HTTL", "h", "FIELDS", "1", "f"}, "[-1]"},
+		{"XX with ttl", []string{"HEXPIRE", "h", "100", "FIELDS", "1", "f"},
+			[]string{"HEXPIRE", "h", "200", "XX", "FIELDS", "1", "f"}, "[1]",
+			[]string{"HTTL", "h", "FIELDS", "1", "f"}, "[200]"},
+		{"GT without ttl", nil, []string{"HEXPIRE", "h", "100", "GT", "FIELDS", "1", "f"}, "[0]", nil, ""},
+		{"GT later", []string{"HEXPIRE", "h", "100", "FIELDS", "1", "f"},
+			[]string{"HEXPIRE", "h", "200", "GT", "FIELDS", "1", "f"}, "[1]", nil, ""},
+		{"GT sooner", []string{"HEXPIRE", "h", "100", "FIELDS", "1", "f"},
+			[]string{"HEXPIRE", "h", "50", "GT", "FIELDS", "1", "f"}, "[0]", nil, ""},
+		{"LT without ttl", nil, []string{"HEXPIRE", "h", "100", "LT", "FIELDS", "1", "f"}, "[1]", nil, ""},
+		{"LT later", []string{"HEXPIRE", "h", "100", "FIELDS", "1", "f"},
+			[]string{"HEXPIRE", "h", "200", "LT", "FIELDS", "1", "f"}, "[0]", nil, ""},
+		{"zero deletes the field", nil, []string{"HEXPIRE", "h", "0", "FIELDS", "1", "f"}, "[2]",
+			[]string{"HLEN", "h"}, "1"},
+		{"past deletes the key with its last field", nil, []string{"HPEXPIREAT", "h", "1", "FIELDS", "2", "f", "g"}, "[2 2]",
+			[]string{"EXISTS", "h"}, "0"},
+		{"persist", []string{"HEXPIRE", "h", "100", "FIELDS", "1", "f"},
+			[]string{"HPERSIST", "h", "FIELDS", "3", "f", "g", "missing"}, "[1 -1 -2]",
+			[]string{"HTTL", "h", "FIELDS", "1", "f"}, "[-1]"},
+		{"negative", nil, []string{"HEXPIRE", "h", "-1", "FIELDS", "1", "f"}, "ERR invalid expire time in 'hexpire' command", nil, ""},
+		{"no FIELDS", nil, []string{"HEXPIRE", "h", "100", "NX", "f", "1"}, "ERR mandatory argument FIELDS is missing or not at the right position", nil, ""},
+		{"numfields mismatch", nil, []string{"HEXPIRE", "h", "100", "FIELDS", "2", "f"}, "ERR The `numfields` parameter must match the number of arguments", nil, ""},
+		{"numfields zero", nil, []string{"HPERSIST", "h", "FIELDS", "0", "f"}, "ERR Parameter `numFields` should be greater than 0", nil, ""},
+		{"missing key", nil, []string{"HTTL", "missing", "FIELDS", "1", "f"}, "[-2]", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			h.HandleCommand([]string{"HSET", "h", "f", "v", "g", "w"})
+			if tt.setup != nil {
+				h.HandleCommand(tt.setup)
+			}
+			if reply := h.HandleCommand(tt.command); fmt.Sprint(reply) != tt.want {
+				t.Fatalf("%v = %v, want %s", tt.command, reply, tt.want)
+			}
+			if tt.check != nil {
+				if reply := h.HandleCommand(tt.check); fmt.Sprint(reply) != tt.checked {
+					t.Fatalf("%v after %v = %v, want %s", tt.check, tt.command, reply, tt.checked)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyExpiration(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   []string
+		command []string
+		want    string
+		check   []string
+		checked string
+	}{
+		{"set", nil, []string{"EXPIRE", "k", "100"}, "1", []string{"TTL", "k"}, "100"},
+		{"missing key", nil, []string{"EXPIRE", "missing", "100"}, "0", []string{"TTL", "missing"}, "-2"},
+		{"no ttl", nil, []string{"PTTL", "k"}, "-1", []string{"EXPIRETIME", "k"}, "-1"},
+		{"NX without ttl", nil, []string{"EXPIRE", "k", "100", "NX"}, "1", []string{"TTL", "k"}, "100"},
+		{"NX with ttl", []string{"EXPIRE", "k", "100"}, []string{"EXPIRE", "k", "200", "NX"}, "0",
+			[]string{"TTL", "k"}, "100"},
+		{"XX without ttl", nil, []string{"PEXPIRE", "k", "100000", "XX"}, "0", []string{"TTL", "k"}, "-1"},
+		{"XX with ttl", []string{"EXPIRE", "k", "100"}, []string{"PEXPIRE", "k", "200000", "XX"}, "1",
+			[]string{"TTL", "k"}, "200"},
+		{"GT without ttl", nil, []string{"EXPIRE", "k", "100", "GT"}, "0", []string{"TTL", "k"}, "-1"},
+		{"GT later", []string{"EXPIRE", "k", "100"}, []string{"EXPIRE", "k", "200", "gt"}, "1",
+			[]string{"TTL", "k"}, "200"},
+		{"GT sooner", []string{"EXPIRE", "k", "100"}, []string{"EXPIRE", "k", "50", "GT"}, "0",
+			[]string{"TTL", "k"}, "100"},
+		{"LT without ttl", nil, []string{"EXPIRE", "k", "100", "LT"}, "1", []string{"TTL", "k"}, "100"},
+		{"LT later", []string{"EXPIRE", "k", "100"}, []string{"EXPIRE", "k", "200", "LT"}, "0",
+			[]string{"TTL", "k"}, "100"},
+		{"LT sooner", []string{"EXPIRE", "k", "100"}, []string{"EXPIRE", "k", "50", "LT"}, "1",
+			[]string{"TTL", "k"}, "50"},
+		{"EXPIREAT", nil, []string{"EXPIREAT", "k", "4102444800"}, "1",
+			[]string{"EXPIRETIME", "k"}, "4102444800"},
+		{"PEXPIREAT NX", []string{"EXPIREAT", "k", "4102444800"}, []string{"PEXPIREAT", "k", "4102444801000", "NX"}, "0",
+			[]string{"PEXPIRETIME", "k"}, "4102444800000"},
+		{"zero deletes the key", nil, []string{"EXPIRE", "k", "0"}, "1", []string{"EXISTS", "k"}, "0"},
+		{"negative deletes the key", nil, []string{"PEXPIRE", "k", "-1"}, "1", []string{"EXISTS", "k"}, "0"},
+		{"past deletes the key", nil, []string{"EXPIREAT", "k", "1"}, "1", []string{"GET", "k"}, "<nil>"},
+		{"past GT keeps the key", []string{"EXPIRE", "k", "100"}, []string{"EXPIRE", "k", "0", "GT"}, "0",
+			[]string{"TTL", "k"}, "100"},
+		{"persist", []string{"EXPIRE", "k", "100"}, []string{"PERSIST", "k"}, "1", []string{"TTL", "k"}, "-1"},
+		{"persist without ttl", nil, []string{"PERSIST", "k"}, "0", nil, ""},
+		{"SET clears the ttl", []string{"EXPIRE", "k", "100"}, []string{"SET", "k", "w"}, "OK",
+			[]string{"TTL", "k"}, "-1"},
+		{"unknown option", nil, []string{"EXPIRE", "k", "100", "YY"}, "ERR Unsupported option YY", nil, ""},
+		{"not an integer", nil, []string{"EXPIRE", "k", "soon"}, "ERR value is not an integer or out of range", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			h.HandleCommand([]string{"SET", "k", "v"})
+			if tt.setup != nil {
+				h.HandleCommand(tt.setup)
+			}
+			if reply := h.HandleCommand(tt.command); fmt.Sprint(reply) != tt.want {
+				t.Fatalf("%v = %v, want %s", tt.command, reply, tt.want)
+			}
+			if tt.check != nil {
+				if reply := h.HandleCommand(tt.check); fmt.Sprint(reply) != tt.checked {
+					t.Fatalf("%v after %v = %v, want %s", tt.check, tt.command, reply, tt.checked)
+				}
+			}
+		})
+	}
+}
+
+func TestLCS(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"MSET", "a", "ohmytext", "b", "mynewtext"})
+	h.HandleCommand([]string{"MSET", "long1", strings.Repeat("a", 12000), "long2", strings.Repeat("b", 12000)})
+
+	tests := []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"a", "b"}, []byte("mytext")},
+		{[]string{"a", "b", "LEN"}, 6},
+		{[]string{"a", "missing"}, []byte{}},
+		{[]string{"a", "b", "IDX", "MINMATCHLEN", "4", "WITHMATCHLEN"},
+			[]interface{}{"matches", []interface{}{[]interface{}{[]interface{}{4, 7}, []interface{}{5, 8}, 4}}, "len", 6}},
+		{[]string{"long1", "long2"}, ErrorReply("ERR String too long for LCS")},
+	}
+	for _, tt := range tests {
+		reply := h.HandleCommand(append([]string{"LCS"}, tt.args...))
+		if fmt.Sprint(reply) != fmt.Sprint(tt.want) {
+			t.Errorf("LCS %v = %v, want %v", tt.args, reply, tt.want)
+		}
+	}
+}
+
+func TestZScan(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"SADD", "z", "a", "b", "c"})
+
+	seen := make(map[string]string)
+	cursor := "0"
+	for {
+		reply := h.HandleCommand([]string{"ZSCAN", "z", cursor, "COUNT", "1"}).([]interface{})
+		pairs := reply[1].([]interface{})
+		for i := 0; i < len(pairs); i += 2 {
+			seen[string(pairs[i].([]byte))] = string(pairs[i+1].([]byte))
+		}
+		if cursor = reply[0].(string); cursor == "0" {
+			break
+		}
+	}
+	if fmt.Sprint(seen) != "map[a:0 b:0 c:0]" {
+		t.Fatalf("ZSCAN returned %v, want a, b and c with a score of 0", seen)
+	}
+
+	if reply := h.HandleCommand([]string{"ZSCAN", "z"}); reply != ErrorReply("ERR wrong number of arguments for 'zscan' command") {
+		t.Fatalf("ZSCAN z = %v, want an arity error", reply)
+	}
+}
+
+func TestSnapshotBetweenCommands(t *testing.T) {
+	h := newTestHandler()
+	started, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Atomically(func(run func(command []string) interface{}) {
+			run([]string{"SET", "a", "1"})
+			close(started)
+			<-release
+			run([]string{"SET", "b", "1"})
+		})
+	}()
+
+	<-started
+	taken := make(chan store.Snapshot)
+	go func() {
+		snapshot, _ := h.Snapshot()
+		taken <- snapshot
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	<-done
+
+	// The snapshot waited for the whole transaction
+	if snapshot := <-taken; len(snapshot.StringData) != 2 {
+		t.Fatalf("snapshot holds %d keys, want 2", len(snapshot.StringData))
+	}
+}
+
+func TestObjectEncoding(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"SET", "string", "10"})
+	h.HandleCommand([]string{"RPUSH", "list", "a"})
+	h.HandleCommand([]string{"SADD", "set", "1"})
+	h.HandleCommand([]string{"HSET", "hash", "f", "v"})
+
+	tests := []struct {
+		key  string
+		want interface{}
+	}{
+		{"string", "raw"},
+		{"list", "quicklist"},
+		{"set", "hashtable"},
+		{"hash", "hashtable"},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		reply := h.HandleCommand([]string{"OBJECT", "ENCODING", tt.key})
+		if b, ok := reply.([]byte); ok {
+			reply = string(b)
+		}
+		if reply != tt.want {
+			t.Errorf("OBJECT ENCODING %s: got %v, want %v", tt.key, reply, tt.want)
+		}
+	}
+
+	// Values aren't reference counted, so there is no REFCOUNT to report
+	want := ErrorReply("ERR unknown subcommand or wrong number of arguments for 'REFCOUNT'. Try OBJECT HELP.")
+	if reply := h.HandleCommand([]string{"OBJECT", "REFCOUNT", "string"}); reply != want {
+		t.Errorf("OBJECT REFCOUNT: got %v, want %s", reply, want)
+	}
+}
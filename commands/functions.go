@@ -0,0 +1,509 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"Memora/lua"
+	"Memora/store"
+)
+
+// libraryLoadTimeout is the longest the code of a library may run while
+// it registers its functions
+const libraryLoadTimeout = 500 * time.Millisecond
+
+// dumpMagic starts the payload of FUNCTION DUMP
+const dumpMagic = "MFN1"
+
+// functionFlags are the flags register_function accepts
+var functionFlags = map[string]bool{
+	"no-writes": true, "allow-oom": true, "allow-stale": true,
+	"no-cluster": true, "allow-cross-slot-keys": true,
+}
+
+// functionRegistry holds the compiled function libraries. The store keeps
+// their code, so they are saved in snapshots; the registry compiles them
+// again whenever the store's libraries change behind its back, as they do
+// when a snapshot is restored.
+type functionRegistry struct {
+	mu        sync.Mutex
+	version   uint64
+	libraries map[string]*library
+	byName    map[string]*function
+}
+
+type library struct {
+	name      string
+	code      string
+	functions []*function
+}
+
+type function struct {
+	name        string
+	library     string
+	callback    *lua.Function
+	flags       []string
+	description string
+}
+
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{
+		libraries: make(map[string]*library),
+		byName:    make(map[string]*function),
+	}
+}
+
+// sync compiles the store's libraries again if they changed since the
+// registry last saw them. The caller holds f.mu.
+func (f *functionRegistry) sync(ds *store.DataStore) {
+	if ds.FunctionLibrariesVersion() == f.version {
+		return
+	}
+	codes, version := ds.FunctionLibraries()
+	f.libraries = make(map[string]*library)
+	f.byName = make(map[string]*function)
+	for name, code := range codes {
+		lib, errMsg := compileLibrary(code)
+		if errMsg != "" {
+			log.Printf("Failed to load function library %s: %s", name, errMsg)
+			continue
+		}
+		f.add(lib)
+	}
+	f.version = version
+}
+
+func (f *functionRegistry) add(lib *library) {
+	f.libraries[lib.name] = lib
+	for _, fn := range lib.functions {
+		f.byName[fn.name] = fn
+	}
+}
+
+func (f *functionRegistry) remove(name string) {
+	if lib, ok := f.libraries[name]; ok {
+		for _, fn := range lib.functions {
+			delete(f.byName, fn.name)
+		}
+		delete(f.libraries, name)
+	}
+}
+
+// conflict returns an error reply if lib can't be added, because a library
+// of that name exists and replace is not set, or one of its functions is
+// defined by another library
+func (f *functionRegistry) conflict(lib *library, replace bool) ErrorReply {
+	if _, exists := f.libraries[lib.name]; exists && !replace {
+		return ErrorReply(fmt.Sprintf("ERR Library '%s' already exists", lib.name))
+	}
+	for _, fn := range lib.functions {
+		if other, exists := f.byName[fn.name]; exists && other.library != lib.name {
+			return ErrorReply(fmt.Sprintf("ERR Function %s already exists", fn.name))
+		}
+	}
+	return ""
+}
+
+// validName reports whether a library or function name is made of letters,
+// digits and underscores only
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// compileLibrary checks the metadata line of a library, #!lua name=<name>,
+// and runs its code to collect the functions it registers
+func compileLibrary(code string) (*library, ErrorReply) {
+	header, _, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(header, "#!") {
+		return nil, "ERR Missing library metadata"
+	}
+	fields := strings.Fields(header[2:])
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "lua") {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+		return nil, ErrorReply(fmt.Sprintf("ERR Engine '%s' not found", engine))
+	}
+	lib := &library{code: code}
+	for _, field := range fields[1:] {
+		value, ok := strings.CutPrefix(field, "name=")
+		if !ok {
+			return nil, ErrorReply("ERR Invalid metadata value given: " + field)
+		}
+		lib.name = value
+	}
+	if lib.name == "" {
+		return nil, "ERR Library name was not given"
+	}
+	if !validName(lib.name) {
+		return nil, "ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long"
+	}
+
+	chunk, err := lua.Compile(lib.name, code)
+	if err != nil {
+		return nil, ErrorReply("ERR Error compiling function: " + err.Error())
+	}
+	redis := lua.NewTable()
+	redis.Set("register_function", lua.NewFunction("register_function", func(args []lua.Value) ([]lua.Value, error) {
+		fn, err := registeredFunction(args)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range lib.functions {
+			if other.name == fn.name {
+				return nil, fmt.Errorf("Function already exists in the library")
+			}
+		}
+		fn.library = lib.name
+		lib.functions = append(lib.functions, fn)
+		return nil, nil
+	}))
+	addScriptHelpers(redis)
+	redis.Freeze()
+
+	_, err = chunk.Run(lua.Options{
+		Globals: map[string]lua.Value{"redis": redis},
+		Timeout: libraryLoadTimeout,
+	})
+	if err != nil {
+		return nil, ErrorReply("ERR Error registering functions: " + err.Error())
+	}
+	if len(lib.functions) == 0 {
+		return nil, "ERR No functions registered"
+	}
+	return lib, ""
+}
+
+// registeredFunction reads the arguments of redis.register_function, which
+// are either a name and a callback, or a table with the fields
+// function_name, callback, and optionally flags and description
+func registeredFunction(args []lua.Value) (*function, error) {
+	fn := &function{}
+	var ok bool
+	switch {
+	case len(args) == 2:
+		if fn.name, ok = args[0].(string); !ok {
+			return nil, fmt.Errorf("wrong argument given to redis.register_function: function name must be a string")
+		}
+		if fn.callback, ok = args[1].(*lua.Function); !ok {
+			return nil, fmt.Errorf("wrong argument given to redis.register_function: callback must be a function")
+		}
+	case len(args) == 1:
+		t, isTable := args[0].(*lua.Table)
+		if !isTable {
+			return nil, fmt.Errorf("calling redis.register_function with a single argument is only applicable to Lua table")
+		}
+		if fn.name, ok = t.Get("function_name").(string); !ok {
+			return nil, fmt.Errorf("function_name argument given to redis.register_function must be a string")
+		}
+		if fn.callback, ok = t.Get("callback").(*lua.Function); !ok {
+			return nil, fmt.Errorf("callback argument given to redis.register_function must be a function")
+		}
+		if description := t.Get("description"); description != nil {
+			if fn.description, ok = description.(string); !ok {
+				return nil, fmt.Errorf("description argument given to redis.register_function must be a string")
+			}
+		}
+		if flags := t.Get("flags"); flags != nil {
+			list, isTable := flags.(*lua.Table)
+			if !isTable {
+				return nil, fmt.Errorf("flags argument to redis.register_function must be a table representing function flags")
+			}
+			for i := 1; i <= list.Len(); i++ {
+				flag, isString := list.Get(float64(i)).(string)
+				if !isString || !functionFlags[flag] {
+					return nil, fmt.Errorf("unknown flag given")
+				}
+				fn.flags = append(fn.flags, flag)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("wrong number of arguments to redis.register_function")
+	}
+	if !validName(fn.name) {
+		return nil, fmt.Errorf("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return fn, nil
+}
+
+func (fn *function) readOnly() bool {
+	for _, flag := range fn.flags {
+		if flag == "no-writes" {
+			return true
+		}
+	}
+	return false
+}
+
+// handleFunction runs FUNCTION LOAD, DELETE, LIST, DUMP, RESTORE, FLUSH and
+// KILL
+func (h *CommandHandler) handleFunction(args []string) interface{} {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'function' command")
+	}
+
+	f := h.functions
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sync(h.store)
+
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "LOAD":
+		replace := len(args) == 3 && strings.EqualFold(args[1], "REPLACE")
+		if len(args) != 2 && !replace {
+			return ErrorReply("ERR wrong number of arguments for 'function|load' command")
+		}
+		lib, errMsg := compileLibrary(args[len(args)-1])
+		if errMsg != "" {
+			return errMsg
+		}
+		if errMsg := f.conflict(lib, replace); errMsg != "" {
+			return errMsg
+		}
+		f.remove(lib.name)
+		f.add(lib)
+		h.store.SetFunctionLibrary(lib.name, lib.code)
+		f.version = h.store.FunctionLibrariesVersion()
+		return []byte(lib.name)
+	case "DELETE":
+		if len(args) != 2 {
+			return ErrorReply("ERR wrong number of arguments for 'function|delete' command")
+		}
+		if _, exists := f.libraries[args[1]]; !exists {
+			return ErrorReply("ERR Library not found")
+		}
+		f.remove(args[1])
+		h.store.DeleteFunctionLibrary(args[1])
+		f.version = h.store.FunctionLibrariesVersion()
+		return "OK"
+	case "LIST":
+		return f.list(args[1:])
+	case "DUMP":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'function|dump' command")
+		}
+		return f.dump()
+	case "RESTORE":
+		if len(args) != 2 && len(args) != 3 {
+			return ErrorReply("ERR wrong number of arguments for 'function|restore' command")
+		}
+		policy := "APPEND"
+		if len(args) == 3 {
+			policy = strings.ToUpper(args[2])
+			if policy != "APPEND" && policy != "REPLACE" && policy != "FLUSH" {
+				return ErrorReply("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+			}
+		}
+		return h.restoreFunctions([]byte(args[1]), policy)
+	case "FLUSH":
+		if len(args) > 2 || len(args) == 2 && !strings.EqualFold(args[1], "SYNC") && !strings.EqualFold(args[1], "ASYNC") {
+			return ErrorReply("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+		}
+		for name := range f.libraries {
+			h.store.DeleteFunctionLibrary(name)
+		}
+		f.libraries = make(map[string]*library)
+		f.byName = make(map[string]*function)
+		f.version = h.store.FunctionLibrariesVersion()
+		return "OK"
+	case "KILL":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'function|kill' command")
+		}
+		return h.killScript()
+	default:
+		return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try FUNCTION HELP.", args[0]))
+	}
+}
+
+// list replies to FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func (f *functionRegistry) list(args []string) interface{} {
+	pattern, withCode := "", false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "WITHCODE") && !withCode:
+			withCode = true
+		case strings.EqualFold(args[i], "LIBRARYNAME") && pattern == "" && i+1 < len(args):
+			i++
+			pattern = args[i]
+		default:
+			return ErrorReply("ERR Unknown argument " + args[i])
+		}
+	}
+
+	names := make([]string, 0, len(f.libraries))
+	for name := range f.libraries {
+		if pattern == "" || store.MatchPattern(pattern, name, false) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		lib := f.libraries[name]
+		functions := make([]interface{}, 0, len(lib.functions))
+		for _, fn := range lib.functions {
+			var description interface{}
+			if fn.description != "" {
+				description = []byte(fn.description)
+			}
+			flags := make([]interface{}, len(fn.flags))
+			for i, flag := range fn.flags {
+				flags[i] = flag
+			}
+			functions = append(functions, Map{
+				"name", fn.name,
+				"description", description,
+				"flags", flags,
+			})
+		}
+		entry := Map{
+			"library_name", lib.name,
+			"engine", "LUA",
+			"functions", functions,
+		}
+		if withCode {
+			entry = append(entry, "library_code", lib.code)
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// dump serializes the code of every library: the magic, each code prefixed
+// by its length, and a CRC32 of what precedes it
+func (f *functionRegistry) dump() interface{} {
+	names := make([]string, 0, len(f.libraries))
+	for name := range f.libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	payload := []byte(dumpMagic)
+	for _, name := range names {
+		code := f.libraries[name].code
+		payload = binary.AppendUvarint(payload, uint64(len(code)))
+		payload = append(payload, code...)
+	}
+	return binary.BigEndian.AppendUint32(payload, crc32.ChecksumIEEE(payload))
+}
+
+// parseDump returns the library codes of a FUNCTION DUMP payload
+func parseDump(payload []byte) ([]string, bool) {
+	if len(payload) < len(dumpMagic)+4 || !bytes.HasPrefix(payload, []byte(dumpMagic)) {
+		return nil, false
+	}
+	body, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, false
+	}
+	var codes []string
+	for rest := body[len(dumpMagic):]; len(rest) > 0; {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < length {
+			return nil, false
+		}
+		codes = append(codes, string(rest[n:n+int(length)]))
+		rest = rest[n+int(length):]
+	}
+	return codes, true
+}
+
+// restoreFunctions loads the libraries of a FUNCTION DUMP payload. Nothing
+// changes unless every library can be loaded. The caller holds f.mu.
+func (h *CommandHandler) restoreFunctions(payload []byte, policy string) interface{} {
+	codes, ok := parseDump(payload)
+	if !ok {
+		return ErrorReply("ERR payload version or checksum are wrong")
+	}
+
+	f := h.functions
+	restored := newFunctionRegistry()
+	if policy != "FLUSH" {
+		for _, lib := range f.libraries {
+			restored.add(lib)
+		}
+	}
+	for _, code := range codes {
+		lib, errMsg := compileLibrary(code)
+		if errMsg != "" {
+			return errMsg
+		}
+		if errMsg := restored.conflict(lib, policy == "REPLACE"); errMsg != "" {
+			return errMsg
+		}
+		restored.remove(lib.name)
+		restored.add(lib)
+	}
+
+	for name := range f.libraries {
+		if _, kept := restored.libraries[name]; !kept {
+			h.store.DeleteFunctionLibrary(name)
+		}
+	}
+	for name, lib := range restored.libraries {
+		if f.libraries[name] != lib {
+			h.store.SetFunctionLibrary(name, lib.code)
+		}
+	}
+	f.libraries, f.byName = restored.libraries, restored.byName
+	f.version = h.store.FunctionLibrariesVersion()
+	return "OK"
+}
+
+// handleFcall runs FCALL function numkeys [key ...] [arg ...] and, with
+// readOnly set, FCALL_RO, which only calls functions flagged no-writes
+func (h *CommandHandler) handleFcall(args []string, readOnly bool) interface{} {
+	name := "fcall"
+	if readOnly {
+		name = "fcall_ro"
+	}
+	if len(args) < 2 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+	}
+
+	numKeys, err := strconv.Atoi(args[1])
+	switch {
+	case err != nil:
+		return ErrorReply("ERR value is not an integer or out of range")
+	case numKeys < 0:
+		return ErrorReply("ERR Number of keys can't be negative")
+	case numKeys > len(args)-2:
+		return ErrorReply("ERR Number of keys can't be greater than number of args")
+	}
+	keys, argv := args[2:2+numKeys], args[2+numKeys:]
+
+	h.functions.mu.Lock()
+	h.functions.sync(h.store)
+	fn := h.functions.byName[args[0]]
+	h.functions.mu.Unlock()
+
+	if fn == nil {
+		return ErrorReply("ERR Function not found")
+	}
+	noWrites := fn.readOnly()
+	if readOnly && !noWrites {
+		return ErrorReply("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	return h.runScript(fn.name, noWrites, map[string]lua.Value{}, func(opts lua.Options) ([]lua.Value, error) {
+		return lua.Call(fn.callback, []lua.Value{stringArray(keys), stringArray(argv)}, opts)
+	})
+}
@@ -0,0 +1,135 @@
+package commands
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testLibrary registers set, which writes a key, and get, flagged no-writes
+const testLibrary = `#!lua name=mylib
+redis.register_function('set', function(keys, args) return redis.call('SET', keys[1], args[1]) end)
+redis.register_function{
+  function_name = 'get',
+  callback = function(keys) return redis.call('GET', keys[1]) end,
+  flags = {'no-writes'},
+  description = 'reads a key',
+}`
+
+// functionReply formats a reply for comparison, bulk strings as text
+func functionReply(reply interface{}) string {
+	if b, ok := reply.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(reply)
+}
+
+func TestFunctionCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   [][]string
+		command []string
+		want    string
+		check   []string
+		checked string
+	}{
+		{"FCALL", nil, []string{"FCALL", "set", "1", "k", "v"}, "OK", []string{"GET", "k"}, "v"},
+		{"FCALL_RO", [][]string{{"SET", "k", "v"}}, []string{"FCALL_RO", "get", "1", "k"}, "v", nil, ""},
+		{"FCALL_RO of a write function", nil, []string{"FCALL_RO", "set", "1", "k", "v"},
+			"ERR Can not execute a script with write flag using *_ro command.", []string{"EXISTS", "k"}, "0"},
+		{"FCALL of a missing function", nil, []string{"FCALL", "missing", "0"}, "ERR Function not found", nil, ""},
+		{"negative numkeys", nil, []string{"FCALL", "set", "-1"}, "ERR Number of keys can't be negative", nil, ""},
+		{"too many keys", nil, []string{"FCALL", "set", "2", "k"}, "ERR Number of keys can't be greater than number of args", nil, ""},
+		{"LOAD an existing library", nil, []string{"FUNCTION", "LOAD", testLibrary}, "ERR Library 'mylib' already exists", nil, ""},
+		{"LOAD REPLACE", nil, []string{"FUNCTION", "LOAD", "REPLACE", "#!lua name=mylib\nredis.register_function('other', function() return 1 end)"}, "mylib",
+			[]string{"FCALL", "set", "1", "k", "v"}, "ERR Function not found"},
+		{"LOAD a function of another library", nil, []string{"FUNCTION", "LOAD", "#!lua name=other\nredis.register_function('set', function() return 1 end)"},
+			"ERR Function set already exists", nil, ""},
+		{"LOAD without metadata", nil, []string{"FUNCTION", "LOAD", "redis.register_function('f', function() return 1 end)"}, "ERR Missing library metadata", nil, ""},
+		{"LOAD another engine", nil, []string{"FUNCTION", "LOAD", "#!js name=js"}, "ERR Engine 'js' not found", nil, ""},
+		{"LOAD without functions", nil, []string{"FUNCTION", "LOAD", "#!lua name=empty\nreturn 1"}, "ERR No functions registered", nil, ""},
+		{"DELETE", nil, []string{"FUNCTION", "DELETE", "mylib"}, "OK", []string{"FCALL", "get", "1", "k"}, "ERR Function not found"},
+		{"DELETE a missing library", nil, []string{"FUNCTION", "DELETE", "missing"}, "ERR Library not found", nil, ""},
+		{"FLUSH", nil, []string{"FUNCTION", "FLUSH", "ASYNC"}, "OK", []string{"FUNCTION", "LIST"}, "[]"},
+		{"FLUSH with an unknown option", nil, []string{"FUNCTION", "FLUSH", "NOW"}, "ERR FUNCTION FLUSH only supports SYNC|ASYNC option", nil, ""},
+		{"LIST with a pattern", nil, []string{"FUNCTION", "LIST", "LIBRARYNAME", "other*"}, "[]", nil, ""},
+		{"LIST with an unknown argument", nil, []string{"FUNCTION", "LIST", "WITHFLAGS"}, "ERR Unknown argument WITHFLAGS", nil, ""},
+		{"RESTORE a bad payload", nil, []string{"FUNCTION", "RESTORE", "MFN1xxxx"}, "ERR payload version or checksum are wrong", nil, ""},
+		{"RESTORE with an unknown policy", nil, []string{"FUNCTION", "RESTORE", "MFN1xxxx", "MERGE"},
+			"ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			if reply := h.HandleCommand([]string{"FUNCTION", "LOAD", testLibrary}); functionReply(reply) != "mylib" {
+				t.Fatalf("FUNCTION LOAD = %v", reply)
+			}
+			for _, command := range tt.setup {
+				h.HandleCommand(command)
+			}
+			if reply := h.HandleCommand(tt.command); functionReply(reply) != tt.want {
+				t.Fatalf("%v = %v, want %s", tt.command, functionReply(reply), tt.want)
+			}
+			if tt.check != nil {
+				if reply := h.HandleCommand(tt.check); functionReply(reply) != tt.checked {
+					t.Fatalf("%v after %v = %v, want %s", tt.check, tt.command, functionReply(reply), tt.checked)
+				}
+			}
+		})
+	}
+}
+
+func TestFunctionList(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"FUNCTION", "LOAD", testLibrary})
+
+	reply := h.HandleCommand([]string{"FUNCTION", "LIST", "WITHCODE"})
+	want := fmt.Sprint([]interface{}{Map{
+		"library_name", "mylib",
+		"engine", "LUA",
+		"functions", []interface{}{
+			Map{"name", "set", "description", nil, "flags", []interface{}{}},
+			Map{"name", "get", "description", []byte("reads a key"), "flags", []interface{}{"no-writes"}},
+		},
+		"library_code", testLibrary,
+	}})
+	if fmt.Sprint(reply) != want {
+		t.Fatalf("FUNCTION LIST WITHCODE = %v, want %s", reply, want)
+	}
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	tests := []struct {
+		policy string
+		loaded string // the library loaded between DUMP and RESTORE
+		want   string
+		called string // the reply of FCALL set after RESTORE
+	}{
+		{"", "", "OK", "OK"},
+		{"APPEND", "#!lua name=mylib\nredis.register_function('other', function() return 1 end)", "ERR Library 'mylib' already exists", "ERR Function not found"},
+		{"REPLACE", "#!lua name=mylib\nredis.register_function('other', function() return 1 end)", "OK", "OK"},
+		{"APPEND", "#!lua name=other\nredis.register_function('set', function() return 1 end)", "ERR Function set already exists", "1"},
+		{"FLUSH", "#!lua name=other\nredis.register_function('set', function() return 1 end)", "OK", "OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.loaded, func(t *testing.T) {
+			h := newTestHandler()
+			h.HandleCommand([]string{"FUNCTION", "LOAD", testLibrary})
+			payload := h.HandleCommand([]string{"FUNCTION", "DUMP"}).([]byte)
+			h.HandleCommand([]string{"FUNCTION", "FLUSH"})
+			if tt.loaded != "" {
+				h.HandleCommand([]string{"FUNCTION", "LOAD", tt.loaded})
+			}
+
+			command := []string{"FUNCTION", "RESTORE", string(payload)}
+			if tt.policy != "" {
+				command = append(command, tt.policy)
+			}
+			if reply := h.HandleCommand(command); functionReply(reply) != tt.want {
+				t.Fatalf("FUNCTION RESTORE %s = %v, want %s", tt.policy, reply, tt.want)
+			}
+			if reply := h.HandleCommand([]string{"FCALL", "set", "1", "k", "v"}); functionReply(reply) != tt.called {
+				t.Fatalf("FCALL set after FUNCTION RESTORE %s = %v, want %s", tt.policy, functionReply(reply), tt.called)
+			}
+		})
+	}
+}
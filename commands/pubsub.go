@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"Memora/pubsub"
+)
+
+// SetHub replaces the hub PUBLISH delivers messages through with the one the
+// server's connections subscribe on. Subscriptions are per connection, so the
+// server handles SUBSCRIBE and friends itself.
+func (h *CommandHandler) SetHub(hub *pubsub.Hub) {
+	h.hub = hub
+}
+
+// handlePublish runs PUBLISH channel message
+func (h *CommandHandler) handlePublish(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'publish' command")
+	}
+	return int64(h.hub.Publish(args[0], []byte(args[1])))
+}
+
+// handleSPublish runs SPUBLISH shardchannel message. A single node owns
+// every hash slot, so the message is always delivered here.
+func (h *CommandHandler) handleSPublish(args []string) interface{} {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for 'spublish' command")
+	}
+	return int64(h.hub.SPublish(args[0], []byte(args[1])))
+}
+
+// handlePubsub runs PUBSUB CHANNELS [pattern], NUMSUB [channel ...], NUMPAT,
+// SHARDCHANNELS [pattern] and SHARDNUMSUB [shardchannel ...]
+func (h *CommandHandler) handlePubsub(args []string) interface{} {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'pubsub' command")
+	}
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "CHANNELS", "SHARDCHANNELS":
+		if len(args) > 2 {
+			return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for 'pubsub|%s' command", strings.ToLower(sub)))
+		}
+		pattern := ""
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+		var channels []string
+		if sub == "CHANNELS" {
+			channels = h.hub.Channels(pattern)
+		} else {
+			channels = h.hub.ShardChannels(pattern)
+		}
+		result := make([]interface{}, len(channels))
+		for i, channel := range channels {
+			result[i] = []byte(channel)
+		}
+		return result
+	case "NUMSUB", "SHARDNUMSUB":
+		var counts []int
+		if sub == "NUMSUB" {
+			counts = h.hub.NumSub(args[1:]...)
+		} else {
+			counts = h.hub.ShardNumSub(args[1:]...)
+		}
+		result := make([]interface{}, 0, 2*len(counts))
+		for i, count := range counts {
+			result = append(result, []byte(args[1+i]), int64(count))
+		}
+		return result
+	case "NUMPAT":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'pubsub|numpat' command")
+		}
+		return int64(h.hub.NumPat())
+	default:
+		return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[0]))
+	}
+}
@@ -0,0 +1,49 @@
+package commands
+
+// Handlers reply with a string for a status reply, an ErrorReply, []byte for
+// a bulk string, an integer, []interface{} for an array, or nil. They may also
+// reply with the types below, which carry meaning RESP3 can express; the
+// server falls back to the nearest RESP2 type for connections that did not
+// negotiate RESP3 with HELLO.
+
+// ErrorReply is an error reply, whose first word is the error code, such as
+// ERR or WRONGTYPE. A reply is only an error if it has this type: a string
+// is a status reply whatever it starts with.
+type ErrorReply string
+
+// Map is a reply of alternating keys and values, such as the fields and
+// values of HGETALL. RESP2 sends it as a flat array.
+type Map []interface{}
+
+// Set is an unordered collection of distinct values. RESP2 sends it as an
+// array.
+type Set []interface{}
+
+// Double is a floating point number. RESP2 sends it as a bulk string.
+type Double float64
+
+// Bool is a boolean. RESP2 sends it as the integer 1 or 0.
+type Bool bool
+
+// BigNumber is an integer, in decimal, too large for a 64 bit integer
+// reply. RESP2 sends it as a bulk string.
+type BigNumber string
+
+// Verbatim is text meant to be shown as it is, such as the reply of INFO.
+// Format is "txt" for plain text or "mkd" for markdown. RESP2 sends the text
+// as a bulk string.
+type Verbatim struct {
+	Format string
+	Text   string
+}
+
+// Attributed is a reply with auxiliary attributes, which RESP3 sends ahead
+// of the value and RESP2 drops
+type Attributed struct {
+	Attributes Map
+	Value      interface{}
+}
+
+// Push is an out-of-band message, such as a published message, that is not
+// the reply to a command. RESP2 sends it as an array.
+type Push []interface{}
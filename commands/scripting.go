@@ -0,0 +1,480 @@
+package commands
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Memora/lua"
+)
+
+// scriptName prefixes the position in script error messages
+const scriptName = "user_script"
+
+// defaultScriptTimeout is the default of lua-time-limit
+const defaultScriptTimeout = 5 * time.Second
+
+// scripting holds the scripts cached by EVAL and SCRIPT LOAD, and the state
+// of the script running, if any
+type scripting struct {
+	mu sync.Mutex
+	// cache maps the SHA1 digest of a script's source to the compiled script
+	cache map[string]*lua.Chunk
+
+	// running is set while a script runs; kill asks it to stop
+	running atomic.Bool
+	kill    atomic.Bool
+	// started is when the running script started, in Unix nanoseconds, and
+	// wrote is set once it called a write command, after which it can't be
+	// killed
+	started atomic.Int64
+	wrote   atomic.Bool
+	// timeout is how long a script may run before other commands are
+	// refused with BUSY, in nanoseconds; zero means no limit
+	timeout atomic.Int64
+}
+
+// BusyReply is the reply to commands sent while a script runs past
+// lua-time-limit
+const BusyReply ErrorReply = "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."
+
+// busy reports whether a script is running past lua-time-limit
+func (s *scripting) busy() bool {
+	timeout := s.timeout.Load()
+	return s.running.Load() && timeout > 0 && time.Now().UnixNano()-s.started.Load() > timeout
+}
+
+// notAllowedInScripts are the commands redis.call refuses: they would nest
+// scripts or transactions, or block
+var notAllowedInScripts = map[string]bool{
+	"EVAL": true, "EVALSHA": true, "SCRIPT": true,
+	"FUNCTION": true, "FCALL": true, "FCALL_RO": true,
+	"MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+	"SSUBSCRIBE": true, "SUNSUBSCRIBE": true, "QUIT": true,
+}
+
+func newScripting() *scripting {
+	s := &scripting{cache: make(map[string]*lua.Chunk)}
+	s.timeout.Store(int64(defaultScriptTimeout))
+	return s
+}
+
+// scriptDigest returns the SHA1 digest of a script, which EVALSHA names it by
+func scriptDigest(source string) string {
+	digest := sha1.Sum([]byte(source))
+	return hex.EncodeToString(digest[:])
+}
+
+// load compiles a script and caches it
+func (s *scripting) load(source string) (string, *lua.Chunk, ErrorReply) {
+	sha := scriptDigest(source)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if chunk, cached := s.cache[sha]; cached {
+		return sha, chunk, ""
+	}
+	chunk, err := lua.Compile(scriptName, source)
+	if err != nil {
+		return "", nil, ErrorReply("ERR Error compiling script (new function): " + err.Error())
+	}
+	s.cache[sha] = chunk
+	return sha, chunk, ""
+}
+
+func (s *scripting) lookup(sha string) *lua.Chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache[strings.ToLower(sha)]
+}
+
+// handleEval runs EVAL script numkeys [key ...] [arg ...] and, with sha set,
+// EVALSHA sha1 numkeys [key ...] [arg ...]
+func (h *CommandHandler) handleEval(args []string, sha bool) interface{} {
+	name := "eval"
+	if sha {
+		name = "evalsha"
+	}
+	if len(args) < 2 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+	}
+
+	numKeys, err := strconv.Atoi(args[1])
+	switch {
+	case err != nil:
+		return ErrorReply("ERR value is not an integer or out of range")
+	case numKeys < 0:
+		return ErrorReply("ERR Number of keys can't be negative")
+	case numKeys > len(args)-2:
+		return ErrorReply("ERR Number of keys can't be greater than number of args")
+	}
+	keys, argv := args[2:2+numKeys], args[2+numKeys:]
+
+	var chunk *lua.Chunk
+	digest := strings.ToLower(args[0])
+	if sha {
+		if chunk = h.scripts.lookup(digest); chunk == nil {
+			return ErrorReply("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	} else {
+		var errMsg ErrorReply
+		if digest, chunk, errMsg = h.scripts.load(args[0]); errMsg != "" {
+			return errMsg
+		}
+	}
+	globals := map[string]lua.Value{"KEYS": stringArray(keys), "ARGV": stringArray(argv)}
+	return h.runScript(digest, false, globals, chunk.Run)
+}
+
+// runScript runs a script or function with the redis library added to its
+// globals; name identifies it in error replies. The caller holds the
+// exclusive lock, so no other command runs until it returns. A script is
+// never aborted for running too long, since it may have written already: it
+// only becomes busy (see lock) and can then be killed if it didn't write.
+func (h *CommandHandler) runScript(name string, readOnly bool, globals map[string]lua.Value, run func(opts lua.Options) ([]lua.Value, error)) interface{} {
+	h.scripts.kill.Store(false)
+	h.scripts.wrote.Store(false)
+	h.scripts.started.Store(time.Now().UnixNano())
+	h.scripts.running.Store(true)
+	defer h.scripts.running.Store(false)
+
+	globals["redis"] = h.redisLibrary(readOnly)
+	results, err := run(lua.Options{
+		Globals:   globals,
+		Interrupt: &h.scripts.kill,
+	})
+
+	switch {
+	case errors.Is(err, lua.ErrKilled):
+		return ErrorReply("ERR Script killed by user with SCRIPT KILL...")
+	case err != nil:
+		var e *lua.Error
+		if errors.As(err, &e) {
+			if t, ok := e.Value.(*lua.Table); ok {
+				if msg, ok := t.Get("err").(string); ok {
+					return errorReply(msg)
+				}
+			}
+		}
+		return ErrorReply(fmt.Sprintf("ERR %s script: %s", err.Error(), name))
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return replyFromLua(results[0])
+}
+
+func stringArray(values []string) *lua.Table {
+	t := lua.NewTable()
+	for i, v := range values {
+		t.Set(float64(i+1), v)
+	}
+	return t
+}
+
+// errorCodes are the codes error replies start with
+var errorCodes = []string{"ERR ", "WRONGTYPE ", "OOM ", "EXECABORT ", "NOSCRIPT ", "NOTBUSY ", "BUSY ", "UNKILLABLE ", "CROSSSLOT ", "NOPROTO ", "WRONGPASS "}
+
+// errorReply makes the error a script raised or returned an error reply,
+// adding the generic error code if it has none
+func errorReply(msg string) ErrorReply {
+	for _, code := range errorCodes {
+		if strings.HasPrefix(msg, code) {
+			return ErrorReply(msg)
+		}
+	}
+	return ErrorReply("ERR " + msg)
+}
+
+// redisLibrary returns the redis table scripts reach the data store through.
+// A read-only script can't call write commands.
+func (h *CommandHandler) redisLibrary(readOnly bool) *lua.Table {
+	redis := lua.NewTable()
+	redis.Set("call", lua.NewFunction("call", func(args []lua.Value) ([]lua.Value, error) {
+		reply, err := h.scriptCall(args, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		if msg, ok := reply.(ErrorReply); ok {
+			return nil, &lua.Error{Value: errorTable(string(msg))}
+		}
+		return []lua.Value{replyToLua(reply)}, nil
+	}))
+	redis.Set("pcall", lua.NewFunction("pcall", func(args []lua.Value) ([]lua.Value, error) {
+		reply, err := h.scriptCall(args, readOnly)
+		if err != nil {
+			var e *lua.Error
+			if errors.As(err, &e) {
+				return []lua.Value{e.Value}, nil
+			}
+			return []lua.Value{errorTable(err.Error())}, nil
+		}
+		return []lua.Value{replyToLua(reply)}, nil
+	}))
+	addScriptHelpers(redis)
+	redis.Freeze()
+	return redis
+}
+
+// addScriptHelpers adds the parts of the redis library that don't run
+// commands
+func addScriptHelpers(redis *lua.Table) {
+	redis.Set("error_reply", lua.NewFunction("error_reply", func(args []lua.Value) ([]lua.Value, error) {
+		msg, ok := scriptArg(args, 0).(string)
+		if !ok {
+			return nil, errors.New("wrong number or type of arguments")
+		}
+		return []lua.Value{errorTable(msg)}, nil
+	}))
+	redis.Set("status_reply", lua.NewFunction("status_reply", func(args []lua.Value) ([]lua.Value, error) {
+		msg, ok := scriptArg(args, 0).(string)
+		if !ok {
+			return nil, errors.New("wrong number or type of arguments")
+		}
+		status := lua.NewTable()
+		status.Set("ok", msg)
+		return []lua.Value{status}, nil
+	}))
+	redis.Set("sha1hex", lua.NewFunction("sha1hex", func(args []lua.Value) ([]lua.Value, error) {
+		s, ok := lua.ToString(scriptArg(args, 0))
+		if len(args) != 1 || !ok {
+			return nil, errors.New("wrong number of arguments")
+		}
+		return []lua.Value{scriptDigest(s)}, nil
+	}))
+	redis.Set("log", lua.NewFunction("log", func(args []lua.Value) ([]lua.Value, error) {
+		if len(args) < 2 {
+			return nil, errors.New("redis.log() requires two arguments or more")
+		}
+		parts := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			s, ok := lua.ToString(arg)
+			if !ok {
+				return nil, errors.New("redis.log() arguments must be strings or numbers")
+			}
+			parts = append(parts, s)
+		}
+		log.Printf("script: %s", strings.Join(parts, " "))
+		return nil, nil
+	}))
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.Set(level, float64(i))
+	}
+}
+
+func scriptArg(args []lua.Value, i int) lua.Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func errorTable(msg string) *lua.Table {
+	t := lua.NewTable()
+	t.Set("err", msg)
+	return t
+}
+
+// scriptCall runs the command redis.call or redis.pcall was given. Errors
+// are problems with the call itself; the command's own errors are returned
+// as error replies.
+func (h *CommandHandler) scriptCall(args []lua.Value, readOnly bool) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, &lua.Error{Value: errorTable("ERR Please specify at least one argument for this redis lib call")}
+	}
+	command := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := lua.ToString(arg)
+		if !ok {
+			return nil, &lua.Error{Value: errorTable("ERR Lua redis lib command arguments must be strings or integers")}
+		}
+		command[i] = s
+	}
+	name := strings.ToUpper(command[0])
+	if notAllowedInScripts[name] {
+		return nil, &lua.Error{Value: errorTable("ERR This Redis command is not allowed from script")}
+	}
+	if _, exists := commandArity[name]; !exists {
+		return nil, &lua.Error{Value: errorTable("ERR Unknown Redis command called from script")}
+	}
+	if CheckCommand(command) != "" {
+		return nil, &lua.Error{Value: errorTable("ERR Wrong number of args calling Redis command from script")}
+	}
+	if writeCommands[name] {
+		if readOnly {
+			return nil, &lua.Error{Value: errorTable("ERR Write commands are not allowed from read-only scripts.")}
+		}
+		h.scripts.wrote.Store(true)
+	}
+	return h.dispatch(command), nil
+}
+
+// replyToLua converts a command reply to a Lua value: integers to numbers,
+// bulk strings to strings, arrays to tables, nil to false, and status and
+// error replies to tables with an ok or err field
+func replyToLua(reply interface{}) lua.Value {
+	switch v := reply.(type) {
+	case nil:
+		return false
+	case ErrorReply:
+		return errorTable(string(v))
+	case string:
+		status := lua.NewTable()
+		status.Set("ok", v)
+		return status
+	case []byte:
+		return string(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case []interface{}:
+		if v == nil {
+			return false
+		}
+		return arrayToLua(v)
+	case Map:
+		return arrayToLua(v)
+	case Set:
+		return arrayToLua(v)
+	// Scripts see replies as a RESP2 client would
+	case Double:
+		return strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case Bool:
+		if v {
+			return float64(1)
+		}
+		return float64(0)
+	case BigNumber:
+		return string(v)
+	case Verbatim:
+		return v.Text
+	case Attributed:
+		return replyToLua(v.Value)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func arrayToLua(elements []interface{}) *lua.Table {
+	t := lua.NewTable()
+	for i, element := range elements {
+		// Strings nested in arrays are sent as bulk strings
+		if s, ok := element.(string); ok {
+			t.Set(float64(i+1), s)
+		} else {
+			t.Set(float64(i+1), replyToLua(element))
+		}
+	}
+	return t
+}
+
+// replyFromLua converts the value a script returns to a reply: numbers are
+// truncated to integers, or an error if they have no integer representation
+// (NaN, infinities, and numbers out of the int64 range), true becomes 1 and false nil, and a table is an
+// error or status reply if it has an err or ok field, otherwise an array of
+// its values up to the first nil
+func replyFromLua(value lua.Value) interface{} {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return nil
+	case float64:
+		n, ok := lua.ToInteger(v)
+		if !ok {
+			return ErrorReply("ERR Number returned by the script has no integer representation")
+		}
+		return n
+	case string:
+		return []byte(v)
+	case *lua.Table:
+		if msg, ok := v.Get("err").(string); ok {
+			return errorReply(msg)
+		}
+		if status, ok := v.Get("ok").(string); ok {
+			return status
+		}
+		array := make([]interface{}, 0, v.Len())
+		for i := 1; ; i++ {
+			element := v.Get(float64(i))
+			if element == nil {
+				break
+			}
+			array = append(array, replyFromLua(element))
+		}
+		return array
+	default:
+		return nil
+	}
+}
+
+// handleScript runs SCRIPT LOAD, EXISTS, FLUSH and KILL
+func (h *CommandHandler) handleScript(args []string) interface{} {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'script' command")
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) != 2 {
+			return ErrorReply("ERR wrong number of arguments for 'script|load' command")
+		}
+		sha, _, errMsg := h.scripts.load(args[1])
+		if errMsg != "" {
+			return errMsg
+		}
+		return []byte(sha)
+	case "EXISTS":
+		if len(args) < 2 {
+			return ErrorReply("ERR wrong number of arguments for 'script|exists' command")
+		}
+		result := make([]interface{}, len(args)-1)
+		for i, sha := range args[1:] {
+			exists := int64(0)
+			if h.scripts.lookup(sha) != nil {
+				exists = 1
+			}
+			result[i] = exists
+		}
+		return result
+	case "FLUSH":
+		if len(args) > 2 || len(args) == 2 && !strings.EqualFold(args[1], "SYNC") && !strings.EqualFold(args[1], "ASYNC") {
+			return ErrorReply("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+		}
+		h.scripts.mu.Lock()
+		h.scripts.cache = make(map[string]*lua.Chunk)
+		h.scripts.mu.Unlock()
+		return "OK"
+	case "KILL":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'script|kill' command")
+		}
+		return h.killScript()
+	default:
+		return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", args[0]))
+	}
+}
+
+// killScript asks the running script to stop. It runs without the exclusive
+// lock, which the script holds. A script that wrote can't be killed, or the
+// dataset would be left with half of its writes.
+func (h *CommandHandler) killScript() interface{} {
+	if !h.scripts.running.Load() {
+		return ErrorReply("NOTBUSY No scripts in execution right now.")
+	}
+	if h.scripts.wrote.Load() {
+		return ErrorReply("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	}
+	h.scripts.kill.Store(true)
+	return "OK"
+}
@@ -0,0 +1,212 @@
+package commands
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startScript runs EVAL in the background once the time limit is set to a
+// few milliseconds, and waits until the script runs
+func startScript(t *testing.T, h *CommandHandler, script string) <-chan interface{} {
+	t.Helper()
+	h.scripts.timeout.Store(int64(10 * time.Millisecond))
+
+	done := make(chan interface{}, 1)
+	go func() {
+		done <- h.HandleCommand([]string{"EVAL", script, "0"})
+	}()
+	for !h.scripts.running.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func TestBusyScriptIsKilled(t *testing.T) {
+	h := newTestHandler()
+	done := startScript(t, h, "while true do end")
+
+	if reply := h.HandleCommand([]string{"GET", "k"}); reply != BusyReply {
+		t.Fatalf("GET while busy: got %v, want %q", reply, BusyReply)
+	}
+	if reply := h.HandleCommand([]string{"SCRIPT", "KILL"}); reply != "OK" {
+		t.Fatalf("SCRIPT KILL: got %v", reply)
+	}
+	if reply := <-done; reply != ErrorReply("ERR Script killed by user with SCRIPT KILL...") {
+		t.Fatalf("killed script: got %v", reply)
+	}
+	if reply := h.HandleCommand([]string{"GET", "k"}); reply != nil {
+		t.Fatalf("GET after kill: got %v", reply)
+	}
+}
+
+func TestBusyScriptAfterWriteIsNotAborted(t *testing.T) {
+	h := newTestHandler()
+	// The script loops until the test sets stop straight in the store,
+	// which doesn't wait for the script
+	done := startScript(t, h, `
+		redis.call('SET', 'k', 'v')
+		while not redis.call('GET', 'stop') do end
+		return redis.call('GET', 'k')`)
+	for !h.scripts.wrote.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if reply := h.HandleCommand([]string{"SET", "k", "other"}); reply != BusyReply {
+		t.Fatalf("SET while busy: got %v, want %q", reply, BusyReply)
+	}
+	for _, kill := range [][]string{{"SCRIPT", "KILL"}, {"FUNCTION", "KILL"}} {
+		reply, _ := h.HandleCommand(kill).(ErrorReply)
+		if len(reply) < 11 || reply[:11] != "UNKILLABLE " {
+			t.Fatalf("%v after a write: got %q, want UNKILLABLE", kill, reply)
+		}
+	}
+	select {
+	case reply := <-done:
+		t.Fatalf("script aborted with %v", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	h.store.Set("stop", []byte("1"), 0)
+	if reply := <-done; string(reply.([]byte)) != "v" {
+		t.Fatalf("script: got %v, want v", reply)
+	}
+	if reply := h.HandleCommand([]string{"SCRIPT", "KILL"}); reply != ErrorReply("NOTBUSY No scripts in execution right now.") {
+		t.Fatalf("SCRIPT KILL with no script: got %v", reply)
+	}
+}
+
+func TestScriptNumberReplies(t *testing.T) {
+	h := newTestHandler()
+	const noInteger = ErrorReply("ERR Number returned by the script has no integer representation")
+
+	tests := []struct {
+		script string
+		want   interface{}
+	}{
+		{"return 42", int64(42)},
+		{"return -3.9", int64(-3)},
+		{"return 2^53", int64(1 << 53)},
+		{"return -2^63", int64(-1 << 63)},
+		{"return 2^63", noInteger},
+		{"return -2^64", noInteger},
+		{"return math.huge", noInteger},
+		{"return -math.huge", noInteger},
+		{"return 0/0", noInteger},
+		{"return 7 % 0", noInteger},
+		{"return {1, 2^63, 3}", []interface{}{int64(1), noInteger, int64(3)}},
+		{"return string.rep('x', 2^63)", ErrorReply("ERR user_script:1: bad argument #2 to 'rep' (number has no integer representation) script: 70fb90b32d58832e8a5f7953d14005ee5a4c5859")},
+		{"return string.rep('ab', 4611686018427387904)", ErrorReply("ERR user_script:1: resulting string too large script: 226cec68a104f7058bebacb416d2913859a11831")},
+		{"return string.rep('', 4611686018427387904)", []byte{}},
+	}
+	for _, tt := range tests {
+		if got := h.HandleCommand([]string{"EVAL", tt.script, "0"}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("EVAL %q = %#v, want %#v", tt.script, got, tt.want)
+		}
+	}
+}
+
+func TestScriptCallErrors(t *testing.T) {
+	h := newTestHandler()
+
+	tests := []struct {
+		script string
+		want   interface{}
+	}{
+		{"return redis.call('NOPE')", ErrorReply("ERR Unknown Redis command called from script")},
+		{"return redis.call('nope', 'a', 'b')", ErrorReply("ERR Unknown Redis command called from script")},
+		{"return redis.pcall('NOPE')['err']", []byte("ERR Unknown Redis command called from script")},
+		{"return redis.pcall('NOPE')", ErrorReply("ERR Unknown Redis command called from script")},
+		{"return redis.call('GET')", ErrorReply("ERR Wrong number of args calling Redis command from script")},
+		{"return redis.pcall('GET', 'a', 'b')['err']", []byte("ERR Wrong number of args calling Redis command from script")},
+		{"return redis.call('MULTI')", ErrorReply("ERR This Redis command is not allowed from script")},
+		{"return redis.call('EVAL', 'return 1', '0')", ErrorReply("ERR This Redis command is not allowed from script")},
+		{"return redis.call('SET', 'k', 'v')", "OK"},
+	}
+	for _, tt := range tests {
+		if got := h.HandleCommand([]string{"EVAL", tt.script, "0"}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("EVAL %q = %#v, want %#v", tt.script, got, tt.want)
+		}
+	}
+}
+
+func TestScriptStringFormat(t *testing.T) {
+	h := newTestHandler()
+
+	tests := []struct {
+		script string
+		want   interface{}
+	}{
+		{"return string.format('%5d|%-5d|%05.1f', 42, 7, 3.14159)", "   42|7    |003.1"},
+		{"return string.format('%x %X %o %u', 255, 255, 8, 3)", "ff FF 10 3"},
+		{"return string.format('%5s|%-4s|%.2s', 'ab', 'é', 'héllo')", "   ab|é  |h\xc3"},
+		{"return string.format('%3c', 65)", "  A"},
+		{"return string.format('%q', 'a\"b')", "\"a\\\"b\""},
+		{"return string.format('%5000000000d', 1)", "invalid format (width or precision too long)"},
+		{"return string.format('%.123f', 1)", "invalid format (width or precision too long)"},
+		{"return string.format('%------d', 1)", "invalid format (repeated flags)"},
+		{"return string.format('%d', 2^63)", "bad argument #2 to 'format' (number has no integer representation)"},
+		{"return string.format('%d', 0/0)", "bad argument #2 to 'format' (number has no integer representation)"},
+		{"return string.format('%y', 1)", "invalid option '%y' to 'format'"},
+		{"return string.format('%d')", "bad argument #2 to 'format' (no value)"},
+	}
+	for _, tt := range tests {
+		got := h.HandleCommand([]string{"EVAL", tt.script, "0"})
+		switch want := tt.want.(string); got := got.(type) {
+		case []byte:
+			if string(got) != want {
+				t.Errorf("EVAL %q = %q, want %q", tt.script, got, want)
+			}
+		case ErrorReply:
+			if !strings.Contains(string(got), want) {
+				t.Errorf("EVAL %q = %q, want an error containing %q", tt.script, got, want)
+			}
+		default:
+			t.Errorf("EVAL %q = %#v, want %q", tt.script, got, want)
+		}
+	}
+}
+
+func TestScriptReplyConversions(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"SET", "s", "value"})
+	h.HandleCommand([]string{"RPUSH", "l", "a", "b"})
+
+	tests := []struct {
+		name   string
+		script string
+		want   interface{}
+	}{
+		// Replies to Lua values
+		{"integer", "return type(redis.call('STRLEN', 's'))", []byte("number")},
+		{"bulk string", "return type(redis.call('GET', 's'))", []byte("string")},
+		{"nil bulk", "return redis.call('GET', 'missing') == false", int64(1)},
+		{"status", "return redis.call('SET', 'k', 'v')['ok']", []byte("OK")},
+		{"error", "return redis.pcall('INCR', 's')['err']", []byte("ERR value is not an integer or out of range")},
+		{"array", "local a = redis.call('LPOP', 'l') return {a, #redis.call('KEYS', 'l')}", []interface{}{[]byte("a"), int64(1)}},
+		// Lua values to replies
+		{"true", "return true", int64(1)},
+		{"false", "return false", nil},
+		{"nil", "return nil", nil},
+		{"no value", "local x = 1", nil},
+		{"string", "return 'x'", []byte("x")},
+		{"float", "return 3.99", int64(3)},
+		{"status table", "return {ok = 'FINE'}", "FINE"},
+		{"status reply", "return redis.status_reply('DONE')", "DONE"},
+		{"status reply with an error code", "return redis.status_reply('ERR x')", "ERR x"},
+		{"error table", "return {err = 'BAD thing'}", ErrorReply("ERR BAD thing")},
+		{"error with code", "return redis.error_reply('WRONGTYPE no')", ErrorReply("WRONGTYPE no")},
+		{"array until nil", "return {1, 'a', nil, 3}", []interface{}{int64(1), []byte("a")}},
+		{"nested", "return {{1}, {ok = 'x'}, {}}", []interface{}{[]interface{}{int64(1)}, "x", []interface{}{}}},
+		{"hash part ignored", "return {1, x = 2}", []interface{}{int64(1)}},
+		{"round trip", "return redis.call('GET', 's')", []byte("value")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.HandleCommand([]string{"EVAL", tt.script, "0"}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EVAL %q = %#v, want %#v", tt.script, got, tt.want)
+			}
+		})
+	}
+}
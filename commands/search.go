@@ -0,0 +1,537 @@
+package commands
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"Memora/search"
+)
+
+// handleFTCreate implements
+//
+//	FT.CREATE index [ON HASH] [PREFIX count prefix ...] [STOPWORDS count word ...]
+//	          SCHEMA field type [options] ...
+//
+// TAG fields accept SEPARATOR and CASESENSITIVE, TEXT fields WEIGHT and
+// NOSTEM, and every field accepts SORTABLE. VECTOR fields are followed by
+// their algorithm and attributes:
+//
+//	field VECTOR FLAT|HNSW count TYPE FLOAT32 DIM dim DISTANCE_METRIC L2|IP|COSINE
+//	             [M m] [EF_CONSTRUCTION ef] [EF_RUNTIME ef]
+//
+// The new index is filled with the existing hashes before the reply.
+func (h *CommandHandler) handleFTCreate(args []string) interface{} {
+	if len(args) < 3 {
+		return ErrorReply("ERR wrong number of arguments for 'ft.create' command")
+	}
+
+	def := search.Definition{Name: args[0]}
+	i := 1
+	for ; i < len(args) && !strings.EqualFold(args[i], "SCHEMA"); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "ON":
+			if i+1 >= len(args) || !strings.EqualFold(args[i+1], "HASH") {
+				return ErrorReply("ERR Only HASH indexes are supported")
+			}
+			i++
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return ErrorReply("ERR syntax error")
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 0 || count > len(args)-i-2 {
+				return ErrorReply("ERR syntax error")
+			}
+			def.Prefixes = append(def.Prefixes, args[i+2:i+2+count]...)
+			i += 1 + count
+		case "STOPWORDS":
+			if i+1 >= len(args) {
+				return ErrorReply("ERR syntax error")
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 0 || count > len(args)-i-2 {
+				return ErrorReply("ERR syntax error")
+			}
+			def.StopWords = append([]string{}, args[i+2:i+2+count]...)
+			i += 1 + count
+		default:
+			return ErrorReply(fmt.Sprintf("ERR Unknown argument `%s`", args[i]))
+		}
+	}
+	if i >= len(args)-1 {
+		return ErrorReply("ERR Fields arguments are missing")
+	}
+
+	fields, errReply := parseSchema(args[i+1:])
+	if errReply != "" {
+		return errReply
+	}
+	def.Fields = fields
+
+	idx, err := h.indexes.Create(def)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+	h.store.RefreshHashes(idx.Definition().Prefixes)
+	return "OK"
+}
+
+// parseSchema parses the field definitions following SCHEMA
+func parseSchema(args []string) ([]search.FieldSpec, ErrorReply) {
+	fields := make([]search.FieldSpec, 0)
+	seen := make(map[string]bool)
+	for i := 0; i < len(args); {
+		if i+1 >= len(args) {
+			return nil, ErrorReply(fmt.Sprintf("ERR Field `%s` does not have a type", args[i]))
+		}
+		fieldType, ok := search.ParseFieldType(args[i+1])
+		if !ok {
+			return nil, ErrorReply(fmt.Sprintf("ERR Invalid field type for field `%s`", args[i]))
+		}
+		if seen[args[i]] {
+			return nil, ErrorReply(fmt.Sprintf("ERR Duplicate field in schema - %s", args[i]))
+		}
+		seen[args[i]] = true
+
+		field := search.FieldSpec{Name: args[i], Type: fieldType, Separator: ','}
+		i += 2
+		if fieldType == search.VectorField {
+			spec, next, errReply := parseVectorSpec(args, i)
+			if errReply != "" {
+				return nil, errReply
+			}
+			field.Vector = spec
+			i = next
+		}
+		for ; i < len(args); i++ {
+			option := strings.ToUpper(args[i])
+			if option == "SORTABLE" {
+				field.Sortable = true
+			} else if option == "CASESENSITIVE" && fieldType == search.TagField {
+				field.CaseSensitive = true
+			} else if option == "SEPARATOR" && fieldType == search.TagField {
+				if i+1 >= len(args) || len(args[i+1]) != 1 {
+					return nil, "ERR Tag separator must be a single character"
+				}
+				field.Separator = args[i+1][0]
+				i++
+			} else if option == "WEIGHT" && fieldType == search.TextField {
+				weight, err := strconv.ParseFloat(argAt(args, i+1), 64)
+				if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+					return nil, "ERR Bad arguments for WEIGHT"
+				}
+				field.Weight = weight
+				i++
+			} else if option == "NOSTEM" && fieldType == search.TextField {
+				// Terms are never stemmed
+			} else {
+				break
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, ""
+}
+
+// parseVectorSpec parses the algorithm and attributes of a VECTOR field at
+// args[i], returning the index following them
+func parseVectorSpec(args []string, i int) (search.VectorSpec, int, ErrorReply) {
+	spec := search.VectorSpec{
+		M:              search.DefaultM,
+		EFConstruction: search.DefaultEFConstruction,
+		EFRuntime:      search.DefaultEFRuntime,
+	}
+	algorithm, ok := search.ParseVectorAlgorithm(argAt(args, i))
+	if !ok {
+		return spec, 0, "ERR Bad arguments for vector similarity algorithm"
+	}
+	spec.Algorithm = algorithm
+	attributes, next, ok := countedArgs(args, i+1)
+	if !ok || len(attributes)%2 != 0 {
+		return spec, 0, ErrorReply(fmt.Sprintf("ERR Bad number of arguments for vector similarity index: got %s", argAt(args, i+1)))
+	}
+
+	hasType, hasMetric := false, false
+	for j := 0; j < len(attributes); j += 2 {
+		name, value := strings.ToUpper(attributes[j]), attributes[j+1]
+		switch name {
+		case "TYPE":
+			if !strings.EqualFold(value, "FLOAT32") {
+				return spec, 0, ErrorReply(fmt.Sprintf("ERR Bad arguments for vector similarity TYPE: unsupported type `%s`", value))
+			}
+			hasType = true
+		case "DISTANCE_METRIC":
+			metric, ok := search.ParseDistanceMetric(value)
+			if !ok {
+				return spec, 0, ErrorReply(fmt.Sprintf("ERR Bad arguments for vector similarity DISTANCE_METRIC: unknown metric `%s`", value))
+			}
+			spec.Metric, hasMetric = metric, true
+		case "DIM", "M", "EF_CONSTRUCTION", "EF_RUNTIME", "INITIAL_CAP", "BLOCK_SIZE":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return spec, 0, ErrorReply(fmt.Sprintf("ERR Bad arguments for vector similarity %s: expected a positive integer", name))
+			}
+			switch name {
+			case "DIM":
+				spec.Dim = n
+			case "M":
+				spec.M = n
+			case "EF_CONSTRUCTION":
+				spec.EFConstruction = n
+			case "EF_RUNTIME":
+				spec.EFRuntime = n
+			}
+			// INITIAL_CAP and BLOCK_SIZE are accepted for compatibility:
+			// indexes grow as needed
+		default:
+			return spec, 0, ErrorReply(fmt.Sprintf("ERR Bad arguments for vector similarity %s index: unknown attribute `%s`", algorithm, attributes[j]))
+		}
+	}
+	if !hasType || !hasMetric || spec.Dim == 0 {
+		return spec, 0, "ERR Missing mandatory parameter: vector similarity index requires TYPE, DIM and DISTANCE_METRIC"
+	}
+	return spec, next, ""
+}
+
+// handleFTSearch implements
+//
+//	FT.SEARCH index query [NOCONTENT] [WITHSCORES] [RETURN count field ...]
+//	          [HIGHLIGHT [FIELDS count field ...] [TAGS open close]]
+//	          [SUMMARIZE [FIELDS count field ...] [FRAGS num] [LEN num] [SEPARATOR sep]]
+//	          [SORTBY field [ASC|DESC]] [LIMIT offset num]
+//	          [PARAMS count name value ...] [DIALECT dialect]
+//
+// The reply is the number of matches followed by each key of the page, its
+// score with WITHSCORES and, unless NOCONTENT is given, its fields and
+// values. HIGHLIGHT and SUMMARIZE rewrite the returned TEXT fields, by
+// default all of them. KNN queries also return the distance of each document
+// to the query vector, as the first field.
+func (h *CommandHandler) handleFTSearch(args []string) interface{} {
+	if len(args) < 2 {
+		return ErrorReply("ERR wrong number of arguments for 'ft.search' command")
+	}
+
+	idx, exists := h.indexes.Index(args[0])
+	if !exists {
+		return ErrorReply(search.ErrUnknownIndex.Error())
+	}
+
+	opts := search.SearchOptions{Limit: 10}
+	noContent, withScores := false, false
+	var returnFields []string
+	highlight := search.HighlightOptions{Open: "<b>", Close: "</b>", Fragments: 3, Length: 20, Separator: "... "}
+	var highlightFields []string
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NOCONTENT":
+			noContent = true
+		case "WITHSCORES":
+			withScores = true
+		case "HIGHLIGHT":
+			highlight.Highlight = true
+			for i+1 < len(args) {
+				switch strings.ToUpper(args[i+1]) {
+				case "FIELDS":
+					fields, next, ok := countedArgs(args, i+2)
+					if !ok {
+						return ErrorReply("ERR Bad arguments for HIGHLIGHT FIELDS")
+					}
+					highlightFields = append(highlightFields, fields...)
+					i = next - 1
+					continue
+				case "TAGS":
+					if i+3 >= len(args) {
+						return ErrorReply("ERR Bad arguments for HIGHLIGHT TAGS")
+					}
+					highlight.Open, highlight.Close = args[i+2], args[i+3]
+					i += 3
+					continue
+				}
+				break
+			}
+		case "SUMMARIZE":
+			highlight.Summarize = true
+			for i+1 < len(args) {
+				option := strings.ToUpper(args[i+1])
+				if option == "FIELDS" {
+					fields, next, ok := countedArgs(args, i+2)
+					if !ok {
+						return ErrorReply("ERR Bad arguments for SUMMARIZE FIELDS")
+					}
+					highlightFields = append(highlightFields, fields...)
+					i = next - 1
+					continue
+				}
+				if option != "FRAGS" && option != "LEN" && option != "SEPARATOR" {
+					break
+				}
+				if i+2 >= len(args) {
+					return ErrorReply(fmt.Sprintf("ERR Bad arguments for SUMMARIZE %s", option))
+				}
+				if option == "SEPARATOR" {
+					highlight.Separator = args[i+2]
+				} else {
+					n, err := strconv.Atoi(args[i+2])
+					if err != nil || n <= 0 {
+						return ErrorReply(fmt.Sprintf("ERR Bad arguments for SUMMARIZE %s", option))
+					}
+					if option == "FRAGS" {
+						highlight.Fragments = n
+					} else {
+						highlight.Length = n
+					}
+				}
+				i += 2
+			}
+		case "RETURN":
+			if i+1 >= len(args) {
+				return ErrorReply("ERR syntax error")
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 0 || count > len(args)-i-2 {
+				return ErrorReply("ERR syntax error")
+			}
+			returnFields = args[i+2 : i+2+count]
+			i += 1 + count
+		case "SORTBY":
+			if i+1 >= len(args) {
+				return ErrorReply("ERR syntax error")
+			}
+			opts.SortBy = args[i+1]
+			i++
+			if i+1 < len(args) && (strings.EqualFold(args[i+1], "ASC") || strings.EqualFold(args[i+1], "DESC")) {
+				opts.Descending = strings.EqualFold(args[i+1], "DESC")
+				i++
+			}
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return ErrorReply("ERR syntax error")
+			}
+			offset, err1 := strconv.Atoi(args[i+1])
+			limit, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil || offset < 0 || limit < 0 {
+				return ErrorReply("ERR Bad arguments for LIMIT")
+			}
+			opts.Offset, opts.Limit = offset, limit
+			i += 2
+		case "PARAMS":
+			params, next, ok := countedArgs(args, i+1)
+			if !ok || len(params)%2 != 0 {
+				return ErrorReply("ERR Bad arguments for PARAMS")
+			}
+			opts.Params = make(map[string]string, len(params)/2)
+			for j := 0; j < len(params); j += 2 {
+				opts.Params[params[j]] = params[j+1]
+			}
+			i = next - 1
+		case "DIALECT":
+			// Every dialect is parsed the same way
+			if i+1 >= len(args) {
+				return ErrorReply("ERR syntax error")
+			}
+			if _, err := strconv.Atoi(args[i+1]); err != nil {
+				return ErrorReply("ERR DIALECT requires a non negative integer")
+			}
+			i++
+		default:
+			return ErrorReply(fmt.Sprintf("ERR Unknown argument `%s`", args[i]))
+		}
+	}
+
+	// Expired hashes and fields linger in the index until reclaimed
+	h.store.ExpireHashes()
+	result, err := idx.Search(args[1], opts)
+	if err != nil {
+		return ErrorReply(err.Error())
+	}
+
+	// Only TEXT fields are highlighted or summarized
+	formatted := make(map[string]bool)
+	if highlight.Highlight || highlight.Summarize {
+		for _, field := range idx.Definition().Fields {
+			if field.Type == search.TextField &&
+				(len(highlightFields) == 0 || slices.Contains(highlightFields, field.Name)) {
+				formatted[field.Name] = true
+			}
+		}
+	}
+
+	// The total is filled in last, less the keys deleted since the query ran
+	reply := []interface{}{nil}
+	deleted := 0
+	for i, key := range result.Keys {
+		if noContent {
+			reply = append(reply, key)
+			if withScores {
+				reply = append(reply, formatScore(result.Scores[i]))
+			}
+			continue
+		}
+
+		// The index is updated under the key lock, but the key may still
+		// have been deleted since the query ran
+		hash := h.store.HGetAll(key)
+		if hash == nil {
+			deleted++
+			continue
+		}
+		reply = append(reply, key)
+		if withScores {
+			reply = append(reply, formatScore(result.Scores[i]))
+		}
+		for field := range formatted {
+			if value, exists := hash[field]; exists {
+				hash[field] = []byte(result.Highlight(field, string(value), highlight))
+			}
+		}
+		fields := documentFields(hash, returnFields)
+		if result.DistanceField != "" && (len(returnFields) == 0 || slices.Contains(returnFields, result.DistanceField)) {
+			fields = append([]interface{}{result.DistanceField, formatScore(result.Distances[i])}, fields...)
+		}
+		reply = append(reply, fields)
+	}
+	reply[0] = result.Total - deleted
+	return reply
+}
+
+// countedArgs reads "count arg ..." at args[i], returning the args and the
+// index following them
+func countedArgs(args []string, i int) ([]string, int, bool) {
+	count, err := strconv.Atoi(argAt(args, i))
+	if err != nil || count < 0 || count > len(args)-i-1 {
+		return nil, 0, false
+	}
+	return args[i+1 : i+1+count], i + 1 + count, true
+}
+
+// argAt returns args[i], or "" past the end of args
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// documentFields returns the fields of a hash as a flat field/value list,
+// limited to fields if any are given
+func documentFields(hash map[string][]byte, fields []string) []interface{} {
+	if len(fields) == 0 {
+		fields = make([]string, 0, len(hash))
+		for field := range hash {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+	}
+
+	result := make([]interface{}, 0, 2*len(fields))
+	for _, field := range fields {
+		if value, exists := hash[field]; exists {
+			result = append(result, field, value)
+		}
+	}
+	return result
+}
+
+// handleFTDropIndex implements FT.DROPINDEX index [DD]. DD also deletes the
+// indexed hashes.
+func (h *CommandHandler) handleFTDropIndex(args []string) interface{} {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrorReply("ERR wrong number of arguments for 'ft.dropindex' command")
+	}
+	if len(args) == 2 && !strings.EqualFold(args[1], "DD") {
+		return ErrorReply("ERR syntax error")
+	}
+
+	idx, exists := h.indexes.Drop(args[0])
+	if !exists {
+		return ErrorReply(search.ErrUnknownIndex.Error())
+	}
+	if len(args) == 2 {
+		for _, key := range idx.Keys() {
+			h.store.Delete(key)
+		}
+	}
+	return "OK"
+}
+
+func (h *CommandHandler) handleFTInfo(args []string) interface{} {
+	if len(args) != 1 {
+		return ErrorReply("ERR wrong number of arguments for 'ft.info' command")
+	}
+
+	idx, exists := h.indexes.Index(args[0])
+	if !exists {
+		return ErrorReply(search.ErrUnknownIndex.Error())
+	}
+
+	def := idx.Definition()
+	prefixes := make([]interface{}, len(def.Prefixes))
+	for i, prefix := range def.Prefixes {
+		prefixes[i] = prefix
+	}
+	attributes := make([]interface{}, len(def.Fields))
+	for i, field := range def.Fields {
+		attribute := []interface{}{"identifier", field.Name, "attribute", field.Name, "type", field.Type.String()}
+		if field.Type == search.TagField {
+			attribute = append(attribute, "SEPARATOR", string(field.Separator))
+			if field.CaseSensitive {
+				attribute = append(attribute, "CASESENSITIVE")
+			}
+		}
+		if field.Type == search.TextField {
+			attribute = append(attribute, "WEIGHT", formatScore(field.Weight))
+		}
+		if field.Type == search.VectorField {
+			vector := field.Vector
+			attribute = append(attribute, "algorithm", vector.Algorithm.String(), "data_type", "FLOAT32",
+				"dim", vector.Dim, "distance_metric", vector.Metric.String())
+			if vector.Algorithm == search.HNSWAlgorithm {
+				attribute = append(attribute, "M", vector.M, "ef_construction", vector.EFConstruction,
+					"ef_runtime", vector.EFRuntime)
+			}
+		}
+		if field.Sortable {
+			attribute = append(attribute, "SORTABLE")
+		}
+		attributes[i] = attribute
+	}
+
+	info := idx.Info()
+	reply := Map{
+		"index_name", def.Name,
+		"index_definition", []interface{}{"key_type", "HASH", "prefixes", prefixes},
+		"attributes", attributes,
+		"num_docs", info.Docs,
+		"num_terms", info.Terms,
+		"num_records", info.Records,
+	}
+	if def.StopWords != nil {
+		stopWords := make([]interface{}, len(def.StopWords))
+		for i, word := range def.StopWords {
+			stopWords[i] = word
+		}
+		reply = append(reply, "stopwords_list", stopWords)
+	}
+	return reply
+}
+
+func (h *CommandHandler) handleFTList(args []string) interface{} {
+	if len(args) != 0 {
+		return ErrorReply("ERR wrong number of arguments for 'ft._list' command")
+	}
+
+	names := h.indexes.Names()
+	result := make([]interface{}, len(names))
+	for i, name := range names {
+		result[i] = name
+	}
+	return result
+}
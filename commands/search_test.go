@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSearchCountedArguments(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"FT.CREATE", "idx", "SCHEMA", "t", "TEXT"})
+	maxInt := strconv.Itoa(int(^uint(0) >> 1))
+
+	tests := []struct {
+		name    string
+		command []string
+	}{
+		{"prefix max int", []string{"FT.CREATE", "i1", "PREFIX", maxInt, "a:", "SCHEMA", "t", "TEXT"}},
+		{"prefix negative", []string{"FT.CREATE", "i1", "PREFIX", "-1", "SCHEMA", "t", "TEXT"}},
+		{"prefix past the end", []string{"FT.CREATE", "i1", "PREFIX", "2", "a:"}},
+		{"return max int", []string{"FT.SEARCH", "idx", "*", "RETURN", maxInt, "t"}},
+		{"return negative", []string{"FT.SEARCH", "idx", "*", "RETURN", "-1"}},
+		{"return past the end", []string{"FT.SEARCH", "idx", "*", "RETURN", "2", "t"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reply := h.HandleCommand(tt.command); reply != ErrorReply("ERR syntax error") {
+				t.Fatalf("%v = %v, want a syntax error", tt.command, reply)
+			}
+		})
+	}
+	if reply := h.HandleCommand([]string{"FT.SEARCH", "idx", "*", "RETURN", "1", "t"}); len(reply.([]interface{})) != 1 {
+		t.Fatalf("RETURN 1 t = %v, want an empty result", reply)
+	}
+}
+
+func TestSearchListCountOverflow(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"FT.CREATE", "idx", "SCHEMA", "t", "TEXT"})
+	maxInt := strconv.Itoa(int(^uint(0) >> 1))
+
+	tests := []struct {
+		name    string
+		command []string
+		want    ErrorReply
+	}{
+		{"stopwords", []string{"FT.CREATE", "i1", "STOPWORDS", maxInt, "a", "SCHEMA", "t", "TEXT"}, "ERR syntax error"},
+		{"stopwords past the end", []string{"FT.CREATE", "i1", "STOPWORDS", "2", "a"}, "ERR syntax error"},
+		{"params", []string{"FT.SEARCH", "idx", "*", "PARAMS", maxInt, "a", "b"}, "ERR Bad arguments for PARAMS"},
+		{"params past the end", []string{"FT.SEARCH", "idx", "*", "PARAMS", "4", "a", "b"}, "ERR Bad arguments for PARAMS"},
+		{"highlight fields", []string{"FT.SEARCH", "idx", "*", "HIGHLIGHT", "FIELDS", maxInt, "t"}, "ERR Bad arguments for HIGHLIGHT FIELDS"},
+		{"summarize fields", []string{"FT.SEARCH", "idx", "*", "SUMMARIZE", "FIELDS", maxInt, "t"}, "ERR Bad arguments for SUMMARIZE FIELDS"},
+		{"vector attributes", []string{"FT.CREATE", "i2", "SCHEMA", "v", "VECTOR", "FLAT", maxInt, "TYPE", "FLOAT32"},
+			"ERR Bad number of arguments for vector similarity index: got " + ErrorReply(maxInt)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reply := h.HandleCommand(tt.command); reply != tt.want {
+				t.Fatalf("%v = %v, want %q", tt.command, reply, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchSkipsExpired(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"FT.CREATE", "idx", "PREFIX", "1", "doc:", "SCHEMA", "c", "TAG"})
+	h.HandleCommand([]string{"HSET", "doc:1", "c", "US"})
+	h.HandleCommand([]string{"HSET", "doc:2", "c", "US", "n", "x"})
+	h.HandleCommand([]string{"HSET", "doc:3", "c", "US"})
+	h.HandleCommand([]string{"PEXPIRE", "doc:1", "1"})
+	h.HandleCommand([]string{"HPEXPIRE", "doc:2", "1", "FIELDS", "1", "c"})
+	time.Sleep(5 * time.Millisecond)
+
+	reply := h.HandleCommand([]string{"FT.SEARCH", "idx", "@c:{US}", "NOCONTENT"})
+	if fmt.Sprint(reply) != "[1 doc:3]" {
+		t.Fatalf("FT.SEARCH idx @c:{US} = %v, want only doc:3", reply)
+	}
+}
@@ -0,0 +1,404 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"Memora/store"
+)
+
+// denyOOM lists the commands that may grow memory. They are rejected, or
+// make room by evicting keys, once the store is over maxmemory.
+var denyOOM = map[string]bool{
+	"SET": true, "SETNX": true, "SETEX": true, "PSETEX": true,
+	"MSET": true, "MSETNX": true, "GETSET": true, "APPEND": true,
+	"SETRANGE": true, "INCR": true, "DECR": true, "INCRBY": true,
+	"DECRBY": true, "INCRBYFLOAT": true,
+	"LPUSH": true, "RPUSH": true, "SADD": true,
+	"HSET": true, "HSETNX": true, "HINCRBY": true, "HINCRBYFLOAT": true,
+}
+
+// writeCommands lists the commands that modify the data set, which
+// read-only scripts may not call
+var writeCommands = map[string]bool{
+	"SET": true, "SETNX": true, "SETEX": true, "PSETEX": true,
+	"MSET": true, "MSETNX": true, "GETSET": true, "GETDEL": true,
+	"GETEX": true, "APPEND": true, "SETRANGE": true, "INCR": true,
+	"DECR": true, "INCRBY": true, "DECRBY": true, "INCRBYFLOAT": true,
+	"DEL": true, "EXPIRE": true, "PEXPIRE": true, "EXPIREAT": true,
+	"PEXPIREAT": true, "PERSIST": true, "FLUSHALL": true,
+	"LPUSH": true, "RPUSH": true, "LPOP": true, "RPOP": true,
+	"SADD": true, "SREM": true,
+	"HSET": true, "HSETNX": true, "HDEL": true, "HINCRBY": true,
+	"HINCRBYFLOAT": true, "HEXPIRE": true, "HPEXPIRE": true,
+	"HEXPIREAT": true, "HPEXPIREAT": true, "HPERSIST": true,
+	"FT.CREATE": true, "FT.DROPINDEX": true,
+}
+
+// readCommands lists the read-only commands whose keys are remembered for
+// client-side caching, with the number of leading arguments that are keys,
+// or -1 if all of them are
+var readCommands = map[string]int{
+	"GET": 1, "MGET": -1, "EXISTS": -1, "STRLEN": 1, "GETRANGE": 1,
+	"LCS": 2, "TTL": 1, "PTTL": 1, "EXPIRETIME": 1, "PEXPIRETIME": 1,
+	"LLEN": 1, "SMEMBERS": 1, "SISMEMBER": 1, "SSCAN": 1,
+	"HGET": 1, "HGETALL": 1, "HKEYS": 1, "HVALS": 1, "HMGET": 1,
+	"HEXISTS": 1, "HLEN": 1, "HSTRLEN": 1, "HRANDFIELD": 1, "HSCAN": 1,
+	"HTTL": 1, "HPTTL": 1, "HEXPIRETIME": 1, "HPEXPIRETIME": 1,
+}
+
+// commandArity is the number of arguments, the command name included, of
+// every command dispatch runs, as in Redis: N means exactly N, -N at least N.
+// Scripts and transactions check commands against it before running them.
+var commandArity = map[string]int{
+	"SET": -3, "GET": 2, "DEL": -2, "EXISTS": -2, "KEYS": 2,
+	"TTL": 2, "PTTL": 2, "EXPIRETIME": 2, "PEXPIRETIME": 2,
+	"EXPIRE": -3, "PEXPIRE": -3, "EXPIREAT": -3, "PEXPIREAT": -3,
+	"PERSIST": 2, "OBJECT": -2, "SCAN": -2,
+	"INCR": 2, "DECR": 2, "INCRBY": 3, "DECRBY": 3, "INCRBYFLOAT": 3,
+	"SETNX": 3, "SETEX": 4, "PSETEX": 4, "MSET": -3, "MSETNX": -3,
+	"MGET": -2, "GETSET": 3, "GETDEL": 2, "GETEX": -2, "APPEND": 3,
+	"STRLEN": 2, "GETRANGE": 4, "SETRANGE": 4, "LCS": -3,
+	"LPUSH": -3, "RPUSH": -3, "LPOP": 2, "RPOP": 2, "LLEN": 2,
+	"SADD": -3, "SREM": -3, "SMEMBERS": 2, "SISMEMBER": 3, "SSCAN": -3,
+	"HSET": -4, "HGET": 3, "HDEL": -3, "HGETALL": 2, "HKEYS": 2,
+	"HVALS": 2, "HMGET": -3, "HEXISTS": 3, "HLEN": 2, "HSETNX": 4,
+	"HINCRBY": 4, "HINCRBYFLOAT": 4, "HSTRLEN": 3, "HRANDFIELD": -2,
+	"HSCAN": -3, "HEXPIRE": -6, "HPEXPIRE": -6, "HEXPIREAT": -6,
+	"HPEXPIREAT": -6, "HTTL": -4, "HPTTL": -4, "HEXPIRETIME": -4,
+	"HPEXPIRETIME": -4, "HPERSIST": -4,
+	"PING": -1, "ECHO": 2, "FLUSHALL": -1, "DBSIZE": -1, "COMMAND": -1,
+	"CONFIG": -2, "INFO": -1, "MEMORY": -2,
+	"EVAL": -3, "EVALSHA": -3, "SCRIPT": -2, "FUNCTION": -2,
+	"FCALL": -3, "FCALL_RO": -3,
+	"PUBLISH": 3, "SPUBLISH": 3, "PUBSUB": -2,
+	"FT.CREATE": -4, "FT.SEARCH": -3, "FT.DROPINDEX": -2, "FT.INFO": 2,
+	"FT._LIST": 1, "ZRANGEBYLEX": 3, "ZSCAN": -3,
+}
+
+// CheckCommand returns the error reply for a command that doesn't exist or
+// is given the wrong number of arguments, or "" if it can run
+func CheckCommand(command []string) ErrorReply {
+	name := strings.ToUpper(command[0])
+	arity, ok := commandArity[name]
+	if !ok {
+		var args strings.Builder
+		for _, arg := range command[1:] {
+			fmt.Fprintf(&args, "'%s' ", arg)
+		}
+		return ErrorReply(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", command[0], args.String()))
+	}
+	if arity > 0 && len(command) != arity || len(command) < -arity {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+	return ""
+}
+
+// ReadKeys returns the keys command reads, for CLIENT TRACKING, or nil if it
+// is not a read-only command
+func ReadKeys(command []string) []string {
+	if len(command) == 0 {
+		return nil
+	}
+	count, ok := readCommands[strings.ToUpper(command[0])]
+	if !ok {
+		return nil
+	}
+	keys := command[1:]
+	if count >= 0 && count < len(keys) {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// configParameter is a setting exposed through CONFIG GET and CONFIG SET
+type configParameter struct {
+	get func(h *CommandHandler) string
+	set func(h *CommandHandler, value string) error
+}
+
+var configParameters = map[string]configParameter{
+	"maxmemory": {
+		get: func(h *CommandHandler) string {
+			return strconv.FormatInt(h.store.MaxMemory(), 10)
+		},
+		set: func(h *CommandHandler, value string) error {
+			limit, err := store.ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			h.store.SetMaxMemory(limit)
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		get: func(h *CommandHandler) string {
+			return h.store.EvictionPolicy().String()
+		},
+		set: func(h *CommandHandler, value string) error {
+			policy, ok := store.ParseEvictionPolicy(value)
+			if !ok {
+				return fmt.Errorf("ERR argument(s) must be one of the following: %s", strings.Join(evictionPolicies(), ", "))
+			}
+			h.store.SetEvictionPolicy(policy)
+			return nil
+		},
+	},
+	"maxmemory-samples": {
+		get: func(h *CommandHandler) string {
+			return strconv.Itoa(h.store.EvictionSamples())
+		},
+		set: func(h *CommandHandler, value string) error {
+			samples, err := strconv.Atoi(value)
+			if err != nil || samples < 1 || samples > 64 {
+				return fmt.Errorf("ERR argument must be between 1 and 64 inclusive")
+			}
+			h.store.SetEvictionSamples(samples)
+			return nil
+		},
+	},
+	"lua-time-limit": {
+		get: func(h *CommandHandler) string {
+			return strconv.FormatInt(time.Duration(h.scripts.timeout.Load()).Milliseconds(), 10)
+		},
+		set: func(h *CommandHandler, value string) error {
+			limit, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || limit < 0 {
+				return fmt.Errorf("ERR argument couldn't be parsed into an integer")
+			}
+			h.scripts.timeout.Store(int64(time.Duration(limit) * time.Millisecond))
+			return nil
+		},
+	},
+	"notify-keyspace-events": {
+		get: func(h *CommandHandler) string {
+			return h.store.KeyspaceEvents().String()
+		},
+		set: func(h *CommandHandler, value string) error {
+			events, err := store.ParseKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+			h.store.SetKeyspaceEvents(events)
+			return nil
+		},
+	},
+}
+
+func evictionPolicies() []string {
+	names := make([]string, 0)
+	for policy := store.NoEviction; policy <= store.VolatileTTL; policy++ {
+		names = append(names, policy.String())
+	}
+	return names
+}
+
+func (h *CommandHandler) handleConfig(args []string) interface{} {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'config' command")
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) < 2 {
+			return ErrorReply("ERR wrong number of arguments for 'config|get' command")
+		}
+
+		names := make([]string, 0, len(configParameters))
+		for name := range configParameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		result := make(Map, 0)
+		for _, name := range names {
+			for _, pattern := range args[1:] {
+				if store.MatchPattern(pattern, name, true) {
+					result = append(result, name, configParameters[name].get(h))
+					break
+				}
+			}
+		}
+		return result
+	case "SET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return ErrorReply("ERR wrong number of arguments for 'config|set' command")
+		}
+
+		// Validate every parameter before applying any of them
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := configParameters[strings.ToLower(args[i])]; !ok {
+				return ErrorReply(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i]))
+			}
+		}
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(args[i])
+			if err := configParameters[name].set(h, args[i+1]); err != nil {
+				return ErrorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, strings.TrimPrefix(err.Error(), "ERR ")))
+			}
+		}
+		return "OK"
+	default:
+		return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG GET or CONFIG SET.", args[0]))
+	}
+}
+
+// handleInfo returns server information in the INFO format, optionally
+// limited to one section
+func (h *CommandHandler) handleInfo(args []string) interface{} {
+	if len(args) > 1 {
+		return ErrorReply("ERR syntax error")
+	}
+
+	sections := []struct {
+		name   string
+		fields [][2]string
+	}{
+		{"Memory", [][2]string{
+			{"used_memory", strconv.FormatInt(h.store.UsedMemory(), 10)},
+			{"maxmemory", strconv.FormatInt(h.store.MaxMemory(), 10)},
+			{"maxmemory_policy", h.store.EvictionPolicy().String()},
+		}},
+		{"Stats", [][2]string{
+			{"evicted_keys", strconv.FormatInt(h.store.EvictedKeys(), 10)},
+		}},
+	}
+
+	var info strings.Builder
+	for _, section := range sections {
+		if len(args) == 1 && !strings.EqualFold(args[0], section.name) &&
+			!strings.EqualFold(args[0], "all") && !strings.EqualFold(args[0], "default") {
+			continue
+		}
+		if info.Len() > 0 {
+			info.WriteString("\r\n")
+		}
+		fmt.Fprintf(&info, "# %s\r\n", section.name)
+		for _, field := range section.fields {
+			fmt.Fprintf(&info, "%s:%s\r\n", field[0], field[1])
+		}
+	}
+	return Verbatim{Format: "txt", Text: info.String()}
+}
+
+func (h *CommandHandler) handleMemory(args []string) interface{} {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'memory' command")
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "USAGE":
+		return h.handleMemoryUsage(args[1:])
+	case "STATS":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'memory|stats' command")
+		}
+		return h.handleMemoryStats()
+	case "DOCTOR":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'memory|doctor' command")
+		}
+		return h.handleMemoryDoctor()
+	case "HELP":
+		return []interface{}{
+			"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value.",
+			"HELP",
+			"    Print this help.",
+		}
+	default:
+		return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try MEMORY HELP.", args[0]))
+	}
+}
+
+// handleMemoryUsage implements MEMORY USAGE key [SAMPLES count]. Redis
+// samples nested elements to estimate large collections; Memora tracks the
+// size of every key as it changes, so SAMPLES is validated but the reply
+// always accounts for every element.
+func (h *CommandHandler) handleMemoryUsage(args []string) interface{} {
+	if len(args) != 1 && len(args) != 3 {
+		return ErrorReply("ERR wrong number of arguments for 'memory|usage' command")
+	}
+	if len(args) == 3 {
+		if !strings.EqualFold(args[1], "SAMPLES") {
+			return ErrorReply("ERR syntax error")
+		}
+		if samples, err := strconv.Atoi(args[2]); err != nil || samples < 0 {
+			return ErrorReply("ERR value is not an integer or out of range")
+		}
+	}
+
+	usage, exists := h.store.MemoryUsage(args[0])
+	if !exists {
+		return nil
+	}
+	return usage
+}
+
+func (h *CommandHandler) handleMemoryStats() interface{} {
+	stats := h.store.MemoryStats()
+
+	bytesPerKey := int64(0)
+	if stats.Keys > 0 {
+		bytesPerKey = stats.Dataset / int64(stats.Keys)
+	}
+	percentage := 0.0
+	if stats.Allocated > 0 {
+		percentage = float64(stats.Dataset) * 100 / float64(stats.Allocated)
+	}
+
+	return Map{
+		"total.allocated", stats.Allocated,
+		"dataset.bytes", stats.Dataset,
+		"dataset.percentage", strconv.FormatFloat(percentage, 'f', 2, 64),
+		"strings.bytes", stats.Strings,
+		"lists.bytes", stats.Lists,
+		"sets.bytes", stats.Sets,
+		"hashes.bytes", stats.Hashes,
+		"keys.count", stats.Keys,
+		"keys.bytes-per-key", bytesPerKey,
+		"maxmemory", stats.MaxMemory,
+		"evicted.keys", stats.EvictedKeys,
+	}
+}
+
+// handleMemoryDoctor reports likely memory problems in plain English
+func (h *CommandHandler) handleMemoryDoctor() interface{} {
+	stats := h.store.MemoryStats()
+	if stats.Keys == 0 {
+		return []byte("The dataset is empty, there is nothing to report.")
+	}
+
+	problems := make([]string, 0)
+	if stats.MaxMemory > 0 {
+		usage := float64(stats.Dataset) / float64(stats.MaxMemory)
+		switch {
+		case usage >= 1 && h.store.EvictionPolicy() == store.NoEviction:
+			problems = append(problems, fmt.Sprintf("The dataset uses %d bytes, over maxmemory (%d bytes), and maxmemory-policy is noeviction: write commands are being rejected with OOM errors. Raise maxmemory or choose an eviction policy.", stats.Dataset, stats.MaxMemory))
+		case usage >= 0.9:
+			problems = append(problems, fmt.Sprintf("The dataset uses %.0f%% of maxmemory. Keys will soon be evicted or writes rejected.", usage*100))
+		}
+	}
+	if stats.EvictedKeys > 0 {
+		problems = append(problems, fmt.Sprintf("%d keys have been evicted so far because of maxmemory. If this is unexpected, raise maxmemory.", stats.EvictedKeys))
+	}
+	if stats.Dataset > 0 && stats.Allocated > 4*stats.Dataset && stats.Allocated > 64<<20 {
+		problems = append(problems, fmt.Sprintf("The process heap (%d bytes) is more than four times the estimated dataset (%d bytes). Memory is being used by connections and buffers, or has not been returned after keys were deleted.", stats.Allocated, stats.Dataset))
+	}
+	if stats.Dataset/int64(stats.Keys) > 1<<20 {
+		problems = append(problems, "The average key holds more than 1 MB. Very large keys make eviction coarse and slow down commands that read them in full; use MEMORY USAGE to find them.")
+	}
+
+	if len(problems) == 0 {
+		return []byte("No memory problems detected.")
+	}
+	return []byte("Memory problems detected:\n\n * " + strings.Join(problems, "\n\n * "))
+}
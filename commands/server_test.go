@@ -0,0 +1,253 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    string
+		evicted string // the key evicted, "" if any may be
+		kept    string // a key that must not be evicted
+	}{
+		{"noeviction", "OOM command not allowed when used memory > 'maxmemory'.", "", "a"},
+		{"allkeys-lru", "OK", "a", ""},
+		{"allkeys-lfu", "OK", "a", ""},
+		{"allkeys-random", "OK", "", ""},
+		{"volatile-lru", "OK", "b", "a"},
+		{"volatile-lfu", "OK", "b", "a"},
+		{"volatile-random", "OK", "", "a"},
+		{"volatile-ttl", "OK", "b", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			h := newTestHandler()
+			// a has no TTL; b expires before c and was read before it
+			for _, command := range [][]string{
+				{"SET", "a", "1"}, {"SET", "b", "2"}, {"SET", "c", "3"},
+				{"EXPIRE", "b", "100"}, {"EXPIRE", "c", "200"},
+				{"GET", "b"}, {"GET", "c"},
+			} {
+				h.HandleCommand(command)
+			}
+			limit := strconv.FormatInt(h.store.UsedMemory()-1, 10)
+			h.HandleCommand([]string{"CONFIG", "SET", "maxmemory-policy", tt.policy, "maxmemory", limit})
+
+			if reply := h.HandleCommand([]string{"SET", "d", "4"}); fmt.Sprint(reply) != tt.want {
+				t.Fatalf("SET d 4 = %v, want %s", reply, tt.want)
+			}
+			evicted := int64(1)
+			if tt.policy == "noeviction" {
+				evicted = 0
+			}
+			if got := h.store.EvictedKeys(); got != evicted {
+				t.Fatalf("evicted %d keys, want %d", got, evicted)
+			}
+			if reply := h.HandleCommand([]string{"EXISTS", "a", "b", "c"}); fmt.Sprint(reply) != fmt.Sprint(3-evicted) {
+				t.Fatalf("EXISTS a b c = %v, want %d", reply, 3-evicted)
+			}
+			if tt.evicted != "" {
+				if reply := h.HandleCommand([]string{"EXISTS", tt.evicted}); fmt.Sprint(reply) != "0" {
+					t.Fatalf("%s was not evicted", tt.evicted)
+				}
+			}
+			if tt.kept != "" {
+				if reply := h.HandleCommand([]string{"EXISTS", tt.kept}); fmt.Sprint(reply) != "1" {
+					t.Fatalf("%s was evicted", tt.kept)
+				}
+			}
+		})
+	}
+}
+
+func TestEvictionWithoutCandidates(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"SET", "a", "1"})
+	limit := strconv.FormatInt(h.store.UsedMemory()-1, 10)
+	h.HandleCommand([]string{"CONFIG", "SET", "maxmemory-policy", "volatile-lru", "maxmemory", limit})
+
+	want := "OOM command not allowed when used memory > 'maxmemory'."
+	if reply := h.HandleCommand([]string{"SET", "b", "2"}); fmt.Sprint(reply) != want {
+		t.Fatalf("SET b 2 = %v, want %s", reply, want)
+	}
+	if reply := h.HandleCommand([]string{"DEL", "a"}); fmt.Sprint(reply) != "1" {
+		t.Fatalf("DEL a = %v, want 1", reply)
+	}
+	if reply := h.HandleCommand([]string{"SET", "b", "2"}); fmt.Sprint(reply) != "OK" {
+		t.Fatalf("SET b 2 after DEL = %v, want OK", reply)
+	}
+}
+
+func TestMemoryCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   [][]string
+		command []string
+		want    string
+	}{
+		{"usage of a missing key", nil, []string{"MEMORY", "USAGE", "missing"}, "<nil>"},
+		{"SAMPLES misspelt", nil, []string{"MEMORY", "USAGE", "k", "SAMPLE", "5"}, "ERR syntax error"},
+		{"negative SAMPLES", nil, []string{"MEMORY", "USAGE", "k", "SAMPLES", "-1"}, "ERR value is not an integer or out of range"},
+		{"SAMPLES without count", nil, []string{"MEMORY", "USAGE", "k", "SAMPLES"}, "ERR wrong number of arguments for 'memory|usage' command"},
+		{"STATS with arguments", nil, []string{"MEMORY", "STATS", "k"}, "ERR wrong number of arguments for 'memory|stats' command"},
+		{"unknown subcommand", nil, []string{"MEMORY", "PURGE"}, "ERR unknown subcommand 'PURGE'. Try MEMORY HELP."},
+		{"doctor on an empty dataset", [][]string{{"DEL", "k"}}, []string{"MEMORY", "DOCTOR"}, "The dataset is empty, there is nothing to report."},
+		{"doctor without problems", nil, []string{"MEMORY", "DOCTOR"}, "No memory problems detected."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			h.HandleCommand([]string{"SET", "k", "v"})
+			for _, command := range tt.setup {
+				h.HandleCommand(command)
+			}
+			reply := h.HandleCommand(tt.command)
+			if b, ok := reply.([]byte); ok {
+				reply = string(b)
+			}
+			if fmt.Sprint(reply) != tt.want {
+				t.Fatalf("%v = %v, want %s", tt.command, reply, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"SET", "k", "v"})
+	h.HandleCommand([]string{"HSET", "h", "f", "v", "g", "w"})
+
+	small := h.HandleCommand([]string{"MEMORY", "USAGE", "k"}).(int64)
+	if small <= 0 {
+		t.Fatalf("MEMORY USAGE k = %d, want a positive size", small)
+	}
+	if reply := h.HandleCommand([]string{"MEMORY", "USAGE", "k", "SAMPLES", "0"}); reply != small {
+		t.Fatalf("MEMORY USAGE k SAMPLES 0 = %v, want %d", reply, small)
+	}
+	h.HandleCommand([]string{"APPEND", "k", strings.Repeat("x", 1000)})
+	if large := h.HandleCommand([]string{"MEMORY", "USAGE", "k"}).(int64); large < small+1000 {
+		t.Fatalf("MEMORY USAGE k = %d after appending 1000 bytes to a %d byte key", large, small)
+	}
+
+	usage := h.HandleCommand([]string{"MEMORY", "USAGE", "k"}).(int64) +
+		h.HandleCommand([]string{"MEMORY", "USAGE", "h"}).(int64)
+	stats := h.HandleCommand([]string{"MEMORY", "STATS"}).(Map)
+	fields := make(map[string]interface{})
+	for i := 0; i < len(stats); i += 2 {
+		fields[stats[i].(string)] = stats[i+1]
+	}
+	if fields["dataset.bytes"] != usage {
+		t.Fatalf("dataset.bytes = %v, want the %d bytes of both keys", fields["dataset.bytes"], usage)
+	}
+	if fields["keys.count"] != 2 {
+		t.Fatalf("keys.count = %v, want 2", fields["keys.count"])
+	}
+}
+
+func TestMemoryDoctorOverMaxMemory(t *testing.T) {
+	h := newTestHandler()
+	h.HandleCommand([]string{"SET", "k", "v"})
+	h.HandleCommand([]string{"CONFIG", "SET", "maxmemory", "1"})
+
+	reply := string(h.HandleCommand([]string{"MEMORY", "DOCTOR"}).([]byte))
+	if !strings.Contains(reply, "maxmemory-policy is noeviction") {
+		t.Fatalf("MEMORY DOCTOR = %q, want the noeviction problem", reply)
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  string
+		command []string
+		want    []string
+	}{
+		{"off by default", "", []string{"SET", "k", "v"}, nil},
+		{"no channel type", "A", []string{"SET", "k", "v"}, nil},
+		{"keyspace and keyevent", "KEA", []string{"SET", "k", "v"},
+			[]string{"__keyspace@0__:k set", "__keyevent@0__:set k"}},
+		{"string class only", "K$", []string{"SET", "k", "v", "EX", "10"},
+			[]string{"__keyspace@0__:k set"}},
+		{"generic class only", "Kg", []string{"SET", "k", "v", "EX", "10"},
+			[]string{"__keyspace@0__:k expire"}},
+		{"expire", "Eg", []string{"EXPIRE", "k", "10"}, []string{"__keyevent@0__:expire k"}},
+		{"expire in the past", "Eg", []string{"EXPIRE", "k", "0"}, []string{"__keyevent@0__:del k"}},
+		{"persist", "Eg", []string{"PERSIST", "k"}, nil},
+		{"del", "Eg", []string{"DEL", "k", "missing"}, []string{"__keyevent@0__:del k"}},
+		{"del filtered out", "E$", []string{"DEL", "k"}, nil},
+		{"append", "E$", []string{"APPEND", "k", "w"}, []string{"__keyevent@0__:append k"}},
+		{"list", "El", []string{"RPUSH", "l", "a"}, []string{"__keyevent@0__:rpush l"}},
+		{"set", "Es", []string{"SADD", "s", "a"}, []string{"__keyevent@0__:sadd s"}},
+		{"hash", "Eh", []string{"HSET", "h", "f", "v"}, []string{"__keyevent@0__:hset h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			var got []string
+			h.store.SetNotifier(func(channel string, message []byte) {
+				got = append(got, channel+" "+string(message))
+			})
+			h.HandleCommand([]string{"SET", "k", "v"})
+			got = nil
+
+			if reply := h.HandleCommand([]string{"CONFIG", "SET", "notify-keyspace-events", tt.events}); reply != "OK" {
+				t.Fatalf("CONFIG SET notify-keyspace-events %s = %v", tt.events, reply)
+			}
+			h.HandleCommand(tt.command)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("%v published %q, want %q", tt.command, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyspaceNotificationsOfExpiredKeys(t *testing.T) {
+	h := newTestHandler()
+	var got []string
+	h.store.SetNotifier(func(channel string, message []byte) {
+		got = append(got, channel+" "+string(message))
+	})
+	h.HandleCommand([]string{"CONFIG", "SET", "notify-keyspace-events", "Ex"})
+	h.HandleCommand([]string{"SET", "k", "v", "PX", "1"})
+	time.Sleep(5 * time.Millisecond)
+
+	if reply := h.HandleCommand([]string{"GET", "k"}); reply != nil {
+		t.Fatalf("GET k = %v after it expired", reply)
+	}
+	if want := []string{"__keyevent@0__:expired k"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("published %q, want %q", got, want)
+	}
+}
+
+func TestKeyspaceEventsConfig(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"KEA", "AKE"},
+		{"Ex", "xE"},
+		{"gA$K", "AK"},
+		{"Q", "ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxet'."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			h := newTestHandler()
+			if reply := h.HandleCommand([]string{"CONFIG", "SET", "notify-keyspace-events", tt.value}); reply != "OK" {
+				if fmt.Sprint(reply) != tt.want {
+					t.Fatalf("CONFIG SET notify-keyspace-events %s = %v, want %s", tt.value, reply, tt.want)
+				}
+				return
+			}
+			reply := h.HandleCommand([]string{"CONFIG", "GET", "notify-keyspace-events"})
+			if want := fmt.Sprint(Map{"notify-keyspace-events", tt.want}); fmt.Sprint(reply) != want {
+				t.Fatalf("CONFIG GET notify-keyspace-events = %v, want %s", reply, want)
+			}
+		})
+	}
+}
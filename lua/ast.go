@@ -0,0 +1,165 @@
+package lua
+
+// The parser resolves every name when it compiles a chunk: a local variable
+// is a slot of its function's frame, a variable of an enclosing function an
+// upvalue, and anything else a global. The interpreter walks the tree.
+
+type expr interface{}
+
+type (
+	// constExpr is nil, a boolean, a number or a string literal
+	constExpr struct {
+		value Value
+	}
+	// varargExpr is ..., the extra arguments of a vararg function
+	varargExpr struct{}
+	localExpr  struct {
+		name string
+		slot int
+	}
+	upvalueExpr struct {
+		name  string
+		index int
+	}
+	globalExpr struct {
+		name string
+	}
+	indexExpr struct {
+		object, key expr
+	}
+	callExpr struct {
+		fn   expr
+		args []expr
+	}
+	// methodExpr is a method call, object:name(args)
+	methodExpr struct {
+		object expr
+		name   string
+		args   []expr
+	}
+	functionExpr struct {
+		name   string
+		line   int
+		params int
+		vararg bool
+		// slots is the number of local variable slots of a frame
+		slots    int
+		upvalues []upvalueDesc
+		body     []stmt
+	}
+	binaryExpr struct {
+		op          binaryOp
+		left, right expr
+	}
+	unaryExpr struct {
+		op      unaryOp
+		operand expr
+	}
+	// logicalExpr is an and or an or, which only evaluate right if needed
+	logicalExpr struct {
+		and         bool
+		left, right expr
+	}
+	tableExpr struct {
+		fields []tableField
+	}
+	// parenExpr truncates a multiple-value expression to its first value
+	parenExpr struct {
+		inner expr
+	}
+)
+
+// tableField is a field of a table constructor. Positional fields have a nil
+// key.
+type tableField struct {
+	key, value expr
+}
+
+// upvalueDesc says where a closure finds an upvalue when it is created: in
+// a local slot of the enclosing function, or among its upvalues
+type upvalueDesc struct {
+	name      string
+	fromLocal bool
+	index     int
+}
+
+type binaryOp int
+
+const (
+	opAdd binaryOp = iota
+	opSub
+	opMul
+	opDiv
+	opMod
+	opPow
+	opConcat
+	opEq
+	opNe
+	opLt
+	opLe
+	opGt
+	opGe
+)
+
+type unaryOp int
+
+const (
+	opNeg unaryOp = iota
+	opNot
+	opLen
+)
+
+// stmt is a statement and the line it starts on
+type stmt struct {
+	line int
+	node interface{}
+}
+
+type (
+	// localStmt declares new local variables in slots
+	localStmt struct {
+		slots  []int
+		values []expr
+	}
+	assignStmt struct {
+		targets []expr
+		values  []expr
+	}
+	callStmt struct {
+		call expr
+	}
+	doStmt struct {
+		body []stmt
+	}
+	whileStmt struct {
+		cond expr
+		body []stmt
+	}
+	repeatStmt struct {
+		body []stmt
+		cond expr
+	}
+	ifStmt struct {
+		conds  []expr
+		blocks [][]stmt
+		orElse []stmt
+	}
+	numericForStmt struct {
+		slot               int
+		start, limit, step expr
+		body               []stmt
+	}
+	genericForStmt struct {
+		slots  []int
+		values []expr
+		body   []stmt
+	}
+	localFunctionStmt struct {
+		slot int
+		fn   *functionExpr
+	}
+	returnStmt struct {
+		values []expr
+	}
+	breakStmt struct{}
+)
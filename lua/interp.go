@@ -0,0 +1,606 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned by Run when a script exceeds its time limit
+	ErrTimeout = errors.New("script timed out")
+	// ErrKilled is returned by Run when a script is interrupted
+	ErrKilled = errors.New("script killed")
+)
+
+// maxCallDepth bounds the nesting of function calls, so runaway recursion
+// raises a Lua error instead of exhausting the Go stack
+const maxCallDepth = 1000
+
+// checkInterval is the number of steps (loop iterations and calls) between
+// two checks of the time limit and the interrupt flag
+const checkInterval = 1024
+
+// Options configure a run of a chunk
+type Options struct {
+	// Globals are defined alongside the standard library. Scripts can't
+	// create or assign global variables.
+	Globals map[string]Value
+	// Timeout aborts the script with ErrTimeout once it has run that long;
+	// zero means no limit
+	Timeout time.Duration
+	// Interrupt aborts the script with ErrKilled once it is set. Neither
+	// abort can be caught by pcall.
+	Interrupt *atomic.Bool
+	// Seed seeds math.random, so a script draws the same numbers on every
+	// run
+	Seed uint64
+}
+
+// abort is panicked to stop a script past pcall
+type abort struct {
+	err error
+}
+
+// interp runs one chunk
+type interp struct {
+	chunk     string
+	globals   *Table
+	strings   *Table
+	line      int
+	depth     int
+	steps     int
+	deadline  time.Time
+	interrupt *atomic.Bool
+	random    *random
+}
+
+// frame holds the variables of a function call
+type frame struct {
+	cells    []*cell
+	upvalues []*cell
+	varargs  []Value
+}
+
+type flow int
+
+const (
+	flowNormal flow = iota
+	flowBreak
+	flowReturn
+)
+
+// Run runs the chunk and returns the values of its return statement. Errors
+// raised by the script are returned as *Error.
+func (c *Chunk) Run(opts Options) ([]Value, error) {
+	return Call(&Function{Name: "main chunk", proto: c.main, chunk: c.name}, nil, opts)
+}
+
+// Call calls a function created by an earlier run, such as a callback a
+// script registered with the host, in a new run with its own globals. The
+// function keeps the variables it captured in the run that created it.
+func Call(fn *Function, args []Value, opts Options) (results []Value, err error) {
+	in := &interp{chunk: fn.chunk, interrupt: opts.Interrupt, random: newRandom(opts.Seed)}
+	if opts.Timeout > 0 {
+		in.deadline = time.Now().Add(opts.Timeout)
+	}
+	in.openLibraries(opts.Globals)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case *Error:
+				err = in.locate(r)
+			case abort:
+				err = r.err
+			case runtime.Error:
+				err = &Error{Value: fmt.Sprintf("%s:%d: %v", in.chunk, in.line, r)}
+			default:
+				panic(r)
+			}
+		}
+	}()
+	return in.call(fn, args, ""), nil
+}
+
+// locate prefixes an error message with the position of the statement that
+// raised it
+func (in *interp) locate(e *Error) *Error {
+	if msg, ok := e.Value.(string); ok && e.located {
+		return &Error{Value: fmt.Sprintf("%s:%d: %s", in.chunk, in.line, msg)}
+	}
+	return e
+}
+
+// pcall calls fn, catching the Lua errors it raises
+func (in *interp) pcall(fn Value, args []Value) (results []Value, err *Error) {
+	depth := in.depth
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			in.depth = depth
+			err = in.locate(e)
+		}
+	}()
+	return in.call(fn, args, ""), nil
+}
+
+// tick counts a step, and checks every so often whether the script must be
+// aborted
+func (in *interp) tick() {
+	in.steps++
+	if in.steps%checkInterval != 0 {
+		return
+	}
+	if in.interrupt != nil && in.interrupt.Load() {
+		panic(abort{ErrKilled})
+	}
+	if !in.deadline.IsZero() && time.Now().After(in.deadline) {
+		panic(abort{ErrTimeout})
+	}
+}
+
+func (in *interp) call(fn Value, args []Value, what string) []Value {
+	f, ok := fn.(*Function)
+	if !ok {
+		errorf("attempt to call %s", described(what, fn))
+	}
+	in.tick()
+	if f.Go != nil {
+		results, err := f.Go(args)
+		if err != nil {
+			var e *Error
+			if !errors.As(err, &e) {
+				e = &Error{Value: err.Error(), located: true}
+			}
+			panic(e)
+		}
+		return results
+	}
+
+	in.depth++
+	if in.depth > maxCallDepth {
+		errorf("stack overflow")
+	}
+	proto := f.proto
+	fr := &frame{cells: make([]*cell, proto.slots), upvalues: f.upvalues}
+	for i := 0; i < proto.params; i++ {
+		var v Value
+		if i < len(args) {
+			v = args[i]
+		}
+		fr.cells[i] = &cell{v}
+	}
+	if proto.vararg && len(args) > proto.params {
+		fr.varargs = append([]Value(nil), args[proto.params:]...)
+	}
+
+	line := in.line
+	flow, results := in.execBlock(fr, proto.body)
+	in.line = line
+	in.depth--
+	if flow == flowReturn {
+		return results
+	}
+	return nil
+}
+
+func (in *interp) closure(fr *frame, fn *functionExpr) *Function {
+	upvalues := make([]*cell, len(fn.upvalues))
+	for i, u := range fn.upvalues {
+		if u.fromLocal {
+			upvalues[i] = fr.cells[u.index]
+		} else {
+			upvalues[i] = fr.upvalues[u.index]
+		}
+	}
+	return &Function{Name: fn.name, proto: fn, upvalues: upvalues, chunk: in.chunk}
+}
+
+func (in *interp) execBlock(fr *frame, body []stmt) (flow, []Value) {
+	for _, s := range body {
+		in.line = s.line
+		switch n := s.node.(type) {
+		case localStmt:
+			values := in.evalList(fr, n.values, len(n.slots))
+			for i, slot := range n.slots {
+				fr.cells[slot] = &cell{values[i]}
+			}
+		case assignStmt:
+			in.assign(fr, n)
+		case callStmt:
+			in.evalMulti(fr, n.call)
+		case doStmt:
+			if flow, results := in.execBlock(fr, n.body); flow != flowNormal {
+				return flow, results
+			}
+		case whileStmt:
+			for Truthy(in.eval(fr, n.cond)) {
+				in.tick()
+				flow, results := in.execBlock(fr, n.body)
+				if flow == flowBreak {
+					break
+				}
+				if flow == flowReturn {
+					return flow, results
+				}
+			}
+		case repeatStmt:
+			for {
+				in.tick()
+				flow, results := in.execBlock(fr, n.body)
+				if flow == flowBreak {
+					break
+				}
+				if flow == flowReturn {
+					return flow, results
+				}
+				if Truthy(in.eval(fr, n.cond)) {
+					break
+				}
+			}
+		case ifStmt:
+			body := n.orElse
+			for i, cond := range n.conds {
+				if Truthy(in.eval(fr, cond)) {
+					body = n.blocks[i]
+					break
+				}
+			}
+			if flow, results := in.execBlock(fr, body); flow != flowNormal {
+				return flow, results
+			}
+		case numericForStmt:
+			if flow, results := in.numericFor(fr, n); flow == flowReturn {
+				return flow, results
+			}
+		case genericForStmt:
+			if flow, results := in.genericFor(fr, n); flow == flowReturn {
+				return flow, results
+			}
+		case localFunctionStmt:
+			c := &cell{}
+			fr.cells[n.slot] = c
+			c.value = in.closure(fr, n.fn)
+		case returnStmt:
+			return flowReturn, in.evalList(fr, n.values, -1)
+		case breakStmt:
+			return flowBreak, nil
+		}
+	}
+	return flowNormal, nil
+}
+
+func (in *interp) numericFor(fr *frame, n numericForStmt) (flow, []Value) {
+	start, ok1 := ToNumber(in.eval(fr, n.start))
+	limit, ok2 := ToNumber(in.eval(fr, n.limit))
+	step, ok3 := ToNumber(in.eval(fr, n.step))
+	switch {
+	case !ok1:
+		errorf("'for' initial value must be a number")
+	case !ok2:
+		errorf("'for' limit must be a number")
+	case !ok3:
+		errorf("'for' step must be a number")
+	}
+
+	for i := start; step > 0 && i <= limit || step <= 0 && i >= limit; i += step {
+		in.tick()
+		fr.cells[n.slot] = &cell{i}
+		flow, results := in.execBlock(fr, n.body)
+		if flow == flowBreak {
+			break
+		}
+		if flow == flowReturn {
+			return flow, results
+		}
+	}
+	return flowNormal, nil
+}
+
+func (in *interp) genericFor(fr *frame, n genericForStmt) (flow, []Value) {
+	init := in.evalList(fr, n.values, 3)
+	iterator, state, control := init[0], init[1], init[2]
+	for {
+		values := in.call(iterator, []Value{state, control}, "'for' iterator")
+		if len(values) == 0 || values[0] == nil {
+			return flowNormal, nil
+		}
+		control = values[0]
+		for i, slot := range n.slots {
+			var v Value
+			if i < len(values) {
+				v = values[i]
+			}
+			fr.cells[slot] = &cell{v}
+		}
+		flow, results := in.execBlock(fr, n.body)
+		if flow == flowBreak {
+			return flowNormal, nil
+		}
+		if flow == flowReturn {
+			return flow, results
+		}
+	}
+}
+
+// assign evaluates the tables and keys of the targets, then the values, and
+// then assigns them
+func (in *interp) assign(fr *frame, n assignStmt) {
+	type place struct {
+		table, key Value
+	}
+	places := make([]place, len(n.targets))
+	for i, target := range n.targets {
+		if t, ok := target.(indexExpr); ok {
+			places[i] = place{in.eval(fr, t.object), in.eval(fr, t.key)}
+		}
+	}
+
+	values := in.evalList(fr, n.values, len(n.targets))
+	for i, target := range n.targets {
+		switch t := target.(type) {
+		case localExpr:
+			fr.cells[t.slot].value = values[i]
+		case upvalueExpr:
+			fr.upvalues[t.index].value = values[i]
+		case globalExpr:
+			errorf("Script attempted to create or modify global variable '%s'", t.name)
+		case indexExpr:
+			table, ok := places[i].table.(*Table)
+			if !ok {
+				errorf("attempt to index %s", described(describe(t.object), places[i].table))
+			}
+			table.Set(places[i].key, values[i])
+		}
+	}
+}
+
+// evalList evaluates a list of expressions. The last one contributes all its
+// values, then the list is truncated or padded with nils to want values,
+// unless want is negative.
+func (in *interp) evalList(fr *frame, exprs []expr, want int) []Value {
+	values := make([]Value, 0, max(want, len(exprs)))
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			values = append(values, in.evalMulti(fr, e)...)
+		} else {
+			values = append(values, in.eval(fr, e))
+		}
+	}
+	if want < 0 {
+		return values
+	}
+	for len(values) < want {
+		values = append(values, nil)
+	}
+	return values[:want]
+}
+
+// evalMulti evaluates an expression that may have several values: a call or
+// a vararg
+func (in *interp) evalMulti(fr *frame, e expr) []Value {
+	switch e := e.(type) {
+	case callExpr:
+		fn := in.eval(fr, e.fn)
+		args := in.evalList(fr, e.args, -1)
+		return in.call(fn, args, describe(e.fn))
+	case methodExpr:
+		object := in.eval(fr, e.object)
+		fn := in.index(object, e.name, e.object)
+		args := append([]Value{object}, in.evalList(fr, e.args, -1)...)
+		return in.call(fn, args, describe(e))
+	case varargExpr:
+		return fr.varargs
+	default:
+		return []Value{in.eval(fr, e)}
+	}
+}
+
+func (in *interp) eval(fr *frame, e expr) Value {
+	switch e := e.(type) {
+	case constExpr:
+		return e.value
+	case localExpr:
+		return fr.cells[e.slot].value
+	case upvalueExpr:
+		return fr.upvalues[e.index].value
+	case globalExpr:
+		v := in.globals.Get(e.name)
+		if v == nil {
+			errorf("Script attempted to access nonexistent global variable '%s'", e.name)
+		}
+		return v
+	case indexExpr:
+		return in.index(in.eval(fr, e.object), in.eval(fr, e.key), e.object)
+	case callExpr, methodExpr, varargExpr:
+		if values := in.evalMulti(fr, e); len(values) > 0 {
+			return values[0]
+		}
+		return nil
+	case parenExpr:
+		return in.eval(fr, e.inner)
+	case *functionExpr:
+		return in.closure(fr, e)
+	case logicalExpr:
+		left := in.eval(fr, e.left)
+		if Truthy(left) != e.and {
+			return left
+		}
+		return in.eval(fr, e.right)
+	case unaryExpr:
+		return in.unary(e.op, in.eval(fr, e.operand), e.operand)
+	case binaryExpr:
+		return in.binary(e.op, in.eval(fr, e.left), in.eval(fr, e.right), e)
+	case tableExpr:
+		return in.table(fr, e)
+	}
+	panic(fmt.Sprintf("lua: unknown expression %T", e))
+}
+
+func (in *interp) table(fr *frame, e tableExpr) *Table {
+	t := NewTable()
+	position := 1
+	for i, f := range e.fields {
+		if f.key != nil {
+			key := in.eval(fr, f.key)
+			if key == nil {
+				errorf("table index is nil")
+			}
+			t.Set(key, in.eval(fr, f.value))
+			continue
+		}
+		if i == len(e.fields)-1 {
+			for _, v := range in.evalMulti(fr, f.value) {
+				t.Set(float64(position), v)
+				position++
+			}
+			continue
+		}
+		t.Set(float64(position), in.eval(fr, f.value))
+		position++
+	}
+	return t
+}
+
+// index returns object[key]. Strings are indexed in the string library, so
+// methods like s:upper() work.
+func (in *interp) index(object, key Value, e expr) Value {
+	switch o := object.(type) {
+	case *Table:
+		return o.Get(key)
+	case string:
+		return in.strings.Get(key)
+	}
+	errorf("attempt to index %s", described(describe(e), object))
+	return nil
+}
+
+func (in *interp) unary(op unaryOp, v Value, e expr) Value {
+	switch op {
+	case opNot:
+		return !Truthy(v)
+	case opLen:
+		switch v := v.(type) {
+		case string:
+			return float64(len(v))
+		case *Table:
+			return float64(v.Len())
+		}
+		errorf("attempt to get length of %s", described(describe(e), v))
+	default:
+		n, ok := ToNumber(v)
+		if !ok {
+			errorf("attempt to perform arithmetic on %s", described(describe(e), v))
+		}
+		return -n
+	}
+	return nil
+}
+
+func (in *interp) binary(op binaryOp, a, b Value, e binaryExpr) Value {
+	switch op {
+	case opEq:
+		return a == b
+	case opNe:
+		return a != b
+	case opLt:
+		return less(a, b)
+	case opLe:
+		return !less(b, a)
+	case opGt:
+		return less(b, a)
+	case opGe:
+		return !less(a, b)
+	case opConcat:
+		x, ok1 := ToString(a)
+		y, ok2 := ToString(b)
+		if !ok1 || !ok2 {
+			culprit, v := e.left, a
+			if ok1 {
+				culprit, v = e.right, b
+			}
+			errorf("attempt to concatenate %s", described(describe(culprit), v))
+		}
+		return x + y
+	}
+
+	x, ok1 := ToNumber(a)
+	y, ok2 := ToNumber(b)
+	if !ok1 || !ok2 {
+		culprit, v := e.left, a
+		if ok1 {
+			culprit, v = e.right, b
+		}
+		errorf("attempt to perform arithmetic on %s", described(describe(culprit), v))
+	}
+	switch op {
+	case opAdd:
+		return x + y
+	case opSub:
+		return x - y
+	case opMul:
+		return x * y
+	case opDiv:
+		return x / y
+	case opMod:
+		return x - math.Floor(x/y)*y
+	default:
+		return math.Pow(x, y)
+	}
+}
+
+// less compares two numbers or two strings
+func less(a, b Value) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x < y
+		}
+	}
+	if TypeName(a) == TypeName(b) {
+		errorf("attempt to compare two %s values", TypeName(a))
+	}
+	errorf("attempt to compare %s with %s", TypeName(a), TypeName(b))
+	return false
+}
+
+// described describes a value for an error message, with the name of the
+// variable it was read from when there is one
+func described(name string, v Value) string {
+	if name == "" {
+		return "a " + TypeName(v) + " value"
+	}
+	return fmt.Sprintf("%s (a %s value)", name, TypeName(v))
+}
+
+// describe names the variable an expression reads, or returns ""
+func describe(e expr) string {
+	switch e := e.(type) {
+	case localExpr:
+		return fmt.Sprintf("local '%s'", e.name)
+	case upvalueExpr:
+		return fmt.Sprintf("upvalue '%s'", e.name)
+	case globalExpr:
+		return fmt.Sprintf("global '%s'", e.name)
+	case indexExpr:
+		if c, ok := e.key.(constExpr); ok {
+			if name, ok := c.value.(string); ok {
+				return fmt.Sprintf("field '%s'", name)
+			}
+		}
+	case methodExpr:
+		return fmt.Sprintf("method '%s'", e.name)
+	}
+	return ""
+}
@@ -0,0 +1,281 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenName
+	tokenNumber
+	tokenString
+	// tokenKeyword and tokenSymbol tokens hold the keyword or symbol in text
+	tokenKeyword
+	tokenSymbol
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	number float64
+	line   int
+}
+
+var keywords = map[string]struct{}{
+	"and": {}, "break": {}, "do": {}, "else": {}, "elseif": {}, "end": {},
+	"false": {}, "for": {}, "function": {}, "if": {}, "in": {}, "local": {},
+	"nil": {}, "not": {}, "or": {}, "repeat": {}, "return": {}, "then": {},
+	"true": {}, "until": {}, "while": {},
+}
+
+// symbols lists the operators and punctuation, longest first so the lexer
+// matches greedily
+var symbols = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+// lexer splits a chunk's source into tokens
+type lexer struct {
+	chunk string
+	src   string
+	pos   int
+	line  int
+}
+
+// syntaxError is raised by the lexer and parser and recovered by Compile
+type syntaxError struct {
+	msg string
+}
+
+func (l *lexer) fail(line int, format string, args ...interface{}) {
+	panic(&syntaxError{fmt.Sprintf("%s:%d: %s", l.chunk, line, fmt.Sprintf(format, args...))})
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func (l *lexer) next() token {
+	l.skipSpace()
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, text: "<eof>", line: l.line}
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case isNameStart(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		word := l.src[start:l.pos]
+		if _, keyword := keywords[word]; keyword {
+			return token{kind: tokenKeyword, text: word, line: l.line}
+		}
+		return token{kind: tokenName, text: word, line: l.line}
+	case isDigit(c) || c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+		return l.number()
+	case c == '"' || c == '\'':
+		return l.quoted(c)
+	case c == '[' && l.longBracketLevel() >= 0:
+		line := l.line
+		return token{kind: tokenString, text: l.longString(), line: line}
+	}
+
+	for _, s := range symbols {
+		if strings.HasPrefix(l.src[l.pos:], s) {
+			l.pos += len(s)
+			return token{kind: tokenSymbol, text: s, line: l.line}
+		}
+	}
+	l.fail(l.line, "unexpected symbol near '%c'", c)
+	return token{}
+}
+
+// skipSpace skips white space and comments
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "--"):
+			l.pos += 2
+			if l.pos < len(l.src) && l.src[l.pos] == '[' && l.longBracketLevel() >= 0 {
+				l.longString()
+				continue
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '#' && l.pos == 0:
+			// A first line starting with # (a shebang) is ignored
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) number() token {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.src) && isHexDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	} else {
+		for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+			l.pos++
+			if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+				l.pos++
+			}
+			for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+				l.pos++
+			}
+		}
+	}
+	// A number running into a name, like 3x, is malformed
+	for l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+		l.pos++
+	}
+
+	text := l.src[start:l.pos]
+	n, ok := parseNumber(text)
+	if !ok {
+		l.fail(l.line, "malformed number near '%s'", text)
+	}
+	return token{kind: tokenNumber, text: text, number: n, line: l.line}
+}
+
+func (l *lexer) quoted(quote byte) token {
+	line := l.line
+	l.pos++
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			l.fail(line, "unfinished string")
+		}
+		c := l.src[l.pos]
+		l.pos++
+		if c == quote {
+			return token{kind: tokenString, text: b.String(), line: line}
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if l.pos >= len(l.src) {
+			l.fail(line, "unfinished string")
+		}
+		c = l.src[l.pos]
+		l.pos++
+		switch c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '"', '\'':
+			b.WriteByte(c)
+		case '\n':
+			l.line++
+			b.WriteByte('\n')
+		case 'x':
+			if l.pos+2 > len(l.src) || !isHexDigit(l.src[l.pos]) || !isHexDigit(l.src[l.pos+1]) {
+				l.fail(line, "hexadecimal digit expected")
+			}
+			n, _ := parseNumber("0x" + l.src[l.pos:l.pos+2])
+			b.WriteByte(byte(n))
+			l.pos += 2
+		case 'z':
+			for l.pos < len(l.src) && strings.IndexByte(" \t\r\n\f\v", l.src[l.pos]) >= 0 {
+				if l.src[l.pos] == '\n' {
+					l.line++
+				}
+				l.pos++
+			}
+		default:
+			if !isDigit(c) {
+				l.fail(line, "invalid escape sequence '\\%c'", c)
+			}
+			n := int(c - '0')
+			for i := 0; i < 2 && l.pos < len(l.src) && isDigit(l.src[l.pos]); i++ {
+				n = n*10 + int(l.src[l.pos]-'0')
+				l.pos++
+			}
+			if n > 255 {
+				l.fail(line, "escape sequence too large")
+			}
+			b.WriteByte(byte(n))
+		}
+	}
+}
+
+// longBracketLevel returns the level of the long bracket [==[ at the current
+// position (the number of = signs), or -1 if there is none
+func (l *lexer) longBracketLevel() int {
+	i := l.pos + 1
+	for i < len(l.src) && l.src[i] == '=' {
+		i++
+	}
+	if i < len(l.src) && l.src[i] == '[' {
+		return i - l.pos - 1
+	}
+	return -1
+}
+
+// longString reads a long bracket string or comment. A newline right after
+// the opening bracket is dropped.
+func (l *lexer) longString() string {
+	line := l.line
+	level := l.longBracketLevel()
+	l.pos += level + 2
+	if strings.HasPrefix(l.src[l.pos:], "\r\n") {
+		l.pos += 2
+		l.line++
+	} else if strings.HasPrefix(l.src[l.pos:], "\n") {
+		l.pos++
+		l.line++
+	}
+
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.src[l.pos:], closing)
+	if end < 0 {
+		l.fail(line, "unfinished long string")
+	}
+	s := l.src[l.pos : l.pos+end]
+	l.line += strings.Count(s, "\n")
+	l.pos += end + len(closing)
+	return s
+}
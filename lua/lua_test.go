@@ -0,0 +1,267 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// test is a script and what it returns: its results separated by commas, or
+// "error: " followed by the error it raised
+type test struct {
+	name   string
+	source string
+	want   string
+}
+
+// run compiles and runs source with opts and formats the outcome like
+// test.want
+func run(source string, opts Options) string {
+	chunk, err := Compile("test", source)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	results, err := chunk.Run(opts)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	parts := make([]string, len(results))
+	for i, v := range results {
+		if s, ok := ToString(v); ok {
+			parts[i] = s
+		} else {
+			parts[i] = TypeName(v)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func runTests(t *testing.T, tests []test) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(tt.source, Options{}); got != tt.want {
+				t.Errorf("%s\ngot  %q\nwant %q", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser(t *testing.T) {
+	runTests(t, []test{
+		{"empty chunk", "", ""},
+		{"return values", "return 1, 'a', nil, true", "1,a,nil,boolean"},
+		{"long strings", "return [[a\nb]], [==[x]]y]==]", "a\nb,x]]y"},
+		{"escapes", `return "\65\t\"\\", '\0' == string.char(0)`, "A\t\"\\,boolean"},
+		{"comments", "-- line\n--[[ block\n]] return 1 --[==[ x ]==]", "1"},
+		{"numerals", "return 0x1F, 1e2, .5, 3.", "31,100,0.5,3"},
+		{"precedence", "return 2 + 3 * 4 ^ 2 / 8 - 1", "7"},
+		{"right associative", "return 2 ^ 3 ^ 2, 'a' .. 'b' .. 'c'", "512,abc"},
+		{"unary", "return -2 ^ 2, not nil == true, #'abc'", "-4,boolean,3"},
+		{"comparison chain", "return 1 < 2 == true", "boolean"},
+		{"local function", "local function f(n) if n < 2 then return n end return f(n-1) + f(n-2) end return f(10)", "55"},
+		{"varargs", "local function f(...) return select('#', ...), ... end return f(1, nil, 3)", "3,1,nil,3"},
+		{"multiple assignment", "local a, b = 1, 2 a, b = b, a return a, b", "2,1"},
+		{"numeric for", "local s = 0 for i = 10, 1, -3 do s = s + i end return s", "22"},
+		{"generic for", "local s = '' for k, v in ipairs({'a', 'b'}) do s = s .. k .. v end return s", "1a2b"},
+		{"while and break", "local i = 0 while true do i = i + 1 if i == 5 then break end end return i", "5"},
+		{"repeat scope", "local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", "4"},
+		{"closures", "local fs = {} for i = 1, 3 do fs[i] = function() return i end end return fs[1](), fs[3]()", "1,3"},
+		{"method call", "local t = {n = 1} function t:add(k) self.n = self.n + k return self end return t:add(2):add(3).n", "6"},
+		{"table constructor", "local t = {1, 2, x = 3, [10] = 4; 5} return #t, t.x, t[10], t[3]", "3,3,4,5"},
+		{"call with string", "local function f(s) return s end return f'x', f[[y]]", "x,y"},
+		{"syntax error", "return 1 +", "error: test:1: unexpected symbol near <eof>"},
+		{"unfinished string", "return 'abc", "error: test:1: unfinished string"},
+		{"unexpected end", "if true then", "error: test:1: 'end' expected near <eof>"},
+		{"goto is a name", "local goto = 1 return goto", "1"},
+	})
+}
+
+func TestArithmetic(t *testing.T) {
+	runTests(t, []test{
+		{"integers", "return 7 + 3, 7 - 3, 7 * 3, 7 / 2", "10,4,21,3.5"},
+		{"modulo", "return 7 % 3, -7 % 3, 7 % -3, 5.5 % 2", "1,2,-2,1.5"},
+		{"modulo by zero", "return 7 % 0", "nan"},
+		{"division by zero", "return 1 / 0, -1 / 0", "inf,-inf"},
+		{"nan", "local n = 0 / 0 return n ~= n", "boolean"},
+		{"power", "return 2 ^ 10, 2 ^ 0.5 == math.sqrt(2)", "1024,boolean"},
+		{"string coercion", "return '10' + 5, '0x10' * 1, ' 2 ' * 3", "15,16,6"},
+		{"bad coercion", "return 'a' + 1", "error: test:1: attempt to perform arithmetic on a string value"},
+		{"nil arithmetic", "local x return x + 1", "error: test:1: attempt to perform arithmetic on local 'x' (a nil value)"},
+		{"concat numbers", "return 1 .. 2, 1.5 .. ''", "12,1.5"},
+		{"concat nil", "return 'a' .. nil", "error: test:1: attempt to concatenate a nil value"},
+		{"formatting", "return 1e15, 1e14, 0.1, -0.0 .. '', 2^53", "1e+15,100000000000000,0.1,-0,9.007199254741e+15"},
+		{"comparison", "return 1 < 2, 'a' < 'b', 'Z' < 'a'", "boolean,boolean,boolean"},
+		{"mixed comparison", "return 1 < 'x'", "error: test:1: attempt to compare number with string"},
+		{"equality", "return 1 == '1', {} == {}, 'a' == 'a'", "boolean,boolean,boolean"},
+		{"tonumber", "return tonumber('12'), tonumber('z', 36), tonumber('ff', 16), tonumber('x')", "12,35,255,nil"},
+		{"math", "return math.floor(-1.5), math.ceil(-1.5), math.max(3, 9, 1), math.fmod(7, 3)", "-2,-1,9,1"},
+		{"huge", "return math.huge, -math.huge", "inf,-inf"},
+	})
+}
+
+func TestStringLibrary(t *testing.T) {
+	runTests(t, []test{
+		{"len and case", "return ('abc'):len(), string.upper('aB'), string.lower('aB')", "3,AB,ab"},
+		{"sub", "local s = 'hello' return s:sub(2, 3), s:sub(-3), s:sub(4, 2), s:sub(0)", "el,llo,,hello"},
+		{"rep", "return string.rep('ab', 3), string.rep('x', 0), string.rep('x', -1)", "ababab,,"},
+		{"rep limit", "return string.rep('x', 2^40)", "error: test:1: resulting string too large"},
+		{"byte and char", "return string.byte('A'), string.char(72, 105)", "65,Hi"},
+		{"reverse", "return string.reverse('abc')", "cba"},
+		{"find plain", "return string.find('a.b', '.', 1, true)", "2,2"},
+		{"find pattern", "return string.find('hello world', 'o w')", "5,7"},
+		{"find captures", "return string.find('key=value', '(%w+)=(%w+)')", "1,9,key,value"},
+		{"match", "return string.match('2024-01-02', '(%d+)-(%d+)-(%d+)')", "2024,01,02"},
+		{"match anchored", "return string.match('abc', '^b'), string.match('abc', 'c$')", "nil,c"},
+		{"gmatch", "local s = '' for w in string.gmatch('one two three', '%a+') do s = s .. w:sub(1, 1) end return s", "ott"},
+		{"gsub", "return string.gsub('hello world', 'o', '0')", "hell0 w0rld,2"},
+		{"gsub captures", "return (string.gsub('a=1, b=2', '(%w)=(%w)', '%2=%1'))", "1=a, 2=b"},
+		{"gsub function", "return (string.gsub('abc', '%w', function(c) return c:upper() .. '.' end))", "A.B.C."},
+		{"gsub table", "return (string.gsub('$x $y', '%$(%w)', {x = 'X'}))", "X $y"},
+		{"gsub limit", "return string.gsub('aaa', 'a', 'b', 2)", "bba,2"},
+		{"balanced", "return string.match('f(a(b)c)d', '%b()')", "(a(b)c)"},
+		{"frontier", "return string.find('THE (quick) fox', '%f[%a]%a+', 5)", "6,10"},
+		{"bad pattern", "return string.find('a', '[a')", "error: test:1: malformed pattern (missing ']')"},
+		{"format", "return string.format('%s=%d %5.2f %q', 'x', 3, 1.5, 'a\\n')", "x=3  1.50 \"a\\n\""},
+		{"format width", "return string.format('%100d', 1)", "error: test:1: invalid format (width or precision too long)"},
+		{"format no value", "return string.format('%s')", "error: test:1: bad argument #2 to 'format' (no value)"},
+		{"tostring", "return tostring(nil), tostring(1.5), tostring(true)", "nil,1.5,true"},
+		{"table concat", "return table.concat({1, 'a', 2}, '-'), table.concat({}, ',')", "1-a-2,"},
+		{"table sort", "local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return unpack(t)", "3,2,1"},
+		{"table insert remove", "local t = {1, 3} table.insert(t, 2, 2) table.insert(t, 4) return table.remove(t, 1), unpack(t)", "1,2,3,4"},
+	})
+}
+
+func TestSandbox(t *testing.T) {
+	runTests(t, []test{
+		{"no global assignment", "x = 1", "error: test:1: Script attempted to create or modify global variable 'x'"},
+		{"no global function", "function f() end", "error: test:1: Script attempted to create or modify global variable 'f'"},
+		{"no io", "return io", "error: test:1: Script attempted to access nonexistent global variable 'io'"},
+		{"no os", "return os", "error: test:1: Script attempted to access nonexistent global variable 'os'"},
+		{"no load", "return loadstring", "error: test:1: Script attempted to access nonexistent global variable 'loadstring'"},
+		{"no require", "return require", "error: test:1: Script attempted to access nonexistent global variable 'require'"},
+		{"no metatables", "return setmetatable", "error: test:1: Script attempted to access nonexistent global variable 'setmetatable'"},
+		{"no coroutines", "return coroutine", "error: test:1: Script attempted to access nonexistent global variable 'coroutine'"},
+		{"undefined global", "return undefined_name", "error: test:1: Script attempted to access nonexistent global variable 'undefined_name'"},
+		{"libraries are frozen", "string.upper = nil", "error: test:1: Attempt to modify a readonly table"},
+		{"string metatable", "return ('x'):rep(3)", "xxx"},
+		{"error values", "local ok, e = pcall(error, {code = 42}) return ok, e.code", "boolean,42"},
+		{"error levels", "local ok, e = pcall(error, 'boom', 0) return e", "boom"},
+		{"error position", "local ok, e = pcall(function() error('boom') end) return e", "test:1: boom"},
+		{"xpcall", "return xpcall(function() error('x', 0) end, function(e) return 'handled ' .. e end)", "boolean,handled x"},
+		{"seeded random", "math.randomseed(7) local a = math.random(100) math.randomseed(7) return a == math.random(100)", "boolean"},
+	})
+}
+
+func TestLimits(t *testing.T) {
+	runTests(t, []test{
+		{"recursion", "local function f() return 1 + f() end return f()", "error: test:1: stack overflow"},
+		{"caught recursion", "local function f() return 1 + f() end return (pcall(f))", "boolean"},
+		{"deep nesting", "return " + strings.Repeat("(", 300) + "1" + strings.Repeat(")", 300), "error: test:1: chunk has too many syntax levels"},
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		got := run("while true do end", Options{Timeout: 20 * time.Millisecond})
+		if got != "error: "+ErrTimeout.Error() {
+			t.Fatalf("got %q, want a timeout", got)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("timed out after %v", elapsed)
+		}
+	})
+
+	t.Run("interrupt", func(t *testing.T) {
+		var interrupt atomic.Bool
+		time.AfterFunc(10*time.Millisecond, func() { interrupt.Store(true) })
+		got := run("local ok = pcall(function() while true do end end) return ok", Options{Interrupt: &interrupt})
+		if got != "error: "+ErrKilled.Error() {
+			t.Fatalf("got %q: pcall must not catch an interrupt", got)
+		}
+	})
+}
+
+func TestValueConversions(t *testing.T) {
+	numbers := []struct {
+		in  float64
+		out int64
+		ok  bool
+	}{
+		{0, 0, true},
+		{-3.9, -3, true},
+		{1 << 53, 1 << 53, true},
+		{-1 << 63, -1 << 63, true},
+		{1 << 63, 0, false},
+		{-1 << 64, 0, false},
+	}
+	for _, tt := range numbers {
+		if out, ok := ToInteger(tt.in); out != tt.out || ok != tt.ok {
+			t.Errorf("ToInteger(%v) = %d, %v, want %d, %v", tt.in, out, ok, tt.out, tt.ok)
+		}
+	}
+	for _, n := range []string{"math.huge", "-math.huge", "0/0"} {
+		chunk, err := Compile("test", "return "+n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, _ := chunk.Run(Options{})
+		if _, ok := ToInteger(results[0].(float64)); ok {
+			t.Errorf("ToInteger(%s) reported an integer", n)
+		}
+	}
+
+	values := []struct {
+		in     Value
+		str    string
+		strOK  bool
+		num    float64
+		numOK  bool
+		truthy bool
+	}{
+		{nil, "", false, 0, false, false},
+		{false, "", false, 0, false, false},
+		{true, "", false, 0, false, true},
+		{float64(0), "0", true, 0, true, true},
+		{1.5, "1.5", true, 1.5, true, true},
+		{"", "", true, 0, false, true},
+		{" 0x10 ", " 0x10 ", true, 16, true, true},
+		{"1e3", "1e3", true, 1000, true, true},
+		{"12abc", "12abc", true, 0, false, true},
+		{NewTable(), "", false, 0, false, true},
+	}
+	for _, tt := range values {
+		if s, ok := ToString(tt.in); s != tt.str || ok != tt.strOK {
+			t.Errorf("ToString(%v) = %q, %v, want %q, %v", tt.in, s, ok, tt.str, tt.strOK)
+		}
+		if n, ok := ToNumber(tt.in); n != tt.num || ok != tt.numOK {
+			t.Errorf("ToNumber(%v) = %v, %v, want %v, %v", tt.in, n, ok, tt.num, tt.numOK)
+		}
+		if Truthy(tt.in) != tt.truthy {
+			t.Errorf("Truthy(%v) = %v", tt.in, !tt.truthy)
+		}
+	}
+}
+
+func TestHostFunctions(t *testing.T) {
+	double := NewFunction("double", func(args []Value) ([]Value, error) {
+		n, ok := ToNumber(args[0])
+		if !ok {
+			return nil, errors.New("not a number")
+		}
+		return []Value{n * 2}, nil
+	})
+	globals := map[string]Value{"double": double, "list": NewArray("a", "b")}
+	tests := []test{
+		{"call", "return double(21)", "42"},
+		{"host error", "return double('x')", "error: test:1: not a number"},
+		{"caught host error", "return pcall(double, 'x')", "boolean,test:1: not a number"},
+		{"array", "return #list, list[2]", "2,b"},
+	}
+	for _, tt := range tests {
+		if got := run(tt.source, Options{Globals: globals}); got != tt.want {
+			t.Errorf("%s\ngot  %q\nwant %q", tt.source, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,635 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Chunk is a compiled script, ready to run any number of times
+type Chunk struct {
+	name string
+	main *functionExpr
+}
+
+// maxSyntaxDepth bounds the nesting of blocks and expressions, so a
+// pathological script can't exhaust the stack of the parser
+const maxSyntaxDepth = 200
+
+// Compile parses source into a chunk. name prefixes the position of syntax
+// and runtime errors.
+func Compile(name, source string) (chunk *Chunk, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*syntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = errors.New(e.msg)
+		}
+	}()
+
+	p := &parser{lex: &lexer{chunk: name, src: source, line: 1}}
+	p.advance()
+	main := &functionExpr{name: "main chunk", vararg: true}
+	p.openFunction(main)
+	main.body = p.block()
+	if p.tok.kind != tokenEOF {
+		p.unexpected()
+	}
+	p.closeFunction()
+	return &Chunk{name: name, main: main}, nil
+}
+
+// funcState tracks the function being parsed
+type funcState struct {
+	parent *funcState
+	fn     *functionExpr
+	// actives are the local variables in scope, innermost last
+	actives []localVar
+	// blocks holds the number of active variables when each open block
+	// started
+	blocks []int
+	loops  int
+}
+
+type localVar struct {
+	name string
+	slot int
+}
+
+type parser struct {
+	lex      *lexer
+	tok      token
+	ahead    token
+	hasAhead bool
+	fs       *funcState
+	depth    int
+}
+
+func (p *parser) advance() {
+	if p.hasAhead {
+		p.tok, p.hasAhead = p.ahead, false
+		return
+	}
+	p.tok = p.lex.next()
+}
+
+func (p *parser) peek() token {
+	if !p.hasAhead {
+		p.ahead, p.hasAhead = p.lex.next(), true
+	}
+	return p.ahead
+}
+
+// is reports whether the current token is the given keyword or symbol
+func (p *parser) is(text string) bool {
+	return (p.tok.kind == tokenKeyword || p.tok.kind == tokenSymbol) && p.tok.text == text
+}
+
+// accept skips the current token if it is the given keyword or symbol
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) {
+	if !p.accept(text) {
+		p.lex.fail(p.tok.line, "'%s' expected near %s", text, p.describe())
+	}
+}
+
+// expectClosing expects the keyword or symbol closing a construct opened on
+// line
+func (p *parser) expectClosing(text, opening string, line int) {
+	if p.accept(text) {
+		return
+	}
+	if line == p.tok.line {
+		p.expect(text)
+	}
+	p.lex.fail(p.tok.line, "'%s' expected (to close '%s' at line %d) near %s", text, opening, line, p.describe())
+}
+
+func (p *parser) expectName() string {
+	if p.tok.kind != tokenName {
+		p.lex.fail(p.tok.line, "<name> expected near %s", p.describe())
+	}
+	name := p.tok.text
+	p.advance()
+	return name
+}
+
+func (p *parser) describe() string {
+	if p.tok.kind == tokenEOF {
+		return "<eof>"
+	}
+	return fmt.Sprintf("'%s'", p.tok.text)
+}
+
+func (p *parser) unexpected() {
+	p.lex.fail(p.tok.line, "unexpected symbol near %s", p.describe())
+}
+
+func (p *parser) enter() {
+	p.depth++
+	if p.depth > maxSyntaxDepth {
+		p.lex.fail(p.tok.line, "chunk has too many syntax levels")
+	}
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) openFunction(fn *functionExpr) {
+	p.fs = &funcState{parent: p.fs, fn: fn}
+}
+
+func (p *parser) closeFunction() {
+	p.fs = p.fs.parent
+}
+
+func (p *parser) openBlock() {
+	p.fs.blocks = append(p.fs.blocks, len(p.fs.actives))
+}
+
+func (p *parser) closeBlock() {
+	fs := p.fs
+	fs.actives = fs.actives[:fs.blocks[len(fs.blocks)-1]]
+	fs.blocks = fs.blocks[:len(fs.blocks)-1]
+}
+
+// declare brings a new local variable into scope and returns its slot
+func (p *parser) declare(name string) int {
+	fs := p.fs
+	slot := len(fs.actives)
+	fs.actives = append(fs.actives, localVar{name, slot})
+	fs.fn.slots = max(fs.fn.slots, slot+1)
+	return slot
+}
+
+// resolve finds the variable a name refers to in the function of fs
+func (p *parser) resolve(fs *funcState, name string) expr {
+	for i := len(fs.actives) - 1; i >= 0; i-- {
+		if fs.actives[i].name == name {
+			return localExpr{name, fs.actives[i].slot}
+		}
+	}
+	for i, u := range fs.fn.upvalues {
+		if u.name == name {
+			return upvalueExpr{name, i}
+		}
+	}
+	if fs.parent == nil {
+		return globalExpr{name}
+	}
+
+	switch outer := p.resolve(fs.parent, name).(type) {
+	case localExpr:
+		fs.fn.upvalues = append(fs.fn.upvalues, upvalueDesc{name, true, outer.slot})
+	case upvalueExpr:
+		fs.fn.upvalues = append(fs.fn.upvalues, upvalueDesc{name, false, outer.index})
+	default:
+		return outer
+	}
+	return upvalueExpr{name, len(fs.fn.upvalues) - 1}
+}
+
+// blockEnds reports whether the current token ends a block
+func (p *parser) blockEnds() bool {
+	return p.tok.kind == tokenEOF || p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+// block parses statements up to the end of a block, in a new scope. The
+// caller closes the scope, so repeat-until conditions can see its variables.
+func (p *parser) block() []stmt {
+	p.enter()
+	defer p.leave()
+	var body []stmt
+	for !p.blockEnds() {
+		if p.is("return") {
+			body = append(body, p.returnStatement())
+			break
+		}
+		if s, ok := p.statement(); ok {
+			body = append(body, s)
+		}
+	}
+	return body
+}
+
+// scopedBlock parses a block in its own scope
+func (p *parser) scopedBlock() []stmt {
+	p.openBlock()
+	body := p.block()
+	p.closeBlock()
+	return body
+}
+
+func (p *parser) returnStatement() stmt {
+	line := p.tok.line
+	p.advance()
+	var values []expr
+	if !p.blockEnds() && !p.is(";") {
+		values = p.exprList()
+	}
+	p.accept(";")
+	if !p.blockEnds() {
+		p.lex.fail(p.tok.line, "'end' expected near %s", p.describe())
+	}
+	return stmt{line, returnStmt{values}}
+}
+
+func (p *parser) statement() (stmt, bool) {
+	line := p.tok.line
+	switch {
+	case p.accept(";"):
+		return stmt{}, false
+	case p.accept("if"):
+		return stmt{line, p.ifStatement(line)}, true
+	case p.accept("while"):
+		cond := p.expr()
+		p.expect("do")
+		body := p.loopBody()
+		p.expectClosing("end", "while", line)
+		return stmt{line, whileStmt{cond, body}}, true
+	case p.accept("do"):
+		body := p.scopedBlock()
+		p.expectClosing("end", "do", line)
+		return stmt{line, doStmt{body}}, true
+	case p.accept("for"):
+		return stmt{line, p.forStatement(line)}, true
+	case p.accept("repeat"):
+		p.fs.loops++
+		p.openBlock()
+		body := p.block()
+		p.expectClosing("until", "repeat", line)
+		cond := p.expr()
+		p.closeBlock()
+		p.fs.loops--
+		return stmt{line, repeatStmt{body, cond}}, true
+	case p.accept("function"):
+		return stmt{line, p.functionStatement(line)}, true
+	case p.accept("local"):
+		if p.accept("function") {
+			name := p.expectName()
+			slot := p.declare(name)
+			return stmt{line, localFunctionStmt{slot, p.functionBody(name, line, false)}}, true
+		}
+		var names []string
+		for {
+			names = append(names, p.expectName())
+			if !p.accept(",") {
+				break
+			}
+		}
+		var values []expr
+		if p.accept("=") {
+			values = p.exprList()
+		}
+		slots := make([]int, len(names))
+		for i, name := range names {
+			slots[i] = p.declare(name)
+		}
+		return stmt{line, localStmt{slots, values}}, true
+	case p.is("break"):
+		if p.fs.loops == 0 {
+			p.lex.fail(line, "no loop to break near %s", p.describe())
+		}
+		p.advance()
+		return stmt{line, breakStmt{}}, true
+	}
+
+	e := p.suffixedExpr()
+	if p.is("=") || p.is(",") {
+		targets := []expr{e}
+		for p.accept(",") {
+			targets = append(targets, p.suffixedExpr())
+		}
+		p.expect("=")
+		for _, t := range targets {
+			switch t.(type) {
+			case localExpr, upvalueExpr, globalExpr, indexExpr:
+			default:
+				p.lex.fail(line, "syntax error near %s", p.describe())
+			}
+		}
+		return stmt{line, assignStmt{targets, p.exprList()}}, true
+	}
+	switch e.(type) {
+	case callExpr, methodExpr:
+		return stmt{line, callStmt{e}}, true
+	}
+	p.lex.fail(p.tok.line, "syntax error near %s", p.describe())
+	return stmt{}, false
+}
+
+func (p *parser) loopBody() []stmt {
+	p.fs.loops++
+	body := p.scopedBlock()
+	p.fs.loops--
+	return body
+}
+
+func (p *parser) ifStatement(line int) ifStmt {
+	var s ifStmt
+	for {
+		s.conds = append(s.conds, p.expr())
+		p.expect("then")
+		s.blocks = append(s.blocks, p.scopedBlock())
+		if !p.accept("elseif") {
+			break
+		}
+	}
+	if p.accept("else") {
+		s.orElse = p.scopedBlock()
+	}
+	p.expectClosing("end", "if", line)
+	return s
+}
+
+func (p *parser) forStatement(line int) interface{} {
+	first := p.expectName()
+	if p.accept("=") {
+		start := p.expr()
+		p.expect(",")
+		limit := p.expr()
+		var step expr = constExpr{1.0}
+		if p.accept(",") {
+			step = p.expr()
+		}
+		p.expect("do")
+		p.openBlock()
+		slot := p.declare(first)
+		body := p.loopBody()
+		p.closeBlock()
+		p.expectClosing("end", "for", line)
+		return numericForStmt{slot, start, limit, step, body}
+	}
+
+	names := []string{first}
+	for p.accept(",") {
+		names = append(names, p.expectName())
+	}
+	p.expect("in")
+	values := p.exprList()
+	p.expect("do")
+	p.openBlock()
+	slots := make([]int, len(names))
+	for i, name := range names {
+		slots[i] = p.declare(name)
+	}
+	body := p.loopBody()
+	p.closeBlock()
+	p.expectClosing("end", "for", line)
+	return genericForStmt{slots, values, body}
+}
+
+// functionStatement parses function a.b.c:m() ... end, an assignment of a
+// new function to a variable or field
+func (p *parser) functionStatement(line int) assignStmt {
+	name := p.expectName()
+	var target expr = p.resolve(p.fs, name)
+	method := false
+	for p.is(".") || p.is(":") {
+		method = p.is(":")
+		p.advance()
+		field := p.expectName()
+		name += "." + field
+		target = indexExpr{target, constExpr{field}}
+		if method {
+			break
+		}
+	}
+	return assignStmt{[]expr{target}, []expr{p.functionBody(name, line, method)}}
+}
+
+// functionBody parses the parameters and body of a function. Methods get an
+// implicit self parameter.
+func (p *parser) functionBody(name string, line int, method bool) *functionExpr {
+	fn := &functionExpr{name: name, line: line}
+	p.openFunction(fn)
+	p.openBlock()
+	if method {
+		p.declare("self")
+		fn.params++
+	}
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				fn.vararg = true
+				break
+			}
+			p.declare(p.expectName())
+			fn.params++
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	fn.body = p.block()
+	p.expectClosing("end", "function", line)
+	p.closeBlock()
+	p.closeFunction()
+	return fn
+}
+
+func (p *parser) exprList() []expr {
+	list := []expr{p.expr()}
+	for p.accept(",") {
+		list = append(list, p.expr())
+	}
+	return list
+}
+
+func (p *parser) expr() expr {
+	return p.subExpr(0)
+}
+
+// binaryPriority holds the left and right priority of each binary operator:
+// a right priority below the left one makes the operator right associative
+var binaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4}, "+": {6, 6}, "-": {6, 6}, "*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const unaryPriority = 8
+
+var binaryOps = map[string]binaryOp{
+	"+": opAdd, "-": opSub, "*": opMul, "/": opDiv, "%": opMod, "^": opPow,
+	"..": opConcat, "==": opEq, "~=": opNe, "<": opLt, "<=": opLe, ">": opGt, ">=": opGe,
+}
+
+// subExpr parses an expression whose binary operators bind tighter than
+// limit, by precedence climbing
+func (p *parser) subExpr(limit int) expr {
+	p.enter()
+	defer p.leave()
+
+	var e expr
+	switch {
+	case p.accept("not"):
+		e = unaryExpr{opNot, p.subExpr(unaryPriority)}
+	case p.accept("-"):
+		operand := p.subExpr(unaryPriority)
+		if c, ok := operand.(constExpr); ok {
+			if n, ok := c.value.(float64); ok {
+				e = constExpr{-n}
+				break
+			}
+		}
+		e = unaryExpr{opNeg, operand}
+	case p.accept("#"):
+		e = unaryExpr{opLen, p.subExpr(unaryPriority)}
+	default:
+		e = p.simpleExpr()
+	}
+
+	for p.tok.kind == tokenKeyword || p.tok.kind == tokenSymbol {
+		op := p.tok.text
+		priority, binary := binaryPriority[op]
+		if !binary || priority[0] <= limit {
+			break
+		}
+		p.advance()
+		right := p.subExpr(priority[1])
+		switch op {
+		case "and":
+			e = logicalExpr{true, e, right}
+		case "or":
+			e = logicalExpr{false, e, right}
+		default:
+			e = binaryExpr{binaryOps[op], e, right}
+		}
+	}
+	return e
+}
+
+func (p *parser) simpleExpr() expr {
+	switch p.tok.kind {
+	case tokenNumber:
+		n := p.tok.number
+		p.advance()
+		return constExpr{n}
+	case tokenString:
+		s := p.tok.text
+		p.advance()
+		return constExpr{s}
+	}
+
+	line := p.tok.line
+	switch {
+	case p.accept("nil"):
+		return constExpr{nil}
+	case p.accept("true"):
+		return constExpr{true}
+	case p.accept("false"):
+		return constExpr{false}
+	case p.is("..."):
+		if !p.fs.fn.vararg {
+			p.lex.fail(line, "cannot use '...' outside a vararg function near '...'")
+		}
+		p.advance()
+		return varargExpr{}
+	case p.is("{"):
+		return p.tableConstructor()
+	case p.accept("function"):
+		return p.functionBody("anonymous", line, false)
+	}
+	return p.suffixedExpr()
+}
+
+func (p *parser) primaryExpr() expr {
+	switch {
+	case p.tok.kind == tokenName:
+		return p.resolve(p.fs, p.expectName())
+	case p.is("("):
+		line := p.tok.line
+		p.advance()
+		e := p.expr()
+		p.expectClosing(")", "(", line)
+		switch e.(type) {
+		case callExpr, methodExpr, varargExpr:
+			return parenExpr{e}
+		}
+		return e
+	}
+	p.unexpected()
+	return nil
+}
+
+func (p *parser) suffixedExpr() expr {
+	e := p.primaryExpr()
+	for {
+		switch {
+		case p.accept("."):
+			e = indexExpr{e, constExpr{p.expectName()}}
+		case p.is("["):
+			p.advance()
+			key := p.expr()
+			p.expect("]")
+			e = indexExpr{e, key}
+		case p.accept(":"):
+			name := p.expectName()
+			e = methodExpr{e, name, p.callArgs()}
+		case p.is("(") || p.is("{") || p.tok.kind == tokenString:
+			e = callExpr{e, p.callArgs()}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) callArgs() []expr {
+	switch {
+	case p.tok.kind == tokenString:
+		s := p.tok.text
+		p.advance()
+		return []expr{constExpr{s}}
+	case p.is("{"):
+		return []expr{p.tableConstructor()}
+	}
+
+	line := p.tok.line
+	p.expect("(")
+	var args []expr
+	if !p.is(")") {
+		args = p.exprList()
+	}
+	p.expectClosing(")", "(", line)
+	return args
+}
+
+func (p *parser) tableConstructor() tableExpr {
+	line := p.tok.line
+	p.expect("{")
+	var t tableExpr
+	for !p.is("}") {
+		switch {
+		case p.is("["):
+			p.advance()
+			key := p.expr()
+			p.expect("]")
+			p.expect("=")
+			t.fields = append(t.fields, tableField{key, p.expr()})
+		case p.tok.kind == tokenName && p.peek().kind == tokenSymbol && p.peek().text == "=":
+			key := p.expectName()
+			p.advance()
+			t.fields = append(t.fields, tableField{constExpr{key}, p.expr()})
+		default:
+			t.fields = append(t.fields, tableField{nil, p.expr()})
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expectClosing("}", "{", line)
+	return t
+}
@@ -0,0 +1,448 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// builtin wraps a library function that raises its errors itself
+func builtin(name string, fn func(args []Value) []Value) *Function {
+	return NewFunction(name, func(args []Value) ([]Value, error) {
+		return fn(args), nil
+	})
+}
+
+// library builds a read-only table of functions
+func library(functions map[string]func(args []Value) []Value) *Table {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	t := NewTable()
+	for _, name := range names {
+		t.Set(name, builtin(name, functions[name]))
+	}
+	return t
+}
+
+// openLibraries creates the global table: the standard library and the
+// host's globals. It is read-only, and so are the library tables.
+func (in *interp) openLibraries(extra map[string]Value) {
+	g := library(in.baseLibrary())
+	g.Set("_G", g)
+	g.Set("_VERSION", "Lua 5.1")
+
+	in.strings = library(in.stringLibrary())
+	tables := library(in.tableLibrary())
+	maths := library(in.mathLibrary())
+	maths.Set("pi", math.Pi)
+	maths.Set("huge", math.Inf(1))
+	for name, lib := range map[string]*Table{"string": in.strings, "table": tables, "math": maths} {
+		lib.Freeze()
+		g.Set(name, lib)
+	}
+	g.Set("unpack", tables.Get("unpack"))
+
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g.Set(name, extra[name])
+	}
+	g.Freeze()
+	in.globals = g
+}
+
+// arg returns the i-th argument, or nil if there are fewer
+func arg(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func argError(name string, i int, format string, a ...interface{}) {
+	errorf("bad argument #%d to '%s' (%s)", i+1, name, fmt.Sprintf(format, a...))
+}
+
+func typeError(name string, args []Value, i int, expected string) {
+	got := "no value"
+	if i < len(args) {
+		got = TypeName(args[i])
+	}
+	argError(name, i, "%s expected, got %s", expected, got)
+}
+
+func checkAny(name string, args []Value, i int) Value {
+	if i >= len(args) {
+		argError(name, i, "value expected")
+	}
+	return args[i]
+}
+
+func checkTable(name string, args []Value, i int) *Table {
+	t, ok := arg(args, i).(*Table)
+	if !ok {
+		typeError(name, args, i, "table")
+	}
+	return t
+}
+
+func checkString(name string, args []Value, i int) string {
+	s, ok := ToString(arg(args, i))
+	if !ok {
+		typeError(name, args, i, "string")
+	}
+	return s
+}
+
+func checkNumber(name string, args []Value, i int) float64 {
+	n, ok := ToNumber(arg(args, i))
+	if !ok {
+		typeError(name, args, i, "number")
+	}
+	return n
+}
+
+func checkInt(name string, args []Value, i int) int {
+	n, ok := ToInteger(checkNumber(name, args, i))
+	if !ok {
+		argError(name, i, "number has no integer representation")
+	}
+	return int(n)
+}
+
+func optInt(name string, args []Value, i, def int) int {
+	if arg(args, i) == nil {
+		return def
+	}
+	return checkInt(name, args, i)
+}
+
+// tostring converts any value to a string, as tostring() does
+func tostring(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	case *Table:
+		return fmt.Sprintf("table: %p", v)
+	case *Function:
+		if v.Go != nil {
+			return fmt.Sprintf("builtin: %p", v)
+		}
+		return fmt.Sprintf("function: %p", v)
+	}
+	return TypeName(v)
+}
+
+func (in *interp) baseLibrary() map[string]func(args []Value) []Value {
+	next := func(args []Value) []Value {
+		key, value := checkTable("next", args, 0).Next(arg(args, 1))
+		if key == nil {
+			return []Value{nil}
+		}
+		return []Value{key, value}
+	}
+	nextFunction := builtin("next", next)
+	ipairsIterator := builtin("ipairs_iterator", func(args []Value) []Value {
+		i := checkNumber("ipairs", args, 1) + 1
+		v := checkTable("ipairs", args, 0).Get(i)
+		if v == nil {
+			return []Value{nil}
+		}
+		return []Value{i, v}
+	})
+
+	return map[string]func(args []Value) []Value{
+		"assert": func(args []Value) []Value {
+			if !Truthy(checkAny("assert", args, 0)) {
+				if msg, ok := arg(args, 1).(string); ok {
+					errorf("%s", msg)
+				}
+				errorf("assertion failed!")
+			}
+			return args
+		},
+		"error": func(args []Value) []Value {
+			value := arg(args, 0)
+			level := optInt("error", args, 1, 1)
+			_, isString := value.(string)
+			panic(&Error{Value: value, located: isString && level > 0})
+		},
+		"ipairs": func(args []Value) []Value {
+			return []Value{ipairsIterator, checkTable("ipairs", args, 0), 0.0}
+		},
+		"next": next,
+		"pairs": func(args []Value) []Value {
+			return []Value{nextFunction, checkTable("pairs", args, 0), nil}
+		},
+		"pcall": func(args []Value) []Value {
+			fn := checkAny("pcall", args, 0)
+			results, err := in.pcall(fn, args[1:])
+			if err != nil {
+				return []Value{false, err.Value}
+			}
+			return append([]Value{true}, results...)
+		},
+		"xpcall": func(args []Value) []Value {
+			handler := arg(args, 1)
+			results, err := in.pcall(checkAny("xpcall", args, 0), nil)
+			if err != nil {
+				return append([]Value{false}, in.call(handler, []Value{err.Value}, "")...)
+			}
+			return append([]Value{true}, results...)
+		},
+		"rawequal": func(args []Value) []Value {
+			return []Value{checkAny("rawequal", args, 0) == checkAny("rawequal", args, 1)}
+		},
+		"rawget": func(args []Value) []Value {
+			return []Value{checkTable("rawget", args, 0).Get(checkAny("rawget", args, 1))}
+		},
+		"rawset": func(args []Value) []Value {
+			t := checkTable("rawset", args, 0)
+			t.Set(checkAny("rawset", args, 1), checkAny("rawset", args, 2))
+			return []Value{t}
+		},
+		"select": func(args []Value) []Value {
+			if arg(args, 0) == "#" {
+				return []Value{float64(len(args) - 1)}
+			}
+			n := checkInt("select", args, 0)
+			switch {
+			case n < 0:
+				n += len(args)
+				if n < 1 {
+					argError("select", 0, "index out of range")
+				}
+			case n == 0:
+				argError("select", 0, "index out of range")
+			case n >= len(args):
+				return nil
+			}
+			return args[n:]
+		},
+		"tonumber": func(args []Value) []Value {
+			v := checkAny("tonumber", args, 0)
+			base := optInt("tonumber", args, 1, 10)
+			if base == 10 {
+				if n, ok := ToNumber(v); ok {
+					return []Value{n}
+				}
+				return []Value{nil}
+			}
+			if base < 2 || base > 36 {
+				argError("tonumber", 1, "base out of range")
+			}
+			s := strings.ToLower(strings.TrimSpace(checkString("tonumber", args, 0)))
+			if n, err := strconv.ParseInt(s, base, 64); err == nil {
+				return []Value{float64(n)}
+			}
+			return []Value{nil}
+		},
+		"tostring": func(args []Value) []Value {
+			return []Value{tostring(checkAny("tostring", args, 0))}
+		},
+		"type": func(args []Value) []Value {
+			return []Value{TypeName(checkAny("type", args, 0))}
+		},
+	}
+}
+
+func (in *interp) tableLibrary() map[string]func(args []Value) []Value {
+	return map[string]func(args []Value) []Value{
+		"concat": func(args []Value) []Value {
+			t := checkTable("concat", args, 0)
+			sep := ""
+			if arg(args, 1) != nil {
+				sep = checkString("concat", args, 1)
+			}
+			first, last := optInt("concat", args, 2, 1), optInt("concat", args, 3, t.Len())
+			var b strings.Builder
+			for i := first; i <= last; i++ {
+				s, ok := ToString(t.Get(float64(i)))
+				if !ok {
+					errorf("invalid value (at index %d) in table for 'concat'", i)
+				}
+				b.WriteString(s)
+				if i < last {
+					b.WriteString(sep)
+				}
+			}
+			return []Value{b.String()}
+		},
+		"getn": func(args []Value) []Value {
+			return []Value{float64(checkTable("getn", args, 0).Len())}
+		},
+		"insert": func(args []Value) []Value {
+			t := checkTable("insert", args, 0)
+			n := t.Len()
+			switch len(args) {
+			case 2:
+				t.Set(float64(n+1), args[1])
+			case 3:
+				pos := checkInt("insert", args, 1)
+				if pos < 1 || pos > n+1 {
+					argError("insert", 1, "position out of bounds")
+				}
+				for i := n; i >= pos; i-- {
+					t.Set(float64(i+1), t.Get(float64(i)))
+				}
+				t.Set(float64(pos), args[2])
+			default:
+				errorf("wrong number of arguments to 'insert'")
+			}
+			return nil
+		},
+		"remove": func(args []Value) []Value {
+			t := checkTable("remove", args, 0)
+			n := t.Len()
+			pos := optInt("remove", args, 1, n)
+			if n == 0 && arg(args, 1) == nil {
+				return []Value{nil}
+			}
+			if pos < 1 || pos > n+1 {
+				argError("remove", 1, "position out of bounds")
+			}
+			removed := t.Get(float64(pos))
+			for i := pos; i < n; i++ {
+				t.Set(float64(i), t.Get(float64(i+1)))
+			}
+			if pos <= n {
+				t.Set(float64(n), nil)
+			}
+			return []Value{removed}
+		},
+		"sort": func(args []Value) []Value {
+			t := checkTable("sort", args, 0)
+			comparator := arg(args, 1)
+			values := make([]Value, t.Len())
+			for i := range values {
+				values[i] = t.Get(float64(i + 1))
+			}
+			sort.SliceStable(values, func(i, j int) bool {
+				in.tick()
+				if comparator == nil {
+					return less(values[i], values[j])
+				}
+				return Truthy(arg(in.call(comparator, []Value{values[i], values[j]}, ""), 0))
+			})
+			for i, v := range values {
+				t.Set(float64(i+1), v)
+			}
+			return nil
+		},
+		"unpack": func(args []Value) []Value {
+			t := checkTable("unpack", args, 0)
+			first, last := optInt("unpack", args, 1, 1), optInt("unpack", args, 2, t.Len())
+			if last-first >= 1<<20 {
+				errorf("too many results to unpack")
+			}
+			var values []Value
+			for i := first; i <= last; i++ {
+				values = append(values, t.Get(float64(i)))
+			}
+			return values
+		},
+	}
+}
+
+// random is the generator behind math.random
+type random struct {
+	rng *rand.Rand
+}
+
+func newRandom(seed uint64) *random {
+	return &random{rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (in *interp) mathLibrary() map[string]func(args []Value) []Value {
+	unary := func(name string, fn func(float64) float64) func(args []Value) []Value {
+		return func(args []Value) []Value {
+			return []Value{fn(checkNumber(name, args, 0))}
+		}
+	}
+	extreme := func(name string, better func(a, b float64) bool) func(args []Value) []Value {
+		return func(args []Value) []Value {
+			result := checkNumber(name, args, 0)
+			for i := 1; i < len(args); i++ {
+				if n := checkNumber(name, args, i); better(n, result) {
+					result = n
+				}
+			}
+			return []Value{result}
+		}
+	}
+
+	return map[string]func(args []Value) []Value{
+		"abs":   unary("abs", math.Abs),
+		"acos":  unary("acos", math.Acos),
+		"asin":  unary("asin", math.Asin),
+		"atan":  unary("atan", math.Atan),
+		"ceil":  unary("ceil", math.Ceil),
+		"cos":   unary("cos", math.Cos),
+		"exp":   unary("exp", math.Exp),
+		"floor": unary("floor", math.Floor),
+		"log10": unary("log10", math.Log10),
+		"sin":   unary("sin", math.Sin),
+		"sqrt":  unary("sqrt", math.Sqrt),
+		"tan":   unary("tan", math.Tan),
+		"atan2": func(args []Value) []Value {
+			return []Value{math.Atan2(checkNumber("atan2", args, 0), checkNumber("atan2", args, 1))}
+		},
+		"fmod": func(args []Value) []Value {
+			return []Value{math.Mod(checkNumber("fmod", args, 0), checkNumber("fmod", args, 1))}
+		},
+		"log": func(args []Value) []Value {
+			x := checkNumber("log", args, 0)
+			if arg(args, 1) == nil {
+				return []Value{math.Log(x)}
+			}
+			return []Value{math.Log(x) / math.Log(checkNumber("log", args, 1))}
+		},
+		"max": extreme("max", func(a, b float64) bool { return a > b }),
+		"min": extreme("min", func(a, b float64) bool { return a < b }),
+		"modf": func(args []Value) []Value {
+			integer, fraction := math.Modf(checkNumber("modf", args, 0))
+			return []Value{integer, fraction}
+		},
+		"pow": func(args []Value) []Value {
+			return []Value{math.Pow(checkNumber("pow", args, 0), checkNumber("pow", args, 1))}
+		},
+		"random": func(args []Value) []Value {
+			r := in.random.rng.Float64()
+			switch len(args) {
+			case 0:
+				return []Value{r}
+			case 1:
+				upper := checkInt("random", args, 0)
+				if upper < 1 {
+					argError("random", 0, "interval is empty")
+				}
+				return []Value{math.Floor(r*float64(upper)) + 1}
+			default:
+				lower, upper := checkInt("random", args, 0), checkInt("random", args, 1)
+				if lower > upper {
+					argError("random", 1, "interval is empty")
+				}
+				return []Value{math.Floor(r*float64(upper-lower+1)) + float64(lower)}
+			}
+		},
+		"randomseed": func(args []Value) []Value {
+			in.random = newRandom(uint64(checkInt("randomseed", args, 0)))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,745 @@
+package lua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxStringLength bounds the strings string.rep and string.format build,
+// like the largest bulk string a client may send
+const maxStringLength = 512 << 20
+
+// stringLibrary returns the string library. Strings are indexed in it too,
+// so s:upper() is string.upper(s).
+func (in *interp) stringLibrary() map[string]func(args []Value) []Value {
+	return map[string]func(args []Value) []Value{
+		"byte": func(args []Value) []Value {
+			s := checkString("byte", args, 0)
+			first := optInt("byte", args, 1, 1)
+			first, last := stringRange(len(s), first, optInt("byte", args, 2, first))
+			var codes []Value
+			for i := first; i <= last; i++ {
+				codes = append(codes, float64(s[i-1]))
+			}
+			return codes
+		},
+		"char": func(args []Value) []Value {
+			b := make([]byte, len(args))
+			for i := range args {
+				c := checkInt("char", args, i)
+				if c < 0 || c > 255 {
+					argError("char", i, "invalid value")
+				}
+				b[i] = byte(c)
+			}
+			return []Value{string(b)}
+		},
+		"find": func(args []Value) []Value {
+			return find(args, true)
+		},
+		"format": format,
+		"gmatch": func(args []Value) []Value {
+			s, pattern := checkString("gmatch", args, 0), checkString("gmatch", args, 1)
+			position := 0
+			return []Value{builtin("gmatch_iterator", func([]Value) []Value {
+				for ; position <= len(s); position++ {
+					m := &matcher{src: s, pattern: pattern}
+					end := m.match(position, 0)
+					if end < 0 {
+						continue
+					}
+					start := position
+					position = end
+					if end == start {
+						position++
+					}
+					return m.captures(start, end, true)
+				}
+				return []Value{nil}
+			})}
+		},
+		"gsub": in.gsub,
+		"len": func(args []Value) []Value {
+			return []Value{float64(len(checkString("len", args, 0)))}
+		},
+		"lower": func(args []Value) []Value {
+			return []Value{strings.ToLower(checkString("lower", args, 0))}
+		},
+		"match": func(args []Value) []Value {
+			return find(args, false)
+		},
+		"rep": func(args []Value) []Value {
+			s, n := checkString("rep", args, 0), checkInt("rep", args, 1)
+			sep := ""
+			if arg(args, 2) != nil {
+				sep = checkString("rep", args, 2)
+			}
+			if n <= 0 {
+				return []Value{""}
+			}
+			// Divided rather than multiplied, which could overflow
+			if size := len(s) + len(sep); size > 0 && n > maxStringLength/size {
+				errorf("resulting string too large")
+			}
+			return []Value{strings.Repeat(s+sep, n-1) + s}
+		},
+		"reverse": func(args []Value) []Value {
+			b := []byte(checkString("reverse", args, 0))
+			for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+				b[i], b[j] = b[j], b[i]
+			}
+			return []Value{string(b)}
+		},
+		"sub": func(args []Value) []Value {
+			s := checkString("sub", args, 0)
+			first, last := stringRange(len(s), optInt("sub", args, 1, 1), optInt("sub", args, 2, -1))
+			if first > last {
+				return []Value{""}
+			}
+			return []Value{s[first-1 : last]}
+		},
+		"upper": func(args []Value) []Value {
+			return []Value{strings.ToUpper(checkString("upper", args, 0))}
+		},
+	}
+}
+
+// stringRange turns the 1-based, possibly negative positions of a substring
+// into a range within 1..length
+func stringRange(length, first, last int) (int, int) {
+	if first < 0 {
+		first += length + 1
+	}
+	if last < 0 {
+		last += length + 1
+	}
+	return max(first, 1), min(last, length)
+}
+
+// patternSpecials are the characters that make a pattern more than a plain
+// substring
+const patternSpecials = "^$*+?.([%-"
+
+// find implements string.find and, without positions, string.match
+func find(args []Value, positions bool) []Value {
+	name := "match"
+	if positions {
+		name = "find"
+	}
+	s, pattern := checkString(name, args, 0), checkString(name, args, 1)
+	init := optInt(name, args, 2, 1)
+	if init < 0 {
+		init = max(init+len(s)+1, 1)
+	} else if init == 0 {
+		init = 1
+	}
+	if init > len(s)+1 {
+		return []Value{nil}
+	}
+
+	if positions && (Truthy(arg(args, 3)) || !strings.ContainsAny(pattern, patternSpecials)) {
+		i := strings.Index(s[init-1:], pattern)
+		if i < 0 {
+			return []Value{nil}
+		}
+		start := init - 1 + i
+		return []Value{float64(start + 1), float64(start + len(pattern))}
+	}
+
+	anchored := strings.HasPrefix(pattern, "^")
+	p := 0
+	if anchored {
+		p = 1
+	}
+	for start := init - 1; start <= len(s); start++ {
+		m := &matcher{src: s, pattern: pattern}
+		if end := m.match(start, p); end >= 0 {
+			if positions {
+				return append([]Value{float64(start + 1), float64(end)}, m.captures(start, end, false)...)
+			}
+			return m.captures(start, end, true)
+		}
+		if anchored {
+			break
+		}
+	}
+	return []Value{nil}
+}
+
+func (in *interp) gsub(args []Value) []Value {
+	s, pattern := checkString("gsub", args, 0), checkString("gsub", args, 1)
+	replacement := arg(args, 2)
+	switch replacement.(type) {
+	case string, float64, *Table, *Function:
+	default:
+		typeError("gsub", args, 2, "string/function/table")
+	}
+	limit := optInt("gsub", args, 3, len(s)+1)
+
+	anchored := strings.HasPrefix(pattern, "^")
+	p := 0
+	if anchored {
+		p = 1
+	}
+	var b strings.Builder
+	position, count := 0, 0
+	for count < limit {
+		m := &matcher{src: s, pattern: pattern}
+		end := m.match(position, p)
+		if end >= 0 {
+			count++
+			in.replace(&b, m, position, end, replacement)
+		}
+		switch {
+		case end > position:
+			position = end
+		case position < len(s):
+			b.WriteByte(s[position])
+			position++
+		default:
+			position = len(s) + 1
+		}
+		if position > len(s) || anchored {
+			break
+		}
+	}
+	if position < len(s) {
+		b.WriteString(s[position:])
+	}
+	return []Value{b.String(), float64(count)}
+}
+
+// replace appends the replacement of the match src[start:end] to b
+func (in *interp) replace(b *strings.Builder, m *matcher, start, end int, replacement Value) {
+	whole := m.src[start:end]
+	var value Value
+	switch r := replacement.(type) {
+	case float64, string:
+		template, _ := ToString(r)
+		for i := 0; i < len(template); i++ {
+			c := template[i]
+			if c != '%' {
+				b.WriteByte(c)
+				continue
+			}
+			i++
+			switch {
+			case i == len(template):
+				errorf("invalid use of '%%' in replacement string")
+			case template[i] == '%':
+				b.WriteByte('%')
+			case isDigit(template[i]):
+				if template[i] == '0' {
+					b.WriteString(whole)
+				} else {
+					s, _ := ToString(m.capture(int(template[i]-'1'), start, end))
+					b.WriteString(s)
+				}
+			default:
+				errorf("invalid use of '%%' in replacement string")
+			}
+		}
+		return
+	case *Table:
+		value = r.Get(m.capture(0, start, end))
+	case *Function:
+		value = arg(in.call(r, m.captures(start, end, true), ""), 0)
+	}
+
+	switch v := value.(type) {
+	case nil, bool:
+		if !Truthy(v) {
+			b.WriteString(whole)
+			return
+		}
+	case string, float64:
+		s, _ := ToString(v)
+		b.WriteString(s)
+		return
+	}
+	errorf("invalid replacement value (a %s)", TypeName(value))
+}
+
+// maxCaptures and maxMatchDepth bound what a pattern may ask for
+const (
+	maxCaptures   = 32
+	maxMatchDepth = 200
+)
+
+// capture lengths with a special meaning
+const (
+	captureUnfinished = -1
+	capturePosition   = -2
+)
+
+// matcher matches a Lua pattern against a string. It is a port of the
+// backtracking matcher of Lua's lstrlib.c.
+type matcher struct {
+	src, pattern string
+	level        int
+	depth        int
+	levels       [maxCaptures]struct{ start, length int }
+}
+
+// match matches the pattern from position p against the source from
+// position s, and returns the end of the match or -1
+func (m *matcher) match(s, p int) int {
+	m.depth++
+	if m.depth > maxMatchDepth {
+		errorf("pattern too complex")
+	}
+	defer func() { m.depth-- }()
+
+	for p < len(m.pattern) {
+		switch m.pattern[p] {
+		case '(':
+			if p+1 < len(m.pattern) && m.pattern[p+1] == ')' {
+				return m.startCapture(s, p+2, capturePosition)
+			}
+			return m.startCapture(s, p+1, captureUnfinished)
+		case ')':
+			return m.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(m.pattern) {
+				if s == len(m.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			if p+1 < len(m.pattern) {
+				switch c := m.pattern[p+1]; {
+				case c == 'b':
+					s = m.matchBalance(s, p+2)
+					if s < 0 {
+						return -1
+					}
+					p += 4
+					continue
+				case c == 'f':
+					p += 2
+					if p >= len(m.pattern) || m.pattern[p] != '[' {
+						errorf("missing '[' after '%%f' in pattern")
+					}
+					end := m.classEnd(p)
+					var previous, current byte
+					if s > 0 {
+						previous = m.src[s-1]
+					}
+					if s < len(m.src) {
+						current = m.src[s]
+					}
+					if m.matchBracketClass(previous, p, end-1) || !m.matchBracketClass(current, p, end-1) {
+						return -1
+					}
+					p = end
+					continue
+				case isDigit(c):
+					s = m.matchCapture(s, int(c-'1'))
+					if s < 0 {
+						return -1
+					}
+					p += 2
+					continue
+				}
+			}
+		}
+
+		end := m.classEnd(p)
+		matched := s < len(m.src) && m.singleMatch(m.src[s], p, end)
+		if end < len(m.pattern) {
+			switch m.pattern[end] {
+			case '?':
+				if matched {
+					if r := m.match(s+1, end+1); r >= 0 {
+						return r
+					}
+				}
+				p = end + 1
+				continue
+			case '*':
+				return m.maxExpand(s, p, end)
+			case '+':
+				if !matched {
+					return -1
+				}
+				return m.maxExpand(s+1, p, end)
+			case '-':
+				return m.minExpand(s, p, end)
+			}
+		}
+		if !matched {
+			return -1
+		}
+		s++
+		p = end
+	}
+	return s
+}
+
+// classEnd returns the end of the character class starting at p
+func (m *matcher) classEnd(p int) int {
+	c := m.pattern[p]
+	p++
+	switch c {
+	case '%':
+		if p >= len(m.pattern) {
+			errorf("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	case '[':
+		if p < len(m.pattern) && m.pattern[p] == '^' {
+			p++
+		}
+		for {
+			if p >= len(m.pattern) {
+				errorf("malformed pattern (missing ']')")
+			}
+			c := m.pattern[p]
+			p++
+			if c == '%' && p < len(m.pattern) {
+				p++
+			}
+			if p < len(m.pattern) && m.pattern[p] == ']' {
+				return p + 1
+			}
+		}
+	}
+	return p
+}
+
+func (m *matcher) singleMatch(c byte, p, end int) bool {
+	switch m.pattern[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, m.pattern[p+1])
+	case '[':
+		return m.matchBracketClass(c, p, end-1)
+	default:
+		return m.pattern[p] == c
+	}
+}
+
+// matchBracketClass matches c against the set [...] from p to the closing
+// bracket at end
+func (m *matcher) matchBracketClass(c byte, p, end int) bool {
+	include := true
+	p++
+	if m.pattern[p] == '^' {
+		include = false
+		p++
+	}
+	for ; p < end; p++ {
+		switch {
+		case m.pattern[p] == '%':
+			p++
+			if matchClass(c, m.pattern[p]) {
+				return include
+			}
+		case p+2 < end && m.pattern[p+1] == '-':
+			if m.pattern[p] <= c && c <= m.pattern[p+2] {
+				return include
+			}
+			p += 2
+		case m.pattern[p] == c:
+			return include
+		}
+	}
+	return !include
+}
+
+// matchClass matches c against a class like %a; an upper case class letter
+// negates it
+func matchClass(c, class byte) bool {
+	var matched bool
+	switch class | 0x20 {
+	case 'a':
+		matched = isLetter(c)
+	case 'c':
+		matched = c < 32 || c == 127
+	case 'd':
+		matched = isDigit(c)
+	case 'l':
+		matched = c >= 'a' && c <= 'z'
+	case 'p':
+		matched = c > 32 && c < 127 && !isLetter(c) && !isDigit(c)
+	case 's':
+		matched = c == ' ' || c >= '\t' && c <= '\r'
+	case 'u':
+		matched = c >= 'A' && c <= 'Z'
+	case 'w':
+		matched = isLetter(c) || isDigit(c)
+	case 'x':
+		matched = isHexDigit(c)
+	case 'z':
+		matched = c == 0
+	default:
+		return class == c
+	}
+	if class >= 'A' && class <= 'Z' {
+		return !matched
+	}
+	return matched
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (m *matcher) maxExpand(s, p, end int) int {
+	i := 0
+	for s+i < len(m.src) && m.singleMatch(m.src[s+i], p, end) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if r := m.match(s+i, end+1); r >= 0 {
+			return r
+		}
+	}
+	return -1
+}
+
+func (m *matcher) minExpand(s, p, end int) int {
+	for {
+		if r := m.match(s, end+1); r >= 0 {
+			return r
+		}
+		if s < len(m.src) && m.singleMatch(m.src[s], p, end) {
+			s++
+		} else {
+			return -1
+		}
+	}
+}
+
+func (m *matcher) startCapture(s, p, what int) int {
+	if m.level >= maxCaptures {
+		errorf("too many captures")
+	}
+	m.levels[m.level].start = s
+	m.levels[m.level].length = what
+	m.level++
+	r := m.match(s, p)
+	if r < 0 {
+		m.level--
+	}
+	return r
+}
+
+func (m *matcher) endCapture(s, p int) int {
+	open := -1
+	for i := m.level - 1; i >= 0; i-- {
+		if m.levels[i].length == captureUnfinished {
+			open = i
+			break
+		}
+	}
+	if open < 0 {
+		errorf("invalid pattern capture")
+	}
+	m.levels[open].length = s - m.levels[open].start
+	r := m.match(s, p)
+	if r < 0 {
+		m.levels[open].length = captureUnfinished
+	}
+	return r
+}
+
+func (m *matcher) matchBalance(s, p int) int {
+	if p+1 >= len(m.pattern) {
+		errorf("missing arguments to '%%b'")
+	}
+	if s >= len(m.src) || m.src[s] != m.pattern[p] {
+		return -1
+	}
+	open, close := m.pattern[p], m.pattern[p+1]
+	depth := 1
+	for s++; s < len(m.src); s++ {
+		switch m.src[s] {
+		case close:
+			depth--
+			if depth == 0 {
+				return s + 1
+			}
+		case open:
+			depth++
+		}
+	}
+	return -1
+}
+
+// matchCapture matches a back reference %1-%9 to capture l
+func (m *matcher) matchCapture(s, l int) int {
+	if l < 0 || l >= m.level || m.levels[l].length == captureUnfinished {
+		errorf("invalid capture index %%%d", l+1)
+	}
+	captured := m.src[m.levels[l].start : m.levels[l].start+m.levels[l].length]
+	if strings.HasPrefix(m.src[s:], captured) {
+		return s + len(captured)
+	}
+	return -1
+}
+
+// capture returns capture i of the match src[start:end]: the whole match
+// when the pattern has no captures and i is 0
+func (m *matcher) capture(i, start, end int) Value {
+	if i >= m.level {
+		if i != 0 {
+			errorf("invalid capture index %%%d", i+1)
+		}
+		return m.src[start:end]
+	}
+	c := m.levels[i]
+	switch c.length {
+	case captureUnfinished:
+		errorf("unfinished capture")
+	case capturePosition:
+		return float64(c.start + 1)
+	}
+	return m.src[c.start : c.start+c.length]
+}
+
+// captures returns the captures of a match. Without captures in the pattern
+// the whole match is returned if whole is set, nothing otherwise.
+func (m *matcher) captures(start, end int, whole bool) []Value {
+	if m.level == 0 && !whole {
+		return nil
+	}
+	n := max(m.level, 1)
+	values := make([]Value, n)
+	for i := range values {
+		values[i] = m.capture(i, start, end)
+	}
+	return values
+}
+
+// format implements string.format
+func format(args []Value) []Value {
+	template := checkString("format", args, 0)
+	var b strings.Builder
+	next := 1
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(template) && template[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		// Like Lua, accept at most 5 flags and 2 digits of width and of
+		// precision, which also keeps fmt from padding to absurd widths
+		spec := i
+		for i < len(template) && strings.IndexByte("-+ #0", template[i]) >= 0 {
+			i++
+		}
+		if i-spec > 5 {
+			errorf("invalid format (repeated flags)")
+		}
+		i = skipDigits(template, i)
+		if i < len(template) && template[i] == '.' {
+			i = skipDigits(template, i+1)
+		}
+		if i < len(template) && isDigit(template[i]) {
+			errorf("invalid format (width or precision too long)")
+		}
+		if i >= len(template) {
+			errorf("invalid option '%%' to 'format'")
+		}
+		flags := template[spec:i]
+		verb := template[i]
+
+		if verb != '%' && next >= len(args) {
+			argError("format", next, "no value")
+		}
+		switch verb {
+		case 'd', 'i':
+			fmt.Fprintf(&b, "%"+flags+"d", formatInt(args, next))
+		case 'u':
+			fmt.Fprintf(&b, "%"+flags+"d", uint64(formatInt(args, next)))
+		case 'c':
+			b.WriteString(pad(string([]byte{byte(checkInt("format", args, next))}), flags))
+		case 'o', 'x', 'X':
+			fmt.Fprintf(&b, "%"+flags+string(verb), uint64(formatInt(args, next)))
+		case 'e', 'E', 'f', 'g', 'G':
+			if verb|0x20 == 'g' && !strings.Contains(flags, ".") {
+				flags += ".6"
+			}
+			fmt.Fprintf(&b, "%"+flags+string(verb), checkNumber("format", args, next))
+		case 'q':
+			b.WriteString(quote(checkString("format", args, next)))
+		case 's':
+			b.WriteString(pad(tostring(args[next]), flags))
+		default:
+			errorf("invalid option '%%%c' to 'format'", verb)
+		}
+		next++
+		if b.Len() > maxStringLength {
+			errorf("resulting string too large")
+		}
+	}
+	return []Value{b.String()}
+}
+
+// skipDigits skips up to two digits of a format specifier
+func skipDigits(template string, i int) int {
+	for n := 0; n < 2 && i < len(template) && isDigit(template[i]); n++ {
+		i++
+	}
+	return i
+}
+
+// formatInt returns the argument of an integer conversion
+func formatInt(args []Value, i int) int64 {
+	n, ok := ToInteger(checkNumber("format", args, i))
+	if !ok {
+		argError("format", i, "number has no integer representation")
+	}
+	return n
+}
+
+// pad applies the width, precision and - flag of a format specifier to s.
+// Like in C they count bytes, where fmt would count runes.
+func pad(s, flags string) string {
+	spec := strings.TrimLeft(flags, "-+ #0")
+	width := spec
+	if dot := strings.IndexByte(spec, '.'); dot >= 0 {
+		width = spec[:dot]
+		precision, _ := strconv.Atoi(spec[dot+1:])
+		s = s[:min(len(s), precision)]
+	}
+	n, _ := strconv.Atoi(width)
+	padding := strings.Repeat(" ", max(n-len(s), 0))
+	if strings.Contains(flags[:len(flags)-len(spec)], "-") {
+		return s + padding
+	}
+	return padding + s
+}
+
+// quote formats s as a Lua string literal, as %q does
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case 0:
+			b.WriteString("\\000")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,382 @@
+// Package lua is a small interpreter for the subset of Lua 5.1 used by
+// server-side scripts: every statement and expression of the language, and
+// the base, string, table and math libraries, but no coroutines, metatables,
+// io, os or module loading. Scripts can only reach the outside world through
+// the functions the host registers.
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Value is a Lua value: nil, bool, float64, string, *Table or *Function
+type Value interface{}
+
+// Function is a Lua function, either defined by a script or provided by the
+// host
+type Function struct {
+	Name string
+	// Go is set for host functions. It returns the results of the call, or
+	// an error which is raised as a Lua error.
+	Go func(args []Value) ([]Value, error)
+
+	proto    *functionExpr
+	upvalues []*cell
+	// chunk names the chunk the function was defined in
+	chunk string
+}
+
+// cell holds a variable, shared by every closure that captured it
+type cell struct {
+	value Value
+}
+
+// NewFunction wraps a host function
+func NewFunction(name string, fn func(args []Value) ([]Value, error)) *Function {
+	return &Function{Name: name, Go: fn}
+}
+
+// Error is a Lua error. Value is what the script passed to error(), or the
+// message of an error raised by the interpreter.
+type Error struct {
+	Value Value
+	// located is set for messages that still need the position of the
+	// statement that raised them
+	located bool
+}
+
+func (e *Error) Error() string {
+	if s, ok := e.Value.(string); ok {
+		return s
+	}
+	if t, ok := e.Value.(*Table); ok {
+		if msg, ok := t.Get("err").(string); ok {
+			return msg
+		}
+	}
+	return fmt.Sprintf("(error object is a %s value)", TypeName(e.Value))
+}
+
+// errorf raises a Lua error with a formatted message
+func errorf(format string, args ...interface{}) {
+	panic(&Error{Value: fmt.Sprintf(format, args...), located: true})
+}
+
+// TypeName returns the Lua type of v, as type() does
+func TypeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Function:
+		return "function"
+	default:
+		return "userdata"
+	}
+}
+
+// Truthy reports whether v counts as true: everything but nil and false
+func Truthy(v Value) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	default:
+		return true
+	}
+}
+
+// ToString converts strings and numbers to a string
+func ToString(v Value) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return formatNumber(v), true
+	default:
+		return "", false
+	}
+}
+
+// ToNumber converts numbers and numeric strings to a number
+func ToNumber(v Value) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseNumber(v)
+	default:
+		return 0, false
+	}
+}
+
+// ToInteger truncates n to an integer, and reports whether the result fits
+// in an int64. NaN, infinities and numbers out of range don't.
+func ToInteger(n float64) (int64, bool) {
+	if math.IsNaN(n) || n < math.MinInt64 || n >= -math.MinInt64 {
+		return 0, false
+	}
+	return int64(n), true
+}
+
+// formatNumber formats a number like Lua's "%.14g"
+func formatNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	case n == math.Trunc(n) && math.Abs(n) < 1e15 && !math.Signbit(n):
+		return strconv.FormatInt(int64(n), 10)
+	case n == 0:
+		return "-0"
+	default:
+		return fmt.Sprintf("%.14g", n)
+	}
+}
+
+// parseNumber parses a Lua numeral, decimal or hexadecimal, with optional
+// surrounding spaces
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	negative := false
+	unsigned := s
+	if strings.HasPrefix(unsigned, "-") {
+		negative, unsigned = true, unsigned[1:]
+	} else if strings.HasPrefix(unsigned, "+") {
+		unsigned = unsigned[1:]
+	}
+
+	if len(unsigned) > 2 && (unsigned[:2] == "0x" || unsigned[:2] == "0X") {
+		n, err := strconv.ParseUint(unsigned[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if negative {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+
+	if unsigned == "" || strings.ContainsAny(unsigned, "_xXpP") ||
+		strings.EqualFold(unsigned, "inf") || strings.EqualFold(unsigned, "infinity") ||
+		strings.EqualFold(unsigned, "nan") || unsigned[0] == '+' || unsigned[0] == '-' {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(unsigned, 64)
+	if err != nil {
+		return 0, false
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
+
+// Table is a Lua table. Consecutive integer keys from 1 live in an array;
+// the other keys in a hash that remembers insertion order, so iterating with
+// pairs is deterministic.
+type Table struct {
+	array []Value
+	// index maps a key to its position in entries. Removed keys keep their
+	// entry with a nil value until the table is compacted, so next keeps
+	// working when fields are cleared during a traversal.
+	index   map[Value]int
+	entries []tableEntry
+	removed int
+	// readonly tables can't be modified by scripts
+	readonly bool
+}
+
+type tableEntry struct {
+	key, value Value
+}
+
+func NewTable() *Table {
+	return &Table{}
+}
+
+// NewArray returns a table holding values at keys 1 to len(values)
+func NewArray(values ...Value) *Table {
+	t := &Table{array: make([]Value, 0, len(values))}
+	for i, v := range values {
+		t.Set(float64(i+1), v)
+	}
+	return t
+}
+
+// arrayIndex returns the array position of key, or -1
+func arrayIndex(key Value) int {
+	n, ok := key.(float64)
+	if !ok || n < 1 || n != math.Trunc(n) || n > math.MaxInt32 {
+		return -1
+	}
+	return int(n) - 1
+}
+
+func (t *Table) Get(key Value) Value {
+	if i := arrayIndex(key); i >= 0 && i < len(t.array) {
+		return t.array[i]
+	}
+	if t.index == nil {
+		return nil
+	}
+	if i, exists := t.index[key]; exists {
+		return t.entries[i].value
+	}
+	return nil
+}
+
+// Freeze makes the table read-only
+func (t *Table) Freeze() {
+	t.readonly = true
+}
+
+// Set stores value at key. A nil value removes the key.
+func (t *Table) Set(key, value Value) {
+	if t.readonly {
+		errorf("Attempt to modify a readonly table")
+	}
+	switch k := key.(type) {
+	case nil:
+		errorf("table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			errorf("table index is NaN")
+		}
+	}
+
+	if i := arrayIndex(key); i >= 0 && i <= len(t.array) {
+		switch {
+		case i < len(t.array) && value != nil:
+			t.array[i] = value
+			return
+		case i < len(t.array):
+			// Keys after a hole move to the hash, so the array stays a
+			// sequence
+			for j := len(t.array) - 1; j > i; j-- {
+				if t.array[j] != nil {
+					t.setHash(float64(j+1), t.array[j])
+				}
+			}
+			t.array = t.array[:i]
+			return
+		case value != nil:
+			t.array = append(t.array, value)
+			t.deleteHash(key)
+			t.migrate()
+			return
+		default:
+			t.deleteHash(key)
+			return
+		}
+	}
+
+	if value == nil {
+		t.deleteHash(key)
+	} else {
+		t.setHash(key, value)
+	}
+}
+
+// migrate moves the keys following the array from the hash to the array
+func (t *Table) migrate() {
+	for t.index != nil {
+		key := float64(len(t.array) + 1)
+		i, exists := t.index[key]
+		if !exists || t.entries[i].value == nil {
+			return
+		}
+		t.array = append(t.array, t.entries[i].value)
+		t.deleteHash(key)
+	}
+}
+
+func (t *Table) setHash(key, value Value) {
+	if t.index == nil {
+		t.index = make(map[Value]int)
+	}
+	if i, exists := t.index[key]; exists {
+		if t.entries[i].value == nil {
+			t.removed--
+		}
+		t.entries[i].value = value
+		return
+	}
+
+	if t.removed > 16 && t.removed > len(t.entries)/2 {
+		t.compact()
+	}
+	t.index[key] = len(t.entries)
+	t.entries = append(t.entries, tableEntry{key, value})
+}
+
+func (t *Table) deleteHash(key Value) {
+	if t.index == nil {
+		return
+	}
+	if i, exists := t.index[key]; exists && t.entries[i].value != nil {
+		t.entries[i].value = nil
+		t.removed++
+	}
+}
+
+// compact drops the entries of removed keys
+func (t *Table) compact() {
+	entries := make([]tableEntry, 0, len(t.entries)-t.removed)
+	index := make(map[Value]int, len(entries))
+	for _, e := range t.entries {
+		if e.value != nil {
+			index[e.key] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+	t.entries, t.index, t.removed = entries, index, 0
+}
+
+// Len returns the length of the table's sequence, as the # operator does
+func (t *Table) Len() int {
+	return len(t.array)
+}
+
+// Next returns the key and value following key in a traversal, starting
+// with key nil. A nil key means the traversal is over.
+func (t *Table) Next(key Value) (Value, Value) {
+	start := 0
+	if key != nil {
+		if i := arrayIndex(key); i >= 0 && i < len(t.array) {
+			start = i + 1
+		} else {
+			i, exists := t.index[key]
+			if !exists {
+				errorf("invalid key to 'next'")
+			}
+			start = len(t.array) + i + 1
+		}
+	}
+
+	for i := start; i < len(t.array); i++ {
+		if t.array[i] != nil {
+			return float64(i + 1), t.array[i]
+		}
+	}
+	for i := max(start-len(t.array), 0); i < len(t.entries); i++ {
+		if e := t.entries[i]; e.value != nil {
+			return e.key, e.value
+		}
+	}
+	return nil, nil
+}
@@ -16,11 +16,13 @@ func main() {
 	mode := flag.String("mode", "server", "Mode: server or client")
 	host := flag.String("host", "localhost", "Server host")
 	port := flag.String("port", "6379", "Server port")
+	maxMemory := flag.String("maxmemory", "0", "Memory limit for the dataset, e.g. 512mb (0 means no limit)")
+	maxMemoryPolicy := flag.String("maxmemory-policy", "noeviction", "Eviction policy used when maxmemory is reached")
 	flag.Parse()
 
 	switch *mode {
 	case "server":
-		startServer(*host, *port)
+		startServer(*host, *port, *maxMemory, *maxMemoryPolicy)
 	case "client":
 		startClient(*host, *port)
 	default:
@@ -29,14 +31,26 @@ func main() {
 	}
 }
 
-func startServer(host, port string) {
+func startServer(host, port, maxMemory, maxMemoryPolicy string) {
 	srv := server.NewServer(host, port)
 
+	limit, err := store.ParseMemory(maxMemory)
+	if err != nil {
+		log.Fatalf("Invalid maxmemory %q", maxMemory)
+	}
+	policy, ok := store.ParseEvictionPolicy(maxMemoryPolicy)
+	if !ok {
+		log.Fatalf("Invalid maxmemory-policy %q", maxMemoryPolicy)
+	}
+	srv.Store.SetMaxMemory(limit)
+	srv.Store.SetEvictionPolicy(policy)
+
 	// Initialize persistence
 	persistence := store.NewPersistence(srv.Store, "memora-dump.rdb")
+	persistence.SetSnapshotter(srv.Snapshot)
 
 	// Load existing data
-	err := persistence.Load()
+	err = persistence.Load()
 	if err != nil {
 		log.Printf("Warning: Could not load snapshot: %v", err)
 	}
@@ -0,0 +1,329 @@
+package pubsub
+
+import (
+	"sort"
+	"sync"
+
+	"Memora/store"
+)
+
+// subscriberBuffer is how many messages may be queued for a subscriber
+// before it is considered too slow and disconnected
+const subscriberBuffer = 1024
+
+// Message is a published message as delivered to a subscriber. Pattern is
+// set when the subscriber received it through a pattern subscription, and
+// Shard when it was published on a shard channel.
+type Message struct {
+	Pattern string
+	Channel string
+	Payload []byte
+	Shard   bool
+}
+
+// Subscription is the reply to a (un)subscribe request: the channel or
+// pattern and the number of subscriptions the subscriber holds afterwards.
+// Shard channel subscriptions are counted apart from the others.
+type Subscription struct {
+	Name  string
+	Count int
+}
+
+// Subscriber receives the messages published on the channels and patterns it
+// is subscribed to
+type Subscriber struct {
+	messages chan Message
+	done     chan struct{}
+	dropOnce sync.Once
+
+	// channels, patterns and shardChannels are guarded by the hub's mutex
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
+}
+
+// Messages returns the queue of messages to deliver
+func (s *Subscriber) Messages() <-chan Message {
+	return s.messages
+}
+
+// Done is closed when the subscriber fell too far behind and messages were
+// dropped. The connection should be closed, like Redis does for clients over
+// their output buffer limit.
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscriber) deliver(msg Message) {
+	select {
+	case s.messages <- msg:
+	default:
+		s.dropOnce.Do(func() { close(s.done) })
+	}
+}
+
+// Hub routes published messages to subscribers. Publishing never blocks: a
+// subscriber whose queue is full is dropped instead of stalling the
+// publisher, which may be holding store locks.
+//
+// Shard channels are a namespace of their own, which patterns don't match.
+// In a cluster a shard channel lives on the node owning its hash slot, like
+// a key; a single node owns every slot, so it is local to the hub.
+type Hub struct {
+	mu            sync.RWMutex
+	channels      map[string]map[*Subscriber]struct{}
+	patterns      map[string]map[*Subscriber]struct{}
+	shardChannels map[string]map[*Subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		channels:      make(map[string]map[*Subscriber]struct{}),
+		patterns:      make(map[string]map[*Subscriber]struct{}),
+		shardChannels: make(map[string]map[*Subscriber]struct{}),
+	}
+}
+
+func (h *Hub) NewSubscriber() *Subscriber {
+	return &Subscriber{
+		messages:      make(chan Message, subscriberBuffer),
+		done:          make(chan struct{}),
+		channels:      make(map[string]struct{}),
+		patterns:      make(map[string]struct{}),
+		shardChannels: make(map[string]struct{}),
+	}
+}
+
+// Subscribe subscribes sub to channels
+func (h *Hub) Subscribe(sub *Subscriber, channels ...string) []Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.add(sub, h.channels, sub.channels, channels, sub.count)
+}
+
+// PSubscribe subscribes sub to the channels matching patterns
+func (h *Hub) PSubscribe(sub *Subscriber, patterns ...string) []Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.add(sub, h.patterns, sub.patterns, patterns, sub.count)
+}
+
+// SSubscribe subscribes sub to shard channels
+func (h *Hub) SSubscribe(sub *Subscriber, channels ...string) []Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.add(sub, h.shardChannels, sub.shardChannels, channels, sub.shardCount)
+}
+
+// Unsubscribe unsubscribes sub from channels, or from every channel if none
+// are given
+func (h *Hub) Unsubscribe(sub *Subscriber, channels ...string) []Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.remove(sub, h.channels, sub.channels, channels, sub.count)
+}
+
+// PUnsubscribe unsubscribes sub from patterns, or from every pattern if none
+// are given
+func (h *Hub) PUnsubscribe(sub *Subscriber, patterns ...string) []Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.remove(sub, h.patterns, sub.patterns, patterns, sub.count)
+}
+
+// SUnsubscribe unsubscribes sub from shard channels, or from every shard
+// channel if none are given
+func (h *Hub) SUnsubscribe(sub *Subscriber, channels ...string) []Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.remove(sub, h.shardChannels, sub.shardChannels, channels, sub.shardCount)
+}
+
+// Count returns the number of channels, patterns and shard channels sub is
+// subscribed to
+func (h *Hub) Count(sub *Subscriber) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return sub.count() + sub.shardCount()
+}
+
+// ShardCount returns the number of shard channels sub is subscribed to
+func (h *Hub) ShardCount(sub *Subscriber) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return sub.shardCount()
+}
+
+// Subscribed reports whether sub is subscribed to channel
+func (h *Hub) Subscribed(sub *Subscriber, channel string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, ok := sub.channels[channel]
+	return ok
+}
+
+// count and shardCount are the subscription counts (un)subscribe replies
+// report. Callers must hold the hub's mutex.
+func (s *Subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+func (s *Subscriber) shardCount() int {
+	return len(s.shardChannels)
+}
+
+// Close removes every subscription of sub
+func (h *Hub) Close(sub *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(sub, h.channels, sub.channels, nil, sub.count)
+	h.remove(sub, h.patterns, sub.patterns, nil, sub.count)
+	h.remove(sub, h.shardChannels, sub.shardChannels, nil, sub.shardCount)
+}
+
+// Publish delivers payload to the subscribers of channel and of the patterns
+// matching it, and returns the number of deliveries
+func (h *Hub) Publish(channel string, payload []byte) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	receivers := 0
+	for sub := range h.channels[channel] {
+		sub.deliver(Message{Channel: channel, Payload: payload})
+		receivers++
+	}
+	for pattern, subs := range h.patterns {
+		if !store.MatchPattern(pattern, channel, false) {
+			continue
+		}
+		for sub := range subs {
+			sub.deliver(Message{Pattern: pattern, Channel: channel, Payload: payload})
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// SPublish delivers payload to the subscribers of a shard channel and
+// returns the number of deliveries
+func (h *Hub) SPublish(channel string, payload []byte) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.shardChannels[channel] {
+		sub.deliver(Message{Channel: channel, Payload: payload, Shard: true})
+	}
+	return len(h.shardChannels[channel])
+}
+
+// Channels returns the channels with at least one subscriber, sorted, that
+// match pattern; an empty pattern matches every channel. Pattern
+// subscriptions are not counted.
+func (h *Hub) Channels(pattern string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return activeChannels(h.channels, pattern)
+}
+
+// ShardChannels is Channels for shard channels
+func (h *Hub) ShardChannels(pattern string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return activeChannels(h.shardChannels, pattern)
+}
+
+func activeChannels(index map[string]map[*Subscriber]struct{}, pattern string) []string {
+	channels := make([]string, 0, len(index))
+	for channel := range index {
+		if pattern == "" || store.MatchPattern(pattern, channel, false) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// NumSub returns the number of subscribers of each channel, not counting
+// pattern subscriptions
+func (h *Hub) NumSub(channels ...string) []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return subscriberCounts(h.channels, channels)
+}
+
+// ShardNumSub returns the number of subscribers of each shard channel
+func (h *Hub) ShardNumSub(channels ...string) []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return subscriberCounts(h.shardChannels, channels)
+}
+
+func subscriberCounts(index map[string]map[*Subscriber]struct{}, channels []string) []int {
+	counts := make([]int, len(channels))
+	for i, channel := range channels {
+		counts[i] = len(index[channel])
+	}
+	return counts
+}
+
+// NumPat returns the number of patterns subscribed to by any subscriber
+func (h *Hub) NumPat() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.patterns)
+}
+
+// add registers sub under names in index and in the subscriber's own set;
+// count is the subscription count to report. Callers must hold h.mu.
+func (h *Hub) add(sub *Subscriber, index map[string]map[*Subscriber]struct{}, own map[string]struct{}, names []string, count func() int) []Subscription {
+	result := make([]Subscription, 0, len(names))
+	for _, name := range names {
+		if _, exists := own[name]; !exists {
+			own[name] = struct{}{}
+			if index[name] == nil {
+				index[name] = make(map[*Subscriber]struct{})
+			}
+			index[name][sub] = struct{}{}
+		}
+		result = append(result, Subscription{Name: name, Count: count()})
+	}
+	return result
+}
+
+// remove unregisters sub from names, or from everything in own if names is
+// empty. Callers must hold h.mu.
+func (h *Hub) remove(sub *Subscriber, index map[string]map[*Subscriber]struct{}, own map[string]struct{}, names []string, count func() int) []Subscription {
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+
+	result := make([]Subscription, 0, len(names))
+	for _, name := range names {
+		if _, exists := own[name]; exists {
+			delete(own, name)
+			delete(index[name], sub)
+			if len(index[name]) == 0 {
+				delete(index, name)
+			}
+		}
+		result = append(result, Subscription{Name: name, Count: count()})
+	}
+	return result
+}
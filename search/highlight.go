@@ -0,0 +1,137 @@
+package search
+
+import (
+	"sort"
+	"strings"
+)
+
+// HighlightOptions control how Highlight formats a field of a result
+type HighlightOptions struct {
+	// Highlight wraps every matched term in Open and Close
+	Highlight   bool
+	Open, Close string
+	// Summarize keeps only the Fragments passages of Length terms with the
+	// most matches, joined by Separator
+	Summarize bool
+	Fragments int
+	Length    int
+	Separator string
+}
+
+// fragment is a passage of a field: the tokens in [start, end) and the
+// number of distinct matched terms in it
+type fragment struct {
+	start, end int
+	matches    int
+}
+
+// Highlight formats the value of a TEXT field of one of the result's
+// documents, marking and summarizing around the terms the query matched.
+func (r *SearchResult) Highlight(field, text string, opts HighlightOptions) string {
+	tokens := scanTokens(text)
+	terms := r.terms[field]
+	matched := make([]bool, len(tokens))
+	for i, t := range tokens {
+		_, matched[i] = terms[t.term]
+	}
+
+	if !opts.Summarize {
+		return mark(text, tokens, matched, 0, len(tokens), 0, len(text), opts)
+	}
+
+	var b strings.Builder
+	fragments := summarize(tokens, matched, opts.Fragments, opts.Length)
+	for i, f := range fragments {
+		if f.start == f.end {
+			continue
+		}
+		if i > 0 || f.start > 0 {
+			b.WriteString(opts.Separator)
+		}
+		b.WriteString(mark(text, tokens, matched, f.start, f.end, tokens[f.start].start, tokens[f.end-1].end, opts))
+	}
+	if last := fragments[len(fragments)-1]; last.end < len(tokens) {
+		b.WriteString(opts.Separator)
+	}
+	return b.String()
+}
+
+// mark returns text[from:to], which holds tokens[first:last], with the
+// matched tokens wrapped in the highlight tags if highlighting is on
+func mark(text string, tokens []token, matched []bool, first, last, from, to int, opts HighlightOptions) string {
+	if !opts.Highlight {
+		return text[from:to]
+	}
+
+	var b strings.Builder
+	for i := first; i < last; i++ {
+		if !matched[i] {
+			continue
+		}
+		b.WriteString(text[from:tokens[i].start])
+		b.WriteString(opts.Open)
+		b.WriteString(text[tokens[i].start:tokens[i].end])
+		b.WriteString(opts.Close)
+		from = tokens[i].end
+	}
+	b.WriteString(text[from:to])
+	return b.String()
+}
+
+// summarize picks up to count non-overlapping passages of length tokens with
+// the most distinct matched terms, in the order they appear in the text.
+// Without any match it returns the first passage.
+func summarize(tokens []token, matched []bool, count, length int) []fragment {
+	if length <= 0 || length > len(tokens) {
+		length = len(tokens)
+	}
+	if count <= 0 {
+		count = 1
+	}
+
+	// Candidate passages start at each match, shifted back so the match
+	// has some context before it
+	candidates := make([]fragment, 0)
+	for i := range tokens {
+		if !matched[i] {
+			continue
+		}
+		start := max(0, min(i-length/4, len(tokens)-length))
+		f := fragment{start: start, end: start + length}
+		seen := make(map[string]struct{})
+		for j := f.start; j < f.end; j++ {
+			if matched[j] {
+				seen[tokens[j].term] = struct{}{}
+			}
+		}
+		f.matches = len(seen)
+		candidates = append(candidates, f)
+	}
+	if len(candidates) == 0 {
+		return []fragment{{start: 0, end: length}}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].matches > candidates[j].matches
+	})
+	chosen := make([]fragment, 0, count)
+	for _, c := range candidates {
+		if len(chosen) == count {
+			break
+		}
+		overlaps := false
+		for _, f := range chosen {
+			if c.start < f.end && f.start < c.end {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			chosen = append(chosen, c)
+		}
+	}
+	sort.Slice(chosen, func(i, j int) bool {
+		return chosen[i].start < chosen[j].start
+	})
+	return chosen
+}
@@ -0,0 +1,313 @@
+package search
+
+import (
+	"container/heap"
+	"math"
+	"math/rand/v2"
+	"sort"
+)
+
+// hnswIndex is an approximate vector index: a hierarchical navigable small
+// world graph (Malkov & Yashunin, 2016). Every vector is a node linked to
+// its nearest neighbors on layer 0; a random, exponentially shrinking subset
+// of them also appears on higher layers with longer links. A search walks
+// greedily down from the top layer, then explores the neighborhood of the
+// closest node on layer 0.
+//
+// Deleted vectors stay in the graph as tombstones, so the links through
+// them keep working, and are skipped in results. The graph is rebuilt once
+// tombstones outnumber live vectors.
+type hnswIndex struct {
+	metric DistanceMetric
+	// m is the number of links of a node per layer, and mMax0 on layer 0
+	m, mMax0       int
+	efConstruction int
+	levelFactor    float64
+	rng            *rand.Rand
+
+	nodes []*hnswNode
+	// ids maps the key of each live vector to its node
+	ids map[string]int
+	// entry is the node on the top layer, or -1 when the graph is empty
+	entry   int
+	deleted int
+}
+
+type hnswNode struct {
+	key    string
+	vector []float32
+	// neighbors holds the linked nodes on each layer the node is on
+	neighbors [][]int
+	deleted   bool
+}
+
+// minHNSWRebuild is the number of tombstones below which the graph is never
+// rebuilt, so small indexes don't rebuild on every other delete
+const minHNSWRebuild = 64
+
+func newHNSWIndex(spec VectorSpec) *hnswIndex {
+	m := max(spec.M, 2)
+	return &hnswIndex{
+		metric:         spec.Metric,
+		m:              m,
+		mMax0:          2 * m,
+		efConstruction: max(spec.EFConstruction, m),
+		levelFactor:    1 / math.Log(float64(m)),
+		// A fixed seed keeps the graph, and so approximate results,
+		// reproducible
+		rng:   rand.New(rand.NewPCG(uint64(m), uint64(spec.EFConstruction))),
+		ids:   make(map[string]int),
+		entry: -1,
+	}
+}
+
+func (h *hnswIndex) add(key string, vector []float32) {
+	h.remove(key)
+	h.insert(key, h.metric.prepare(vector))
+}
+
+// insert links a new node for a prepared vector into the graph
+func (h *hnswIndex) insert(key string, vector []float32) {
+	level := int(-math.Log(1-h.rng.Float64()) * h.levelFactor)
+	id := len(h.nodes)
+	node := &hnswNode{key: key, vector: vector, neighbors: make([][]int, level+1)}
+	h.nodes = append(h.nodes, node)
+	h.ids[key] = id
+	if h.entry < 0 {
+		h.entry = id
+		return
+	}
+
+	top := len(h.nodes[h.entry].neighbors) - 1
+	entries := []int{h.entry}
+	for layer := top; layer > level; layer-- {
+		entries = candidateIDs(h.searchLayer(vector, entries, 1, layer))
+	}
+	for layer := min(level, top); layer >= 0; layer-- {
+		candidates := h.searchLayer(vector, entries, h.efConstruction, layer)
+		links := h.selectNeighbors(candidates, h.m)
+		node.neighbors[layer] = links
+		for _, other := range links {
+			h.link(other, id, layer)
+		}
+		entries = candidateIDs(candidates)
+	}
+	if level > top {
+		h.entry = id
+	}
+}
+
+// selectNeighbors picks up to m nodes to link to among candidates sorted
+// closest first. A candidate is skipped when it is closer to an already
+// picked node than to the new one: links then point in diverse directions,
+// which keeps clusters connected to each other. Tombstones are never picked.
+func (h *hnswIndex) selectNeighbors(candidates []candidate, m int) []int {
+	links := make([]int, 0, m)
+	for _, c := range candidates {
+		if len(links) == m {
+			break
+		}
+		node := h.nodes[c.id]
+		if node.deleted {
+			continue
+		}
+		diverse := true
+		for _, id := range links {
+			if h.metric.distance(node.vector, h.nodes[id].vector) < c.distance {
+				diverse = false
+				break
+			}
+		}
+		if diverse {
+			links = append(links, c.id)
+		}
+	}
+	return links
+}
+
+// link adds a link from one node to another on a layer, selecting the links
+// to keep again if the node has too many
+func (h *hnswIndex) link(from, to, layer int) {
+	node := h.nodes[from]
+	links := append(node.neighbors[layer], to)
+	limit := h.m
+	if layer == 0 {
+		limit = h.mMax0
+	}
+	if len(links) > limit {
+		candidates := make([]candidate, len(links))
+		for i, id := range links {
+			candidates[i] = candidate{id, h.metric.distance(node.vector, h.nodes[id].vector)}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].distance < candidates[j].distance
+		})
+		links = h.selectNeighbors(candidates, limit)
+	}
+	node.neighbors[layer] = links
+}
+
+func (h *hnswIndex) remove(key string) {
+	id, exists := h.ids[key]
+	if !exists {
+		return
+	}
+	h.nodes[id].deleted = true
+	delete(h.ids, key)
+	h.deleted++
+
+	if len(h.ids) == 0 {
+		h.nodes, h.entry, h.deleted = nil, -1, 0
+	} else if h.deleted > minHNSWRebuild && h.deleted > len(h.ids) {
+		h.rebuild()
+	}
+}
+
+// rebuild builds the graph again from the live vectors, dropping tombstones
+func (h *hnswIndex) rebuild() {
+	nodes := h.nodes
+	h.nodes, h.ids, h.entry, h.deleted = nil, make(map[string]int), -1, 0
+	for _, node := range nodes {
+		if !node.deleted {
+			h.insert(node.key, node.vector)
+		}
+	}
+}
+
+func (h *hnswIndex) len() int {
+	return len(h.ids)
+}
+
+func (h *hnswIndex) search(query []float32, k, ef int, filter keySet) []neighbor {
+	if h.entry < 0 || k <= 0 {
+		return nil
+	}
+	query = h.metric.prepare(query)
+	// Comparing with every allowed vector is cheaper than walking the
+	// graph when the filter leaves only a few
+	if filter != nil && len(filter) <= max(k, ef) {
+		return h.exact(query, k, filter)
+	}
+
+	entries := []int{h.entry}
+	for layer := len(h.nodes[h.entry].neighbors) - 1; layer > 0; layer-- {
+		entries = candidateIDs(h.searchLayer(query, entries, 1, layer))
+	}
+
+	results := make([]neighbor, 0, k)
+	for _, c := range h.searchLayer(query, entries, max(k, ef), 0) {
+		node := h.nodes[c.id]
+		if node.deleted || filter != nil && !hasKey(filter, node.key) {
+			continue
+		}
+		results = append(results, neighbor{node.key, c.distance})
+		if len(results) == k {
+			break
+		}
+	}
+
+	// The neighborhood explored may hold too few allowed vectors when the
+	// filter is selective or there are many tombstones: fall back to an
+	// exact search rather than return fewer than k results
+	available := len(h.ids)
+	if filter != nil {
+		available = min(available, len(filter))
+	}
+	if len(results) < k && len(results) < available {
+		return h.exact(query, k, filter)
+	}
+	return results
+}
+
+// exact compares query with every live vector allowed by filter
+func (h *hnswIndex) exact(query []float32, k int, filter keySet) []neighbor {
+	nearest := &neighborHeap{farthestFirst: true}
+	for key, id := range h.ids {
+		if filter != nil && !hasKey(filter, key) {
+			continue
+		}
+		heap.Push(nearest, neighbor{key, h.metric.distance(query, h.nodes[id].vector)})
+		if nearest.Len() > k {
+			heap.Pop(nearest)
+		}
+	}
+	return nearest.sorted()
+}
+
+// searchLayer returns the ef nodes closest to query found by a best-first
+// walk of a layer from the entry nodes, closest first
+func (h *hnswIndex) searchLayer(query []float32, entries []int, ef, layer int) []candidate {
+	visited := make(map[int]struct{}, ef*h.m)
+	closest := &candidateHeap{}
+	found := &candidateHeap{farthestFirst: true}
+	for _, id := range entries {
+		c := candidate{id, h.metric.distance(query, h.nodes[id].vector)}
+		visited[id] = struct{}{}
+		heap.Push(closest, c)
+		heap.Push(found, c)
+	}
+
+	for closest.Len() > 0 {
+		current := heap.Pop(closest).(candidate)
+		if found.Len() >= ef && current.distance > found.items[0].distance {
+			break
+		}
+		for _, id := range h.nodes[current.id].neighbors[layer] {
+			if _, seen := visited[id]; seen {
+				continue
+			}
+			visited[id] = struct{}{}
+
+			c := candidate{id, h.metric.distance(query, h.nodes[id].vector)}
+			if found.Len() < ef || c.distance < found.items[0].distance {
+				heap.Push(closest, c)
+				heap.Push(found, c)
+				if found.Len() > ef {
+					heap.Pop(found)
+				}
+			}
+		}
+	}
+
+	result := make([]candidate, found.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(found).(candidate)
+	}
+	return result
+}
+
+// candidate is a node met during a graph search
+type candidate struct {
+	id       int
+	distance float64
+}
+
+func candidateIDs(candidates []candidate) []int {
+	ids := make([]int, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.id
+	}
+	return ids
+}
+
+// candidateHeap is a heap of candidates, closest first or farthest first
+type candidateHeap struct {
+	items         []candidate
+	farthestFirst bool
+}
+
+func (h *candidateHeap) Len() int { return len(h.items) }
+
+func (h *candidateHeap) Less(i, j int) bool {
+	return (h.items[i].distance < h.items[j].distance) != h.farthestFirst
+}
+
+func (h *candidateHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *candidateHeap) Push(x interface{}) { h.items = append(h.items, x.(candidate)) }
+
+func (h *candidateHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
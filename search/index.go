@@ -0,0 +1,348 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// keySet is a set of document keys, the result of evaluating a query
+type keySet map[string]struct{}
+
+// Index is a secondary index over the hashes whose keys match its prefixes.
+// It keeps its own copy of the indexed fields, so queries never touch the
+// store until the matching documents are loaded.
+type Index struct {
+	def    Definition
+	fields map[string]*FieldSpec
+
+	mu   sync.RWMutex
+	docs map[string]*document
+	// tags maps field -> tag -> keys
+	tags map[string]map[string]keySet
+	// numbers holds a sorted index per NUMERIC field for range queries
+	numbers map[string]*numericIndex
+	// terms maps field -> term -> key -> occurrences of the term in the field
+	terms map[string]map[string]map[string]int
+	// textLength is the total number of terms per TEXT field over all
+	// documents, and textDocs the number of documents having the field
+	textLength map[string]int
+	textDocs   map[string]int
+	stopWords  map[string]struct{}
+	// vectors holds the nearest neighbor index of each VECTOR field
+	vectors map[string]vectorIndex
+}
+
+// document is what the index knows about one hash
+type document struct {
+	// values are the raw values of the indexed fields, used for sorting
+	values  map[string]string
+	tags    map[string][]string
+	numbers map[string]float64
+	// terms maps field -> term -> occurrences, and lengths holds the number
+	// of terms of each TEXT field
+	terms   map[string]map[string]int
+	lengths map[string]int
+	vectors map[string][]float32
+}
+
+func newIndex(def Definition) *Index {
+	idx := &Index{
+		def:        def,
+		fields:     make(map[string]*FieldSpec, len(def.Fields)),
+		docs:       make(map[string]*document),
+		tags:       make(map[string]map[string]keySet),
+		numbers:    make(map[string]*numericIndex),
+		terms:      make(map[string]map[string]map[string]int),
+		textLength: make(map[string]int),
+		textDocs:   make(map[string]int),
+		stopWords:  make(map[string]struct{}),
+		vectors:    make(map[string]vectorIndex),
+	}
+	stopWords := def.StopWords
+	if stopWords == nil {
+		stopWords = DefaultStopWords
+	}
+	for _, word := range stopWords {
+		idx.stopWords[strings.ToLower(word)] = struct{}{}
+	}
+	for i := range def.Fields {
+		field := &idx.def.Fields[i]
+		idx.fields[field.Name] = field
+		switch field.Type {
+		case TagField:
+			idx.tags[field.Name] = make(map[string]keySet)
+		case NumericField:
+			idx.numbers[field.Name] = &numericIndex{}
+		case TextField:
+			idx.terms[field.Name] = make(map[string]map[string]int)
+			if field.Weight <= 0 {
+				field.Weight = 1
+			}
+		case VectorField:
+			idx.vectors[field.Name] = newVectorIndex(field.Vector)
+		}
+	}
+	return idx
+}
+
+// Definition returns the definition the index was created with
+func (idx *Index) Definition() Definition {
+	return idx.def
+}
+
+// Info summarizes the contents of the index
+type Info struct {
+	Docs int
+	// Terms is the number of distinct terms over all TEXT fields
+	Terms int
+	// Records is the number of entries in the inverted indexes
+	Records int
+}
+
+func (idx *Index) Info() Info {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	info := Info{Docs: len(idx.docs)}
+	for _, terms := range idx.terms {
+		info.Terms += len(terms)
+		for _, postings := range terms {
+			info.Records += len(postings)
+		}
+	}
+	for _, tags := range idx.tags {
+		for _, keys := range tags {
+			info.Records += len(keys)
+		}
+	}
+	for _, numbers := range idx.numbers {
+		info.Records += len(numbers.entries)
+	}
+	return info
+}
+
+// Keys returns the keys of every indexed document
+func (idx *Index) Keys() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	keys := make([]string, 0, len(idx.docs))
+	for key := range idx.docs {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// update indexes the hash at key, replacing what was indexed before. A nil
+// hash removes the document.
+func (idx *Index) update(key string, hash map[string][]byte) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if old, exists := idx.docs[key]; exists {
+		idx.unindex(key, old)
+		delete(idx.docs, key)
+	}
+	if hash == nil {
+		return
+	}
+
+	doc := &document{
+		values:  make(map[string]string),
+		tags:    make(map[string][]string),
+		numbers: make(map[string]float64),
+		terms:   make(map[string]map[string]int),
+		lengths: make(map[string]int),
+		vectors: make(map[string][]float32),
+	}
+	for name, field := range idx.fields {
+		raw, exists := hash[name]
+		if !exists {
+			continue
+		}
+		value := string(raw)
+
+		switch field.Type {
+		case TagField:
+			doc.tags[name] = splitTags(value, field)
+		case NumericField:
+			number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || math.IsNaN(number) {
+				// Not a number: the document is indexed without this field
+				continue
+			}
+			doc.numbers[name] = number
+		case TextField:
+			counts := make(map[string]int)
+			tokens := idx.tokenize(value)
+			for _, token := range tokens {
+				counts[token]++
+			}
+			doc.terms[name] = counts
+			doc.lengths[name] = len(tokens)
+		case VectorField:
+			vector, ok := decodeVector(value, field.Vector.Dim)
+			if !ok {
+				// Not a vector of the right size: the document is indexed
+				// without this field
+				continue
+			}
+			doc.vectors[name] = vector
+		}
+		doc.values[name] = value
+	}
+
+	idx.docs[key] = doc
+	idx.index(key, doc)
+}
+
+// clear removes every document
+func (idx *Index) clear() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	fresh := newIndex(idx.def)
+	idx.docs = fresh.docs
+	idx.tags = fresh.tags
+	idx.numbers = fresh.numbers
+	idx.terms = fresh.terms
+	idx.textLength = fresh.textLength
+	idx.textDocs = fresh.textDocs
+	idx.vectors = fresh.vectors
+}
+
+// index adds doc to the inverted indexes. Callers must hold idx.mu.
+func (idx *Index) index(key string, doc *document) {
+	for name, tags := range doc.tags {
+		for _, tag := range tags {
+			keys := idx.tags[name][tag]
+			if keys == nil {
+				keys = make(keySet)
+				idx.tags[name][tag] = keys
+			}
+			keys[key] = struct{}{}
+		}
+	}
+	for name, number := range doc.numbers {
+		idx.numbers[name].insert(number, key)
+	}
+	for name, counts := range doc.terms {
+		for term, count := range counts {
+			postings := idx.terms[name][term]
+			if postings == nil {
+				postings = make(map[string]int)
+				idx.terms[name][term] = postings
+			}
+			postings[key] = count
+		}
+		idx.textLength[name] += doc.lengths[name]
+		idx.textDocs[name]++
+	}
+	for name, vector := range doc.vectors {
+		idx.vectors[name].add(key, vector)
+	}
+}
+
+// unindex removes doc from the inverted indexes. Callers must hold idx.mu.
+func (idx *Index) unindex(key string, doc *document) {
+	for name, tags := range doc.tags {
+		for _, tag := range tags {
+			delete(idx.tags[name][tag], key)
+			if len(idx.tags[name][tag]) == 0 {
+				delete(idx.tags[name], tag)
+			}
+		}
+	}
+	for name, number := range doc.numbers {
+		idx.numbers[name].remove(number, key)
+	}
+	for name, counts := range doc.terms {
+		for term := range counts {
+			delete(idx.terms[name][term], key)
+			if len(idx.terms[name][term]) == 0 {
+				delete(idx.terms[name], term)
+			}
+		}
+		idx.textLength[name] -= doc.lengths[name]
+		idx.textDocs[name]--
+	}
+	for name := range doc.vectors {
+		idx.vectors[name].remove(key)
+	}
+}
+
+// splitTags splits a TAG value on the field's separator, trimming spaces and
+// dropping empty tags
+func splitTags(value string, field *FieldSpec) []string {
+	parts := strings.Split(value, string(field.Separator))
+	tags := make([]string, 0, len(parts))
+	for _, part := range parts {
+		tag := normalizeTag(part, field)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func normalizeTag(tag string, field *FieldSpec) string {
+	tag = strings.TrimSpace(tag)
+	if !field.CaseSensitive {
+		tag = strings.ToLower(tag)
+	}
+	return tag
+}
+
+// numericIndex keeps the values of a NUMERIC field sorted, so a range query
+// is two binary searches
+type numericIndex struct {
+	entries []numericEntry
+}
+
+type numericEntry struct {
+	value float64
+	key   string
+}
+
+func (n *numericIndex) search(value float64, key string) int {
+	return sort.Search(len(n.entries), func(i int) bool {
+		e := n.entries[i]
+		return e.value > value || e.value == value && e.key >= key
+	})
+}
+
+func (n *numericIndex) insert(value float64, key string) {
+	i := n.search(value, key)
+	n.entries = append(n.entries, numericEntry{})
+	copy(n.entries[i+1:], n.entries[i:])
+	n.entries[i] = numericEntry{value: value, key: key}
+}
+
+func (n *numericIndex) remove(value float64, key string) {
+	i := n.search(value, key)
+	if i < len(n.entries) && n.entries[i].key == key {
+		n.entries = append(n.entries[:i], n.entries[i+1:]...)
+	}
+}
+
+// between returns the keys whose value is in the range
+func (n *numericIndex) between(min, max float64, minExclusive, maxExclusive bool) keySet {
+	start := sort.Search(len(n.entries), func(i int) bool {
+		if minExclusive {
+			return n.entries[i].value > min
+		}
+		return n.entries[i].value >= min
+	})
+
+	keys := make(keySet)
+	for _, e := range n.entries[start:] {
+		if e.value > max || maxExclusive && e.value == max {
+			break
+		}
+		keys[e.key] = struct{}{}
+	}
+	return keys
+}
@@ -0,0 +1,768 @@
+package search
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Query syntax
+//
+// A query is a sequence of clauses that must all match, for example
+//
+//	@country:{IN | US} @age:[(30 +inf] -@status:{banned} database
+//
+// where a clause is one of:
+//
+//	term                 a term in any TEXT field
+//	prefix*              terms starting with prefix (at least 2 characters)
+//	%term%               terms within 1 edit of term (%%term%% for 2,
+//	                     %%%term%%% for 3)
+//	@field:term          a term in one TEXT field
+//	@field:(a b | c)     a sub-query whose bare terms apply to field
+//	@field:{a | b}       any of the tags of a TAG field
+//	@field:[min max]     a NUMERIC range, ( before a bound excludes it, and
+//	                     -inf / +inf leave it open
+//	"a b"                every term of the phrase
+//	( ... )              a sub-query
+//	-clause              documents not matching clause
+//	*                    every document
+//
+// and clauses separated by | match if either side does. Whitespace binds
+// tighter than |, so "a b | c" means "(a b) | c". Stop words in exact terms
+// are ignored.
+//
+// A query may end with a vector similarity clause, which returns the k
+// documents matching the rest of the query whose vector is nearest to a
+// query vector passed as a parameter:
+//
+//	(@genre:{jazz})=>[KNN 10 @embedding $vec EF_RUNTIME 50 AS distance]
+
+// queryNode is a parsed query clause
+type queryNode interface {
+	eval(idx *Index) keySet
+}
+
+type (
+	allNode  struct{}
+	andNode  []queryNode
+	orNode   []queryNode
+	notNode  struct{ node queryNode }
+	termNode struct {
+		// field is empty for terms matching any TEXT field
+		field string
+		term  string
+		// prefix matches every term starting with term, and distance > 0
+		// every term within that many edits of it
+		prefix   bool
+		distance int
+		// matches caches the indexed terms the node expanded to, per field
+		matches map[string][]string
+	}
+	tagNode struct {
+		field string
+		tags  []string
+	}
+	rangeNode struct {
+		field                      string
+		min, max                   float64
+		minExclusive, maxExclusive bool
+	}
+)
+
+// queryError is a syntax error at a byte offset of the query
+func queryError(offset int, format string, args ...interface{}) error {
+	return fmt.Errorf("ERR Syntax error at offset %d: %s", offset, fmt.Sprintf(format, args...))
+}
+
+// queryParser is a recursive descent parser for the query syntax
+type queryParser struct {
+	idx    *Index
+	query  string
+	pos    int
+	params map[string]string
+}
+
+// knnQuery is a parsed vector similarity clause
+type knnQuery struct {
+	field     *FieldSpec
+	k         int
+	vector    []float32
+	efRuntime int
+	// scoreField is the name under which the distance is returned
+	scoreField string
+}
+
+func (idx *Index) parseQuery(query string, params map[string]string) (queryNode, *knnQuery, error) {
+	p := &queryParser{idx: idx, query: query, params: params}
+	node, err := p.parseUnion("")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var knn *knnQuery
+	p.skipSpaces()
+	if p.atKNN() {
+		if knn, err = p.parseKNN(); err != nil {
+			return nil, nil, err
+		}
+		p.skipSpaces()
+	}
+	if p.pos < len(p.query) {
+		return nil, nil, queryError(p.pos, "unexpected '%c'", p.query[p.pos])
+	}
+	return node, knn, nil
+}
+
+func (p *queryParser) atKNN() bool {
+	return strings.HasPrefix(p.query[p.pos:], "=>")
+}
+
+// parseKNN parses =>[KNN k @field $param [EF_RUNTIME ef] [AS name]]
+func (p *queryParser) parseKNN() (*knnQuery, error) {
+	start := p.pos
+	p.pos += 2 // =>
+	p.skipSpaces()
+	end := strings.IndexByte(p.query[p.pos:], ']')
+	if p.peek() != '[' || end < 0 {
+		return nil, queryError(start, "expected =>[KNN ...]")
+	}
+	args := strings.Fields(p.query[p.pos+1 : p.pos+end])
+	p.pos += end + 1
+
+	if len(args) < 3 || !strings.EqualFold(args[0], "KNN") || !strings.HasPrefix(args[2], "@") {
+		return nil, queryError(start, "expected KNN k @field $vector")
+	}
+	k, err := p.intParam(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	name := args[2][1:]
+	field, exists := p.idx.fields[name]
+	if !exists || field.Type != VectorField {
+		return nil, fmt.Errorf("ERR Expected a VECTOR field, got '%s'", name)
+	}
+	knn := &knnQuery{field: field, k: k, efRuntime: field.Vector.EFRuntime, scoreField: "__" + name + "_score"}
+
+	if len(args) < 4 || !strings.HasPrefix(args[3], "$") {
+		return nil, queryError(start, "expected a $parameter holding the query vector")
+	}
+	blob, err := p.param(args[3])
+	if err != nil {
+		return nil, err
+	}
+	if knn.vector, exists = decodeVector(blob, field.Vector.Dim); !exists {
+		return nil, fmt.Errorf("ERR Error parsing vector similarity query: query vector blob size (%d) does not match index's expected size (%d).",
+			len(blob), 4*field.Vector.Dim)
+	}
+
+	for i := 4; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, queryError(start, "missing value for %s", args[i])
+		}
+		switch strings.ToUpper(args[i]) {
+		case "EF_RUNTIME":
+			if knn.efRuntime, err = p.intParam(args[i+1]); err != nil {
+				return nil, err
+			}
+		case "AS":
+			knn.scoreField = args[i+1]
+		default:
+			return nil, queryError(start, "unknown KNN attribute '%s'", args[i])
+		}
+	}
+	return knn, nil
+}
+
+// param returns the value of a $name parameter, or arg itself if it is not
+// one
+func (p *queryParser) param(arg string) (string, error) {
+	name, isParam := strings.CutPrefix(arg, "$")
+	if !isParam {
+		return arg, nil
+	}
+	value, exists := p.params[name]
+	if !exists {
+		return "", fmt.Errorf("ERR No such parameter `%s`", name)
+	}
+	return value, nil
+}
+
+// intParam parses a non-negative integer, given directly or as a parameter
+func (p *queryParser) intParam(arg string) (int, error) {
+	value, err := p.param(arg)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("ERR Invalid value '%s' for %s: expected a non-negative integer", value, arg)
+	}
+	return n, nil
+}
+
+func (p *queryParser) skipSpaces() {
+	for p.pos < len(p.query) && isSpace(p.query[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *queryParser) peek() byte {
+	if p.pos < len(p.query) {
+		return p.query[p.pos]
+	}
+	return 0
+}
+
+// parseUnion parses clauses separated by |. Bare terms are looked up in
+// field, or in every TEXT field if it is empty.
+func (p *queryParser) parseUnion(field string) (queryNode, error) {
+	branches := make(orNode, 0, 1)
+	for {
+		branch, err := p.parseIntersection(field)
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch)
+
+		p.skipSpaces()
+		if p.peek() != '|' {
+			break
+		}
+		p.pos++
+	}
+
+	if len(branches) == 1 {
+		return branches[0], nil
+	}
+	return branches, nil
+}
+
+func (p *queryParser) parseIntersection(field string) (queryNode, error) {
+	clauses := make(andNode, 0, 1)
+	for {
+		p.skipSpaces()
+		if c := p.peek(); c == 0 || c == '|' || c == ')' || p.atKNN() {
+			break
+		}
+
+		clause, err := p.parseClause(field)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+	}
+
+	switch len(clauses) {
+	case 0:
+		return nil, queryError(p.pos, "empty query")
+	case 1:
+		return clauses[0], nil
+	default:
+		return clauses, nil
+	}
+}
+
+func (p *queryParser) parseClause(field string) (queryNode, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		node, err := p.parseClause(field)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	case '(':
+		p.pos++
+		node, err := p.parseUnion(field)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, queryError(p.pos, "missing ')'")
+		}
+		p.pos++
+		return node, nil
+	case '@':
+		return p.parseFieldClause()
+	case '*':
+		p.pos++
+		return allNode{}, nil
+	case '"':
+		return p.parsePhrase(field)
+	default:
+		return p.parseTerm(field)
+	}
+}
+
+// parseFieldClause parses @field:... clauses
+func (p *queryParser) parseFieldClause() (queryNode, error) {
+	start := p.pos
+	p.pos++ // @
+	name := p.readWord()
+	if name == "" || p.peek() != ':' {
+		return nil, queryError(start, "expected @field:")
+	}
+	p.pos++
+
+	field, exists := p.idx.fields[name]
+	if !exists {
+		return nil, queryError(start, "unknown field '%s'", name)
+	}
+
+	p.skipSpaces()
+	switch field.Type {
+	case TagField:
+		if p.peek() != '{' {
+			return nil, queryError(p.pos, "expected {tags} after TAG field '%s'", name)
+		}
+		return p.parseTags(field)
+	case NumericField:
+		if p.peek() != '[' {
+			return nil, queryError(p.pos, "expected [min max] after NUMERIC field '%s'", name)
+		}
+		return p.parseRange(field)
+	case VectorField:
+		return nil, queryError(start, "VECTOR field '%s' can only be queried with =>[KNN ...]", name)
+	default:
+		return p.parseClause(name)
+	}
+}
+
+// parseTags parses {tag | tag ...}
+func (p *queryParser) parseTags(field *FieldSpec) (queryNode, error) {
+	start := p.pos
+	p.pos++ // {
+	node := tagNode{field: field.Name}
+	var tag strings.Builder
+	for {
+		if p.pos >= len(p.query) {
+			return nil, queryError(start, "missing '}'")
+		}
+		c := p.query[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && p.pos < len(p.query):
+			tag.WriteByte(p.query[p.pos])
+			p.pos++
+		case c == '|' || c == '}':
+			if value := normalizeTag(tag.String(), field); value != "" {
+				node.tags = append(node.tags, value)
+			}
+			tag.Reset()
+			if c == '}' {
+				return node, nil
+			}
+		default:
+			tag.WriteByte(c)
+		}
+	}
+}
+
+// parseRange parses [min max]
+func (p *queryParser) parseRange(field *FieldSpec) (queryNode, error) {
+	start := p.pos
+	end := strings.IndexByte(p.query[p.pos:], ']')
+	if end < 0 {
+		return nil, queryError(start, "missing ']'")
+	}
+	bounds := strings.Fields(p.query[p.pos+1 : p.pos+end])
+	p.pos += end + 1
+	if len(bounds) != 2 {
+		return nil, queryError(start, "expected [min max]")
+	}
+
+	node := rangeNode{field: field.Name}
+	var err error
+	if node.min, node.minExclusive, err = parseBound(bounds[0]); err != nil {
+		return nil, queryError(start, "bad range bound '%s'", bounds[0])
+	}
+	if node.max, node.maxExclusive, err = parseBound(bounds[1]); err != nil {
+		return nil, queryError(start, "bad range bound '%s'", bounds[1])
+	}
+	return node, nil
+}
+
+// parseBound parses a range bound: a number, -inf or +inf, optionally
+// preceded by ( to make it exclusive
+func parseBound(bound string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(bound, "(")
+	bound = strings.TrimPrefix(bound, "(")
+	switch strings.ToLower(bound) {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "inf", "+inf":
+		return math.Inf(1), exclusive, nil
+	}
+	value, err := strconv.ParseFloat(bound, 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, false, errors.New("invalid bound")
+	}
+	return value, exclusive, nil
+}
+
+// parsePhrase parses "a b c", which matches documents with every term
+func (p *queryParser) parsePhrase(field string) (queryNode, error) {
+	start := p.pos
+	end := strings.IndexByte(p.query[p.pos+1:], '"')
+	if end < 0 {
+		return nil, queryError(start, "missing closing '\"'")
+	}
+	phrase := p.query[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+	return p.termsNode(field, phrase, false, 0), nil
+}
+
+// parseTerm parses a bare word, which may tokenize to several terms. The
+// last one is a prefix if the word ends with * and fuzzy if it is wrapped
+// in %.
+func (p *queryParser) parseTerm(field string) (queryNode, error) {
+	start := p.pos
+	word := p.readWord()
+	raw := p.query[start:p.pos]
+	if word == "" {
+		return nil, queryError(start, "unexpected '%c'", p.peek())
+	}
+
+	if strings.HasPrefix(raw, "%") {
+		distance := len(raw) - len(strings.TrimLeft(raw, "%"))
+		if distance > maxFuzzyDistance || len(raw) < 2*distance+1 ||
+			strings.Trim(raw[len(raw)-distance:], "%") != "" {
+			return nil, queryError(start, "bad fuzzy term '%s'", raw)
+		}
+		return p.termsNode(field, word[distance:len(word)-distance], false, distance), nil
+	}
+
+	if strings.HasSuffix(raw, "*") && !strings.HasSuffix(raw, "\\*") {
+		word = strings.TrimSuffix(word, "*")
+		tokens := scanTokens(word)
+		if len(tokens) == 0 || runeCount(tokens[len(tokens)-1].term) < minPrefixLength {
+			return nil, queryError(start, "prefix '%s' is shorter than %d characters", raw, minPrefixLength)
+		}
+		return p.termsNode(field, word, true, 0), nil
+	}
+	return p.termsNode(field, word, false, 0), nil
+}
+
+const (
+	// minPrefixLength is the shortest prefix query, so a prefix can't
+	// expand to most of the vocabulary
+	minPrefixLength = 2
+	// maxFuzzyDistance is the largest edit distance of fuzzy terms
+	maxFuzzyDistance = 3
+	// maxExpansions caps the number of terms a prefix or fuzzy term
+	// expands to
+	maxExpansions = 200
+)
+
+// termsNode matches documents having every term of text. Stop words are
+// skipped, except for the last term when it is a prefix or fuzzy term.
+func (p *queryParser) termsNode(field, text string, prefix bool, distance int) queryNode {
+	tokens := scanTokens(text)
+	node := make(andNode, 0, len(tokens))
+	for i, t := range tokens {
+		last := i == len(tokens)-1
+		if last && (prefix || distance > 0) {
+			node = append(node, &termNode{field: field, term: t.term, prefix: prefix, distance: distance})
+		} else if _, stop := p.idx.stopWords[t.term]; !stop {
+			node = append(node, &termNode{field: field, term: t.term})
+		}
+	}
+
+	switch len(node) {
+	case 0:
+		// Nothing left to search for, so nothing matches
+		return orNode{}
+	case 1:
+		return node[0]
+	default:
+		return node
+	}
+}
+
+// readWord reads up to the next space or query operator. A backslash escapes
+// the following character.
+func (p *queryParser) readWord() string {
+	var word strings.Builder
+	for p.pos < len(p.query) {
+		c := p.query[p.pos]
+		if c == '\\' && p.pos+1 < len(p.query) {
+			word.WriteByte(p.query[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		if isSpace(c) || strings.IndexByte("()|{}[]@:\"", c) >= 0 {
+			break
+		}
+		word.WriteByte(c)
+		p.pos++
+	}
+	return word.String()
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// Evaluation. Callers hold idx.mu for reading.
+
+func (allNode) eval(idx *Index) keySet {
+	keys := make(keySet, len(idx.docs))
+	for key := range idx.docs {
+		keys[key] = struct{}{}
+	}
+	return keys
+}
+
+func (n andNode) eval(idx *Index) keySet {
+	result := n[0].eval(idx)
+	for _, clause := range n[1:] {
+		if len(result) == 0 {
+			break
+		}
+		other := clause.eval(idx)
+		for key := range result {
+			if _, ok := other[key]; !ok {
+				delete(result, key)
+			}
+		}
+	}
+	return result
+}
+
+func (n orNode) eval(idx *Index) keySet {
+	result := make(keySet)
+	for _, branch := range n {
+		for key := range branch.eval(idx) {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (n notNode) eval(idx *Index) keySet {
+	excluded := n.node.eval(idx)
+	result := make(keySet, len(idx.docs))
+	for key := range idx.docs {
+		if _, ok := excluded[key]; !ok {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (n *termNode) eval(idx *Index) keySet {
+	result := make(keySet)
+	for name, terms := range n.expand(idx) {
+		for _, term := range terms {
+			for key := range idx.terms[name][term] {
+				result[key] = struct{}{}
+			}
+		}
+	}
+	return result
+}
+
+// expand returns the indexed terms matching the node, per TEXT field
+func (n *termNode) expand(idx *Index) map[string][]string {
+	if n.matches != nil {
+		return n.matches
+	}
+
+	n.matches = make(map[string][]string)
+	expansions := 0
+	for name, terms := range idx.terms {
+		if n.field != "" && name != n.field {
+			continue
+		}
+		if !n.prefix && n.distance == 0 {
+			if _, exists := terms[n.term]; exists {
+				n.matches[name] = []string{n.term}
+			}
+			continue
+		}
+
+		for term := range terms {
+			if expansions == maxExpansions {
+				break
+			}
+			if n.prefix && strings.HasPrefix(term, n.term) ||
+				n.distance > 0 && editDistance(term, n.term, n.distance) <= n.distance {
+				n.matches[name] = append(n.matches[name], term)
+				expansions++
+			}
+		}
+	}
+	return n.matches
+}
+
+func (n tagNode) eval(idx *Index) keySet {
+	result := make(keySet)
+	for _, tag := range n.tags {
+		for key := range idx.tags[n.field][tag] {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (n rangeNode) eval(idx *Index) keySet {
+	return idx.numbers[n.field].between(n.min, n.max, n.minExclusive, n.maxExclusive)
+}
+
+// SearchOptions control the order and paging of search results
+type SearchOptions struct {
+	// SortBy orders the results by a field of the schema, or by the
+	// distance of a KNN query, instead of by relevance
+	SortBy     string
+	Descending bool
+	Offset     int
+	Limit      int
+	// Params holds the values of the $name parameters of the query
+	Params map[string]string
+}
+
+// SearchResult is one page of matching documents
+type SearchResult struct {
+	// Total is the number of matching documents, before paging
+	Total int
+	Keys  []string
+	// Scores holds the BM25 relevance of each key. Queries without text
+	// terms score 0 for every document.
+	Scores []float64
+	// For KNN queries, Distances holds the distance of each key to the
+	// query vector and DistanceField the name to return it under
+	Distances     []float64
+	DistanceField string
+
+	// terms are the indexed terms the query matched, for highlighting
+	terms matchedTerms
+}
+
+// Search runs query and returns the requested page of matching keys. KNN
+// queries return the nearest documents first; otherwise, unless
+// opts.SortBy is set, the most relevant documents come first, ties ordered
+// by key.
+func (idx *Index) Search(query string, opts SearchOptions) (SearchResult, error) {
+	node, knn, err := idx.parseQuery(query, opts.Params)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	var sortField *FieldSpec
+	if opts.SortBy != "" && (knn == nil || opts.SortBy != knn.scoreField) {
+		field, exists := idx.fields[opts.SortBy]
+		if !exists {
+			return SearchResult{}, fmt.Errorf("ERR Property `%s` not loaded nor in schema", opts.SortBy)
+		}
+		sortField = field
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	matches := node.eval(idx)
+	terms := make(matchedTerms)
+	collectTerms(node, terms)
+
+	var keys []string
+	scores := make(map[string]float64, len(matches))
+	distances := make(map[string]float64)
+	if knn != nil {
+		// The rest of the query filters the candidates before the nearest
+		// are picked, so there are k results whenever k documents match
+		var filter keySet
+		if _, all := node.(allNode); !all {
+			filter = matches
+		}
+		// k and EF_RUNTIME come from the client and size allocations, but
+		// there are never more neighbors than vectors. The query is parsed
+		// before idx.mu is taken, so they are bounded here.
+		vectors := idx.vectors[knn.field.Name]
+		k, ef := min(knn.k, vectors.len()), min(knn.efRuntime, vectors.len())
+		neighbors := vectors.search(knn.vector, k, ef, filter)
+		keys = make([]string, len(neighbors))
+		for i, n := range neighbors {
+			keys[i] = n.key
+			distances[n.key] = n.distance
+			scores[n.key] = idx.score(n.key, terms)
+		}
+		if sortField == nil && opts.SortBy != "" && opts.Descending {
+			slices.Reverse(keys)
+		}
+	} else {
+		keys = make([]string, 0, len(matches))
+		for key := range matches {
+			keys = append(keys, key)
+			scores[key] = idx.score(key, terms)
+		}
+		if sortField == nil {
+			sort.Slice(keys, func(i, j int) bool {
+				if scores[keys[i]] != scores[keys[j]] {
+					return scores[keys[i]] > scores[keys[j]]
+				}
+				return keys[i] < keys[j]
+			})
+		}
+	}
+	if sortField != nil {
+		idx.sortByField(keys, sortField, opts.Descending)
+	}
+
+	result := SearchResult{Total: len(keys), terms: terms}
+	if knn != nil {
+		result.DistanceField = knn.scoreField
+	}
+	if opts.Offset < len(keys) {
+		keys = keys[opts.Offset:]
+		if len(keys) > opts.Limit {
+			keys = keys[:opts.Limit]
+		}
+		result.Keys = keys
+		result.Scores = make([]float64, len(keys))
+		for i, key := range keys {
+			result.Scores[i] = scores[key]
+		}
+		if knn != nil {
+			result.Distances = make([]float64, len(keys))
+			for i, key := range keys {
+				result.Distances[i] = distances[key]
+			}
+		}
+	}
+	return result, nil
+}
+
+// sortByField orders keys by the value of field, numerically for NUMERIC
+// fields. Documents without the field come last; ties are broken by key.
+func (idx *Index) sortByField(keys []string, field *FieldSpec, descending bool) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := idx.docs[keys[i]], idx.docs[keys[j]]
+		order, aok, bok := 0, false, false
+		if field.Type == NumericField {
+			var x, y float64
+			x, aok = a.numbers[field.Name]
+			y, bok = b.numbers[field.Name]
+			order = cmp.Compare(x, y)
+		} else {
+			var x, y string
+			x, aok = a.values[field.Name]
+			y, bok = b.values[field.Name]
+			order = strings.Compare(x, y)
+		}
+
+		if aok != bok {
+			return aok
+		}
+		if order != 0 {
+			return (order < 0) != descending
+		}
+		return keys[i] < keys[j]
+	})
+}
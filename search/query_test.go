@@ -0,0 +1,69 @@
+package search
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func encodeVector(values ...float32) string {
+	blob := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(blob[4*i:], math.Float32bits(v))
+	}
+	return string(blob)
+}
+
+func newKNNTestIndex(t *testing.T, algorithm VectorAlgorithm) *Index {
+	t.Helper()
+	registry := NewRegistry()
+	idx, err := registry.Create(Definition{
+		Name: "idx",
+		Fields: []FieldSpec{{
+			Name: "v",
+			Type: VectorField,
+			Vector: VectorSpec{
+				Algorithm: algorithm, Dim: 2, Metric: L2Distance,
+				M: 16, EFConstruction: 200, EFRuntime: 10,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		registry.HashChanged("doc:"+strconv.Itoa(i), map[string][]byte{
+			"v": []byte(encodeVector(float32(i), 0)),
+		})
+	}
+	return idx
+}
+
+func TestKNNHugeCounts(t *testing.T) {
+	queries := []string{
+		"*=>[KNN 9223372036854775807 @v $q]",
+		"*=>[KNN 3 @v $q EF_RUNTIME 9223372036854775807]",
+		"*=>[KNN 9223372036854775807 @v $q EF_RUNTIME 9223372036854775807]",
+		"*=>[KNN $k @v $q]",
+	}
+	for _, algorithm := range []VectorAlgorithm{FlatAlgorithm, HNSWAlgorithm} {
+		idx := newKNNTestIndex(t, algorithm)
+		for _, query := range queries {
+			result, err := idx.Search(query, SearchOptions{
+				Limit:  10,
+				Params: map[string]string{"q": encodeVector(0, 0), "k": "9223372036854775807"},
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+			want := 5
+			if query == queries[1] {
+				want = 3
+			}
+			if result.Total != want {
+				t.Errorf("%s over %s: %d results, want %d", query, algorithm, result.Total, want)
+			}
+		}
+	}
+}
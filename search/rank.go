@@ -0,0 +1,69 @@
+package search
+
+import "math"
+
+// BM25 parameters: k1 limits how much repeating a term raises the score, and
+// b how much long fields are penalized
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// matchedTerms maps field -> indexed term for every term a query matched
+type matchedTerms map[string]map[string]struct{}
+
+// collectTerms gathers the terms that node matched while it was evaluated.
+// Negated terms are left out: they never contribute to a match.
+func collectTerms(node queryNode, terms matchedTerms) {
+	switch n := node.(type) {
+	case andNode:
+		for _, child := range n {
+			collectTerms(child, terms)
+		}
+	case orNode:
+		for _, child := range n {
+			collectTerms(child, terms)
+		}
+	case *termNode:
+		for field, matches := range n.matches {
+			if terms[field] == nil {
+				terms[field] = make(map[string]struct{})
+			}
+			for _, term := range matches {
+				terms[field][term] = struct{}{}
+			}
+		}
+	}
+}
+
+// score returns the BM25 relevance of the document at key for terms, each
+// field's contribution scaled by its weight. Callers must hold idx.mu.
+func (idx *Index) score(key string, terms matchedTerms) float64 {
+	doc := idx.docs[key]
+	total := 0.0
+	for field, fieldTerms := range terms {
+		docs := float64(idx.textDocs[field])
+		if docs == 0 {
+			continue
+		}
+		averageLength := float64(idx.textLength[field]) / docs
+		length := float64(doc.lengths[field])
+		weight := idx.fields[field].Weight
+
+		for term := range fieldTerms {
+			postings := idx.terms[field][term]
+			frequency := float64(postings[key])
+			if frequency == 0 {
+				continue
+			}
+			df := float64(len(postings))
+			idf := math.Log(1 + (docs-df+0.5)/(df+0.5))
+			norm := 1 - bm25B
+			if averageLength > 0 {
+				norm += bm25B * length / averageLength
+			}
+			total += weight * idf * frequency * (bm25K1 + 1) / (frequency + bm25K1*norm)
+		}
+	}
+	return total
+}
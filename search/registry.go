@@ -0,0 +1,94 @@
+package search
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry holds the indexes of a store. It is the store's HashObserver, so
+// every hash write is applied to the indexes covering its key.
+type Registry struct {
+	mu      sync.RWMutex
+	indexes map[string]*Index
+}
+
+func NewRegistry() *Registry {
+	return &Registry{indexes: make(map[string]*Index)}
+}
+
+// Create adds an empty index. The caller fills it with the existing hashes,
+// see store.DataStore.RefreshHashes.
+func (r *Registry) Create(def Definition) (*Index, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.indexes[def.Name]; exists {
+		return nil, ErrIndexExists
+	}
+	idx := newIndex(def)
+	r.indexes[def.Name] = idx
+	return idx, nil
+}
+
+// Drop removes an index and returns it
+func (r *Registry) Drop(name string) (*Index, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	idx, exists := r.indexes[name]
+	delete(r.indexes, name)
+	return idx, exists
+}
+
+func (r *Registry) Index(name string) (*Index, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	idx, exists := r.indexes[name]
+	return idx, exists
+}
+
+// Names returns the names of every index, sorted
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.indexes))
+	for name := range r.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Registry) Observes(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, idx := range r.indexes {
+		if idx.def.covers(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registry) HashChanged(key string, fields map[string][]byte) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, idx := range r.indexes {
+		if idx.def.covers(key) {
+			idx.update(key, fields)
+		}
+	}
+}
+
+func (r *Registry) HashesCleared() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, idx := range r.indexes {
+		idx.clear()
+	}
+}
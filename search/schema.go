@@ -0,0 +1,91 @@
+package search
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrIndexExists  = errors.New("ERR Index already exists")
+	ErrUnknownIndex = errors.New("ERR Unknown Index name")
+)
+
+// FieldType is how a hash field is indexed
+type FieldType int
+
+const (
+	// TagField holds exact values such as countries or categories, split on
+	// a separator
+	TagField FieldType = iota
+	// NumericField holds numbers that can be queried by range
+	NumericField
+	// TextField holds free text, split into terms
+	TextField
+	// VectorField holds embeddings, queried by similarity with KNN
+	VectorField
+)
+
+var fieldTypeNames = [...]string{
+	TagField:     "TAG",
+	NumericField: "NUMERIC",
+	TextField:    "TEXT",
+	VectorField:  "VECTOR",
+}
+
+func (t FieldType) String() string {
+	return fieldTypeNames[t]
+}
+
+// ParseFieldType returns the field type with the given (case-insensitive)
+// name
+func ParseFieldType(name string) (FieldType, bool) {
+	for t, typeName := range fieldTypeNames {
+		if strings.EqualFold(name, typeName) {
+			return FieldType(t), true
+		}
+	}
+	return TagField, false
+}
+
+// FieldSpec describes one indexed hash field
+type FieldSpec struct {
+	Name string
+	Type FieldType
+	// Separator splits TAG values into several tags (',' by default)
+	Separator byte
+	// CaseSensitive keeps the case of TAG values, which are otherwise
+	// matched case-insensitively
+	CaseSensitive bool
+	// Sortable is accepted for compatibility: every field can be sorted on
+	Sortable bool
+	// Weight scales the score of TEXT matches in this field (1 by default)
+	Weight float64
+	// Vector describes a VECTOR field
+	Vector VectorSpec
+}
+
+// Definition describes an index: which hashes it covers and how their
+// fields are indexed
+type Definition struct {
+	Name string
+	// Prefixes select the keys of the indexed hashes. No prefix means every
+	// hash.
+	Prefixes []string
+	Fields   []FieldSpec
+	// StopWords are the terms left out of TEXT fields. Nil means
+	// DefaultStopWords; an empty list indexes every term.
+	StopWords []string
+}
+
+// covers reports whether the hash at key belongs to the index
+func (d *Definition) covers(key string) bool {
+	if len(d.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range d.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
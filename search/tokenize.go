@@ -0,0 +1,91 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultStopWords are left out of TEXT indexes unless an index sets its own
+// list. They are so common that they match nearly every document.
+var DefaultStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in",
+	"into", "is", "it", "no", "not", "of", "on", "or", "such", "that", "the",
+	"their", "then", "there", "these", "they", "this", "to", "was", "will",
+	"with",
+}
+
+// token is a term and where it appears in the text
+type token struct {
+	term       string
+	start, end int // byte offsets of the original word
+}
+
+// scanTokens splits text into terms: runs of letters and digits, lowercased.
+// Terms are not stemmed, so "run" and "running" are different terms.
+func scanTokens(text string) []token {
+	tokens := make([]token, 0)
+	start := -1
+	for i, r := range text {
+		wordChar := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if wordChar && start < 0 {
+			start = i
+		} else if !wordChar && start >= 0 {
+			tokens = append(tokens, token{term: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{term: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+// tokenize returns the terms of text that are not stop words
+func (idx *Index) tokenize(text string) []string {
+	tokens := scanTokens(text)
+	terms := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		if _, stop := idx.stopWords[t.term]; !stop {
+			terms = append(terms, t.term)
+		}
+	}
+	return terms
+}
+
+// editDistance returns the Levenshtein distance between a and b in
+// characters, or max+1 if it is larger than max
+func editDistance(a, b string, max int) int {
+	x, y := []rune(a), []rune(b)
+	if diff := len(x) - len(y); diff > max || -diff > max {
+		return max + 1
+	}
+
+	previous := make([]int, len(y)+1)
+	current := make([]int, len(y)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			rowMin = min(rowMin, current[j])
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		previous, current = current, previous
+	}
+	return previous[len(y)]
+}
+
+// runeCount is the number of characters of s
+func runeCount(s string) int {
+	return utf8.RuneCountInString(s)
+}
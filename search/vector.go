@@ -0,0 +1,265 @@
+package search
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+)
+
+// VectorAlgorithm is how the vectors of a VECTOR field are searched
+type VectorAlgorithm int
+
+const (
+	// FlatAlgorithm compares the query with every vector: exact, and linear
+	// in the number of documents
+	FlatAlgorithm VectorAlgorithm = iota
+	// HNSWAlgorithm walks a hierarchical navigable small world graph:
+	// approximate, and logarithmic in the number of documents
+	HNSWAlgorithm
+)
+
+var vectorAlgorithmNames = [...]string{
+	FlatAlgorithm: "FLAT",
+	HNSWAlgorithm: "HNSW",
+}
+
+func (a VectorAlgorithm) String() string {
+	return vectorAlgorithmNames[a]
+}
+
+// ParseVectorAlgorithm returns the algorithm with the given
+// (case-insensitive) name
+func ParseVectorAlgorithm(name string) (VectorAlgorithm, bool) {
+	for a, algorithmName := range vectorAlgorithmNames {
+		if strings.EqualFold(name, algorithmName) {
+			return VectorAlgorithm(a), true
+		}
+	}
+	return FlatAlgorithm, false
+}
+
+// DistanceMetric is how the distance between two vectors is measured. The
+// smaller the distance, the more similar the vectors.
+type DistanceMetric int
+
+const (
+	// L2Distance is the squared Euclidean distance
+	L2Distance DistanceMetric = iota
+	// IPDistance is 1 minus the inner product
+	IPDistance
+	// CosineDistance is 1 minus the cosine of the angle between the vectors
+	CosineDistance
+)
+
+var distanceMetricNames = [...]string{
+	L2Distance:     "L2",
+	IPDistance:     "IP",
+	CosineDistance: "COSINE",
+}
+
+func (m DistanceMetric) String() string {
+	return distanceMetricNames[m]
+}
+
+// ParseDistanceMetric returns the metric with the given (case-insensitive)
+// name
+func ParseDistanceMetric(name string) (DistanceMetric, bool) {
+	for m, metricName := range distanceMetricNames {
+		if strings.EqualFold(name, metricName) {
+			return DistanceMetric(m), true
+		}
+	}
+	return L2Distance, false
+}
+
+// Default HNSW parameters
+const (
+	DefaultM              = 16
+	DefaultEFConstruction = 200
+	DefaultEFRuntime      = 10
+)
+
+// VectorSpec describes a VECTOR field. Vectors are stored in the hash as
+// Dim little-endian FLOAT32 values.
+type VectorSpec struct {
+	Algorithm VectorAlgorithm
+	Dim       int
+	Metric    DistanceMetric
+	// M is the number of neighbors of each HNSW node (twice as many on the
+	// bottom layer), EFConstruction the number of candidates considered
+	// when inserting and EFRuntime when searching
+	M              int
+	EFConstruction int
+	EFRuntime      int
+}
+
+// decodeVector parses a FLOAT32 blob of dim values
+func decodeVector(blob string, dim int) ([]float32, bool) {
+	if len(blob) != 4*dim {
+		return nil, false
+	}
+	vector := make([]float32, dim)
+	for i := range vector {
+		bits := binary.LittleEndian.Uint32([]byte(blob[4*i : 4*i+4]))
+		vector[i] = math.Float32frombits(bits)
+		if math.IsNaN(float64(vector[i])) || math.IsInf(float64(vector[i]), 0) {
+			return nil, false
+		}
+	}
+	return vector, true
+}
+
+// prepare returns the form of vector the metric compares: a unit vector for
+// cosine distance, vector itself otherwise
+func (m DistanceMetric) prepare(vector []float32) []float32 {
+	if m != CosineDistance {
+		return vector
+	}
+	norm := 0.0
+	for _, x := range vector {
+		norm += float64(x) * float64(x)
+	}
+	if norm == 0 {
+		return vector
+	}
+	norm = math.Sqrt(norm)
+	unit := make([]float32, len(vector))
+	for i, x := range vector {
+		unit[i] = float32(float64(x) / norm)
+	}
+	return unit
+}
+
+// distance compares two vectors prepared for the metric
+func (m DistanceMetric) distance(a, b []float32) float64 {
+	sum := 0.0
+	if m == L2Distance {
+		for i := range a {
+			d := float64(a[i]) - float64(b[i])
+			sum += d * d
+		}
+		return sum
+	}
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return 1 - sum
+}
+
+// neighbor is a search result: a document and its distance to the query
+type neighbor struct {
+	key      string
+	distance float64
+}
+
+// vectorIndex finds the nearest vectors of a VECTOR field
+type vectorIndex interface {
+	add(key string, vector []float32)
+	remove(key string)
+	// search returns the k nearest documents to query, closest first. A
+	// non-nil filter restricts the results to its keys.
+	search(query []float32, k, ef int, filter keySet) []neighbor
+	// len returns the number of vectors indexed
+	len() int
+}
+
+func newVectorIndex(spec VectorSpec) vectorIndex {
+	if spec.Algorithm == HNSWAlgorithm {
+		return newHNSWIndex(spec)
+	}
+	return &flatIndex{metric: spec.Metric, vectors: make(map[string][]float32)}
+}
+
+// flatIndex is an exact vector index: every search is a linear scan
+type flatIndex struct {
+	metric  DistanceMetric
+	vectors map[string][]float32
+}
+
+func (f *flatIndex) add(key string, vector []float32) {
+	f.vectors[key] = f.metric.prepare(vector)
+}
+
+func (f *flatIndex) remove(key string) {
+	delete(f.vectors, key)
+}
+
+func (f *flatIndex) len() int {
+	return len(f.vectors)
+}
+
+func (f *flatIndex) search(query []float32, k, _ int, filter keySet) []neighbor {
+	query = f.metric.prepare(query)
+	nearest := &neighborHeap{farthestFirst: true}
+	consider := func(key string, vector []float32) {
+		heap.Push(nearest, neighbor{key, f.metric.distance(query, vector)})
+		if nearest.Len() > k {
+			heap.Pop(nearest)
+		}
+	}
+
+	if filter != nil && len(filter) < len(f.vectors) {
+		for key := range filter {
+			if vector, exists := f.vectors[key]; exists {
+				consider(key, vector)
+			}
+		}
+	} else {
+		for key, vector := range f.vectors {
+			if filter == nil || hasKey(filter, key) {
+				consider(key, vector)
+			}
+		}
+	}
+	return nearest.sorted()
+}
+
+func hasKey(keys keySet, key string) bool {
+	_, exists := keys[key]
+	return exists
+}
+
+// neighborHeap is a heap of neighbors, closest first or farthest first.
+// Equal distances are ordered by key so results are deterministic.
+type neighborHeap struct {
+	items         []neighbor
+	farthestFirst bool
+}
+
+func (h *neighborHeap) Len() int { return len(h.items) }
+
+func (h *neighborHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if a.distance != b.distance {
+		return (a.distance < b.distance) != h.farthestFirst
+	}
+	return (a.key < b.key) != h.farthestFirst
+}
+
+func (h *neighborHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *neighborHeap) Push(x interface{}) { h.items = append(h.items, x.(neighbor)) }
+
+func (h *neighborHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// sorted returns the neighbors closest first
+func (h *neighborHeap) sorted() []neighbor {
+	result := append([]neighbor(nil), h.items...)
+	sortNeighbors(result)
+	return result
+}
+
+func sortNeighbors(neighbors []neighbor) {
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].distance != neighbors[j].distance {
+			return neighbors[i].distance < neighbors[j].distance
+		}
+		return neighbors[i].key < neighbors[j].key
+	})
+}
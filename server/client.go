@@ -2,11 +2,15 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+
+	"Memora/client"
 )
 
 type Client struct {
@@ -16,7 +20,7 @@ type Client struct {
 }
 
 func NewClient(host, port string) (*Client, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
 	if err != nil {
 		return nil, err
 	}
@@ -33,18 +37,23 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) SendCommand(command []string) (interface{}, error) {
-	// Build RESP array
-	resp := fmt.Sprintf("*%d\r\n", len(command))
-	for _, arg := range command {
-		resp += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
-	}
-
-	_, err := c.writer.WriteString(resp)
-	if err != nil {
+	// Build RESP array. Arguments are written as they are so binary values
+	// (including CRLF) survive the round trip.
+	if _, err := fmt.Fprintf(c.writer, "*%d\r\n", len(command)); err != nil {
 		return nil, err
 	}
-	err = c.writer.Flush()
-	if err != nil {
+	for _, arg := range command {
+		if _, err := fmt.Fprintf(c.writer, "$%d\r\n", len(arg)); err != nil {
+			return nil, err
+		}
+		if _, err := c.writer.WriteString(arg); err != nil {
+			return nil, err
+		}
+		if _, err := c.writer.WriteString("\r\n"); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
 		return nil, err
 	}
 
@@ -67,7 +76,7 @@ func (c *Client) readResponse() (interface{}, error) {
 	case '+': // Simple string
 		return line[1:], nil
 	case '-': // Error
-		return nil, fmt.Errorf(line[1:])
+		return nil, errors.New(line[1:])
 	case ':': // Integer
 		return strconv.ParseInt(line[1:], 10, 64)
 	case '$': // Bulk string
@@ -80,7 +89,7 @@ func (c *Client) readResponse() (interface{}, error) {
 		}
 
 		data := make([]byte, length+2) // +2 for \r\n
-		_, err = c.reader.Read(data)
+		_, err = io.ReadFull(c.reader, data)
 		if err != nil {
 			return nil, err
 		}
@@ -185,7 +194,11 @@ func (c *Client) StartCLI() {
 		}
 
 		// Parse command
-		parts := strings.Fields(input)
+		parts, err := client.SplitArgs(input)
+		if err != nil {
+			fmt.Printf("(error) %v\n", err)
+			continue
+		}
 		result, err := c.SendCommand(parts)
 		if err != nil {
 			fmt.Printf("(error) %v\n", err)
@@ -195,7 +208,7 @@ func (c *Client) StartCLI() {
 		// Pretty print result
 		switch v := result.(type) {
 		case string:
-			fmt.Printf("\"%s\"\n", v)
+			fmt.Println(strconv.Quote(v))
 		case int64:
 			fmt.Printf("(integer) %d\n", v)
 		case []interface{}:
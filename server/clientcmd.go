@@ -0,0 +1,265 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"Memora/commands"
+)
+
+// client handles CLIENT, whose subcommands act on the connection itself
+func (s *Server) client(c *connection, args []string) {
+	if len(args) == 0 {
+		s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'client' command"))
+		return
+	}
+
+	sub := strings.ToUpper(args[0])
+	switch sub {
+	case "ID":
+		if len(args) != 1 {
+			s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'client|id' command"))
+			return
+		}
+		s.reply(c, c.id)
+	case "GETNAME":
+		if len(args) != 1 {
+			s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'client|getname' command"))
+			return
+		}
+		c.writeMu.Lock()
+		name := c.name
+		c.writeMu.Unlock()
+		if name == "" {
+			s.reply(c, nil)
+			return
+		}
+		s.reply(c, []byte(name))
+	case "SETNAME":
+		if len(args) != 2 {
+			s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'client|setname' command"))
+			return
+		}
+		if strings.ContainsAny(args[1], " \n") {
+			s.reply(c, commands.ErrorReply("ERR Client names cannot contain spaces, newlines or special characters."))
+			return
+		}
+		c.writeMu.Lock()
+		c.name = args[1]
+		c.writeMu.Unlock()
+		s.reply(c, "OK")
+	case "TRACKING":
+		if len(args) < 2 {
+			s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'client|tracking' command"))
+			return
+		}
+		s.reply(c, s.clientTracking(c, args[1:]))
+	case "CACHING":
+		if len(args) != 2 {
+			s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'client|caching' command"))
+			return
+		}
+		s.reply(c, s.clientCaching(c, args[1]))
+	case "GETREDIR":
+		if len(args) != 1 {
+			s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'client|getredir' command"))
+			return
+		}
+		s.tracker.mu.Lock()
+		state := c.tracking
+		s.tracker.mu.Unlock()
+		if !state.on {
+			s.reply(c, int64(-1))
+			return
+		}
+		s.reply(c, state.redirect)
+	case "TRACKINGINFO":
+		if len(args) != 1 {
+			s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'client|trackinginfo' command"))
+			return
+		}
+		s.reply(c, s.trackingInfo(c))
+	default:
+		s.reply(c, commands.ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[0])))
+	}
+}
+
+// clientTracking handles CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix
+// ...] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func (s *Server) clientTracking(c *connection, args []string) interface{} {
+	var on bool
+	switch strings.ToUpper(args[0]) {
+	case "ON":
+		on = true
+	case "OFF":
+	default:
+		return commands.ErrorReply("ERR syntax error")
+	}
+
+	var options trackingState
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return commands.ErrorReply("ERR syntax error")
+			}
+			id, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return commands.ErrorReply("ERR value is not an integer or out of range")
+			}
+			// Redirecting to itself is the same as not redirecting
+			if id != c.id {
+				if s.connection(id) == nil {
+					return commands.ErrorReply("ERR The client ID you want redirect to does not exist")
+				}
+				options.redirect = id
+			}
+			i++
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return commands.ErrorReply("ERR syntax error")
+			}
+			options.prefixes = append(options.prefixes, args[i+1])
+			i++
+		case "BCAST":
+			options.bcast = true
+		case "OPTIN":
+			options.optin = true
+		case "OPTOUT":
+			options.optout = true
+		case "NOLOOP":
+			options.noloop = true
+		default:
+			return commands.ErrorReply("ERR syntax error")
+		}
+	}
+
+	if !on {
+		s.tracker.disable(c)
+		return "OK"
+	}
+
+	s.tracker.mu.Lock()
+	current := c.tracking
+	s.tracker.mu.Unlock()
+
+	switch {
+	case current.on && current.bcast != options.bcast:
+		return commands.ErrorReply("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+	case len(options.prefixes) > 0 && !options.bcast:
+		return commands.ErrorReply("ERR PREFIX option requires BCAST mode to be enabled")
+	case options.optin && options.optout:
+		return commands.ErrorReply("ERR You can't use both OPTIN and OPTOUT")
+	case options.bcast && (options.optin || options.optout):
+		return commands.ErrorReply("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	case current.on && (current.optin != options.optin || current.optout != options.optout):
+		return commands.ErrorReply("ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+	}
+
+	// The prefixes of a connection must not overlap, or a key would be
+	// reported twice
+	prefixes := current.prefixes
+	if len(prefixes) == 1 && prefixes[0] == "" {
+		prefixes = nil
+	}
+	for i, prefix := range options.prefixes {
+		for _, other := range append(prefixes, options.prefixes[:i]...) {
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return commands.ErrorReply(fmt.Sprintf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, other))
+			}
+		}
+	}
+
+	s.tracker.enable(c, options)
+	return "OK"
+}
+
+// clientCaching handles CLIENT CACHING YES|NO, which picks whether the keys
+// read by the next command are tracked in OPTIN or OPTOUT mode
+func (s *Server) clientCaching(c *connection, arg string) interface{} {
+	s.tracker.mu.Lock()
+	state := c.tracking
+	s.tracker.mu.Unlock()
+
+	if !state.on || !state.optin && !state.optout {
+		return commands.ErrorReply("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	}
+	switch strings.ToUpper(arg) {
+	case "YES":
+		if !state.optin {
+			return commands.ErrorReply("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+		}
+		c.tracking.caching = "yes"
+	case "NO":
+		if !state.optout {
+			return commands.ErrorReply("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+		}
+		c.tracking.caching = "no"
+	default:
+		return commands.ErrorReply("ERR syntax error")
+	}
+	return "OK"
+}
+
+// endCaching ends the effect of CLIENT CACHING once the command following
+// it ran, or the transaction that command started
+func (s *Server) endCaching(c *connection, cmd string, args []string) {
+	if c.tracking.caching == "" || c.transaction.active {
+		return
+	}
+	if cmd == "CLIENT" && len(args) > 0 && strings.EqualFold(args[0], "CACHING") {
+		return
+	}
+	c.tracking.caching = ""
+}
+
+// trackingInfo is the reply of CLIENT TRACKINGINFO
+func (s *Server) trackingInfo(c *connection) interface{} {
+	s.tracker.mu.Lock()
+	state := c.tracking
+	s.tracker.mu.Unlock()
+
+	if !state.on {
+		return commands.Map{
+			"flags", []interface{}{"off"},
+			"redirect", int64(-1),
+			"prefixes", []interface{}{},
+		}
+	}
+
+	flags := []interface{}{"on"}
+	if state.bcast {
+		flags = append(flags, "bcast")
+	}
+	if state.optin {
+		flags = append(flags, "optin")
+	}
+	if state.optout {
+		flags = append(flags, "optout")
+	}
+	switch state.caching {
+	case "yes":
+		flags = append(flags, "caching-yes")
+	case "no":
+		flags = append(flags, "caching-no")
+	}
+	if state.noloop {
+		flags = append(flags, "noloop")
+	}
+	if s.tracker.redirectBroken(c) {
+		flags = append(flags, "broken_redirect")
+	}
+
+	prefixes := []interface{}{}
+	for _, prefix := range state.prefixes {
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return commands.Map{
+		"flags", flags,
+		"redirect", state.redirect,
+		"prefixes", prefixes,
+	}
+}
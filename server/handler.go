@@ -1 +1,234 @@
 package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"Memora/commands"
+	"Memora/pubsub"
+	"Memora/store"
+)
+
+// connection is the per-client state of a connection
+type connection struct {
+	id     int64
+	conn   net.Conn
+	writer *bufio.Writer
+	// writeMu serializes replies with messages pushed to subscribers
+	writeMu sync.Mutex
+	// protocol is the RESP version replies are written in, 2 unless the
+	// client switched with HELLO. It changes under writeMu.
+	protocol int
+	// name is set with HELLO SETNAME
+	name string
+
+	// subscriber is created on the first (P)SUBSCRIBE. Once it holds any
+	// subscription the connection is in subscriber mode.
+	subscriber *pubsub.Subscriber
+	closed     chan struct{}
+
+	// transaction is the state of MULTI/EXEC, see transaction.go
+	transaction transaction
+
+	// tracking is the state of CLIENT TRACKING, see tracking.go. pushes
+	// queues the invalidation messages sent to the connection, and is
+	// created on the first one.
+	tracking trackingState
+	pushes   chan commands.Push
+	pushOnce sync.Once
+}
+
+func newConnection(conn net.Conn, id int64) *connection {
+	return &connection{
+		id:       id,
+		conn:     conn,
+		writer:   bufio.NewWriter(conn),
+		protocol: 2,
+		closed:   make(chan struct{}),
+	}
+}
+
+// subscriberCommands are the commands allowed in subscriber mode
+var subscriberCommands = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true,
+	"PUNSUBSCRIBE": true, "SSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+	"PING": true, "QUIT": true,
+}
+
+// execute runs a command for the connection and writes its reply. It returns
+// false if the connection should be closed.
+func (s *Server) execute(c *connection, command []string) bool {
+	cmd := strings.ToUpper(command[0])
+	args := command[1:]
+
+	if cmd == "QUIT" {
+		s.reply(c, "OK")
+		return false
+	}
+
+	// RESP3 sends published messages as pushes, which can't be mistaken for
+	// replies, so only RESP2 connections are restricted in subscriber mode
+	if c.protocol == 2 && s.subscribed(c) {
+		if !subscriberCommands[cmd] {
+			s.reply(c, commands.ErrorReply(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(cmd))))
+			return true
+		}
+		if cmd == "PING" {
+			message := ""
+			if len(args) > 0 {
+				message = args[0]
+			}
+			s.reply(c, []interface{}{"pong", message})
+			return true
+		}
+	}
+
+	s.trackCommand(c, cmd, command)
+	defer s.endCaching(c, cmd, args)
+
+	if s.transactionCommand(c, cmd, command) {
+		return true
+	}
+
+	switch cmd {
+	case "HELLO":
+		s.hello(c, args)
+	case "CLIENT":
+		s.client(c, args)
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE":
+		if len(args) == 0 {
+			s.reply(c, commands.ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))))
+			return true
+		}
+		if cmd == "SSUBSCRIBE" && !sameSlot(args) {
+			s.reply(c, commands.ErrorReply("CROSSSLOT Keys in request don't hash to the same slot"))
+			return true
+		}
+		s.subscribe(c, cmd, args)
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE":
+		s.unsubscribe(c, cmd, args)
+	default:
+		s.reply(c, s.commandHandler.HandleCommandAs(c.writerID(), command))
+	}
+	return true
+}
+
+func (s *Server) reply(c *connection, result interface{}) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	s.writeResponse(c.writer, result, c.protocol)
+}
+
+func (s *Server) subscribed(c *connection) bool {
+	return c.subscriber != nil && s.hub.Count(c.subscriber) > 0
+}
+
+func (s *Server) subscribe(c *connection, cmd string, channels []string) {
+	if c.subscriber == nil {
+		// Invalidations redirected to the connection check its
+		// subscriptions under writeMu
+		c.writeMu.Lock()
+		c.subscriber = s.hub.NewSubscriber()
+		c.writeMu.Unlock()
+		go s.forwardMessages(c)
+	}
+
+	// A message published as soon as the subscription exists must not reach
+	// the client before the confirmation: forwardMessages writes under
+	// writeMu too, so holding it until the confirmations are written keeps
+	// the messages queued until then
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var subscriptions []pubsub.Subscription
+	switch cmd {
+	case "SUBSCRIBE":
+		subscriptions = s.hub.Subscribe(c.subscriber, channels...)
+	case "PSUBSCRIBE":
+		subscriptions = s.hub.PSubscribe(c.subscriber, channels...)
+	default:
+		subscriptions = s.hub.SSubscribe(c.subscriber, channels...)
+	}
+	for _, subscription := range subscriptions {
+		s.writeResponse(c.writer, commands.Push{strings.ToLower(cmd), subscription.Name, subscription.Count}, c.protocol)
+	}
+}
+
+func (s *Server) unsubscribe(c *connection, cmd string, channels []string) {
+	var subscriptions []pubsub.Subscription
+	if c.subscriber != nil {
+		switch cmd {
+		case "UNSUBSCRIBE":
+			subscriptions = s.hub.Unsubscribe(c.subscriber, channels...)
+		case "PUNSUBSCRIBE":
+			subscriptions = s.hub.PUnsubscribe(c.subscriber, channels...)
+		default:
+			subscriptions = s.hub.SUnsubscribe(c.subscriber, channels...)
+		}
+	}
+
+	if len(subscriptions) == 0 {
+		// Nothing to unsubscribe from still gets one reply
+		count := 0
+		if c.subscriber != nil && cmd == "SUNSUBSCRIBE" {
+			count = s.hub.ShardCount(c.subscriber)
+		} else if c.subscriber != nil {
+			count = s.hub.Count(c.subscriber) - s.hub.ShardCount(c.subscriber)
+		}
+		s.reply(c, commands.Push{strings.ToLower(cmd), nil, count})
+		return
+	}
+	for _, subscription := range subscriptions {
+		s.reply(c, commands.Push{strings.ToLower(cmd), subscription.Name, subscription.Count})
+	}
+}
+
+// sameSlot reports whether shard channels all map to the same hash slot, as
+// SSUBSCRIBE requires so that a cluster node can serve them all
+func sameSlot(channels []string) bool {
+	for _, channel := range channels[1:] {
+		if store.KeySlot(channel) != store.KeySlot(channels[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardMessages pushes published messages to the client until the
+// connection closes. A subscriber that fell too far behind is disconnected.
+func (s *Server) forwardMessages(c *connection) {
+	sub := c.subscriber
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-sub.Done():
+			c.conn.Close()
+			return
+		case msg := <-sub.Messages():
+			switch {
+			case msg.Shard:
+				s.reply(c, commands.Push{"smessage", msg.Channel, msg.Payload})
+			case msg.Pattern != "":
+				s.reply(c, commands.Push{"pmessage", msg.Pattern, msg.Channel, msg.Payload})
+			default:
+				s.reply(c, commands.Push{"message", msg.Channel, msg.Payload})
+			}
+		}
+	}
+}
+
+// closeConnection releases the connection's subscriptions, watched and
+// tracked keys
+func (s *Server) closeConnection(c *connection) {
+	close(c.closed)
+	s.unwatch(c)
+	s.tracker.disable(c)
+	if c.subscriber != nil {
+		s.hub.Close(c.subscriber)
+	}
+}
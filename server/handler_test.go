@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSubscribeConfirmedBeforeMessages(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+
+	// Publish a message as soon as the first channel is subscribed to, while
+	// the confirmations are still being written
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for s.hub.Publish("a", []byte("hello")) == 0 {
+			time.Sleep(10 * time.Microsecond)
+		}
+	}()
+
+	channels := []string{"a", "b", "c", "d", "e", "f"}
+	command := fmt.Sprintf("*%d\r\n$9\r\nSUBSCRIBE\r\n", len(channels)+1)
+	for _, channel := range channels {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(channel), channel)
+	}
+	if _, err := c.conn.Write([]byte(command)); err != nil {
+		t.Fatal(err)
+	}
+	for i, channel := range channels {
+		if got, want := c.read().String(), fmt.Sprintf("[subscribe, %s, %d]", channel, i+1); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+		// Leave the message time to be forwarded between confirmations
+		<-published
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := c.read().String(); got != "[message, a, hello]" {
+		t.Fatalf("got %s after the confirmations, want the message", got)
+	}
+}
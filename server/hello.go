@@ -0,0 +1,71 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"Memora/commands"
+)
+
+// serverVersion is the Redis version whose commands and protocol Memora
+// follows, reported by HELLO for clients that check it
+const serverVersion = "7.2.0"
+
+// hello handles HELLO [protover [AUTH username password] [SETNAME name]],
+// which switches the connection to RESP2 or RESP3 and describes the server.
+// Memora has no users, so AUTH only accepts the default user, with any
+// password.
+func (s *Server) hello(c *connection, args []string) {
+	protocol := c.protocol
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			s.reply(c, commands.ErrorReply("ERR Protocol version is not an integer or out of range"))
+			return
+		}
+		if version != 2 && version != 3 {
+			s.reply(c, commands.ErrorReply("NOPROTO unsupported protocol version"))
+			return
+		}
+		protocol = version
+	}
+
+	name, setName := "", false
+	for i := 1; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "AUTH") && i+2 < len(args):
+			if args[i+1] != "default" {
+				s.reply(c, commands.ErrorReply("WRONGPASS invalid username-password pair or user is disabled."))
+				return
+			}
+			i += 2
+		case strings.EqualFold(args[i], "SETNAME") && i+1 < len(args):
+			name, setName = args[i+1], true
+			if strings.ContainsAny(name, " \n") {
+				s.reply(c, commands.ErrorReply("ERR Client names cannot contain spaces, newlines or special characters."))
+				return
+			}
+			i++
+		default:
+			s.reply(c, commands.ErrorReply("ERR Syntax error in HELLO option '"+args[i]+"'"))
+			return
+		}
+	}
+
+	c.writeMu.Lock()
+	c.protocol = protocol
+	if setName {
+		c.name = name
+	}
+	c.writeMu.Unlock()
+
+	s.reply(c, commands.Map{
+		"server", "memora",
+		"version", serverVersion,
+		"proto", int64(protocol),
+		"id", c.id,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []interface{}{},
+	})
+}
@@ -6,12 +6,25 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"strconv"
 )
 
 var (
-	ErrInvalidFormat = errors.New("invalid RESP format")
-	ErrEmptyCommand  = errors.New("empty command")
+	ErrInvalidFormat      = errors.New("invalid RESP format")
+	ErrEmptyCommand       = errors.New("empty command")
+	ErrInvalidBulkLength  = errors.New("invalid bulk length")
+	ErrInvalidArrayLength = errors.New("invalid multibulk length")
+)
+
+const (
+	// MaxBulkLength is the largest bulk string accepted from clients (512 MB)
+	MaxBulkLength = 512 * 1024 * 1024
+	// MaxArrayLength is the largest number of elements accepted in an array
+	MaxArrayLength = 1024 * 1024 * 1024
+	// MaxNesting is how deeply aggregates may nest in a decoded value
+	MaxNesting = 32
 )
 
 type RESPType byte
@@ -22,14 +35,35 @@ const (
 	Integer      RESPType = ':'
 	BulkString   RESPType = '$'
 	Array        RESPType = '*'
+
+	// RESP3 types
+	Null           RESPType = '_'
+	Double         RESPType = ','
+	Boolean        RESPType = '#'
+	BigNumber      RESPType = '('
+	BlobError      RESPType = '!'
+	VerbatimString RESPType = '='
+	Map            RESPType = '%'
+	Set            RESPType = '~'
+	Attribute      RESPType = '|'
+	Push           RESPType = '>'
 )
 
+// RESPValue is a decoded value. Simple holds simple strings, errors and big
+// numbers; Bulk holds bulk strings, blob errors and verbatim strings, whose
+// format is in Format; Array holds the elements of arrays, sets and pushes,
+// and the alternating keys and values of maps. Attributes are the
+// alternating keys and values of an attribute sent ahead of the value.
 type RESPValue struct {
-	Type    RESPType
-	Simple  string
-	Integer int64
-	Bulk    []byte
-	Array   []*RESPValue
+	Type       RESPType
+	Simple     string
+	Integer    int64
+	Double     float64
+	Boolean    bool
+	Bulk       []byte
+	Format     string
+	Array      []*RESPValue
+	Attributes []*RESPValue
 }
 
 func (v *RESPValue) String() string {
@@ -40,14 +74,26 @@ func (v *RESPValue) String() string {
 		return v.Simple
 	case Integer:
 		return strconv.FormatInt(v.Integer, 10)
-	case BulkString:
+	case BulkString, BlobError, VerbatimString:
 		return string(v.Bulk)
-	case Array:
+	case BigNumber:
+		return v.Simple
+	case Double:
+		return formatDouble(v.Double)
+	case Boolean:
+		return strconv.FormatBool(v.Boolean)
+	case Null:
+		return "(nil)"
+	case Array, Set, Push, Map:
 		var buf bytes.Buffer
 		buf.WriteString("[")
 		for i, item := range v.Array {
 			if i > 0 {
-				buf.WriteString(", ")
+				if v.Type == Map && i%2 == 1 {
+					buf.WriteString(": ")
+				} else {
+					buf.WriteString(", ")
+				}
 			}
 			buf.WriteString(item.String())
 		}
@@ -64,43 +110,90 @@ func NewRESPProtocol() *RESPProtocol {
 	return &RESPProtocol{}
 }
 
+// ReadCommand reads a command sent by a client: an array of bulk strings.
+// Nothing else is accepted, so a request can't nest values to make the
+// server recurse.
 func (r *RESPProtocol) ReadCommand(reader *bufio.Reader) ([]string, error) {
-	value, err := r.readValue(reader)
+	line, err := readLine(reader)
 	if err != nil {
 		return nil, err
 	}
-
-	if value.Type != Array {
+	if RESPType(line[0]) != Array {
 		return nil, ErrInvalidFormat
 	}
-
-	if len(value.Array) == 0 {
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	if length < -1 || length > MaxArrayLength {
+		return nil, ErrInvalidArrayLength
+	}
+	if length <= 0 {
 		return nil, ErrEmptyCommand
 	}
 
-	command := make([]string, len(value.Array))
-	for i, arg := range value.Array {
-		if arg.Type != BulkString {
+	// Grow as arguments arrive rather than trusting the declared length
+	command := make([]string, 0, min(length, 1024))
+	for i := 0; i < length; i++ {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if RESPType(line[0]) != BulkString {
 			return nil, ErrInvalidFormat
 		}
-		command[i] = string(arg.Bulk)
+		arg, err := readBulk(reader, line)
+		if err != nil {
+			return nil, err
+		}
+		command = append(command, string(arg))
 	}
-
 	return command, nil
 }
 
-func (r *RESPProtocol) readValue(reader *bufio.Reader) (*RESPValue, error) {
+// readLine reads a line terminated by CRLF and returns it without the CRLF.
+// The line is never empty.
+func readLine(reader *bufio.Reader) ([]byte, error) {
 	line, err := reader.ReadBytes('\n')
 	if err != nil {
 		return nil, err
 	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrInvalidFormat
+	}
+	return line[:len(line)-2], nil
+}
 
-	if len(line) < 2 {
+// readBulk reads the payload of a bulk string whose header line is line,
+// followed by its CRLF. Null bulk strings are not accepted.
+func readBulk(reader *bufio.Reader, line []byte) ([]byte, error) {
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
 		return nil, ErrInvalidFormat
 	}
+	if length < 0 || length > MaxBulkLength {
+		return nil, ErrInvalidBulkLength
+	}
+	data := make([]byte, length+2) // +2 for \r\n
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return nil, ErrInvalidFormat
+	}
+	return data[:length], nil
+}
 
-	// Remove \r\n
-	line = line[:len(line)-2]
+// readValue decodes any RESP2 or RESP3 value, such as a reply. depth is the
+// number of aggregates it is nested in.
+func (r *RESPProtocol) readValue(reader *bufio.Reader, depth int) (*RESPValue, error) {
+	if depth > MaxNesting {
+		return nil, ErrInvalidFormat
+	}
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
 
 	switch RESPType(line[0]) {
 	case SimpleString:
@@ -114,21 +207,14 @@ func (r *RESPProtocol) readValue(reader *bufio.Reader) (*RESPValue, error) {
 		}
 		return &RESPValue{Type: Integer, Integer: num}, nil
 	case BulkString:
-		length, err := strconv.Atoi(string(line[1:]))
-		if err != nil {
-			return nil, ErrInvalidFormat
-		}
-
-		if length == -1 {
+		if string(line[1:]) == "-1" {
 			return &RESPValue{Type: BulkString, Bulk: nil}, nil // Null bulk string
 		}
-
-		data := make([]byte, length+2) // +2 for \r\n
-		if _, err := io.ReadFull(reader, data); err != nil {
+		data, err := readBulk(reader, line)
+		if err != nil {
 			return nil, err
 		}
-
-		return &RESPValue{Type: BulkString, Bulk: data[:length]}, nil
+		return &RESPValue{Type: BulkString, Bulk: data}, nil
 	case Array:
 		length, err := strconv.Atoi(string(line[1:]))
 		if err != nil {
@@ -138,17 +224,83 @@ func (r *RESPProtocol) readValue(reader *bufio.Reader) (*RESPValue, error) {
 		if length == -1 {
 			return &RESPValue{Type: Array, Array: nil}, nil // Null array
 		}
+		if length < -1 || length > MaxArrayLength {
+			return nil, ErrInvalidArrayLength
+		}
 
-		array := make([]*RESPValue, length)
+		// Grow as elements arrive rather than trusting the declared length
+		array := make([]*RESPValue, 0, min(length, 1024))
 		for i := 0; i < length; i++ {
-			value, err := r.readValue(reader)
+			value, err := r.readValue(reader, depth+1)
 			if err != nil {
 				return nil, err
 			}
-			array[i] = value
+			array = append(array, value)
 		}
 
 		return &RESPValue{Type: Array, Array: array}, nil
+	case Null:
+		if len(line) != 1 {
+			return nil, ErrInvalidFormat
+		}
+		return &RESPValue{Type: Null}, nil
+	case Double:
+		num, err := parseDouble(string(line[1:]))
+		if err != nil {
+			return nil, ErrInvalidFormat
+		}
+		return &RESPValue{Type: Double, Double: num}, nil
+	case Boolean:
+		if len(line) != 2 || line[1] != 't' && line[1] != 'f' {
+			return nil, ErrInvalidFormat
+		}
+		return &RESPValue{Type: Boolean, Boolean: line[1] == 't'}, nil
+	case BigNumber:
+		digits := string(line[1:])
+		if _, ok := new(big.Int).SetString(digits, 10); !ok {
+			return nil, ErrInvalidFormat
+		}
+		return &RESPValue{Type: BigNumber, Simple: digits}, nil
+	case BlobError, VerbatimString:
+		data, err := readBulk(reader, line)
+		if err != nil {
+			return nil, err
+		}
+		value := &RESPValue{Type: RESPType(line[0]), Bulk: data}
+		if value.Type == VerbatimString {
+			// The text is preceded by its three letter format and a colon
+			if len(data) < 4 || data[3] != ':' {
+				return nil, ErrInvalidFormat
+			}
+			value.Format, value.Bulk = string(data[:3]), data[4:]
+		}
+		return value, nil
+	case Map, Set, Push, Attribute:
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length < 0 || length > MaxArrayLength {
+			return nil, ErrInvalidArrayLength
+		}
+		if RESPType(line[0]) == Map || RESPType(line[0]) == Attribute {
+			length *= 2
+		}
+		elements := make([]*RESPValue, 0, min(length, 1024))
+		for i := 0; i < length; i++ {
+			element, err := r.readValue(reader, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+		if RESPType(line[0]) == Attribute {
+			// An attribute describes the value that follows it
+			value, err := r.readValue(reader, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			value.Attributes = elements
+			return value, nil
+		}
+		return &RESPValue{Type: RESPType(line[0]), Array: elements}, nil
 	default:
 		return nil, ErrInvalidFormat
 	}
@@ -209,6 +361,12 @@ func (r *RESPProtocol) WriteNull(writer *bufio.Writer) error {
 	return writer.Flush()
 }
 
+// WriteArrayHeader starts an array of n values, which the caller writes next
+func (r *RESPProtocol) WriteArrayHeader(writer *bufio.Writer, n int) error {
+	_, err := writer.WriteString(fmt.Sprintf("*%d\r\n", n))
+	return err
+}
+
 func (r *RESPProtocol) WriteArray(writer *bufio.Writer, values []interface{}) error {
 	if values == nil {
 		_, err := writer.WriteString("*-1\r\n")
@@ -231,6 +389,8 @@ func (r *RESPProtocol) WriteArray(writer *bufio.Writer, values []interface{}) er
 				err = r.WriteInteger(writer, int64(v))
 			case int64:
 				err = r.WriteInteger(writer, v)
+			case []interface{}:
+				err = r.WriteArray(writer, v)
 			case nil:
 				err = r.WriteNull(writer)
 			default:
@@ -244,3 +404,113 @@ func (r *RESPProtocol) WriteArray(writer *bufio.Writer, values []interface{}) er
 	}
 	return writer.Flush()
 }
+
+// WriteNullRESP3 writes the RESP3 null, which replaces both the null bulk
+// string and the null array of RESP2
+func (r *RESPProtocol) WriteNullRESP3(writer *bufio.Writer) error {
+	_, err := writer.WriteString("_\r\n")
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// WriteNullArray writes the RESP2 null array
+func (r *RESPProtocol) WriteNullArray(writer *bufio.Writer) error {
+	_, err := writer.WriteString("*-1\r\n")
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// WriteMapHeader starts a map of n key-value pairs, which the caller writes
+// next, key first
+func (r *RESPProtocol) WriteMapHeader(writer *bufio.Writer, n int) error {
+	_, err := writer.WriteString(fmt.Sprintf("%%%d\r\n", n))
+	return err
+}
+
+// WriteSetHeader starts a set of n values, which the caller writes next
+func (r *RESPProtocol) WriteSetHeader(writer *bufio.Writer, n int) error {
+	_, err := writer.WriteString(fmt.Sprintf("~%d\r\n", n))
+	return err
+}
+
+// WritePushHeader starts a push message of n values, which the caller
+// writes next
+func (r *RESPProtocol) WritePushHeader(writer *bufio.Writer, n int) error {
+	_, err := writer.WriteString(fmt.Sprintf(">%d\r\n", n))
+	return err
+}
+
+// WriteAttributeHeader starts an attribute of n key-value pairs. The caller
+// writes them, then the value they describe.
+func (r *RESPProtocol) WriteAttributeHeader(writer *bufio.Writer, n int) error {
+	_, err := writer.WriteString(fmt.Sprintf("|%d\r\n", n))
+	return err
+}
+
+func (r *RESPProtocol) WriteDouble(writer *bufio.Writer, value float64) error {
+	_, err := writer.WriteString(fmt.Sprintf(",%s\r\n", formatDouble(value)))
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func (r *RESPProtocol) WriteBoolean(writer *bufio.Writer, value bool) error {
+	b := "f"
+	if value {
+		b = "t"
+	}
+	_, err := writer.WriteString(fmt.Sprintf("#%s\r\n", b))
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// WriteBigNumber writes an integer given in decimal
+func (r *RESPProtocol) WriteBigNumber(writer *bufio.Writer, digits string) error {
+	_, err := writer.WriteString(fmt.Sprintf("(%s\r\n", digits))
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// WriteVerbatimString writes text with its three letter format, such as txt
+func (r *RESPProtocol) WriteVerbatimString(writer *bufio.Writer, format, text string) error {
+	_, err := writer.WriteString(fmt.Sprintf("=%d\r\n%s:%s\r\n", len(format)+1+len(text), format, text))
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// formatDouble formats a double the way RESP3 spells it, with inf, -inf and
+// nan for the special values
+func formatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
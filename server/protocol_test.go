@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"Memora/commands"
+)
+
+func readCommand(input string) ([]string, error) {
+	return NewRESPProtocol().ReadCommand(bufio.NewReader(strings.NewReader(input)))
+}
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		err   error
+	}{
+		{"command", "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", []string{"GET", "key"}, nil},
+		{"empty argument", "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", []string{"ECHO", ""}, nil},
+		{"binary argument", "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n", []string{"ECHO", "a\r\nb"}, nil},
+		{"empty array", "*0\r\n", nil, ErrEmptyCommand},
+		{"null array", "*-1\r\n", nil, ErrEmptyCommand},
+		{"negative array length", "*-2\r\n", nil, ErrInvalidArrayLength},
+		{"not an array", "$3\r\nGET\r\n", nil, ErrInvalidFormat},
+		{"nested array", "*1\r\n*1\r\n$3\r\nGET\r\n", nil, ErrInvalidFormat},
+		{"nested map", "*1\r\n%1\r\n$1\r\na\r\n$1\r\nb\r\n", nil, ErrInvalidFormat},
+		{"integer argument", "*1\r\n:1\r\n", nil, ErrInvalidFormat},
+		{"null bulk argument", "*1\r\n$-1\r\n", nil, ErrInvalidBulkLength},
+		{"bulk too long", "*1\r\n$536870913\r\n", nil, ErrInvalidBulkLength},
+		{"missing CRLF after payload", "*1\r\n$3\r\nGETxx", nil, ErrInvalidFormat},
+		{"LF without CR", "*1\n$3\nGET\n", nil, ErrInvalidFormat},
+		{"bad length", "*x\r\n", nil, ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, err := readCommand(tt.input)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if strings.Join(command, "|") != strings.Join(tt.want, "|") || len(command) != len(tt.want) {
+				t.Fatalf("got %q, want %q", command, tt.want)
+			}
+		})
+	}
+}
+
+// A deeply nested request is rejected at the first nested element instead
+// of making the parser recurse
+func TestReadCommandDeepNesting(t *testing.T) {
+	input := strings.Repeat("*1\r\n", 1_000_000) + "$1\r\na\r\n"
+	if _, err := readCommand(input); !errors.Is(err, ErrInvalidFormat) {
+		t.Fatalf("error %v, want %v", err, ErrInvalidFormat)
+	}
+}
+
+func TestReadValueNestingLimit(t *testing.T) {
+	for _, prefix := range []string{"*1\r\n", "%1\r\n$1\r\nk\r\n", ">1\r\n", "|1\r\n$1\r\nk\r\n$1\r\nv\r\n"} {
+		input := strings.Repeat(prefix, MaxNesting+10) + ":1\r\n"
+		_, err := NewRESPProtocol().readValue(bufio.NewReader(strings.NewReader(input)), 0)
+		if !errors.Is(err, ErrInvalidFormat) {
+			t.Errorf("%q nested: error %v, want %v", prefix, err, ErrInvalidFormat)
+		}
+	}
+
+	input := strings.Repeat("*1\r\n", MaxNesting) + ":1\r\n"
+	if _, err := NewRESPProtocol().readValue(bufio.NewReader(strings.NewReader(input)), 0); err != nil {
+		t.Errorf("%d levels: %v", MaxNesting, err)
+	}
+}
+
+// Only an ErrorReply is written as an error: a status reply stays a status
+// reply whatever it starts with
+func TestWriteErrorReplies(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	tests := []struct {
+		name  string
+		reply interface{}
+		want  string
+	}{
+		{"status", "OK", "+OK\r\n"},
+		{"status with an error code", "ERR not an error", "+ERR not an error\r\n"},
+		{"error", commands.ErrorReply("ERR syntax error"), "-ERR syntax error\r\n"},
+		{"nested error", []interface{}{"a", commands.ErrorReply("WRONGTYPE x")}, "*2\r\n$1\r\na\r\n-WRONGTYPE x\r\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		s.writeResponse(writer, tt.reply, 2)
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrote %q, want %q", tt.name, buf.String(), tt.want)
+		}
+	}
+}
+
+// payload is a reproducible stream of random bytes
+func payload(seed uint64, size int) io.Reader {
+	return io.LimitReader(rand.NewChaCha8(seedBytes(seed)), int64(size))
+}
+
+func seedBytes(seed uint64) [32]byte {
+	var s [32]byte
+	binary.LittleEndian.PutUint64(s[:], seed)
+	return s
+}
+
+// startConnection serves a connection of a fresh server over an in-memory
+// pipe and returns the client end
+func startConnection(t testing.TB) net.Conn {
+	t.Helper()
+	s := NewServer("127.0.0.1", "0")
+	client, conn := net.Pipe()
+	go s.handleConnection(conn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// roundTrip stores a random payload with SET and reads it back with GET,
+// streaming both ways so that the test itself holds no copy of it
+func roundTrip(t testing.TB, conn net.Conn, seed uint64, size int) {
+	t.Helper()
+
+	sent := sha256.New()
+	errs := make(chan error, 1)
+	go func() {
+		w := bufio.NewWriter(conn)
+		fmt.Fprintf(w, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$%d\r\n", size)
+		if _, err := io.Copy(io.MultiWriter(w, sent), payload(seed, size)); err != nil {
+			errs <- err
+			return
+		}
+		w.WriteString("\r\n*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")
+		errs <- w.Flush()
+	}()
+
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || line != "+OK\r\n" {
+		t.Fatalf("SET of %d bytes: %q, %v", size, line, err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != fmt.Sprintf("$%d\r\n", size) {
+		t.Fatalf("GET of %d bytes: header %q, %v", size, line, err)
+	}
+	received := sha256.New()
+	if _, err := io.CopyN(received, r, int64(size)); err != nil {
+		t.Fatalf("GET of %d bytes: %v", size, err)
+	}
+	if crlf := make([]byte, 2); func() bool { _, err := io.ReadFull(r, crlf); return err != nil }() || string(crlf) != "\r\n" {
+		t.Fatalf("GET of %d bytes: missing CRLF after the payload", size)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent.Sum(nil), received.Sum(nil)) {
+		t.Fatalf("payload of %d bytes came back changed", size)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	conn := startConnection(t)
+	sizes := []int{0, 1, 2, 255, 4096, 65536, 1 << 20, 16 << 20}
+	random := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 20; i++ {
+		sizes = append(sizes, random.IntN(1<<16))
+	}
+	for i, size := range sizes {
+		roundTrip(t, conn, uint64(i), size)
+	}
+}
+
+// Every byte value, CRLF sequences and invalid UTF-8 survive as they are
+func TestBinaryRoundTripSpecialBytes(t *testing.T) {
+	conn := startConnection(t)
+	values := [][]byte{
+		[]byte("\r\n"), []byte("a\r\nb\r\n"), []byte("$3\r\nfoo\r\n"), {0}, {0xff, 0xfe, 0}, []byte("*1\r\n"),
+	}
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	values = append(values, all)
+
+	w, r := bufio.NewWriter(conn), bufio.NewReader(conn)
+	protocol := NewRESPProtocol()
+	for _, value := range values {
+		// net.Pipe is unbuffered, so the commands are written while the
+		// replies are read
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			fmt.Fprintf(w, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$%d\r\n%s\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", len(value), value)
+			w.Flush()
+		}()
+		if reply, err := protocol.readValue(r, 0); err != nil || reply.Simple != "OK" {
+			t.Fatalf("SET %q: %v, %v", value, reply, err)
+		}
+		reply, err := protocol.readValue(r, 0)
+		if err != nil || !bytes.Equal(reply.Bulk, value) {
+			t.Fatalf("GET returned %v (%v), want %q", reply, err, value)
+		}
+		<-written
+	}
+}
+
+// The largest value a client may send, 512 MB, round-trips through the
+// server. It needs about 2 GB of memory, so it only runs with
+// MEMORA_LARGE_TESTS=1.
+func TestBinaryRoundTripMaxBulk(t *testing.T) {
+	if os.Getenv("MEMORA_LARGE_TESTS") != "1" {
+		t.Skip("skipping the 512 MB round trip, set MEMORA_LARGE_TESTS=1 to run it")
+	}
+	roundTrip(t, startConnection(t), 42, MaxBulkLength)
+}
+
+func TestBulkLongerThanMaxRejected(t *testing.T) {
+	conn := startConnection(t)
+	go fmt.Fprintf(conn, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$%d\r\n", MaxBulkLength+1)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "-ERR invalid bulk length") {
+		t.Fatalf("got %q, %v", line, err)
+	}
+}
@@ -9,10 +9,12 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"Memora/commands"
+	"Memora/pubsub"
 	"Memora/store"
 )
 
@@ -23,24 +25,50 @@ type Server struct {
 	Store          *store.DataStore
 	commandHandler *commands.CommandHandler
 	protocol       *RESPProtocol
+	hub            *pubsub.Hub
 	clients        map[net.Conn]bool
 	mu             sync.RWMutex
 	shutdown       chan struct{}
+	// lastClientID numbers connections, from 1
+	lastClientID atomic.Int64
+	// connections are the open connections by ID, for CLIENT TRACKING
+	// REDIRECT. They are guarded by mu, like clients.
+	connections map[int64]*connection
+	// tracker remembers the keys clients cache, see tracking.go
+	tracker *tracker
 }
 
 func NewServer(host, port string) *Server {
 	dataStore := store.NewDataStore()
 	commandHandler := commands.NewCommandHandler(dataStore)
 
-	return &Server{
+	// Keyspace notifications are published on the same hub as clients use
+	hub := pubsub.NewHub()
+	dataStore.SetNotifier(func(channel string, message []byte) {
+		hub.Publish(channel, message)
+	})
+	commandHandler.SetHub(hub)
+
+	s := &Server{
 		host:           host,
 		port:           port,
 		Store:          dataStore,
 		commandHandler: commandHandler,
 		protocol:       NewRESPProtocol(),
+		hub:            hub,
 		clients:        make(map[net.Conn]bool),
+		connections:    make(map[int64]*connection),
 		shutdown:       make(chan struct{}),
 	}
+	s.tracker = newTracker(s)
+	dataStore.SetInvalidator(s.tracker)
+	return s
+}
+
+// Snapshot takes a snapshot of the store between two commands, see
+// commands.CommandHandler.Snapshot
+func (s *Server) Snapshot() (store.Snapshot, bool) {
+	return s.commandHandler.Snapshot()
 }
 
 func (s *Server) Start() error {
@@ -55,6 +83,7 @@ func (s *Server) Start() error {
 
 	// Start background tasks
 	go s.cleanupExpiredKeys()
+	go s.rehashTables()
 	go s.handleSignals()
 
 	// Main event loop
@@ -84,15 +113,20 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
+	c := newConnection(conn, s.lastClientID.Add(1))
+	s.mu.Lock()
+	s.connections[c.id] = c
+	s.mu.Unlock()
 	defer func() {
 		s.mu.Lock()
 		delete(s.clients, conn)
+		delete(s.connections, c.id)
 		s.mu.Unlock()
+		s.closeConnection(c)
 		conn.Close()
 	}()
 
 	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
 
 	for {
 		// Set read timeout
@@ -106,7 +140,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
-			s.protocol.WriteError(writer, fmt.Sprintf("ERR %v", err))
+			s.reply(c, commands.ErrorReply(fmt.Sprintf("ERR %v", err)))
 			return
 		}
 
@@ -120,32 +154,141 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
-		result := s.commandHandler.HandleCommand(command)
-		s.writeResponse(writer, result)
+		if !s.execute(c, command) {
+			return
+		}
 	}
 }
 
-func (s *Server) writeResponse(writer *bufio.Writer, result interface{}) {
+// connection returns the open connection with the given ID, or nil
+func (s *Server) connection(id int64) *connection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.connections[id]
+}
+
+// writeResponse writes a reply in the protocol version the connection
+// negotiated, 2 or 3
+func (s *Server) writeResponse(writer *bufio.Writer, result interface{}, protocol int) {
+	s.writeValue(writer, result, protocol, false)
+	writer.Flush()
+}
+
+// writeValue writes one value of a reply. Nested strings are bulk strings:
+// only a whole reply can be a status or error reply.
+func (s *Server) writeValue(writer *bufio.Writer, result interface{}, protocol int, nested bool) {
+	resp3 := protocol == 3
 	switch v := result.(type) {
 	case string:
-		s.protocol.WriteSimpleString(writer, v)
+		// Values are always []byte, so a bare string is a status reply
+		if nested {
+			s.protocol.WriteBulkString(writer, []byte(v))
+		} else {
+			s.protocol.WriteSimpleString(writer, v)
+		}
+	case commands.ErrorReply:
+		s.protocol.WriteError(writer, string(v))
 	case []byte:
-		s.protocol.WriteBulkString(writer, v)
+		if v == nil && resp3 {
+			s.protocol.WriteNullRESP3(writer)
+		} else {
+			s.protocol.WriteBulkString(writer, v)
+		}
 	case int:
 		s.protocol.WriteInteger(writer, int64(v))
 	case int64:
 		s.protocol.WriteInteger(writer, v)
 	case []interface{}:
-		s.protocol.WriteArray(writer, v)
+		switch {
+		case v == nil && resp3:
+			s.protocol.WriteNullRESP3(writer)
+		case v == nil:
+			s.protocol.WriteNullArray(writer)
+		default:
+			s.protocol.WriteArrayHeader(writer, len(v))
+			s.writeElements(writer, v, protocol)
+		}
+	case replies:
+		// Each reply of EXEC keeps its type, so it is not nested
+		s.protocol.WriteArrayHeader(writer, len(v))
+		for _, reply := range v {
+			s.writeValue(writer, reply, protocol, false)
+		}
+	case commands.Map:
+		if resp3 {
+			s.protocol.WriteMapHeader(writer, len(v)/2)
+		} else {
+			s.protocol.WriteArrayHeader(writer, len(v))
+		}
+		s.writeElements(writer, v, protocol)
+	case commands.Set:
+		if resp3 {
+			s.protocol.WriteSetHeader(writer, len(v))
+		} else {
+			s.protocol.WriteArrayHeader(writer, len(v))
+		}
+		s.writeElements(writer, v, protocol)
+	case commands.Push:
+		if resp3 {
+			s.protocol.WritePushHeader(writer, len(v))
+		} else {
+			s.protocol.WriteArrayHeader(writer, len(v))
+		}
+		s.writeElements(writer, v, protocol)
+	case commands.Double:
+		if resp3 {
+			s.protocol.WriteDouble(writer, float64(v))
+		} else {
+			s.protocol.WriteBulkString(writer, []byte(formatDouble(float64(v))))
+		}
+	case commands.Bool:
+		switch {
+		case resp3:
+			s.protocol.WriteBoolean(writer, bool(v))
+		case bool(v):
+			s.protocol.WriteInteger(writer, 1)
+		default:
+			s.protocol.WriteInteger(writer, 0)
+		}
+	case commands.BigNumber:
+		if resp3 {
+			s.protocol.WriteBigNumber(writer, string(v))
+		} else {
+			s.protocol.WriteBulkString(writer, []byte(v))
+		}
+	case commands.Verbatim:
+		if resp3 {
+			s.protocol.WriteVerbatimString(writer, v.Format, v.Text)
+		} else {
+			s.protocol.WriteBulkString(writer, []byte(v.Text))
+		}
+	case commands.Attributed:
+		if resp3 {
+			s.protocol.WriteAttributeHeader(writer, len(v.Attributes)/2)
+			s.writeElements(writer, v.Attributes, protocol)
+		}
+		s.writeValue(writer, v.Value, protocol, nested)
 	case nil:
-		s.protocol.WriteNull(writer)
+		if resp3 {
+			s.protocol.WriteNullRESP3(writer)
+		} else {
+			s.protocol.WriteNull(writer)
+		}
 	default:
 		s.protocol.WriteBulkString(writer, []byte(fmt.Sprintf("%v", v)))
 	}
 }
 
+func (s *Server) writeElements(writer *bufio.Writer, elements []interface{}, protocol int) {
+	for _, element := range elements {
+		s.writeValue(writer, element, protocol, true)
+	}
+}
+
+// cleanupExpiredKeys runs an active expire cycle ten times a second, each
+// bounded to 25ms of CPU so expiry never causes a latency spike
 func (s *Server) cleanupExpiredKeys() {
-	ticker := time.NewTicker(1 * time.Minute)
+	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
 
 	for {
@@ -153,10 +296,23 @@ func (s *Server) cleanupExpiredKeys() {
 		case <-s.shutdown:
 			return
 		case <-ticker.C:
-			removed := s.Store.RemoveExpired()
-			if removed > 0 {
-				log.Printf("Cleaned up %d expired keys", removed)
-			}
+			s.Store.ActiveExpire(25 * time.Millisecond)
+		}
+	}
+}
+
+// rehashTables drives incremental rehashing in the background, spending at
+// most a millisecond per table every 100ms
+func (s *Server) rehashTables() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.Store.Rehash(time.Millisecond)
 		}
 	}
 }
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"Memora/commands"
+)
+
+// invalidationChannel is the channel RESP2 connections subscribe to when
+// they receive the invalidation messages of another connection (REDIRECT)
+const invalidationChannel = "__redis__:invalidate"
+
+// pushBuffer is how many invalidation messages may be queued for a
+// connection before it is considered too slow and disconnected
+const pushBuffer = 1024
+
+// trackingState is the CLIENT TRACKING state of a connection. It is guarded
+// by the tracker's mutex, except caching, which only the connection's own
+// goroutine uses.
+type trackingState struct {
+	on bool
+	// bcast connections are told about every key matching one of their
+	// prefixes, or every key if they have none, instead of the keys they read
+	bcast    bool
+	prefixes []string
+	// optin connections only track the keys read by the command following
+	// CLIENT CACHING YES, optout connections all but those read by the
+	// command following CLIENT CACHING NO
+	optin  bool
+	optout bool
+	noloop bool
+	// redirect is the ID of the connection invalidations are sent to, or 0
+	// to send them to this connection
+	redirect int64
+	// keys are the keys this connection is tracking, so they can be released
+	// when it stops
+	keys map[string]struct{}
+
+	// caching is "yes" or "no" from CLIENT CACHING until the next command
+	caching string
+}
+
+// tracker is the server side of client-side caching: it remembers which
+// connection read which key and tells it when the key is modified, so that
+// it can drop the value it cached. A key is only reported once: the
+// connection tracks it again when it reads it again.
+type tracker struct {
+	server *Server
+
+	mu sync.Mutex
+	// clients are the connections with tracking on, and active their number
+	clients map[*connection]struct{}
+	active  atomic.Int64
+	// keys maps every tracked key to the connections that read it
+	keys map[string]map[*connection]struct{}
+}
+
+func newTracker(s *Server) *tracker {
+	return &tracker{
+		server:  s,
+		clients: make(map[*connection]struct{}),
+		keys:    make(map[string]map[*connection]struct{}),
+	}
+}
+
+// enable turns tracking on for c, or updates its options if it already was
+func (t *tracker) enable(c *connection, options trackingState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := &c.tracking
+	if !state.on {
+		t.clients[c] = struct{}{}
+		t.active.Add(1)
+		state.on = true
+		state.bcast = options.bcast
+		state.optin = options.optin
+		state.optout = options.optout
+	}
+	state.noloop = options.noloop
+	state.redirect = options.redirect
+	state.prefixes = append(state.prefixes, options.prefixes...)
+	if state.bcast && len(state.prefixes) == 0 {
+		// Every key starts with the empty prefix
+		state.prefixes = []string{""}
+	}
+}
+
+// disable turns tracking off for c and forgets the keys it read
+func (t *tracker) disable(c *connection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !c.tracking.on {
+		return
+	}
+	for key := range c.tracking.keys {
+		t.forget(c, key)
+	}
+	delete(t.clients, c)
+	t.active.Add(-1)
+	c.tracking = trackingState{}
+}
+
+// forget stops tracking key for c. Callers must hold the mutex.
+func (t *tracker) forget(c *connection, key string) {
+	readers := t.keys[key]
+	delete(readers, c)
+	if len(readers) == 0 {
+		delete(t.keys, key)
+	}
+}
+
+// remember tracks keys for c, which is about to read them. Keys are
+// remembered before the read, so that a write racing with it is reported.
+func (t *tracker) remember(c *connection, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := &c.tracking
+	if !state.on || state.bcast {
+		return
+	}
+	if state.optin && state.caching != "yes" || state.optout && state.caching == "no" {
+		return
+	}
+	if state.keys == nil {
+		state.keys = make(map[string]struct{})
+	}
+	for _, key := range keys {
+		readers := t.keys[key]
+		if readers == nil {
+			readers = make(map[*connection]struct{})
+			t.keys[key] = readers
+		}
+		readers[c] = struct{}{}
+		state.keys[key] = struct{}{}
+	}
+}
+
+// KeyModified tells the connections that read key, and those broadcasting
+// a prefix of it, that it changed. A NOLOOP connection isn't told about its
+// own writes.
+func (t *tracker) KeyModified(key string, writer int64) {
+	if t.active.Load() == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for c := range t.keys[key] {
+		delete(c.tracking.keys, key)
+		if !c.ownWrite(writer) {
+			t.invalidate(c, []interface{}{key})
+		}
+	}
+	delete(t.keys, key)
+
+	for c := range t.clients {
+		if !c.tracking.bcast || c.ownWrite(writer) {
+			continue
+		}
+		for _, prefix := range c.tracking.prefixes {
+			if strings.HasPrefix(key, prefix) {
+				t.invalidate(c, []interface{}{key})
+				break
+			}
+		}
+	}
+}
+
+// KeysFlushed tells every tracking connection to drop everything it cached
+func (t *tracker) KeysFlushed() {
+	if t.active.Load() == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for c := range t.clients {
+		c.tracking.keys = nil
+		t.invalidate(c, nil)
+	}
+	t.keys = make(map[string]map[*connection]struct{})
+}
+
+// invalidate sends the invalidation of keys, nil meaning every key, to c or
+// to the connection it redirects to. If that connection is gone, c is told
+// its redirection broke. Callers must hold the mutex.
+func (t *tracker) invalidate(c *connection, keys []interface{}) {
+	target := c
+	if c.tracking.redirect != 0 {
+		target = t.server.connection(c.tracking.redirect)
+		if target == nil {
+			t.server.push(c, commands.Push{"tracking-redir-broken", c.tracking.redirect})
+			return
+		}
+	}
+	t.server.push(target, commands.Push{"invalidate", keys})
+}
+
+// ownWrite reports whether a write by writer is c's own and c asked not to
+// be told about those (NOLOOP). Callers must hold the mutex.
+func (c *connection) ownWrite(writer int64) bool {
+	return c.tracking.noloop && writer == c.id
+}
+
+// writerID is the ID the writes of c are attributed to: its own if it tracks
+// keys with NOLOOP, 0 otherwise. Only c's goroutine changes its tracking
+// state, so it may read it without the mutex.
+func (c *connection) writerID() int64 {
+	if c.tracking.on && c.tracking.noloop {
+		return c.id
+	}
+	return 0
+}
+
+// redirectBroken reports whether the connection c redirects to is gone
+func (t *tracker) redirectBroken(c *connection) bool {
+	t.mu.Lock()
+	redirect := c.tracking.redirect
+	t.mu.Unlock()
+
+	return redirect != 0 && t.server.connection(redirect) == nil
+}
+
+// trackCommand remembers the keys command reads, or those of the commands
+// EXEC is about to run, before the connection runs it. CLIENT CACHING only
+// applies to the command following it, or to the transaction it is in.
+func (s *Server) trackCommand(c *connection, cmd string, command []string) {
+	if s.tracker.active.Load() == 0 {
+		return
+	}
+
+	tx := &c.transaction
+	switch {
+	case cmd == "EXEC" && tx.active && !tx.aborted:
+		for _, queued := range tx.queued {
+			s.tracker.remember(c, commands.ReadKeys(queued))
+		}
+	case !tx.active:
+		s.tracker.remember(c, commands.ReadKeys(command))
+	}
+}
+
+// push queues an out-of-band message for c without blocking, since the
+// tracker calls it with store locks held. A connection that fell too far
+// behind is disconnected, like a slow subscriber.
+func (s *Server) push(c *connection, message commands.Push) {
+	c.pushOnce.Do(func() {
+		c.pushes = make(chan commands.Push, pushBuffer)
+		go s.forwardPushes(c)
+	})
+
+	select {
+	case c.pushes <- message:
+	default:
+		c.conn.Close()
+	}
+}
+
+// forwardPushes writes the messages queued by push until the connection
+// closes
+func (s *Server) forwardPushes(c *connection) {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case message := <-c.pushes:
+			s.writePush(c, message)
+		}
+	}
+}
+
+// writePush writes an invalidation message. RESP2 has no pushes, so a RESP2
+// connection only receives the invalidations redirected to it, as messages
+// published on __redis__:invalidate, once it subscribed to that channel.
+func (s *Server) writePush(c *connection, message commands.Push) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.protocol == 2 {
+		if message[0] != "invalidate" || c.subscriber == nil || !s.hub.Subscribed(c.subscriber, invalidationChannel) {
+			return
+		}
+		message = commands.Push{"message", invalidationChannel, message[1]}
+	}
+	s.writeResponse(c.writer, message, c.protocol)
+}
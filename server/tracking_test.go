@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClient is a RESP3 connection to a server, which sets aside the
+// pushes it receives while waiting for replies
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	pushes []string
+}
+
+func connect(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	client, conn := net.Pipe()
+	go s.handleConnection(conn)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &testClient{t: t, conn: client, reader: bufio.NewReader(client)}
+	c.do("HELLO", "3")
+	return c
+}
+
+// read returns the next value the server sent
+func (c *testClient) read() *RESPValue {
+	c.t.Helper()
+	value, err := NewRESPProtocol().readValue(c.reader, 0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return value
+}
+
+// do sends a command and returns its reply
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(command)); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		value := c.read()
+		if value.Type != Push {
+			return value.String()
+		}
+		c.pushes = append(c.pushes, value.String())
+	}
+}
+
+// nextPush returns the next push the server sent
+func (c *testClient) nextPush() string {
+	c.t.Helper()
+	if len(c.pushes) > 0 {
+		push := c.pushes[0]
+		c.pushes = c.pushes[1:]
+		return push
+	}
+	value := c.read()
+	if value.Type != Push {
+		c.t.Fatalf("got %s, want a push", value)
+	}
+	return value.String()
+}
+
+// expectInvalidation checks that the next push invalidates key. Pushes are
+// sent in order, so writing an unrelated tracked key and expecting its
+// invalidation proves that none was sent for the writes before it.
+func (c *testClient) expectInvalidation(key string) {
+	c.t.Helper()
+	if push, want := c.nextPush(), fmt.Sprintf("[invalidate, [%s]]", key); push != want {
+		c.t.Fatalf("got push %s, want %s", push, want)
+	}
+}
+
+func TestTrackingReportsOwnWrites(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+
+	c.do("CLIENT", "TRACKING", "ON")
+	c.do("GET", "k")
+	c.do("SET", "k", "v")
+	c.expectInvalidation("k")
+}
+
+func TestTrackingNoLoop(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+	other := connect(t, s)
+
+	if reply := c.do("CLIENT", "TRACKING", "ON", "NOLOOP"); reply != "OK" {
+		t.Fatal(reply)
+	}
+
+	tests := []struct {
+		name  string
+		write func()
+	}{
+		{"command", func() { c.do("SET", "k", "v") }},
+		{"transaction", func() {
+			c.do("MULTI")
+			c.do("INCR", "k")
+			c.do("EXEC")
+		}},
+		{"script", func() { c.do("EVAL", "return redis.call('DEL', KEYS[1])", "1", "k") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.do("GET", "k")
+			c.do("GET", "sentinel")
+			tt.write()
+			other.do("SET", "sentinel", tt.name)
+			c.expectInvalidation("sentinel")
+
+			// Another connection's writes are still reported
+			c.do("GET", "k")
+			other.do("SET", "k", tt.name)
+			c.expectInvalidation("k")
+		})
+	}
+}
+
+func TestTrackingNoLoopWithRedirect(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+	target := connect(t, s)
+	other := connect(t, s)
+
+	id := target.do("CLIENT", "ID")
+	c.do("CLIENT", "TRACKING", "ON", "REDIRECT", id, "NOLOOP")
+	c.do("GET", "k")
+	c.do("GET", "sentinel")
+	c.do("SET", "k", "v")
+	other.do("SET", "sentinel", "v")
+	target.expectInvalidation("sentinel")
+}
+
+func TestTrackingBroadcast(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+	other := connect(t, s)
+
+	c.do("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "NOLOOP")
+	other.do("SET", "user:1", "v")
+	c.expectInvalidation("user:1")
+
+	// Keys outside the prefix and the connection's own writes aren't
+	// reported, whether or not they were read
+	other.do("SET", "order:1", "v")
+	c.do("SET", "user:2", "v")
+	other.do("SET", "user:3", "v")
+	c.expectInvalidation("user:3")
+	other.do("SET", "user:3", "again")
+	c.expectInvalidation("user:3")
+}
+
+func TestTrackingOptIn(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+	other := connect(t, s)
+
+	c.do("CLIENT", "TRACKING", "ON", "OPTIN")
+	c.do("GET", "untracked")
+	if reply := c.do("CLIENT", "CACHING", "YES"); reply != "OK" {
+		t.Fatal(reply)
+	}
+	c.do("GET", "tracked")
+	// CACHING YES only applies to the next command
+	c.do("GET", "later")
+
+	other.do("SET", "untracked", "v")
+	other.do("SET", "later", "v")
+	other.do("SET", "tracked", "v")
+	c.expectInvalidation("tracked")
+}
+
+func TestTrackingOptOut(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+	other := connect(t, s)
+
+	c.do("CLIENT", "TRACKING", "ON", "OPTOUT")
+	if reply := c.do("CLIENT", "CACHING", "NO"); reply != "OK" {
+		t.Fatal(reply)
+	}
+	c.do("GET", "untracked")
+	c.do("GET", "tracked")
+
+	other.do("SET", "untracked", "v")
+	other.do("SET", "tracked", "v")
+	c.expectInvalidation("tracked")
+}
+
+func TestTrackingFlush(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+
+	c.do("CLIENT", "TRACKING", "ON", "NOLOOP")
+	c.do("GET", "k")
+	// Flushing drops everything the connection cached, even its own
+	c.do("FLUSHALL")
+	if push := c.nextPush(); push != "[invalidate, (nil)]" {
+		t.Fatalf("got push %s, want a flush", push)
+	}
+}
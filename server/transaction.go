@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"Memora/commands"
+	"Memora/store"
+)
+
+// transaction is the MULTI/EXEC state of a connection
+type transaction struct {
+	// active is set between MULTI and EXEC or DISCARD, while commands are
+	// queued instead of run
+	active bool
+	queued [][]string
+	// aborted is set when a command could not be queued, so EXEC fails
+	aborted bool
+	// watches are the keys watched with WATCH, until EXEC, DISCARD or UNWATCH
+	watches []store.Watch
+}
+
+// replies is the reply of EXEC: each element is written as a reply of its
+// own, so errors and status replies keep their type
+type replies []interface{}
+
+// notQueued are the commands that can't be part of a transaction
+var notQueued = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+	"SSUBSCRIBE": true, "SUNSUBSCRIBE": true, "HELLO": true, "CLIENT": true,
+}
+
+// transactionCommand handles MULTI, EXEC, DISCARD, WATCH and UNWATCH, and
+// queues every other command inside a transaction. It reports whether the
+// command was handled.
+func (s *Server) transactionCommand(c *connection, cmd string, command []string) bool {
+	tx := &c.transaction
+	args := command[1:]
+
+	switch cmd {
+	case "MULTI":
+		if tx.active {
+			s.reply(c, commands.ErrorReply("ERR MULTI calls can not be nested"))
+			return true
+		}
+		tx.active = true
+		s.reply(c, "OK")
+	case "EXEC":
+		if !tx.active {
+			s.reply(c, commands.ErrorReply("ERR EXEC without MULTI"))
+			return true
+		}
+		s.reply(c, s.exec(c))
+	case "DISCARD":
+		if !tx.active {
+			s.reply(c, commands.ErrorReply("ERR DISCARD without MULTI"))
+			return true
+		}
+		s.endTransaction(c)
+		s.reply(c, "OK")
+	case "WATCH":
+		if tx.active {
+			s.reply(c, commands.ErrorReply("ERR WATCH inside MULTI is not allowed"))
+			return true
+		}
+		if len(args) == 0 {
+			s.reply(c, commands.ErrorReply("ERR wrong number of arguments for 'watch' command"))
+			return true
+		}
+		for _, key := range args {
+			tx.watches = append(tx.watches, s.Store.WatchKey(key))
+		}
+		s.reply(c, "OK")
+	case "UNWATCH":
+		s.unwatch(c)
+		s.reply(c, "OK")
+	default:
+		if !tx.active {
+			return false
+		}
+		if notQueued[cmd] {
+			tx.aborted = true
+			s.reply(c, commands.ErrorReply(fmt.Sprintf("ERR Command '%s' not allowed inside a transaction", strings.ToLower(cmd))))
+			return true
+		}
+		// Unknown commands and wrong arities are caught before EXEC, so a
+		// transaction never runs only partly because of them
+		if err := commands.CheckCommand(command); err != "" {
+			tx.aborted = true
+			s.reply(c, err)
+			return true
+		}
+		tx.queued = append(tx.queued, command)
+		s.reply(c, "QUEUED")
+	}
+	return true
+}
+
+// exec runs the queued commands with no other command interleaved. A nil
+// reply means a watched key was modified and nothing ran.
+func (s *Server) exec(c *connection) interface{} {
+	tx := &c.transaction
+	defer s.endTransaction(c)
+
+	if tx.aborted {
+		return commands.ErrorReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	var results replies
+	ran := s.commandHandler.Atomically(func(run func(command []string) interface{}) {
+		for _, watch := range tx.watches {
+			if s.Store.Modified(watch) {
+				return
+			}
+		}
+		s.Store.SetWriter(c.writerID())
+		defer s.Store.SetWriter(0)
+		results = make(replies, len(tx.queued))
+		for i, command := range tx.queued {
+			results[i] = run(command)
+		}
+	})
+	if !ran {
+		return commands.BusyReply
+	}
+	if results == nil {
+		return []interface{}(nil)
+	}
+	return results
+}
+
+// endTransaction leaves MULTI and releases the watched keys
+func (s *Server) endTransaction(c *connection) {
+	c.transaction.active = false
+	c.transaction.queued = nil
+	c.transaction.aborted = false
+	s.unwatch(c)
+}
+
+func (s *Server) unwatch(c *connection) {
+	for _, watch := range c.transaction.watches {
+		s.Store.Unwatch(watch)
+	}
+	c.transaction.watches = nil
+}
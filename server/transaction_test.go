@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransactionQueueErrors(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+
+	tests := []struct {
+		name    string
+		command []string
+		want    string
+	}{
+		{"unknown command", []string{"NOPE", "a"}, "ERR unknown command 'NOPE', with args beginning with: 'a' "},
+		{"wrong arity", []string{"GET"}, "ERR wrong number of arguments for 'get' command"},
+		{"not allowed", []string{"SUBSCRIBE", "ch"}, "ERR Command 'subscribe' not allowed inside a transaction"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.do("MULTI")
+			if reply := c.do("SET", "k", "v"); reply != "QUEUED" {
+				t.Fatalf("SET: got %s, want QUEUED", reply)
+			}
+			if reply := c.do(tt.command...); reply != tt.want {
+				t.Fatalf("got %s, want %s", reply, tt.want)
+			}
+			if reply := c.do("EXEC"); reply != "EXECABORT Transaction discarded because of previous errors." {
+				t.Fatalf("EXEC: got %s", reply)
+			}
+			// Nothing ran, not even the commands queued before the error
+			if reply := c.do("GET", "k"); reply != "(nil)" {
+				t.Fatalf("GET: got %s, want (nil)", reply)
+			}
+		})
+	}
+}
+
+func TestWatchExpiredKey(t *testing.T) {
+	s := NewServer("127.0.0.1", "0")
+	c := connect(t, s)
+
+	// A TTL that hasn't run out doesn't abort the transaction
+	c.do("SET", "k", "v", "PX", "60000")
+	c.do("WATCH", "k")
+	c.do("MULTI")
+	c.do("SET", "other", "v")
+	if reply := c.do("EXEC"); reply != "[OK]" {
+		t.Fatalf("EXEC: got %s, want [OK]", reply)
+	}
+
+	// One that does counts as a modification, although nothing deleted the
+	// key yet
+	c.do("SET", "k", "v", "PX", "20")
+	c.do("WATCH", "k")
+	time.Sleep(40 * time.Millisecond)
+	c.do("MULTI")
+	c.do("SET", "other", "v")
+	if reply := c.do("EXEC"); reply != "(nil)" {
+		t.Fatalf("EXEC: got %s, want (nil)", reply)
+	}
+}
@@ -0,0 +1,156 @@
+package store
+
+import "iter"
+
+// collection is the hash table holding the members of a set or the fields of
+// a hash. Go maps can't be iterated from a position, so collections chain
+// their items in buckets by hashKey like HashTable does: SSCAN and HSCAN then
+// visit only the buckets their cursor covers.
+//
+// The table doubles when it holds more items than buckets and halves when it
+// is less than 1/8 full, rehashing everything at once. Collections are only
+// written under the key lock, and read under at least its read lock. Like a
+// nil map, a nil collection reads as empty.
+type collection[V any] struct {
+	buckets [][]collectionItem[V]
+	mask    uint64
+	n       int
+}
+
+type collectionItem[V any] struct {
+	key   string
+	value V
+}
+
+// minCollectionBuckets is the size of an empty collection
+const minCollectionBuckets = 4
+
+func newCollection[V any](n int) *collection[V] {
+	c := &collection[V]{}
+	c.resize(n)
+	return c
+}
+
+// resize rehashes the items into the power of two buckets at or above n
+func (c *collection[V]) resize(n int) {
+	size := nextPowerOfTwo(max(n, minCollectionBuckets))
+	buckets := make([][]collectionItem[V], size)
+	mask := uint64(size - 1)
+	for _, bucket := range c.buckets {
+		for _, item := range bucket {
+			index := hashKey(item.key) & mask
+			buckets[index] = append(buckets[index], item)
+		}
+	}
+	c.buckets, c.mask = buckets, mask
+}
+
+func (c *collection[V]) len() int {
+	if c == nil {
+		return 0
+	}
+	return c.n
+}
+
+func (c *collection[V]) get(key string) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+	for _, item := range c.buckets[hashKey(key)&c.mask] {
+		if item.key == key {
+			return item.value, true
+		}
+	}
+	return zero, false
+}
+
+// put stores value at key and reports whether the key is new
+func (c *collection[V]) put(key string, value V) bool {
+	index := hashKey(key) & c.mask
+	bucket := c.buckets[index]
+	for i := range bucket {
+		if bucket[i].key == key {
+			bucket[i].value = value
+			return false
+		}
+	}
+
+	c.buckets[index] = append(bucket, collectionItem[V]{key, value})
+	c.n++
+	if c.n > len(c.buckets) {
+		c.resize(c.n)
+	}
+	return true
+}
+
+// remove deletes key and returns its value, if it was there
+func (c *collection[V]) remove(key string) (V, bool) {
+	index := hashKey(key) & c.mask
+	bucket := c.buckets[index]
+	for i := range bucket {
+		if bucket[i].key != key {
+			continue
+		}
+		value := bucket[i].value
+		last := len(bucket) - 1
+		bucket[i] = bucket[last]
+		bucket[last] = collectionItem[V]{}
+		c.buckets[index] = bucket[:last]
+		c.n--
+		if c.n*8 < len(c.buckets) && len(c.buckets) > minCollectionBuckets {
+			c.resize(c.n)
+		}
+		return value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// all iterates the items in bucket order
+func (c *collection[V]) all() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		if c == nil {
+			return
+		}
+		for _, bucket := range c.buckets {
+			for _, item := range bucket {
+				if !yield(item.key, item.value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// keys iterates the keys in bucket order
+func (c *collection[V]) keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for key := range c.all() {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// scan calls fn for the items of count buckets starting at cursor, and
+// returns the cursor of the next call, 0 once every bucket was visited. The
+// buckets are walked with the reverse binary cursor of SCAN, so items present
+// for the whole iteration are returned at least once even if the collection
+// is resized between two calls.
+func (c *collection[V]) scan(cursor uint64, count int, fn func(key string, value V)) uint64 {
+	if c == nil {
+		return 0
+	}
+	v := cursor
+	for range count {
+		for _, item := range c.buckets[v&c.mask] {
+			fn(item.key, item.value)
+		}
+		if v = nextScanCursor(v, c.mask); v == 0 {
+			break
+		}
+	}
+	return v
+}
@@ -0,0 +1,316 @@
+package store
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrOOM           = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+	ErrInvalidMemory = errors.New("ERR argument must be a memory value")
+)
+
+// EvictionPolicy decides which keys are removed when the store is over its
+// maxmemory limit
+type EvictionPolicy int32
+
+const (
+	NoEviction     EvictionPolicy = iota // reject writes instead of evicting
+	AllKeysLRU                           // least recently used key
+	VolatileLRU                          // least recently used key with a TTL
+	AllKeysLFU                           // least frequently used key
+	VolatileLFU                          // least frequently used key with a TTL
+	AllKeysRandom                        // any key
+	VolatileRandom                       // any key with a TTL
+	VolatileTTL                          // key with the nearest expiration
+)
+
+var evictionPolicyNames = [...]string{
+	NoEviction:     "noeviction",
+	AllKeysLRU:     "allkeys-lru",
+	VolatileLRU:    "volatile-lru",
+	AllKeysLFU:     "allkeys-lfu",
+	VolatileLFU:    "volatile-lfu",
+	AllKeysRandom:  "allkeys-random",
+	VolatileRandom: "volatile-random",
+	VolatileTTL:    "volatile-ttl",
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+// ParseEvictionPolicy returns the policy with the given (case-insensitive)
+// name
+func ParseEvictionPolicy(name string) (EvictionPolicy, bool) {
+	for policy, policyName := range evictionPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return EvictionPolicy(policy), true
+		}
+	}
+	return NoEviction, false
+}
+
+// volatileOnly reports whether the policy only evicts keys with a TTL
+func (p EvictionPolicy) volatileOnly() bool {
+	return p == VolatileLRU || p == VolatileLFU || p == VolatileRandom || p == VolatileTTL
+}
+
+// ParseMemory parses a memory size such as 1048576, 100kb, 64mb or 1gb. The
+// units k, m and g are powers of 1000; kb, mb and gb are powers of 1024.
+func ParseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	value = strings.ToLower(value)
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+
+	amount, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || amount < 0 || amount > (1<<62)/factor {
+		return 0, ErrInvalidMemory
+	}
+	return amount * factor, nil
+}
+
+const (
+	// lfuInitVal is the access counter of a new key, so it isn't evicted
+	// before it had a chance to be read
+	lfuInitVal = 5
+	// lfuLogFactor controls how quickly the logarithmic counter saturates:
+	// with 10 it reaches 255 after about a million accesses
+	lfuLogFactor = 10
+	// lfuDecayTime is how long a key must stay idle for its counter to drop
+	// by one
+	lfuDecayTime = time.Minute
+	// defaultEvictionSamples is how many keys are sampled per table when
+	// choosing a victim
+	defaultEvictionSamples = 5
+)
+
+// touch records an access for LRU and LFU. The frequency is a Morris-style
+// logarithmic counter: the higher it is the less likely an access increments
+// it. It decays by one for every lfuDecayTime the key stayed idle.
+func (e *Entry) touch(now int64) {
+	freq := e.frequency(now)
+	if freq < 255 {
+		base := float64(freq) - lfuInitVal
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			freq++
+		}
+	}
+	atomic.StoreUint32(&e.freq, freq)
+	atomic.StoreInt64(&e.accessed, now)
+}
+
+// frequency returns the access counter after applying the idle decay
+func (e *Entry) frequency(now int64) uint32 {
+	freq := atomic.LoadUint32(&e.freq)
+	decay := (now - atomic.LoadInt64(&e.accessed)) / int64(lfuDecayTime)
+	if decay >= int64(freq) {
+		return 0
+	}
+	return freq - uint32(max(decay, 0))
+}
+
+// evictionCandidate is a sampled key and the metadata policies compare
+type evictionCandidate struct {
+	table      *HashTable
+	key        string
+	idle       int64
+	freq       uint32
+	expiration int64
+}
+
+// better reports whether c should be evicted before other under policy
+func (c *evictionCandidate) better(other *evictionCandidate, policy EvictionPolicy) bool {
+	switch policy {
+	case AllKeysLFU, VolatileLFU:
+		if c.freq != other.freq {
+			return c.freq < other.freq
+		}
+		return c.idle > other.idle
+	case VolatileTTL:
+		return c.expiration < other.expiration
+	default:
+		return c.idle > other.idle
+	}
+}
+
+// sample returns up to n random keys of the table, only keys with an
+// expiration when volatile is set. Like Redis, eviction works on samples
+// rather than exact LRU/LFU order, which would need a global linked list.
+func (h *HashTable) sample(n int, volatile bool, now int64) []evictionCandidate {
+	candidates := make([]evictionCandidate, 0, n)
+	start := rand.Intn(tableShards)
+	for i := 0; i < tableShards && len(candidates) < n; i++ {
+		s := h.shards[(start+i)%tableShards]
+		s.mu.RLock()
+		collect := func(node *bucketEntry) bool {
+			candidates = append(candidates, evictionCandidate{
+				table:      h,
+				key:        node.key,
+				idle:       now - atomic.LoadInt64(&node.entry.accessed),
+				freq:       node.entry.frequency(now),
+				expiration: node.entry.Expiration,
+			})
+			return len(candidates) < n
+		}
+		if volatile {
+			// Map iteration order is random
+			for _, node := range s.expires {
+				if !collect(node) {
+					break
+				}
+			}
+		} else {
+			s.sampleBuckets(collect)
+		}
+		s.mu.RUnlock()
+	}
+	return candidates
+}
+
+// sampleBuckets walks the buckets from a random position, calling fn for each
+// node until fn returns false or every bucket was visited. Callers must hold
+// s.mu.
+func (s *shard) sampleBuckets(fn func(node *bucketEntry) bool) {
+	if s.count == 0 {
+		return
+	}
+	for i, t := range s.tables {
+		if t == nil || (i == 1 && !s.rehashing()) {
+			break
+		}
+		start := rand.Intn(len(t.buckets))
+		for j := range t.buckets {
+			for node := t.buckets[(start+j)&int(t.mask)]; node != nil; node = node.next {
+				if !fn(node) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// SetMaxMemory sets the memory limit in bytes, 0 meaning no limit
+func (ds *DataStore) SetMaxMemory(limit int64) {
+	ds.maxMemory.Store(limit)
+}
+
+func (ds *DataStore) MaxMemory() int64 {
+	return ds.maxMemory.Load()
+}
+
+func (ds *DataStore) SetEvictionPolicy(policy EvictionPolicy) {
+	ds.evictionPolicy.Store(int32(policy))
+}
+
+func (ds *DataStore) EvictionPolicy() EvictionPolicy {
+	return EvictionPolicy(ds.evictionPolicy.Load())
+}
+
+// SetEvictionSamples sets how many keys are sampled per table when choosing
+// a victim. More samples approximate true LRU/LFU better but cost more CPU.
+func (ds *DataStore) SetEvictionSamples(samples int) {
+	ds.evictionSamples.Store(int32(samples))
+}
+
+func (ds *DataStore) EvictionSamples() int {
+	return int(ds.evictionSamples.Load())
+}
+
+// EvictedKeys returns the number of keys evicted because of maxmemory
+func (ds *DataStore) EvictedKeys() int64 {
+	return ds.evictedKeys.Load()
+}
+
+// UsedMemory returns the estimated memory held by all keys and values
+func (ds *DataStore) UsedMemory() int64 {
+	return ds.stringStore.Used() + ds.listStore.Used() + ds.setStore.Used() + ds.hashStore.Used()
+}
+
+// FreeMemoryIfNeeded evicts keys until the store is back under maxmemory. It
+// returns ErrOOM if the limit is exceeded and nothing can be evicted, either
+// because the policy is noeviction or because no key qualifies. Commands that
+// may grow memory call it before running.
+func (ds *DataStore) FreeMemoryIfNeeded() error {
+	limit := ds.MaxMemory()
+	if limit <= 0 || ds.UsedMemory() <= limit {
+		return nil
+	}
+
+	policy := ds.EvictionPolicy()
+	if policy == NoEviction {
+		return ErrOOM
+	}
+
+	// Writers evict one at a time so they don't all evict for the same excess
+	ds.evictMu.Lock()
+	defer ds.evictMu.Unlock()
+
+	for ds.UsedMemory() > limit {
+		if !ds.evictOne(policy) {
+			return ErrOOM
+		}
+	}
+	return nil
+}
+
+// evictOne samples every table and deletes the best victim for policy. It
+// returns false if there was no key to evict.
+func (ds *DataStore) evictOne(policy EvictionPolicy) bool {
+	now := time.Now().UnixNano()
+	samples := ds.EvictionSamples()
+
+	candidates := make([]evictionCandidate, 0, 4*samples)
+	for _, table := range ds.tables() {
+		candidates = append(candidates, table.sample(samples, policy.volatileOnly(), now)...)
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+
+	victim := &candidates[rand.Intn(len(candidates))]
+	if policy != AllKeysRandom && policy != VolatileRandom {
+		for i := range candidates {
+			if candidates[i].better(victim, policy) {
+				victim = &candidates[i]
+			}
+		}
+	}
+
+	ds.lockKey(victim.key)
+	defer ds.unlockKey(victim.key)
+
+	if victim.table.Delete(victim.key) {
+		if victim.table == ds.hashStore {
+			ds.volatileMu.Lock()
+			delete(ds.volatileHashes, victim.key)
+			ds.volatileMu.Unlock()
+			ds.hashChanged(victim.key)
+		}
+		ds.evictedKeys.Add(1)
+		ds.notify(EventEvicted, "evicted", victim.key)
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package store
+
+// The store keeps the source code of the function libraries loaded with
+// FUNCTION LOAD, so they are saved in snapshots along with the data. The
+// commands package compiles and runs them; it notices libraries restored
+// from a snapshot by the change of version.
+
+// SetFunctionLibrary adds or replaces the library with the given name
+func (ds *DataStore) SetFunctionLibrary(name, code string) {
+	ds.librariesMu.Lock()
+	defer ds.librariesMu.Unlock()
+
+	ds.libraries[name] = code
+	ds.librariesVersion++
+}
+
+// DeleteFunctionLibrary removes a library
+func (ds *DataStore) DeleteFunctionLibrary(name string) {
+	ds.librariesMu.Lock()
+	defer ds.librariesMu.Unlock()
+
+	delete(ds.libraries, name)
+	ds.librariesVersion++
+}
+
+// FunctionLibraries returns the code of every library by name, and a version
+// that changes whenever a library is added, replaced or removed
+func (ds *DataStore) FunctionLibraries() (map[string]string, uint64) {
+	ds.librariesMu.Lock()
+	defer ds.librariesMu.Unlock()
+
+	libraries := make(map[string]string, len(ds.libraries))
+	for name, code := range ds.libraries {
+		libraries[name] = code
+	}
+	return libraries, ds.librariesVersion
+}
+
+// FunctionLibrariesVersion returns the version FunctionLibraries would
+func (ds *DataStore) FunctionLibrariesVersion() uint64 {
+	ds.librariesMu.Lock()
+	defer ds.librariesMu.Unlock()
+	return ds.librariesVersion
+}
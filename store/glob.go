@@ -0,0 +1,147 @@
+package store
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// MatchPattern reports whether s matches the glob-style pattern used by KEYS,
+// SCAN and PSUBSCRIBE, optionally ignoring case. The syntax is Redis': *
+// matches any sequence including the empty one, ? any single character,
+// [abc] one of the listed characters, [a-z] a character in the range (bounds
+// may be given in either order) and [^a-z] a character not in the class. A
+// backslash matches the next character literally, also inside classes where
+// it never starts a range. A class missing its closing bracket extends to the
+// end of the pattern.
+func MatchPattern(pattern, s string, nocase bool) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	// Each element other than * consumes exactly one character, so it is
+	// enough to remember the last star: on a mismatch it absorbs one more
+	// character and matching resumes after it. Earlier stars never need to be
+	// revisited, which keeps matching O(len(pattern) * len(s)) instead of
+	// exponential.
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				if p == len(pattern) {
+					return true
+				}
+				starP, starI = p, i
+				continue
+			}
+
+			c, size := decodeChar(s, i)
+			if next, ok := matchElement(pattern, p, c, nocase); ok {
+				p = next
+				i += size
+				continue
+			}
+		}
+
+		if starP < 0 {
+			return false
+		}
+		_, size := decodeChar(s, starI)
+		starI += size
+		p, i = starP, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchesPattern is the case-sensitive MatchPattern
+func matchesPattern(key, pattern string) bool {
+	return MatchPattern(pattern, key, false)
+}
+
+// matchElement matches c against the pattern element starting at p, which
+// is not a star, and returns the position of the next element
+func matchElement(pattern string, p int, c rune, nocase bool) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		return matchClass(pattern, p+1, c, nocase)
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+
+	pc, size := decodeChar(pattern, p)
+	return p + size, equalChars(pc, c, nocase)
+}
+
+// matchClass matches c against the character class whose body starts at p,
+// just after the opening bracket, and returns the position after the class
+func matchClass(pattern string, p int, c rune, nocase bool) (int, bool) {
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		escaped := pattern[p] == '\\' && p+1 < len(pattern)
+		if escaped {
+			p++
+		}
+		start, size := decodeChar(pattern, p)
+		p += size
+
+		// An escaped character never starts a range
+		if !escaped && p+1 < len(pattern) && pattern[p] == '-' {
+			end, size := decodeChar(pattern, p+1)
+			p += 1 + size
+			folded := c
+			if nocase {
+				start, end, folded = unicode.ToLower(start), unicode.ToLower(end), unicode.ToLower(c)
+			}
+			matched = matched || inRange(folded, start, end)
+			continue
+		}
+		matched = matched || equalChars(start, c, nocase)
+	}
+
+	if p < len(pattern) {
+		p++ // closing bracket
+	}
+	return p, matched != negate
+}
+
+func inRange(c, start, end rune) bool {
+	if start > end {
+		start, end = end, start
+	}
+	return c >= start && c <= end
+}
+
+func equalChars(a, b rune, nocase bool) bool {
+	return a == b || nocase && unicode.ToLower(a) == unicode.ToLower(b)
+}
+
+// invalidByte offsets bytes that aren't valid UTF-8 past the last code
+// point, so binary keys still match byte for byte
+const invalidByte = unicode.MaxRune + 1
+
+// decodeChar returns the character starting at s[i] and its length in bytes.
+// Patterns and keys are matched by character rather than by byte, so ? and
+// classes work with multi-byte characters.
+func decodeChar(s string, i int) (rune, int) {
+	c, size := utf8.DecodeRuneInString(s[i:])
+	if c == utf8.RuneError && size == 1 {
+		return invalidByte + rune(s[i]), 1
+	}
+	return c, size
+}
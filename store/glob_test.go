@@ -0,0 +1,171 @@
+package store
+
+import (
+	"testing"
+	"unicode"
+)
+
+// decodeAll splits s into the characters MatchPattern works on
+func decodeAll(s string) []rune {
+	chars := make([]rune, 0, len(s))
+	for i := 0; i < len(s); {
+		c, size := decodeChar(s, i)
+		chars = append(chars, c)
+		i += size
+	}
+	return chars
+}
+
+// referenceMatch is a port of Redis' recursive stringmatchlen, working on
+// characters instead of bytes and lowering them with unicode.ToLower instead
+// of tolower. Unlike Redis, which orders range bounds before lowering them and
+// compares escaped class characters case-sensitively, it applies nocase to
+// every character like MatchPattern. Results are memoized by position so
+// patterns full of stars don't take exponential time.
+func referenceMatch(pattern, s string, nocase bool) bool {
+	p, str := decodeAll(pattern), decodeAll(s)
+	memo := make(map[[2]int]bool)
+	lower := func(c rune) rune {
+		if nocase {
+			return unicode.ToLower(c)
+		}
+		return c
+	}
+
+	var match func(pi, si int) bool
+	match = func(pi, si int) bool {
+		key := [2]int{pi, si}
+		if result, ok := memo[key]; ok {
+			return result
+		}
+
+		var result bool
+		switch {
+		case pi == len(p):
+			result = si == len(str)
+		case p[pi] == '*':
+			result = match(pi+1, si) || si < len(str) && match(pi, si+1)
+		case si == len(str):
+			result = false
+		case p[pi] == '?':
+			result = match(pi+1, si+1)
+		case p[pi] == '[':
+			next, matched := referenceClass(p, pi+1, str[si], lower)
+			result = matched && match(next, si+1)
+		default:
+			if p[pi] == '\\' && pi+1 < len(p) {
+				pi++
+			}
+			result = lower(p[pi]) == lower(str[si]) && match(pi+1, si+1)
+		}
+		memo[key] = result
+		return result
+	}
+	return match(0, 0)
+}
+
+// referenceClass follows the class branch of stringmatchlen: it matches c
+// against the class body starting at pi and returns the position after it
+func referenceClass(p []rune, pi int, c rune, lower func(rune) rune) (int, bool) {
+	not := pi < len(p) && p[pi] == '^'
+	if not {
+		pi++
+	}
+
+	match := false
+	for {
+		switch {
+		case pi < len(p) && p[pi] == '\\' && pi+1 < len(p):
+			pi++
+			if lower(p[pi]) == lower(c) {
+				match = true
+			}
+		case pi < len(p) && p[pi] == ']':
+			return pi + 1, match != not
+		case pi >= len(p):
+			return len(p), match != not
+		case pi+2 < len(p) && p[pi+1] == '-':
+			start, end := lower(p[pi]), lower(p[pi+2])
+			if start > end {
+				start, end = end, start
+			}
+			if lower(c) >= start && lower(c) <= end {
+				match = true
+			}
+			pi += 2
+		default:
+			if lower(p[pi]) == lower(c) {
+				match = true
+			}
+		}
+		pi++
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		nocase     bool
+		want       bool
+	}{
+		{"*", "", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h*llo", "heeeello", false, true},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hbllo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"[\\-a]", "-", false, true},
+		{"[a-]", "]", false, true},
+		{"[abc", "b", false, true},
+		{"[]", "]", false, false},
+		{"HELLO", "hello", true, true},
+		{"[A-C]", "b", true, true},
+		{"é?", "éa", false, true},
+		{"?", "é", false, true},
+		{"\xff*", "\xff\xfe", false, true},
+		{"?", "\xff\xfe", false, false},
+		{"a*b*c*d*e*f*g*h*i*j*k", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false, false},
+		{"trailing\\", "trailing\\", false, true},
+	}
+	for _, tt := range tests {
+		if got := MatchPattern(tt.pattern, tt.s, tt.nocase); got != tt.want {
+			t.Errorf("MatchPattern(%q, %q, %v) = %v, want %v", tt.pattern, tt.s, tt.nocase, got, tt.want)
+		}
+		if got := referenceMatch(tt.pattern, tt.s, tt.nocase); got != tt.want {
+			t.Errorf("referenceMatch(%q, %q, %v) = %v, want %v", tt.pattern, tt.s, tt.nocase, got, tt.want)
+		}
+	}
+}
+
+func FuzzMatchPattern(f *testing.F) {
+	seeds := []struct{ pattern, s string }{
+		{"*", "anything"},
+		{"h?l*o", "hello"},
+		{"[a-z]*[^0-9]", "abc!"},
+		{"[z-a]", "m"},
+		{"\\[*\\]", "[x]"},
+		{"[\\]]", "]"},
+		{"[a-", "b"},
+		{"*a*a*a*a*b", "aaaaaaaaaaaaaaaaaaaa"},
+		{"[Z-a]", "_"},
+		{"é[à-ü]?", "éèx"},
+		{"\xff[\x80-\xfe]", "\xff\x90"},
+	}
+	for _, seed := range seeds {
+		f.Add(seed.pattern, seed.s, false)
+		f.Add(seed.pattern, seed.s, true)
+	}
+
+	f.Fuzz(func(t *testing.T, pattern, s string, nocase bool) {
+		if len(pattern) > 64 || len(s) > 64 {
+			return
+		}
+		if got, want := MatchPattern(pattern, s, nocase), referenceMatch(pattern, s, nocase); got != want {
+			t.Fatalf("MatchPattern(%q, %q, %v) = %v, reference says %v", pattern, s, nocase, got, want)
+		}
+	})
+}
@@ -1,250 +1,677 @@
 package store
 
 import (
-	"fmt"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Entry struct {
 	Value      interface{}
 	Expiration int64 // Unix nano timestamp, 0 means no expiration
+
+	// size is the estimated memory held by the key and its value
+	size int64
+	// accessed (Unix nano) and freq are the LRU and LFU metadata used by
+	// eviction. Reads update them under a shared lock, so they are only
+	// accessed atomically.
+	accessed int64
+	freq     uint32
+}
+
+func (e *Entry) expired(now int64) bool {
+	return e.Expiration > 0 && now > e.Expiration
+}
+
+// clone copies the entry, reading the access metadata atomically
+func (e *Entry) clone() Entry {
+	return Entry{
+		Value:      e.Value,
+		Expiration: e.Expiration,
+		size:       e.size,
+		accessed:   atomic.LoadInt64(&e.accessed),
+		freq:       atomic.LoadUint32(&e.freq),
+	}
 }
 
+// ExpireCondition restricts when a new expiration replaces the current one
+// (the NX, XX, GT and LT options of the EXPIRE family).
+type ExpireCondition int
+
+const (
+	ExpireAlways ExpireCondition = iota
+	ExpireNX                     // only if there is no expiration yet
+	ExpireXX                     // only if there is an expiration already
+	ExpireGT                     // only if the new expiration is later
+	ExpireLT                     // only if the new expiration is sooner
+)
+
+// allows reports whether next may replace current. A current value of 0 means
+// no expiration, which counts as an infinite TTL for GT and LT.
+func (c ExpireCondition) allows(current, next int64) bool {
+	switch c {
+	case ExpireNX:
+		return current == 0
+	case ExpireXX:
+		return current != 0
+	case ExpireGT:
+		return current != 0 && next > current
+	case ExpireLT:
+		return current == 0 || next < current
+	default:
+		return true
+	}
+}
+
+// HashTable is a sharded hash table. Keys are spread over tableShards shards,
+// each guarded by its own lock, so operations on different keys rarely
+// contend. The low bits of a key's hash pick the shard and the remaining bits
+// pick the bucket inside it.
 type HashTable struct {
-	mu      sync.RWMutex
-	buckets []map[string]*Entry
-	size    int
-	count   int
+	shards [tableShards]*shard
+	used   atomic.Int64 // estimated memory of all entries
+
+	// onExpired, if set, is called with every key deleted because it
+	// expired, after the shard lock has been released
+	onExpired func(key string)
+	// expireNext is the shard the next active expire cycle starts with
+	expireNext atomic.Int64
+}
+
+const (
+	shardBits   = 5
+	tableShards = 1 << shardBits
+)
+
+// shard is a chained hash table with a power of two number of buckets. It
+// grows when the load factor reaches 1 and shrinks when it drops below 1/8.
+// Resizing is incremental like in Redis: a second table is allocated and every
+// write moves a bucket from the old table to the new one (RehashFor moves more
+// in the background), so no single request pays for a full rehash.
+type shard struct {
+	mu        sync.RWMutex
+	tables    [2]*table // tables[1] is only set while rehashing
+	rehashIdx int       // next bucket of tables[0] to move, -1 when not rehashing
+	minSize   int
+	count     int
+
+	// expires indexes the keys that have an expiration, so active expiry can
+	// sample them without walking the buckets
+	expires map[string]*bucketEntry
+	owner   *HashTable
+}
+
+type table struct {
+	buckets []*bucketEntry
+	mask    uint64
+}
+
+type bucketEntry struct {
+	key   string
+	hash  uint64 // bucket hash, cached for rehashing
+	entry *Entry
+	next  *bucketEntry
 }
 
+const (
+	// rehashEmptyVisits bounds how many empty buckets a single rehash step
+	// may skip, so a step stays cheap even in a sparse table
+	rehashEmptyVisits = 10
+	// shrinkRatio is the inverse load factor below which a shard shrinks
+	shrinkRatio = 8
+	// minShardSize is the smallest number of buckets in a shard
+	minShardSize = 8
+)
+
 func NewHashTable(size int) *HashTable {
 	if size <= 0 {
 		size = 1024
 	}
 
-	buckets := make([]map[string]*Entry, size)
-	for i := range buckets {
-		buckets[i] = make(map[string]*Entry)
+	h := &HashTable{}
+	perShard := nextPowerOfTwo(max(size/tableShards, minShardSize))
+	for i := range h.shards {
+		h.shards[i] = newShard(perShard, h)
 	}
+	return h
+}
 
-	return &HashTable{
-		buckets: buckets,
-		size:    size,
+func newShard(size int, owner *HashTable) *shard {
+	return &shard{
+		tables:    [2]*table{newTable(size)},
+		rehashIdx: -1,
+		minSize:   size,
+		expires:   make(map[string]*bucketEntry),
+		owner:     owner,
 	}
 }
 
-func (h *HashTable) hash(key string) int {
-	hash := 0
-	for i := 0; i < len(key); i++ {
-		hash = 31*hash + int(key[i])
+func newTable(size int) *table {
+	return &table{
+		buckets: make([]*bucketEntry, size),
+		mask:    uint64(size - 1),
 	}
-	return hash % h.size
 }
 
-func (h *HashTable) Set(key string, value interface{}, ttl time.Duration) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+func nextPowerOfTwo(n int) int {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	return size
+}
 
-	bucketIndex := h.hash(key)
-	bucket := h.buckets[bucketIndex]
+// hashSeed is chosen randomly at startup, so clients cannot craft keys that
+// all land in the same bucket
+var hashSeed = maphash.MakeSeed()
 
-	var expiration int64
-	if ttl > 0 {
-		expiration = time.Now().Add(ttl).UnixNano()
+// hashKey hashes arbitrary key bytes with the process-wide seed. The result
+// is unsigned, so bucket and shard indexes derived from it are never negative.
+func hashKey(key string) uint64 {
+	return maphash.String(hashSeed, key)
+}
+
+// locate returns the shard owning key and the hash used for its buckets
+func (h *HashTable) locate(key string) (*shard, uint64) {
+	hash := hashKey(key)
+	return h.shards[hash&(tableShards-1)], hash >> shardBits
+}
+
+func (s *shard) rehashing() bool {
+	return s.rehashIdx >= 0
+}
+
+// find returns the node holding key in either table. Callers must hold s.mu.
+func (s *shard) find(key string, hash uint64) *bucketEntry {
+	for i, t := range s.tables {
+		if t == nil || (i == 1 && !s.rehashing()) {
+			break
+		}
+		for node := t.buckets[hash&t.mask]; node != nil; node = node.next {
+			if node.hash == hash && node.key == key {
+				return node
+			}
+		}
 	}
+	return nil
+}
 
-	if _, exists := bucket[key]; !exists {
-		h.count++
+// lookup returns a copy of the live entry stored at key. An expired key is
+// deleted on the spot (lazy expiration), which needs the write lock, so the
+// read lock is only upgraded when that actually happens.
+func (s *shard) lookup(key string, hash uint64) (Entry, bool) {
+	s.mu.RLock()
+	node := s.find(key, hash)
+	if node == nil {
+		s.mu.RUnlock()
+		return Entry{}, false
 	}
+	if now := time.Now().UnixNano(); !node.entry.expired(now) {
+		node.entry.touch(now)
+		entry := node.entry.clone()
+		s.mu.RUnlock()
+		return entry, true
+	}
+	s.mu.RUnlock()
 
-	bucket[key] = &Entry{
-		Value:      value,
-		Expiration: expiration,
+	s.mu.Lock()
+	// Re-check: the key may have been rewritten between the two locks
+	removed := false
+	if node := s.find(key, hash); node != nil && node.entry.expired(time.Now().UnixNano()) {
+		removed = s.remove(key, hash)
 	}
+	s.mu.Unlock()
 
-	fmt.Printf("DEBUG: HashTable Set - key: '%s', value type: %T, value: %v\n", key, value, value) // Debug log
+	if removed {
+		s.owner.expiredKeys([]string{key})
+	}
+	return Entry{}, false
 }
 
-func (h *HashTable) Get(key string) (interface{}, bool) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// expireSample checks up to n keys of the expires index and deletes the ones
+// that have expired, returning their names. Go randomizes map iteration
+// order, so every call looks at a different random sample. Callers must hold
+// s.mu for writing.
+func (s *shard) expireSample(n int, now int64) (int, []string) {
+	sampled := 0
+	victims := make([]*bucketEntry, 0)
+	for _, node := range s.expires {
+		if sampled == n {
+			break
+		}
+		sampled++
+		if node.entry.expired(now) {
+			victims = append(victims, node)
+		}
+	}
 
-	bucketIndex := h.hash(key)
-	bucket := h.buckets[bucketIndex]
+	expired := make([]string, len(victims))
+	for i, node := range victims {
+		s.remove(node.key, node.hash)
+		expired[i] = node.key
+	}
+	return sampled, expired
+}
 
-	entry, exists := bucket[key]
-	if !exists {
-		return nil, false
+// expiredKeys reports keys deleted because they expired. Callers must not
+// hold any shard lock.
+func (h *HashTable) expiredKeys(keys []string) {
+	if h.onExpired == nil {
+		return
+	}
+	for _, key := range keys {
+		h.onExpired(key)
 	}
+}
 
-	if entry.Expiration > 0 && time.Now().UnixNano() > entry.Expiration {
-		return nil, false
+// insert stores entry at key, replacing any previous entry. Overwriting a key
+// counts as an access and keeps its access frequency. Callers must hold s.mu
+// for writing.
+func (s *shard) insert(key string, hash uint64, entry *Entry) {
+	s.rehashStep(1)
+
+	now := time.Now().UnixNano()
+	if node := s.find(key, hash); node != nil {
+		entry.freq = node.entry.freq
+		entry.accessed = node.entry.accessed
+		entry.touch(now)
+		s.owner.used.Add(entry.size - node.entry.size)
+		node.entry = entry
+		s.indexExpiration(node)
+		return
 	}
 
-	return entry.Value, true
-}
+	entry.freq = lfuInitVal
+	entry.accessed = now
+	s.owner.used.Add(entry.size)
 
-func (h *HashTable) Delete(key string) bool {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	// New keys go to the new table while rehashing so the old one drains
+	t := s.tables[0]
+	if s.rehashing() {
+		t = s.tables[1]
+	}
+	index := hash & t.mask
+	node := &bucketEntry{key: key, hash: hash, entry: entry, next: t.buckets[index]}
+	t.buckets[index] = node
+	s.count++
+	s.indexExpiration(node)
 
-	bucketIndex := h.hash(key)
-	bucket := h.buckets[bucketIndex]
+	s.resizeIfNeeded()
+}
 
-	if _, exists := bucket[key]; exists {
-		delete(bucket, key)
-		h.count--
-		return true
+// indexExpiration keeps the expires index in sync with node's entry. Callers
+// must hold s.mu for writing.
+func (s *shard) indexExpiration(node *bucketEntry) {
+	if node.entry.Expiration > 0 {
+		s.expires[node.key] = node
+	} else {
+		delete(s.expires, node.key)
 	}
+}
+
+// remove deletes key from whichever table holds it. Callers must hold s.mu
+// for writing.
+func (s *shard) remove(key string, hash uint64) bool {
+	s.rehashStep(1)
 
+	for i, t := range s.tables {
+		if t == nil || (i == 1 && !s.rehashing()) {
+			break
+		}
+		index := hash & t.mask
+		for prev, node := (*bucketEntry)(nil), t.buckets[index]; node != nil; prev, node = node, node.next {
+			if node.hash != hash || node.key != key {
+				continue
+			}
+			if prev == nil {
+				t.buckets[index] = node.next
+			} else {
+				prev.next = node.next
+			}
+			delete(s.expires, key)
+			s.owner.used.Add(-node.entry.size)
+			s.count--
+			s.resizeIfNeeded()
+			return true
+		}
+	}
 	return false
 }
 
-func (h *HashTable) Exists(key string) bool {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// resizeIfNeeded starts an incremental rehash when the load factor leaves the
+// [1/shrinkRatio, 1) range. Callers must hold s.mu for writing.
+func (s *shard) resizeIfNeeded() {
+	if s.rehashing() {
+		return
+	}
 
-	bucketIndex := h.hash(key)
-	bucket := h.buckets[bucketIndex]
+	size := len(s.tables[0].buckets)
+	switch {
+	case s.count >= size:
+		s.startRehash(nextPowerOfTwo(s.count * 2))
+	case size > s.minSize && s.count*shrinkRatio < size:
+		s.startRehash(max(s.minSize, nextPowerOfTwo(s.count)))
+	}
+}
 
-	entry, exists := bucket[key]
-	if !exists {
+func (s *shard) startRehash(size int) {
+	s.tables[1] = newTable(size)
+	s.rehashIdx = 0
+}
+
+// rehashStep moves up to n non-empty buckets from the old table to the new
+// one. It returns false once rehashing is complete. Callers must hold s.mu for
+// writing.
+func (s *shard) rehashStep(n int) bool {
+	if !s.rehashing() {
 		return false
 	}
 
-	if entry.Expiration > 0 && time.Now().UnixNano() > entry.Expiration {
-		return false
+	old, next := s.tables[0], s.tables[1]
+	emptyVisits := n * rehashEmptyVisits
+	for ; n > 0 && s.rehashIdx < len(old.buckets); n-- {
+		for old.buckets[s.rehashIdx] == nil {
+			s.rehashIdx++
+			emptyVisits--
+			if s.rehashIdx >= len(old.buckets) || emptyVisits == 0 {
+				return s.finishRehash()
+			}
+		}
+
+		for node := old.buckets[s.rehashIdx]; node != nil; {
+			following := node.next
+			index := node.hash & next.mask
+			node.next = next.buckets[index]
+			next.buckets[index] = node
+			node = following
+		}
+		old.buckets[s.rehashIdx] = nil
+		s.rehashIdx++
 	}
 
-	return true
+	return s.finishRehash()
 }
 
-func (h *HashTable) Keys(pattern string) []string {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// finishRehash swaps in the new table once the old one has been drained
+func (s *shard) finishRehash() bool {
+	if s.rehashIdx < len(s.tables[0].buckets) {
+		return true
+	}
 
-	keys := make([]string, 0)
-	now := time.Now().UnixNano()
+	s.tables[0], s.tables[1] = s.tables[1], nil
+	s.rehashIdx = -1
+	s.resizeIfNeeded()
+	return s.rehashing()
+}
 
-	for _, bucket := range h.buckets {
-		for key, entry := range bucket {
-			// Check expiration
-			if entry.Expiration > 0 && now > entry.Expiration {
-				continue
+// forEach calls fn for every node in both tables. Callers must hold s.mu.
+func (s *shard) forEach(fn func(node *bucketEntry)) {
+	for i, t := range s.tables {
+		if t == nil || (i == 1 && !s.rehashing()) {
+			break
+		}
+		for _, node := range t.buckets {
+			for ; node != nil; node = node.next {
+				fn(node)
 			}
+		}
+	}
+}
 
-			// Simple pattern matching (supports * wildcard)
-			if matchesPattern(key, pattern) {
-				keys = append(keys, key)
+// RehashFor performs incremental rehashing for at most budget per shard. It
+// is meant to be called periodically so idle tables still finish resizing. It
+// returns whether a rehash is still in progress.
+func (h *HashTable) RehashFor(budget time.Duration) bool {
+	pending := false
+	for _, s := range h.shards {
+		s.mu.Lock()
+		deadline := time.Now().Add(budget)
+		for s.rehashStep(100) {
+			if time.Now().After(deadline) {
+				pending = true
+				break
 			}
 		}
+		s.mu.Unlock()
 	}
+	return pending
+}
 
-	return keys
+func (h *HashTable) Set(key string, value interface{}, ttl time.Duration) {
+	var expiration int64
+	if ttl > 0 {
+		expiration = time.Now().Add(ttl).UnixNano()
+	}
+
+	h.SetWithExpiration(key, value, expiration)
 }
 
-func (h *HashTable) TTL(key string) int64 {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// SetWithExpiration stores value with an absolute Unix nano expiration, 0
+// meaning no expiration
+func (h *HashTable) SetWithExpiration(key string, value interface{}, expiration int64) {
+	s, hash := h.locate(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	bucketIndex := h.hash(key)
-	bucket := h.buckets[bucketIndex]
+	s.insert(key, hash, &Entry{
+		Value:      value,
+		Expiration: expiration,
+		size:       sizeOf(key, value),
+	})
+}
 
-	entry, exists := bucket[key]
-	if !exists {
-		return -2 // Key doesn't exist
+// Update replaces the value at key keeping its expiration, and adjusts the
+// key's memory estimate by delta. Collections use it so their size is tracked
+// incrementally instead of being recomputed on every write. A missing key is
+// created without an expiration and its size is computed from value.
+func (h *HashTable) Update(key string, value interface{}, delta int64) {
+	s, hash := h.locate(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.find(key, hash)
+	if node == nil {
+		s.insert(key, hash, &Entry{Value: value, size: sizeOf(key, value)})
+		return
 	}
 
-	if entry.Expiration == 0 {
-		return -1 // No expiration
+	node.entry.Value = value
+	node.entry.size += delta
+	s.owner.used.Add(delta)
+}
+
+// Used returns the estimated memory held by the table's keys and values
+func (h *HashTable) Used() int64 {
+	return h.used.Load()
+}
+
+func (h *HashTable) Get(key string) (interface{}, bool) {
+	s, hash := h.locate(key)
+	entry, exists := s.lookup(key, hash)
+	if !exists {
+		return nil, false
 	}
 
-	ttl := (entry.Expiration - time.Now().UnixNano()) / int64(time.Second)
-	if ttl < 0 {
-		return -2 // Key expired
+	return entry.Value, true
+}
+
+// GetEntry returns a copy of the live entry stored at key, including its
+// expiration
+func (h *HashTable) GetEntry(key string) (Entry, bool) {
+	s, hash := h.locate(key)
+	return s.lookup(key, hash)
+}
+
+// Peek returns a copy of the live entry stored at key like GetEntry, but
+// without counting as an access or deleting an expired key
+func (h *HashTable) Peek(key string) (Entry, bool) {
+	s, hash := h.locate(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node := s.find(key, hash)
+	if node == nil || node.entry.expired(time.Now().UnixNano()) {
+		return Entry{}, false
 	}
+	return node.entry.clone(), true
+}
+
+func (h *HashTable) Delete(key string) bool {
+	s, hash := h.locate(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return ttl
+	return s.remove(key, hash)
 }
 
-func (h *HashTable) Expire(key string, ttl time.Duration) bool {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+func (h *HashTable) Exists(key string) bool {
+	s, hash := h.locate(key)
+	_, exists := s.lookup(key, hash)
+	return exists
+}
 
-	bucketIndex := h.hash(key)
-	bucket := h.buckets[bucketIndex]
+func (h *HashTable) Keys(pattern string) []string {
+	keys := make([]string, 0)
+	now := time.Now().UnixNano()
 
-	entry, exists := bucket[key]
-	if !exists {
-		return false
+	for _, s := range h.shards {
+		s.mu.RLock()
+		s.forEach(func(node *bucketEntry) {
+			// Check expiration
+			if node.entry.expired(now) {
+				return
+			}
+
+			if matchesPattern(node.key, pattern) {
+				keys = append(keys, node.key)
+			}
+		})
+		s.mu.RUnlock()
 	}
 
-	if ttl > 0 {
-		entry.Expiration = time.Now().Add(ttl).UnixNano()
-	} else {
-		entry.Expiration = 0
+	return keys
+}
+
+// ExpireAt replaces the expiration of key with the absolute Unix nano
+// timestamp at, 0 persisting the key, if cond allows it. It reports whether
+// the expiration was changed.
+func (h *HashTable) ExpireAt(key string, at int64, cond ExpireCondition) bool {
+	s, hash := h.locate(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.find(key, hash)
+	if node == nil || node.entry.expired(time.Now().UnixNano()) ||
+		!cond.allows(node.entry.Expiration, at) {
+		return false
 	}
 
+	node.entry.Expiration = at
+	s.indexExpiration(node)
 	return true
 }
 
 func (h *HashTable) Count() int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return h.count
+	count := 0
+	for _, s := range h.shards {
+		s.mu.RLock()
+		count += s.count
+		s.mu.RUnlock()
+	}
+	return count
 }
 
-func (h *HashTable) RemoveExpired() int {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	removed := 0
+// Entries returns a copy of every entry that has not expired
+func (h *HashTable) Entries() map[string]Entry {
+	entries := make(map[string]Entry)
 	now := time.Now().UnixNano()
 
-	for _, bucket := range h.buckets {
-		for key, entry := range bucket {
-			if entry.Expiration > 0 && now > entry.Expiration {
-				delete(bucket, key)
-				removed++
-				h.count--
+	for _, s := range h.shards {
+		s.mu.RLock()
+		s.forEach(func(node *bucketEntry) {
+			if !node.entry.expired(now) {
+				entries[node.key] = node.entry.clone()
 			}
-		}
+		})
+		s.mu.RUnlock()
 	}
 
-	return removed
+	return entries
 }
 
-func matchesPattern(key, pattern string) bool {
-	if pattern == "*" {
-		return true
+// RemoveExpired deletes every expired key. It walks the whole expires index,
+// so the server relies on ActiveExpire instead and this is only meant for
+// one-off sweeps.
+func (h *HashTable) RemoveExpired() int {
+	removed := 0
+	now := time.Now().UnixNano()
+
+	for _, s := range h.shards {
+		s.mu.Lock()
+		_, expired := s.expireSample(len(s.expires), now)
+		s.mu.Unlock()
+
+		removed += len(expired)
+		h.expiredKeys(expired)
 	}
 
-	// Simple wildcard matching
-	patternIndex, keyIndex := 0, 0
-	patternLen, keyLen := len(pattern), len(key)
+	return removed
+}
+
+const (
+	// activeExpireSamples is how many keys with a TTL are checked at once
+	activeExpireSamples = 20
+	// activeExpireRepeatRatio: a shard is sampled again while more than
+	// 1/activeExpireRepeatRatio of its sample had expired
+	activeExpireRepeatRatio = 4
+)
 
-	for patternIndex < patternLen {
-		if pattern[patternIndex] == '*' {
-			patternIndex++
-			if patternIndex >= patternLen {
-				return true
+// ActiveExpire reclaims expired keys the way Redis does: each shard's expires
+// index is sampled and sampling is repeated while more than a quarter of the
+// sample had expired, until deadline. Memory is freed promptly without ever
+// scanning the whole table. A cycle cut short by the deadline is resumed by
+// the next one from the following shard, so every shard gets its turn. It
+// returns the number of keys deleted.
+func (h *HashTable) ActiveExpire(deadline time.Time) int {
+	removed := 0
+	start := int(h.expireNext.Load())
+	for i := range tableShards {
+		index := (start + i) % tableShards
+		s := h.shards[index]
+		for {
+			s.mu.Lock()
+			sampled, expired := s.expireSample(activeExpireSamples, time.Now().UnixNano())
+			s.mu.Unlock()
+
+			removed += len(expired)
+			h.expiredKeys(expired)
+			if time.Now().After(deadline) {
+				h.expireNext.Store(int64((index + 1) % tableShards))
+				return removed
 			}
-
-			for keyIndex < keyLen {
-				if matchesPattern(key[keyIndex:], pattern[patternIndex:]) {
-					return true
-				}
-				keyIndex++
+			if sampled == 0 || len(expired)*activeExpireRepeatRatio <= sampled {
+				break
 			}
-			return false
-		} else if keyIndex < keyLen && (pattern[patternIndex] == '?' || pattern[patternIndex] == key[keyIndex]) {
-			patternIndex++
-			keyIndex++
-		} else {
-			return false
 		}
 	}
+	return removed
+}
 
-	return keyIndex == keyLen
+// Clear removes every key and shrinks all shards back to their initial size
+func (h *HashTable) Clear() {
+	// All shards are held so the memory counter resets together with them
+	for _, s := range h.shards {
+		s.mu.Lock()
+	}
+	for _, s := range h.shards {
+		s.tables = [2]*table{newTable(s.minSize)}
+		s.rehashIdx = -1
+		s.count = 0
+		s.expires = make(map[string]*bucketEntry)
+	}
+	h.used.Store(0)
+	for _, s := range h.shards {
+		s.mu.Unlock()
+	}
 }
@@ -0,0 +1,329 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rehashingShards returns how many shards of h are in the middle of a rehash
+func rehashingShards(h *HashTable) int {
+	n := 0
+	for _, s := range h.shards {
+		s.mu.RLock()
+		if s.rehashing() {
+			n++
+		}
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+func TestHashTableIncrementalRehash(t *testing.T) {
+	h := NewHashTable(tableShards * minShardSize)
+
+	// Fill the table until a shard starts growing, then check that every key
+	// stays readable while both of its tables are in use
+	seen := false
+	n := 0
+	for ; n < 100000; n++ {
+		h.Set(strconv.Itoa(n), n, 0)
+		if rehashingShards(h) > 0 {
+			seen = true
+			if n > 10000 {
+				break
+			}
+		}
+	}
+	if !seen {
+		t.Fatal("no shard ever rehashed incrementally")
+	}
+	for i := 0; i <= n; i++ {
+		if value, ok := h.Get(strconv.Itoa(i)); !ok || value != i {
+			t.Fatalf("key %d: got %v, %v while rehashing", i, value, ok)
+		}
+	}
+
+	for h.RehashFor(time.Millisecond) {
+	}
+	if h.Count() != n+1 {
+		t.Fatalf("count: got %d, want %d", h.Count(), n+1)
+	}
+	for i, s := range h.shards {
+		if s.rehashing() {
+			t.Fatalf("shard %d still rehashing", i)
+		}
+		if size := len(s.tables[0].buckets); s.count >= size {
+			t.Fatalf("shard %d: %d keys in %d buckets", i, s.count, size)
+		}
+	}
+
+	// Deleting most keys shrinks the shards back, again without losing any
+	for i := 0; i <= n; i++ {
+		if i%16 != 0 {
+			h.Delete(strconv.Itoa(i))
+		}
+	}
+	for h.RehashFor(time.Millisecond) {
+	}
+	for i, s := range h.shards {
+		if size := len(s.tables[0].buckets); size > s.minSize && s.count*shrinkRatio < size {
+			t.Fatalf("shard %d: %d keys in %d buckets after shrinking", i, s.count, size)
+		}
+	}
+	for i := 0; i <= n; i += 16 {
+		if value, ok := h.Get(strconv.Itoa(i)); !ok || value != i {
+			t.Fatalf("key %d: got %v, %v after shrinking", i, value, ok)
+		}
+	}
+}
+
+// TestActiveExpireResumes runs cycles whose deadline has already passed, so
+// each one samples a single shard, and checks that they take turns instead of
+// sampling the first shard over and over
+func TestActiveExpireResumes(t *testing.T) {
+	h := NewHashTable(0)
+	for i := 0; i < 100*tableShards; i++ {
+		h.SetWithExpiration(strconv.Itoa(i), i, 1)
+	}
+	before := make([]int, tableShards)
+	for i, s := range h.shards {
+		before[i] = len(s.expires)
+	}
+
+	for range tableShards {
+		if h.ActiveExpire(time.Now()) == 0 {
+			t.Fatal("cycle deleted nothing")
+		}
+	}
+	for i, s := range h.shards {
+		if len(s.expires) == before[i] {
+			t.Fatalf("shard %d was never sampled", i)
+		}
+	}
+}
+
+// BenchmarkHashTableGrowth inserts into a table that starts small, so it
+// goes through many resizes, and reports the latency percentiles of single
+// inserts. With incremental rehashing the p99 and max stay close to the
+// median instead of spiking whenever a shard doubles.
+func BenchmarkHashTableGrowth(b *testing.B) {
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	latencies := make([]time.Duration, b.N)
+	h := NewHashTable(tableShards * minShardSize)
+
+	b.ResetTimer()
+	for i, key := range keys {
+		start := time.Now()
+		h.Set(key, i, 0)
+		latencies[i] = time.Since(start)
+	}
+	b.StopTimer()
+
+	reportLatencies(b, latencies)
+}
+
+// BenchmarkHashTableGetDuringGrowth measures reads of a table that keeps
+// growing, so lookups regularly have to check both tables of a shard
+func BenchmarkHashTableGetDuringGrowth(b *testing.B) {
+	h := NewHashTable(tableShards * minShardSize)
+	latencies := make([]time.Duration, b.N)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Set(strconv.Itoa(i), i, 0)
+		key := strconv.Itoa(i / 2)
+		start := time.Now()
+		h.Get(key)
+		latencies[i] = time.Since(start)
+	}
+	b.StopTimer()
+
+	reportLatencies(b, latencies)
+}
+
+// reportLatencies reports the median, p99, p99.9 and max of latencies
+func reportLatencies(b *testing.B, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	slices.Sort(latencies)
+	percentile := func(p float64) float64 {
+		return float64(latencies[int(float64(len(latencies)-1)*p)].Nanoseconds())
+	}
+	b.ReportMetric(percentile(0.5), "p50-ns")
+	b.ReportMetric(percentile(0.99), "p99-ns")
+	b.ReportMetric(percentile(0.999), "p99.9-ns")
+	b.ReportMetric(percentile(1), "max-ns")
+}
+
+func TestHashTableConcurrentAccess(t *testing.T) {
+	h := NewHashTable(0)
+	const workers, ops = 8, 2000
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				key := fmt.Sprintf("%d:%d", w, i)
+				h.Set(key, i, 0)
+				if value, ok := h.Get(key); !ok || value != i {
+					t.Errorf("key %s: got %v, %v", key, value, ok)
+					return
+				}
+				// Shared keys are written by every worker at once
+				h.Set(strconv.Itoa(i%64), w, 0)
+				h.Get(strconv.Itoa((i + 1) % 64))
+				if i%3 == 0 {
+					h.Delete(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := workers*ops - workers*((ops+2)/3) + 64
+	if got := h.Count(); got != want {
+		t.Fatalf("count: got %d, want %d", got, want)
+	}
+}
+
+// lockedMap is a map behind a single lock, the baseline the sharded table is
+// compared with in the parallel benchmarks
+type lockedMap struct {
+	mu sync.RWMutex
+	m  map[string]interface{}
+}
+
+func (l *lockedMap) Set(key string, value interface{}) {
+	l.mu.Lock()
+	l.m[key] = value
+	l.mu.Unlock()
+}
+
+func (l *lockedMap) Get(key string) (interface{}, bool) {
+	l.mu.RLock()
+	value, ok := l.m[key]
+	l.mu.RUnlock()
+	return value, ok
+}
+
+// benchmarkMixed runs a mix of one write for every four reads over a fixed
+// key space from every goroutine. Run it with -cpu 1,2,4,8 to see how the
+// throughput scales with GOMAXPROCS, and with -race to check the locking.
+func benchmarkMixed(b *testing.B, set func(string, interface{}), get func(string) (interface{}, bool)) {
+	const keySpace = 1 << 16
+	keys := make([]string, keySpace)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+		set(keys[i], i)
+	}
+
+	var next atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Every goroutine walks the keys from its own offset with a stride
+		// coprime with the key space
+		i := next.Add(1) * 7919
+		for pb.Next() {
+			key := keys[i%keySpace]
+			if i%5 == 0 {
+				set(key, i)
+			} else {
+				get(key)
+			}
+			i += 40503
+		}
+	})
+}
+
+func BenchmarkParallelMixed(b *testing.B) {
+	b.Run("sharded", func(b *testing.B) {
+		h := NewHashTable(0)
+		benchmarkMixed(b, func(key string, value interface{}) { h.Set(key, value, 0) }, h.Get)
+	})
+	b.Run("global-lock", func(b *testing.B) {
+		l := &lockedMap{m: make(map[string]interface{})}
+		benchmarkMixed(b, l.Set, l.Get)
+	})
+}
+
+// BenchmarkDataStoreParallelMixed is the same mix through the data store,
+// which is what the command handler calls
+func BenchmarkDataStoreParallelMixed(b *testing.B) {
+	ds := NewDataStore()
+	benchmarkMixed(b,
+		func(key string, value interface{}) { ds.Set(key, []byte("value"), 0) },
+		func(key string) (interface{}, bool) { return ds.Get(key) })
+}
+
+func FuzzHashTableKeys(f *testing.F) {
+	for _, seed := range []string{"", "a", "\x00", "\xff\xfe", "Aa", "BB", "key:1", "\x80\x00\x80"} {
+		f.Add(seed)
+	}
+
+	h := NewHashTable(0)
+	f.Fuzz(func(t *testing.T, key string) {
+		s, hash := h.locate(key)
+		if !slices.Contains(h.shards[:], s) {
+			t.Fatalf("key %q: located outside of the shards", key)
+		}
+		s.mu.RLock()
+		index := hash & s.tables[0].mask
+		size := len(s.tables[0].buckets)
+		s.mu.RUnlock()
+		if index >= uint64(size) {
+			t.Fatalf("key %q: bucket %d out of %d", key, index, size)
+		}
+
+		h.Set(key, key, 0)
+		if value, ok := h.Get(key); !ok || value != key {
+			t.Fatalf("key %q: got %v, %v", key, value, ok)
+		}
+		if !h.Delete(key) || h.Exists(key) {
+			t.Fatalf("key %q: not deleted", key)
+		}
+	})
+}
+
+// TestHashTableCollidingKeys stores keys that all collide under a Java style
+// 31*h hash ("Aa" and "BB" hash the same, and so does any string made of
+// them), which a seeded hash must still spread over the shards and buckets
+func TestHashTableCollidingKeys(t *testing.T) {
+	const parts = 12
+	h := NewHashTable(0)
+	for i := 0; i < 1<<parts; i++ {
+		key := ""
+		for bit := 0; bit < parts; bit++ {
+			if i&(1<<bit) != 0 {
+				key += "Aa"
+			} else {
+				key += "BB"
+			}
+		}
+		h.Set(key, i, 0)
+	}
+
+	longest := 0
+	for _, s := range h.shards {
+		for _, node := range s.tables[0].buckets {
+			length := 0
+			for ; node != nil; node = node.next {
+				length++
+			}
+			longest = max(longest, length)
+		}
+	}
+	if longest > 16 {
+		t.Fatalf("%d colliding keys share a bucket", longest)
+	}
+}
@@ -0,0 +1,29 @@
+package store
+
+// Invalidator is told about every written key, so that clients caching
+// values on their side can be told to drop them (CLIENT TRACKING). Its
+// methods are called with key locks held, so they must not block or call
+// back into the store.
+type Invalidator interface {
+	// KeyModified is called on every write of key, including expiration
+	// and eviction. writer is the client the write is attributed to (see
+	// SetWriter), or 0. It should be cheap when nothing is tracked.
+	KeyModified(key string, writer int64)
+	// KeysFlushed is called when the whole keyspace was replaced, by
+	// FLUSHALL or by loading a snapshot
+	KeysFlushed()
+}
+
+// SetInvalidator sets the invalidator told about written keys. It must be
+// called before the store is used concurrently.
+func (ds *DataStore) SetInvalidator(invalidator Invalidator) {
+	ds.invalidator = invalidator
+}
+
+// SetWriter attributes the writes made from now on to the client with ID
+// id, until it is called again with 0. The caller must make sure no other
+// client writes meanwhile, by running the command with no other command
+// interleaved. Keys that expire or are evicted are never attributed.
+func (ds *DataStore) SetWriter(id int64) {
+	ds.writer.Store(id)
+}
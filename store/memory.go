@@ -0,0 +1,140 @@
+package store
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// Memory estimates
+//
+// Every key carries an estimate of the memory it holds (Entry.size) and each
+// HashTable keeps the running total. Strings are sized on every write, while
+// collections are adjusted by the size of the elements added or removed, so
+// keeping the estimate up to date never walks a whole collection. The
+// overheads below approximate what the Go runtime allocates for each part of
+// a value; allocator size classes and fragmentation are not included.
+const (
+	// keyOverhead is the bucket node and Entry allocated for every key
+	keyOverhead = int64(unsafe.Sizeof(bucketEntry{}) + unsafe.Sizeof(Entry{}))
+	// boxOverhead is the header an interface value points to, such as the
+	// slice header of a string value
+	boxOverhead = int64(unsafe.Sizeof([]byte(nil)))
+	// collectionOverhead is the fixed part of a set or hash collection
+	collectionOverhead = int64(unsafe.Sizeof(collection[struct{}]{}))
+	// elementOverhead is the slice header of a list element
+	elementOverhead = int64(unsafe.Sizeof([]byte(nil)))
+	// memberOverhead is a set item plus the bucket header it takes up at
+	// the collection's maximum load factor of one item per bucket
+	memberOverhead = int64(unsafe.Sizeof(collectionItem[struct{}]{}) + unsafe.Sizeof([]collectionItem[struct{}](nil)))
+	// fieldOverhead is a hash item and its bucket header like memberOverhead,
+	// plus the field's Entry and the header of its value
+	fieldOverhead = int64(unsafe.Sizeof(collectionItem[*Entry]{})+unsafe.Sizeof([]collectionItem[*Entry](nil))) +
+		int64(unsafe.Sizeof(Entry{})) + boxOverhead
+)
+
+// sizeOf estimates the memory held by key and its value
+func sizeOf(key string, value interface{}) int64 {
+	size := keyOverhead + int64(len(key))
+	switch v := value.(type) {
+	case []byte:
+		size += boxOverhead + int64(len(v))
+	case [][]byte:
+		size += boxOverhead + elementsSize(v)
+	case *collection[struct{}]:
+		size += collectionOverhead
+		for member := range v.keys() {
+			size += memberSize(member)
+		}
+	case *collection[*Entry]:
+		size += collectionOverhead
+		for field, entry := range v.all() {
+			size += fieldSize(field, entry)
+		}
+	}
+	return size
+}
+
+// elementSize estimates the memory held by one list element
+func elementSize(element []byte) int64 {
+	return elementOverhead + int64(len(element))
+}
+
+// elementsSize estimates the memory held by several list elements
+func elementsSize(elements [][]byte) int64 {
+	var size int64
+	for _, element := range elements {
+		size += elementSize(element)
+	}
+	return size
+}
+
+// memberSize estimates the memory held by one set member
+func memberSize(member string) int64 {
+	return memberOverhead + int64(len(member))
+}
+
+// fieldSize estimates the memory held by one hash field and its value
+func fieldSize(field string, entry *Entry) int64 {
+	return fieldOverhead + int64(len(field)+len(entry.Value.([]byte)))
+}
+
+// MemoryUsage returns the estimated memory held by key and its value, and
+// whether the key exists. Looking a key up this way doesn't count as an
+// access for eviction.
+func (ds *DataStore) MemoryUsage(key string) (int64, bool) {
+	var usage int64
+	found := false
+	for _, table := range ds.tables() {
+		if entry, exists := table.Peek(key); exists {
+			usage += entry.size
+			found = true
+		}
+	}
+	return usage, found
+}
+
+// MemoryStats breaks the memory usage of the store down
+type MemoryStats struct {
+	// Allocated is the heap memory allocated by the whole process, as
+	// reported by the Go runtime
+	Allocated int64
+	// Dataset is the estimated memory held by keys and values
+	Dataset int64
+	// Strings, Lists, Sets and Hashes split Dataset by value type
+	Strings int64
+	Lists   int64
+	Sets    int64
+	Hashes  int64
+	// Keys is the number of keys, including expired keys not yet reclaimed
+	Keys int
+	// MaxMemory and EvictedKeys mirror the eviction settings and counters
+	MaxMemory   int64
+	EvictedKeys int64
+}
+
+// MemoryStats reports how memory is used. Reading the runtime's statistics
+// briefly stops the world, so it is meant for diagnostics only.
+func (ds *DataStore) MemoryStats() MemoryStats {
+	var runtimeStats runtime.MemStats
+	runtime.ReadMemStats(&runtimeStats)
+
+	stats := MemoryStats{
+		Allocated:   int64(runtimeStats.HeapAlloc),
+		Strings:     ds.stringStore.Used(),
+		Lists:       ds.listStore.Used(),
+		Sets:        ds.setStore.Used(),
+		Hashes:      ds.hashStore.Used(),
+		MaxMemory:   ds.MaxMemory(),
+		EvictedKeys: ds.EvictedKeys(),
+	}
+	stats.Dataset = stats.Strings + stats.Lists + stats.Sets + stats.Hashes
+	for _, table := range ds.tables() {
+		stats.Keys += table.Count()
+	}
+	return stats
+}
+
+// tables returns the typed tables of the store
+func (ds *DataStore) tables() []*HashTable {
+	return []*HashTable{ds.stringStore, ds.listStore, ds.setStore, ds.hashStore}
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidKeyspaceEvents = errors.New("ERR Invalid event class character. Use 'Ag$lshzxet'.")
+
+// KeyspaceEvents selects which keyspace notifications are published, like
+// Redis' notify-keyspace-events setting
+type KeyspaceEvents uint32
+
+const (
+	EventKeyspace KeyspaceEvents = 1 << iota // K: __keyspace@0__:<key> channels
+	EventKeyevent                            // E: __keyevent@0__:<event> channels
+	EventGeneric                             // g: del, expire, persist...
+	EventString                              // $: string commands
+	EventList                                // l: list commands
+	EventSet                                 // s: set commands
+	EventHash                                // h: hash commands
+	EventZSet                                // z: sorted set commands
+	EventExpired                             // x: keys deleted because they expired
+	EventEvicted                             // e: keys evicted because of maxmemory
+	EventStream                              // t: stream commands
+
+	// EventAll is the A alias for every event class
+	EventAll = EventGeneric | EventString | EventList | EventSet | EventHash |
+		EventZSet | EventExpired | EventEvicted | EventStream
+)
+
+// keyspaceEventFlags maps the characters of notify-keyspace-events to
+// classes, in the order String prints them
+var keyspaceEventFlags = []struct {
+	flag  byte
+	class KeyspaceEvents
+}{
+	{'g', EventGeneric}, {'$', EventString}, {'l', EventList}, {'s', EventSet},
+	{'h', EventHash}, {'z', EventZSet}, {'x', EventExpired}, {'e', EventEvicted},
+	{'t', EventStream}, {'K', EventKeyspace}, {'E', EventKeyevent},
+}
+
+// ParseKeyspaceEvents parses a notify-keyspace-events string such as "KEA"
+// or "Ex". Nothing is published unless K or E is part of it.
+func ParseKeyspaceEvents(flags string) (KeyspaceEvents, error) {
+	var events KeyspaceEvents
+	for i := 0; i < len(flags); i++ {
+		if flags[i] == 'A' {
+			events |= EventAll
+			continue
+		}
+
+		found := false
+		for _, f := range keyspaceEventFlags {
+			if f.flag == flags[i] {
+				events |= f.class
+				found = true
+			}
+		}
+		if !found {
+			return 0, ErrInvalidKeyspaceEvents
+		}
+	}
+	return events, nil
+}
+
+func (e KeyspaceEvents) String() string {
+	var flags strings.Builder
+	if e&EventAll == EventAll {
+		flags.WriteByte('A')
+	}
+	for _, f := range keyspaceEventFlags {
+		if e&f.class != 0 && (f.class&EventAll == 0 || e&EventAll != EventAll) {
+			flags.WriteByte(f.flag)
+		}
+	}
+	return flags.String()
+}
+
+// NotifyFunc publishes a keyspace notification message on channel. It is
+// called with key locks held, so it must not block or call back into the
+// store.
+type NotifyFunc func(channel string, message []byte)
+
+// SetNotifier sets the function notifications are published with. It must
+// be called before the store is used concurrently.
+func (ds *DataStore) SetNotifier(notifier NotifyFunc) {
+	ds.notifier = notifier
+}
+
+func (ds *DataStore) SetKeyspaceEvents(events KeyspaceEvents) {
+	ds.keyspaceEvents.Store(uint32(events))
+}
+
+func (ds *DataStore) KeyspaceEvents() KeyspaceEvents {
+	return KeyspaceEvents(ds.keyspaceEvents.Load())
+}
+
+// notify publishes event for key if its class is enabled. Notifications are
+// off by default, in which case this is a single atomic load. Every write
+// goes through notify, so it also bumps the version of watched keys.
+func (ds *DataStore) notify(class KeyspaceEvents, event, key string) {
+	var writer int64
+	if class&(EventExpired|EventEvicted) == 0 {
+		writer = ds.writer.Load()
+	}
+	ds.touch(key, writer)
+
+	events := ds.KeyspaceEvents()
+	if events&class == 0 || ds.notifier == nil {
+		return
+	}
+
+	if events&EventKeyspace != 0 {
+		ds.notifier("__keyspace@0__:"+key, []byte(event))
+	}
+	if events&EventKeyevent != 0 {
+		ds.notifier("__keyevent@0__:"+event, []byte(key))
+	}
+}
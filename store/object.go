@@ -0,0 +1,47 @@
+package store
+
+import "time"
+
+// ObjectInfo describes how a key is stored, for the OBJECT command
+type ObjectInfo struct {
+	// Encoding is the internal representation of the value
+	Encoding string
+	// Idle is the time since the key was last read or written
+	Idle time.Duration
+	// Freq is the logarithmic access counter used by LFU eviction, after
+	// idle decay
+	Freq uint32
+}
+
+// Object returns introspection data about key without counting as an access
+func (ds *DataStore) Object(key string) (ObjectInfo, bool) {
+	for _, table := range ds.tables() {
+		entry, exists := table.Peek(key)
+		if !exists {
+			continue
+		}
+
+		now := time.Now().UnixNano()
+		return ObjectInfo{
+			Encoding: encodingOf(entry.Value),
+			Idle:     time.Duration(now - entry.accessed),
+			Freq:     entry.frequency(now),
+		}, true
+	}
+	return ObjectInfo{}, false
+}
+
+// encodingOf names the representation of a value. Memora has none of Redis'
+// compact encodings (int, embstr, listpack, intset), so every value reports
+// the general purpose encoding Redis uses for its type once it outgrows them:
+// tools checking for a compact encoding correctly find none.
+func encodingOf(value interface{}) string {
+	switch value.(type) {
+	case []byte:
+		return "raw"
+	case [][]byte:
+		return "quicklist"
+	default:
+		return "hashtable"
+	}
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"strings"
+	"time"
+)
+
+// HashObserver is told about every change to hashes, so secondary indexes
+// over them can be kept up to date. Its methods are called with key locks
+// held, so they must not call back into the store.
+type HashObserver interface {
+	// Observes reports whether changes to the hash at key are of interest.
+	// It is called on every hash write and should be cheap.
+	Observes(key string) bool
+	// HashChanged is called with the live fields of the hash at key after
+	// it changed, or with nil once the key no longer exists
+	HashChanged(key string, fields map[string][]byte)
+	// HashesCleared is called when every key was removed by FLUSHALL
+	HashesCleared()
+}
+
+// SetHashObserver sets the observer of hash changes. It must be called before
+// the store is used concurrently.
+func (ds *DataStore) SetHashObserver(observer HashObserver) {
+	ds.hashObserver = observer
+}
+
+// hashChanged reports the current fields of the hash at key to the observer.
+// Callers must hold the key lock.
+func (ds *DataStore) hashChanged(key string) {
+	if ds.hashObserver == nil || !ds.hashObserver.Observes(key) {
+		return
+	}
+
+	entry, exists := ds.hashStore.Peek(key)
+	if !exists {
+		ds.hashObserver.HashChanged(key, nil)
+		return
+	}
+
+	now := time.Now().UnixNano()
+	hash := entry.Value.(*collection[*Entry])
+	fields := make(map[string][]byte, hash.len())
+	for field, fieldEntry := range hash.all() {
+		if !fieldEntry.expired(now) {
+			fields[field] = fieldEntry.Value.([]byte)
+		}
+	}
+	if len(fields) == 0 {
+		fields = nil
+	}
+	ds.hashObserver.HashChanged(key, fields)
+}
+
+// hashExpired queues a hash key that was deleted because it expired. Keys can
+// expire during lookups that don't hold the key lock, so the observer is told
+// later by flushExpiredHashes, which can take it.
+func (ds *DataStore) hashExpired(key string) {
+	if ds.hashObserver == nil || !ds.hashObserver.Observes(key) {
+		return
+	}
+
+	ds.expiredHashesMu.Lock()
+	ds.expiredHashes[key] = struct{}{}
+	ds.expiredHashesMu.Unlock()
+}
+
+// flushExpiredHashes reports the queued expired hashes to the observer. A key
+// written again in the meantime was already reported by its writer, so it
+// is skipped.
+func (ds *DataStore) flushExpiredHashes() {
+	ds.expiredHashesMu.Lock()
+	keys := ds.expiredHashes
+	if len(keys) > 0 {
+		ds.expiredHashes = make(map[string]struct{})
+	}
+	ds.expiredHashesMu.Unlock()
+
+	for key := range keys {
+		ds.lockKey(key)
+		if !ds.hashStore.Exists(key) {
+			ds.hashObserver.HashChanged(key, nil)
+		}
+		ds.unlockKey(key)
+	}
+}
+
+// ExpireHashes reclaims the expired hashes and hash fields right away, so the
+// observer no longer sees them. Only hashes with a TTL or field TTLs are
+// visited.
+func (ds *DataStore) ExpireHashes() {
+	ds.hashStore.RemoveExpired()
+	ds.removeExpiredFields()
+	ds.flushExpiredHashes()
+}
+
+// RefreshHashes reports every existing hash whose key starts with one of
+// prefixes to the observer, for indexes created over existing data. Hashes
+// written concurrently are reported by their writers as usual.
+func (ds *DataStore) RefreshHashes(prefixes []string) {
+	var cursor uint64
+	for {
+		next, keys, _ := ds.Scan(cursor, "*", 1000, "hash")
+		for _, key := range keys {
+			if !hasAnyPrefix(key, prefixes) {
+				continue
+			}
+			ds.lockKey(key)
+			ds.hashChanged(key)
+			ds.unlockKey(key)
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,16 +2,31 @@ package store
 
 import (
 	"encoding/gob"
+	"errors"
 	"log"
 	"os"
 	"sync"
 	"time"
 )
 
+func init() {
+	// Value types stored behind Entry.Value
+	gob.Register([]byte{})
+	gob.Register([][]byte{})
+	gob.Register(map[string]struct{}{})
+	gob.Register(map[string]*Entry{})
+}
+
+// ErrSnapshotBusy is returned by Save when a busy script kept the snapshot
+// from being taken
+var ErrSnapshotBusy = errors.New("snapshot skipped: a script is busy")
+
 type Persistence struct {
 	store    *DataStore
 	filename string
 	mu       sync.RWMutex
+	// snapshotter takes the snapshot to save, see SetSnapshotter
+	snapshotter func() (Snapshot, bool)
 }
 
 type Snapshot struct {
@@ -19,7 +34,9 @@ type Snapshot struct {
 	ListData   map[string]Entry
 	SetData    map[string]Entry
 	HashData   map[string]Entry
-	Timestamp  time.Time
+	// Functions holds the code of the function libraries by name
+	Functions map[string]string
+	Timestamp time.Time
 }
 
 func NewPersistence(store *DataStore, filename string) *Persistence {
@@ -29,10 +46,26 @@ func NewPersistence(store *DataStore, filename string) *Persistence {
 	}
 }
 
+// SetSnapshotter replaces DataStore.Snapshot as the way snapshots are taken.
+// The server uses it to take them between two commands, so that a snapshot
+// never holds half of a transaction or script. fn returns false when it
+// couldn't take the snapshot.
+func (p *Persistence) SetSnapshotter(fn func() (Snapshot, bool)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.snapshotter = fn
+}
+
 func (p *Persistence) Save() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	// Create snapshot
+	snapshot, err := p.createSnapshot()
+	if err != nil {
+		return err
+	}
+
 	file, err := os.Create(p.filename)
 	if err != nil {
 		return err
@@ -40,10 +73,6 @@ func (p *Persistence) Save() error {
 	defer file.Close()
 
 	encoder := gob.NewEncoder(file)
-
-	// Create snapshot
-	snapshot := p.createSnapshot()
-
 	err = encoder.Encode(snapshot)
 	if err != nil {
 		return err
@@ -53,21 +82,18 @@ func (p *Persistence) Save() error {
 	return nil
 }
 
-func (p *Persistence) createSnapshot() Snapshot {
-	// This is a simplified snapshot - in production you'd want to handle
-	// the actual data structures more carefully
-	snapshot := Snapshot{
-		StringData: make(map[string]Entry),
-		ListData:   make(map[string]Entry),
-		SetData:    make(map[string]Entry),
-		HashData:   make(map[string]Entry),
-		Timestamp:  time.Now(),
+func (p *Persistence) createSnapshot() (Snapshot, error) {
+	var snapshot Snapshot
+	if p.snapshotter != nil {
+		var ok bool
+		if snapshot, ok = p.snapshotter(); !ok {
+			return Snapshot{}, ErrSnapshotBusy
+		}
+	} else {
+		snapshot = p.store.Snapshot()
 	}
-
-	// Note: This is a placeholder - you'd need to implement proper serialization
-	// for the actual data structures in your store
-
-	return snapshot
+	snapshot.Timestamp = time.Now()
+	return snapshot, nil
 }
 
 func (p *Persistence) Load() error {
@@ -91,8 +117,7 @@ func (p *Persistence) Load() error {
 		return err
 	}
 
-	// Restore from snapshot
-	// Note: This is a placeholder - implement proper deserialization
+	p.store.Restore(snapshot)
 	log.Printf("Loaded snapshot from %s (created at %v)", p.filename, snapshot.Timestamp)
 
 	return nil
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"errors"
+	"math/bits"
+	"time"
+)
+
+var ErrUnknownType = errors.New("ERR unknown type name")
+
+// valueTypes names the value type held by each of the tables returned by
+// DataStore.tables
+var valueTypes = []string{"string", "list", "set", "hash"}
+
+// Key iteration
+//
+// SCAN walks the tables shard by shard with Redis' reverse binary cursor:
+// the bucket index is incremented from its most significant bit down, so
+// when a shard grows or shrinks between two calls, the buckets already
+// visited map to buckets that are also behind the cursor in the new table.
+// Keys present for the whole iteration are therefore returned at least once
+// (possibly more than once), even across resizes and while rehashing.
+//
+// The cursor holds the table and shard being scanned in its low
+// scanSegmentBits bits and the bucket cursor of that shard above them.
+const scanSegmentBits = 7
+
+// scanShard emits every node of the buckets of shard i at bucket cursor v
+// and returns the next cursor, or 0 once the whole shard has been visited.
+// While rehashing, the bucket of the smaller table and all the buckets of
+// the larger table it expands to are emitted together.
+func (h *HashTable) scanShard(i int, v uint64, fn func(node *bucketEntry)) uint64 {
+	s := h.shards[i]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.count == 0 {
+		return 0
+	}
+
+	visit := func(t *table, index uint64) {
+		for node := t.buckets[index]; node != nil; node = node.next {
+			fn(node)
+		}
+	}
+
+	if !s.rehashing() {
+		t := s.tables[0]
+		visit(t, v&t.mask)
+		return nextScanCursor(v, t.mask)
+	}
+
+	small, large := s.tables[0], s.tables[1]
+	if len(small.buckets) > len(large.buckets) {
+		small, large = large, small
+	}
+
+	visit(small, v&small.mask)
+	for {
+		visit(large, v&large.mask)
+		v = nextScanCursor(v, large.mask)
+		// Stop once the bits only the larger table uses wrap around
+		if v&(small.mask^large.mask) == 0 {
+			return v
+		}
+	}
+}
+
+// nextScanCursor increments the reversed bits of v covered by mask
+func nextScanCursor(v, mask uint64) uint64 {
+	v |= ^mask
+	v = bits.Reverse64(v)
+	v++
+	return bits.Reverse64(v)
+}
+
+// Scan returns a batch of keys matching pattern, and the cursor to pass to
+// the next call, 0 once the iteration is complete. About count keys are
+// returned per call, and at most 10*count buckets are visited so a call
+// stays cheap even when few keys match. A non-empty valueType restricts the
+// keys to one type.
+func (ds *DataStore) Scan(cursor uint64, pattern string, count int, valueType string) (uint64, []string, error) {
+	tables := ds.tables()
+	only := -1
+	if valueType != "" {
+		for i, name := range valueTypes {
+			if name == valueType {
+				only = i
+			}
+		}
+		if only < 0 {
+			return 0, nil, ErrUnknownType
+		}
+	}
+
+	segments := uint64(len(tables) * tableShards)
+	segment, v := cursor&(1<<scanSegmentBits-1), cursor>>scanSegmentBits
+
+	keys := make([]string, 0, count)
+	now := time.Now().UnixNano()
+	collect := func(node *bucketEntry) {
+		if !node.entry.expired(now) && matchesPattern(node.key, pattern) {
+			keys = append(keys, node.key)
+		}
+	}
+
+	for visits := 0; segment < segments && len(keys) < count && visits < count*10; visits++ {
+		// Jump straight to the table of the requested type
+		if t := int(segment) / tableShards; only >= 0 && t != only {
+			if t < only {
+				segment, v = uint64(only*tableShards), 0
+			} else {
+				segment = segments
+			}
+			continue
+		}
+
+		v = tables[segment/tableShards].scanShard(int(segment%tableShards), v, collect)
+		if v == 0 {
+			segment++
+		}
+	}
+
+	if segment >= segments {
+		return 0, keys, nil
+	}
+	return v<<scanSegmentBits | segment, keys, nil
+}
+
+// SScan iterates the members of a set, visiting count buckets per call, see
+// collection.scan
+func (ds *DataStore) SScan(key string, cursor uint64, pattern string, count int) (uint64, [][]byte) {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	existing, ok := ds.setStore.Get(key)
+	if !ok {
+		return 0, nil
+	}
+
+	set := existing.(*collection[struct{}])
+	result := make([][]byte, 0, min(count, set.len()))
+	next := set.scan(cursor, count, func(member string, _ struct{}) {
+		if matchesPattern(member, pattern) {
+			result = append(result, []byte(member))
+		}
+	})
+	return next, result
+}
+
+// HScan iterates the fields of a hash like SScan. The result alternates field
+// names and values.
+func (ds *DataStore) HScan(key string, cursor uint64, pattern string, count int) (uint64, []interface{}) {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	hash := ds.readHash(key)
+	now := time.Now().UnixNano()
+	result := make([]interface{}, 0, 2*min(count, hash.len()))
+	next := hash.scan(cursor, count, func(field string, entry *Entry) {
+		if !entry.expired(now) && matchesPattern(field, pattern) {
+			result = append(result, field, entry.Value)
+		}
+	})
+	return next, result
+}
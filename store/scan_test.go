@@ -0,0 +1,109 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestSScanResize scans a set while it grows and shrinks between calls, past
+// a power of two either way, and checks that every member present for the
+// whole iteration is returned. The set changes by a few members per call, as
+// an iteration only ends if it covers buckets faster than they are added.
+func TestSScanResize(t *testing.T) {
+	tests := []struct {
+		name   string
+		resize func(ds *DataStore, call int)
+	}{
+		{"unchanged", func(ds *DataStore, call int) {}},
+		{"growing", func(ds *DataStore, call int) {
+			for i := 0; i < 5; i++ {
+				ds.SAdd("set", []byte("new:"+strconv.Itoa(call*5+i)))
+			}
+		}},
+		{"shrinking", func(ds *DataStore, call int) {
+			for i := 0; i < 5; i++ {
+				ds.SRem("set", []byte("temp:"+strconv.Itoa(call*5+i)))
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDataStore()
+			for i := 0; i < 1000; i++ {
+				ds.SAdd("set", []byte("kept:"+strconv.Itoa(i)))
+				ds.SAdd("set", []byte("temp:"+strconv.Itoa(i)))
+			}
+
+			seen := make(map[string]bool)
+			cursor, calls := uint64(0), 0
+			for {
+				next, members := ds.SScan("set", cursor, "kept:*", 10)
+				for _, member := range members {
+					seen[string(member)] = true
+				}
+				if next == 0 {
+					break
+				}
+				calls++
+				if calls > 10000 {
+					t.Fatal("the iteration never ends")
+				}
+				tt.resize(ds, calls)
+				cursor = next
+			}
+
+			for i := 0; i < 1000; i++ {
+				if member := "kept:" + strconv.Itoa(i); !seen[member] {
+					t.Fatalf("%s was never returned", member)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectionScan(t *testing.T) {
+	c := newCollection[struct{}](0)
+	for i := 0; i < 100; i++ {
+		c.put(strconv.Itoa(i), struct{}{})
+	}
+
+	// 100 items fill 128 buckets, so a COUNT of 16 takes 8 calls that each
+	// return a distinct share of the items
+	seen := make(map[string]bool)
+	cursor, calls := uint64(0), 0
+	for {
+		next := c.scan(cursor, 16, func(item string, _ struct{}) {
+			if seen[item] {
+				t.Fatalf("%s returned twice", item)
+			}
+			seen[item] = true
+		})
+		calls++
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if calls != 8 || len(seen) != c.len() {
+		t.Fatalf("%d calls returned %d items, want 8 calls and %d items", calls, len(seen), c.len())
+	}
+
+	// Dropping below 16 items leaves the 128 buckets less than 1/8 full, so
+	// the items are rehashed into 16 buckets
+	for i := 0; i < 95; i++ {
+		c.remove(strconv.Itoa(i))
+	}
+	if len(c.buckets) != 16 || c.len() != 5 {
+		t.Fatalf("got %d items in %d buckets, want 5 in 16", c.len(), len(c.buckets))
+	}
+	for i := 95; i < 100; i++ {
+		if _, ok := c.get(strconv.Itoa(i)); !ok {
+			t.Fatalf("%d lost when shrinking", i)
+		}
+	}
+
+	var empty *collection[struct{}]
+	if next := empty.scan(0, 10, func(string, struct{}) { t.Fatal("item in an empty collection") }); next != 0 {
+		t.Fatalf("empty collection: got cursor %d", next)
+	}
+}
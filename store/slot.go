@@ -0,0 +1,39 @@
+package store
+
+import "strings"
+
+// Keys are mapped to one of Slots hash slots, the unit a cluster of nodes
+// divides the keyspace by. Memora runs as a single node, which owns every
+// slot.
+
+// Slots is the number of hash slots
+const Slots = 16384
+
+// KeySlot returns the hash slot of a key: the CRC16 of the key modulo Slots.
+// If the key contains a hash tag, a non-empty {...} section, only the tag is
+// hashed, so keys sharing a tag share a slot.
+func KeySlot(key string) int {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			key = key[open+1 : open+1+end]
+		}
+	}
+	return int(crc16(key)) % Slots
+}
+
+// crc16 is CRC-16/XMODEM (polynomial 0x1021, initial value 0), the variant
+// Redis Cluster uses
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
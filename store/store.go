@@ -1,42 +1,213 @@
 package store
 
 import (
-	"fmt"
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	ErrNotInteger          = errors.New("ERR value is not an integer or out of range")
+	ErrNotFloat            = errors.New("ERR value is not a valid float")
+	ErrHashValueNotInteger = errors.New("ERR hash value is not an integer")
+	ErrHashValueNotFloat   = errors.New("ERR hash value is not a float")
+	ErrIncrOverflow        = errors.New("ERR increment or decrement would overflow")
+	ErrIncrNaNOrInfinity   = errors.New("ERR increment would produce NaN or Infinity")
+	ErrWrongType           = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+// DataStore holds the four typed tables. Read-modify-write operations lock the
+// stripe of their key, so writers of different keys don't contend.
+//
+// Lock ordering: evictMu is taken before key stripes, which are always taken
+// before HashTable shard locks, which are taken before volatileMu. Operations
+// that need several stripes
+// (MSET, snapshots, FLUSHALL) take them in ascending stripe order, so two
+// multi-key operations can never deadlock. watchMu is taken last of all.
 type DataStore struct {
-	mu          sync.RWMutex
+	locks       [lockStripes]sync.RWMutex
 	stringStore *HashTable
 	listStore   *HashTable
 	setStore    *HashTable
 	hashStore   *HashTable
+
+	// volatileHashes holds the keys of hashes with at least one field that
+	// has an expiration, so active expiry doesn't need to walk every hash
+	volatileMu     sync.Mutex
+	volatileHashes map[string]struct{}
+
+	// expireNext is the table the next active expire cycle starts with
+	expireNext atomic.Int64
+
+	// maxmemory settings, see eviction.go
+	evictMu         sync.Mutex
+	maxMemory       atomic.Int64
+	evictionPolicy  atomic.Int32
+	evictionSamples atomic.Int32
+	evictedKeys     atomic.Int64
+
+	// keyspace notifications, see notify.go
+	notifier       NotifyFunc
+	keyspaceEvents atomic.Uint32
+
+	// secondary indexes over hashes, see observer.go
+	hashObserver    HashObserver
+	expiredHashesMu sync.Mutex
+	expiredHashes   map[string]struct{}
+
+	// client-side caching invalidation, see invalidate.go
+	invalidator Invalidator
+	writer      atomic.Int64
+
+	// versions of the keys watched by transactions, see watch.go
+	watchMu  sync.Mutex
+	watched  map[string]*watchedKey
+	watching atomic.Int64
+
+	// code of the function libraries, see functions.go
+	librariesMu      sync.Mutex
+	libraries        map[string]string
+	librariesVersion uint64
+}
+
+// lockStripes is the number of key lock stripes
+const lockStripes = 256
+
+func (ds *DataStore) stripe(key string) int {
+	return int(hashKey(key) % lockStripes)
+}
+
+func (ds *DataStore) lockKey(key string) {
+	ds.locks[ds.stripe(key)].Lock()
+}
+
+func (ds *DataStore) unlockKey(key string) {
+	ds.locks[ds.stripe(key)].Unlock()
+}
+
+func (ds *DataStore) rlockKey(key string) {
+	ds.locks[ds.stripe(key)].RLock()
+}
+
+func (ds *DataStore) runlockKey(key string) {
+	ds.locks[ds.stripe(key)].RUnlock()
+}
+
+// lockKeys locks the stripes of all keys in ascending stripe order and returns
+// the function that unlocks them
+func (ds *DataStore) lockKeys(keys ...string) func() {
+	var stripes [lockStripes]bool
+	for _, key := range keys {
+		stripes[ds.stripe(key)] = true
+	}
+
+	for i := range stripes {
+		if stripes[i] {
+			ds.locks[i].Lock()
+		}
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			if stripes[i] {
+				ds.locks[i].Unlock()
+			}
+		}
+	}
+}
+
+// lockAll locks every stripe in ascending order, for reading or writing
+func (ds *DataStore) lockAll(write bool) func() {
+	for i := range ds.locks {
+		if write {
+			ds.locks[i].Lock()
+		} else {
+			ds.locks[i].RLock()
+		}
+	}
+	return func() {
+		for i := len(ds.locks) - 1; i >= 0; i-- {
+			if write {
+				ds.locks[i].Unlock()
+			} else {
+				ds.locks[i].RUnlock()
+			}
+		}
+	}
 }
 
 func NewDataStore() *DataStore {
-	return &DataStore{
-		stringStore: NewHashTable(1024),
-		listStore:   NewHashTable(512),
-		setStore:    NewHashTable(512),
-		hashStore:   NewHashTable(512),
+	ds := &DataStore{
+		stringStore:    NewHashTable(1024),
+		listStore:      NewHashTable(512),
+		setStore:       NewHashTable(512),
+		hashStore:      NewHashTable(512),
+		volatileHashes: make(map[string]struct{}),
+		expiredHashes:  make(map[string]struct{}),
+		watched:        make(map[string]*watchedKey),
+		libraries:      make(map[string]string),
+	}
+	ds.SetEvictionSamples(defaultEvictionSamples)
+	for _, table := range ds.tables() {
+		table.onExpired = func(key string) {
+			ds.notify(EventExpired, "expired", key)
+		}
+	}
+	ds.hashStore.onExpired = func(key string) {
+		ds.notify(EventExpired, "expired", key)
+		ds.hashExpired(key)
 	}
+	return ds
 }
 
 // Set String operations
-func (ds *DataStore) Set(key string, value interface{}, ttl time.Duration) {
+//
+// Every value held by the store is binary safe: strings are []byte, lists are
+// [][]byte, sets are *collection[struct{}] (Go strings may hold arbitrary bytes)
+// and hashes map field names to entries holding []byte.
+func (ds *DataStore) Set(key string, value []byte, ttl time.Duration) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	ds.clearNonString(key)
 	ds.stringStore.Set(key, value, ttl)
+	ds.notify(EventString, "set", key)
+	if ttl > 0 {
+		ds.notify(EventGeneric, "expire", key)
+	}
 }
 
-func (ds *DataStore) Get(key string) (interface{}, bool) {
-	return ds.stringStore.Get(key)
+func (ds *DataStore) Get(key string) ([]byte, bool) {
+	value, ok := ds.stringStore.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.([]byte), true
 }
 
 func (ds *DataStore) Delete(key string) bool {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	return ds.delete(key)
+}
+
+// delete removes key whatever its type. Callers must hold the key's lock.
+func (ds *DataStore) delete(key string) bool {
 	deleted := ds.stringStore.Delete(key)
 	deleted = ds.listStore.Delete(key) || deleted
 	deleted = ds.setStore.Delete(key) || deleted
-	deleted = ds.hashStore.Delete(key) || deleted
+	if ds.hashStore.Delete(key) {
+		ds.hashChanged(key)
+		deleted = true
+	}
+	if deleted {
+		ds.notify(EventGeneric, "del", key)
+	}
 	return deleted
 }
 
@@ -71,97 +242,389 @@ func (ds *DataStore) Keys(pattern string) []string {
 	return keys
 }
 
-func (ds *DataStore) TTL(key string) int64 {
-	// Check all stores
-	if ttl := ds.stringStore.TTL(key); ttl != -2 {
-		return ttl
+// ExpireTime returns the absolute Unix nano expiration of key, -1 if it has
+// none or -2 if the key doesn't exist
+func (ds *DataStore) ExpireTime(key string) int64 {
+	for _, table := range ds.tables() {
+		if entry, exists := table.Peek(key); exists {
+			if entry.Expiration == 0 {
+				return -1
+			}
+			return entry.Expiration
+		}
 	}
-	if ttl := ds.listStore.TTL(key); ttl != -2 {
-		return ttl
+	return -2
+}
+
+// ExpireAt sets the expiration of key to the absolute Unix nano timestamp at
+// if cond allows it. A time in the past deletes the key right away. It
+// reports whether the key was changed.
+func (ds *DataStore) ExpireAt(key string, at int64, cond ExpireCondition) bool {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	for _, table := range ds.tables() {
+		entry, exists := table.Peek(key)
+		if !exists {
+			continue
+		}
+		if !cond.allows(entry.Expiration, at) {
+			return false
+		}
+
+		if at <= time.Now().UnixNano() {
+			return ds.delete(key)
+		}
+		table.ExpireAt(key, at, ExpireAlways)
+		ds.notify(EventGeneric, "expire", key)
+		return true
 	}
-	if ttl := ds.setStore.TTL(key); ttl != -2 {
-		return ttl
+	return false
+}
+
+// Persist removes the expiration of key. It reports whether the key had one.
+func (ds *DataStore) Persist(key string) bool {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	for _, table := range ds.tables() {
+		if entry, exists := table.Peek(key); exists {
+			if entry.Expiration == 0 || !table.ExpireAt(key, 0, ExpireAlways) {
+				return false
+			}
+			ds.notify(EventGeneric, "persist", key)
+			return true
+		}
 	}
-	if ttl := ds.hashStore.TTL(key); ttl != -2 {
-		return ttl
+	return false
+}
+
+// SetOptions holds the modifiers of the SET command
+type SetOptions struct {
+	NX         bool  // only set if the key doesn't exist
+	XX         bool  // only set if the key already exists
+	Get        bool  // the previous value is wanted, so it must be a string
+	KeepTTL    bool  // keep the current expiration of the key
+	Expiration int64 // absolute Unix nano expiration, 0 means none
+}
+
+// SetWithOptions sets a string value honouring the SET modifiers, replacing
+// the key whatever its type. It returns the previous value if it was a
+// string, whether the key existed and whether the value was written. With
+// opts.Get, a key of another type is left alone and ErrWrongType returned.
+func (ds *DataStore) SetWithOptions(key string, value []byte, opts SetOptions) ([]byte, bool, bool, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	old, isString := ds.stringStore.GetEntry(key)
+	exists := isString
+	for _, table := range []*HashTable{ds.listStore, ds.setStore, ds.hashStore} {
+		if exists {
+			break
+		}
+		old, exists = table.GetEntry(key)
 	}
-	return -2
+	if opts.Get && exists && !isString {
+		return nil, true, false, ErrWrongType
+	}
+	oldValue, _ := old.Value.([]byte)
+	if (opts.NX && exists) || (opts.XX && !exists) {
+		return oldValue, exists, false, nil
+	}
+
+	expiration := opts.Expiration
+	if opts.KeepTTL && exists {
+		expiration = old.Expiration
+	}
+
+	ds.clearNonString(key)
+	ds.stringStore.SetWithExpiration(key, value, expiration)
+	ds.notify(EventString, "set", key)
+	if opts.Expiration > 0 {
+		ds.notify(EventGeneric, "expire", key)
+	}
+	return oldValue, exists, true, nil
 }
 
-func (ds *DataStore) Expire(key string, ttl time.Duration) bool {
-	expired := ds.stringStore.Expire(key, ttl)
-	expired = ds.listStore.Expire(key, ttl) || expired
-	expired = ds.setStore.Expire(key, ttl) || expired
-	expired = ds.hashStore.Expire(key, ttl) || expired
-	return expired
+// clearNonString removes key from the tables of the other types, before a
+// string replaces it. Callers must hold the key's lock.
+func (ds *DataStore) clearNonString(key string) {
+	ds.listStore.Delete(key)
+	ds.setStore.Delete(key)
+	if ds.hashStore.Delete(key) {
+		ds.hashChanged(key)
+	}
+}
+
+// otherType reports whether key is held by a table other than own, meaning a
+// command for own's type must fail with ErrWrongType. Callers must hold the
+// key's lock.
+func (ds *DataStore) otherType(key string, own *HashTable) bool {
+	for _, table := range ds.tables() {
+		if table != own && table.Exists(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// MSet sets several string keys at once. With nx set, nothing is written if
+// any of the keys already exists.
+func (ds *DataStore) MSet(keys []string, values [][]byte, nx bool) bool {
+	unlock := ds.lockKeys(keys...)
+	defer unlock()
+
+	if nx {
+		for _, key := range keys {
+			if ds.Exists(key) {
+				return false
+			}
+		}
+	}
+
+	for i, key := range keys {
+		ds.clearNonString(key)
+		ds.stringStore.Set(key, values[i], 0)
+		ds.notify(EventString, "set", key)
+	}
+	return true
+}
+
+func (ds *DataStore) MGet(keys ...string) []interface{} {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if value, ok := ds.stringStore.Get(key); ok {
+			values[i] = value
+		}
+	}
+	return values
+}
+
+func (ds *DataStore) GetDel(key string) ([]byte, bool, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.stringStore) {
+		return nil, false, ErrWrongType
+	}
+	value, exists := ds.stringStore.Get(key)
+	if !exists {
+		return nil, false, nil
+	}
+	ds.stringStore.Delete(key)
+	ds.notify(EventGeneric, "del", key)
+	return value.([]byte), true, nil
+}
+
+// GetEx returns the value of key and, when update is set, replaces its
+// expiration with the absolute Unix nano timestamp expiration (0 persists it).
+func (ds *DataStore) GetEx(key string, update bool, expiration int64) ([]byte, bool, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.stringStore) {
+		return nil, false, ErrWrongType
+	}
+	entry, exists := ds.stringStore.GetEntry(key)
+	if !exists {
+		return nil, false, nil
+	}
+
+	if update {
+		ds.stringStore.SetWithExpiration(key, entry.Value, expiration)
+		if expiration > 0 {
+			ds.notify(EventGeneric, "expire", key)
+		} else {
+			ds.notify(EventGeneric, "persist", key)
+		}
+	}
+	return entry.Value.([]byte), true, nil
+}
+
+// Append appends value to the string at key and returns the new length
+func (ds *DataStore) Append(key string, value []byte) (int, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.stringStore) {
+		return 0, ErrWrongType
+	}
+	entry, _ := ds.stringStore.GetEntry(key)
+	current, _ := entry.Value.([]byte)
+
+	// Appending past len never touches bytes a reader may still hold
+	updated := append(current, value...)
+	ds.stringStore.SetWithExpiration(key, updated, entry.Expiration)
+	ds.notify(EventString, "append", key)
+	return len(updated), nil
+}
+
+// SetRange overwrites part of the string at key starting at offset, padding
+// with zero bytes when the string is too short. It returns the new length.
+func (ds *DataStore) SetRange(key string, offset int, value []byte) (int, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.stringStore) {
+		return 0, ErrWrongType
+	}
+	entry, _ := ds.stringStore.GetEntry(key)
+	current, _ := entry.Value.([]byte)
+	if len(value) == 0 {
+		return len(current), nil
+	}
+
+	// Copy rather than modify in place: readers may still hold current
+	size := len(current)
+	if end := offset + len(value); end > size {
+		size = end
+	}
+	buf := make([]byte, size)
+	copy(buf, current)
+	copy(buf[offset:], value)
+
+	ds.stringStore.SetWithExpiration(key, buf, entry.Expiration)
+	ds.notify(EventString, "setrange", key)
+	return len(buf), nil
+}
+
+// IncrBy adds delta to the integer stored at key, keeping its expiration
+func (ds *DataStore) IncrBy(key string, delta int64) (int64, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.stringStore) {
+		return 0, ErrWrongType
+	}
+	entry, exists := ds.stringStore.GetEntry(key)
+
+	var current int64
+	if exists {
+		num, err := strconv.ParseInt(string(entry.Value.([]byte)), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		current = num
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) ||
+		(delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrIncrOverflow
+	}
+
+	current += delta
+	ds.stringStore.SetWithExpiration(key, strconv.AppendInt(nil, current, 10), entry.Expiration)
+	ds.notify(EventString, "incrby", key)
+	return current, nil
+}
+
+// IncrByFloat adds delta to the float stored at key, keeping its expiration
+func (ds *DataStore) IncrByFloat(key string, delta float64) (float64, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.stringStore) {
+		return 0, ErrWrongType
+	}
+	entry, exists := ds.stringStore.GetEntry(key)
+
+	var current float64
+	if exists {
+		num, err := strconv.ParseFloat(string(entry.Value.([]byte)), 64)
+		if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
+			return 0, ErrNotFloat
+		}
+		current = num
+	}
+
+	current += delta
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return 0, ErrIncrNaNOrInfinity
+	}
+
+	ds.stringStore.SetWithExpiration(key, strconv.AppendFloat(nil, current, 'f', -1, 64), entry.Expiration)
+	ds.notify(EventString, "incrbyfloat", key)
+	return current, nil
 }
 
 // LPush List operations
-func (ds *DataStore) LPush(key string, values ...interface{}) int {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+func (ds *DataStore) LPush(key string, values ...[]byte) (int, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
 
-	var list []interface{}
+	if ds.otherType(key, ds.listStore) {
+		return 0, ErrWrongType
+	}
+
+	var list [][]byte
 	if existing, ok := ds.listStore.Get(key); ok {
-		list = existing.([]interface{})
+		list = existing.([][]byte)
 	}
 
 	list = append(values, list...)
-	ds.listStore.Set(key, list, 0)
-	return len(list)
+	ds.listStore.Update(key, list, elementsSize(values))
+	ds.notify(EventList, "lpush", key)
+	return len(list), nil
 }
 
-func (ds *DataStore) RPush(key string, values ...interface{}) int {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+func (ds *DataStore) RPush(key string, values ...[]byte) (int, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
 
-	var list []interface{}
+	if ds.otherType(key, ds.listStore) {
+		return 0, ErrWrongType
+	}
+
+	var list [][]byte
 	if existing, ok := ds.listStore.Get(key); ok {
-		list = existing.([]interface{})
+		list = existing.([][]byte)
 	}
 
 	list = append(list, values...)
-	ds.listStore.Set(key, list, 0)
-	return len(list)
+	ds.listStore.Update(key, list, elementsSize(values))
+	ds.notify(EventList, "rpush", key)
+	return len(list), nil
 }
 
-func (ds *DataStore) LPop(key string) interface{} {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+func (ds *DataStore) LPop(key string) []byte {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
 
 	existing, ok := ds.listStore.Get(key)
 	if !ok {
 		return nil
 	}
 
-	list := existing.([]interface{})
+	list := existing.([][]byte)
 	if len(list) == 0 {
 		return nil
 	}
 
 	value := list[0]
 	list = list[1:]
-	ds.listStore.Set(key, list, 0)
+	ds.listStore.Update(key, list, -elementSize(value))
+	ds.notify(EventList, "lpop", key)
 	return value
 }
 
-func (ds *DataStore) RPop(key string) interface{} {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+func (ds *DataStore) RPop(key string) []byte {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
 
 	existing, ok := ds.listStore.Get(key)
 	if !ok {
 		return nil
 	}
 
-	list := existing.([]interface{})
+	list := existing.([][]byte)
 	if len(list) == 0 {
 		return nil
 	}
 
 	value := list[len(list)-1]
 	list = list[:len(list)-1]
-	ds.listStore.Set(key, list, 0)
+	ds.listStore.Update(key, list, -elementSize(value))
+	ds.notify(EventList, "rpop", key)
 	return value
 }
 
@@ -171,141 +634,646 @@ func (ds *DataStore) LLen(key string) int {
 		return 0
 	}
 
-	list := existing.([]interface{})
+	list := existing.([][]byte)
 	return len(list)
 }
 
 // SAdd Set operations
-func (ds *DataStore) SAdd(key string, members ...interface{}) int {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+func (ds *DataStore) SAdd(key string, members ...[]byte) (int, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
 
-	set := make(map[interface{}]bool)
+	if ds.otherType(key, ds.setStore) {
+		return 0, ErrWrongType
+	}
+
+	var set *collection[struct{}]
 	if existing, ok := ds.setStore.Get(key); ok {
-		set = existing.(map[interface{}]bool)
+		set = existing.(*collection[struct{}])
+	} else {
+		set = newCollection[struct{}](len(members))
 	}
 
 	added := 0
+	var delta int64
 	for _, member := range members {
-		if !set[member] {
-			set[member] = true
+		if set.put(string(member), struct{}{}) {
+			delta += memberSize(string(member))
 			added++
 		}
 	}
 
-	ds.setStore.Set(key, set, 0)
-	return added
+	ds.setStore.Update(key, set, delta)
+	if added > 0 {
+		ds.notify(EventSet, "sadd", key)
+	}
+	return added, nil
 }
 
-func (ds *DataStore) SRem(key string, members ...interface{}) int {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+func (ds *DataStore) SRem(key string, members ...[]byte) int {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
 
 	existing, ok := ds.setStore.Get(key)
 	if !ok {
 		return 0
 	}
 
-	set := existing.(map[interface{}]bool)
+	set := existing.(*collection[struct{}])
 	removed := 0
+	var delta int64
 	for _, member := range members {
-		if set[member] {
-			delete(set, member)
+		if _, exists := set.remove(string(member)); exists {
+			delta -= memberSize(string(member))
 			removed++
 		}
 	}
 
-	ds.setStore.Set(key, set, 0)
+	ds.setStore.Update(key, set, delta)
+	if removed > 0 {
+		ds.notify(EventSet, "srem", key)
+	}
 	return removed
 }
 
-func (ds *DataStore) SMembers(key string) []interface{} {
-	existing, ok := ds.setStore.Get(key)
-	if !ok {
-		fmt.Printf("DEBUG: Set '%s' not found\n", key) // Debug log
-		return nil
-	}
+func (ds *DataStore) SMembers(key string) [][]byte {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
 
-	set, ok := existing.(map[interface{}]bool)
+	existing, ok := ds.setStore.Get(key)
 	if !ok {
-		fmt.Printf("DEBUG: Invalid set type for key '%s': %T\n", key, existing) // Debug log
 		return nil
 	}
 
-	members := make([]interface{}, 0, len(set))
-	for member := range set {
-		members = append(members, member)
-		fmt.Printf("DEBUG: Found member '%v' in set '%s'\n", member, key) // Debug log
+	set := existing.(*collection[struct{}])
+	members := make([][]byte, 0, set.len())
+	for member := range set.keys() {
+		members = append(members, []byte(member))
 	}
 
 	return members
 }
 
-func (ds *DataStore) SIsMember(key string, member interface{}) bool {
+func (ds *DataStore) SIsMember(key string, member []byte) bool {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
 	existing, ok := ds.setStore.Get(key)
 	if !ok {
 		return false
 	}
 
-	set := existing.(map[interface{}]bool)
-	return set[member]
+	_, exists := existing.(*collection[struct{}]).get(string(member))
+	return exists
 }
 
 // HSet Hash operations
-func (ds *DataStore) HSet(key string, field string, value interface{}) bool {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+//
+// A hash is stored as a *collection[*Entry] so every field can carry its own
+// expiration. Expired fields are skipped on read, dropped when a write touches
+// them and reclaimed in bulk by RemoveExpired.
+func (ds *DataStore) HSet(key string, field string, value []byte) (bool, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
 
-	hash := make(map[string]interface{})
-	if existing, ok := ds.hashStore.Get(key); ok {
-		hash = existing.(map[string]interface{})
+	if ds.otherType(key, ds.hashStore) {
+		return false, ErrWrongType
 	}
 
-	exists := hash[field] != nil
-	hash[field] = value
-	ds.hashStore.Set(key, hash, 0)
-	return !exists
+	hash := ds.writableHash(key)
+	_, exists := ds.liveField(key, hash, field)
+	ds.putField(key, hash, field, &Entry{Value: value})
+	ds.notify(EventHash, "hset", key)
+	ds.hashChanged(key)
+	return !exists, nil
 }
 
-func (ds *DataStore) HGet(key, field string) interface{} {
-	existing, ok := ds.hashStore.Get(key)
+func (ds *DataStore) HGet(key, field string) []byte {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	entry, ok := fieldEntry(ds.readHash(key), field, time.Now().UnixNano())
 	if !ok {
 		return nil
 	}
-
-	hash := existing.(map[string]interface{})
-	return hash[field]
+	return entry.Value.([]byte)
 }
 
 func (ds *DataStore) HDel(key string, fields ...string) int {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
 
-	existing, ok := ds.hashStore.Get(key)
-	if !ok {
+	hash := ds.readHash(key)
+	if hash == nil {
 		return 0
 	}
 
-	hash := existing.(map[string]interface{})
 	deleted := 0
 	for _, field := range fields {
-		if hash[field] != nil {
-			delete(hash, field)
+		if _, exists := ds.liveField(key, hash, field); exists {
+			ds.deleteField(key, hash, field)
 			deleted++
 		}
 	}
 
-	ds.hashStore.Set(key, hash, 0)
+	ds.dropIfEmpty(key, hash)
+	if deleted > 0 {
+		ds.notify(EventHash, "hdel", key)
+		ds.hashChanged(key)
+	}
 	return deleted
 }
 
-func (ds *DataStore) HGetAll(key string) map[string]interface{} {
+func (ds *DataStore) HGetAll(key string) map[string][]byte {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	hash := ds.readHash(key)
+	if hash == nil {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	result := make(map[string][]byte, hash.len())
+	for field, entry := range hash.all() {
+		if !entry.expired(now) {
+			result[field] = entry.Value.([]byte)
+		}
+	}
+	return result
+}
+
+func (ds *DataStore) HMGet(key string, fields ...string) []interface{} {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	hash := ds.readHash(key)
+	now := time.Now().UnixNano()
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if entry, ok := fieldEntry(hash, field, now); ok {
+			values[i] = entry.Value
+		}
+	}
+	return values
+}
+
+func (ds *DataStore) HExists(key, field string) bool {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	_, exists := fieldEntry(ds.readHash(key), field, time.Now().UnixNano())
+	return exists
+}
+
+func (ds *DataStore) HLen(key string) int {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	hash := ds.readHash(key)
+	ds.volatileMu.Lock()
+	_, volatile := ds.volatileHashes[key]
+	ds.volatileMu.Unlock()
+	if !volatile {
+		return hash.len()
+	}
+
+	now := time.Now().UnixNano()
+	count := 0
+	for _, entry := range hash.all() {
+		if !entry.expired(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// HSetNX sets field only if it does not already exist in the hash
+func (ds *DataStore) HSetNX(key string, field string, value []byte) (bool, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.hashStore) {
+		return false, ErrWrongType
+	}
+
+	hash := ds.writableHash(key)
+	if _, exists := ds.liveField(key, hash, field); exists {
+		return false, nil
+	}
+
+	ds.putField(key, hash, field, &Entry{Value: value})
+	ds.notify(EventHash, "hset", key)
+	ds.hashChanged(key)
+	return true, nil
+}
+
+func (ds *DataStore) HIncrBy(key, field string, increment int64) (int64, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.hashStore) {
+		return 0, ErrWrongType
+	}
+
+	hash := ds.writableHash(key)
+
+	var current int64
+	entry, exists := ds.liveField(key, hash, field)
+	if exists {
+		num, err := strconv.ParseInt(string(entry.Value.([]byte)), 10, 64)
+		if err != nil {
+			return 0, ErrHashValueNotInteger
+		}
+		current = num
+	}
+
+	if (increment > 0 && current > math.MaxInt64-increment) ||
+		(increment < 0 && current < math.MinInt64-increment) {
+		ds.dropIfEmpty(key, hash)
+		return 0, ErrIncrOverflow
+	}
+
+	current += increment
+	ds.setFieldValue(key, hash, field, entry, strconv.AppendInt(nil, current, 10))
+	ds.notify(EventHash, "hincrby", key)
+	ds.hashChanged(key)
+	return current, nil
+}
+
+func (ds *DataStore) HIncrByFloat(key, field string, increment float64) (float64, error) {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	if ds.otherType(key, ds.hashStore) {
+		return 0, ErrWrongType
+	}
+
+	hash := ds.writableHash(key)
+
+	var current float64
+	entry, exists := ds.liveField(key, hash, field)
+	if exists {
+		num, err := strconv.ParseFloat(string(entry.Value.([]byte)), 64)
+		if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
+			return 0, ErrHashValueNotFloat
+		}
+		current = num
+	}
+
+	current += increment
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		ds.dropIfEmpty(key, hash)
+		return 0, ErrIncrNaNOrInfinity
+	}
+
+	ds.setFieldValue(key, hash, field, entry, strconv.AppendFloat(nil, current, 'f', -1, 64))
+	ds.notify(EventHash, "hincrbyfloat", key)
+	ds.hashChanged(key)
+	return current, nil
+}
+
+func (ds *DataStore) HStrLen(key, field string) int {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	entry, exists := fieldEntry(ds.readHash(key), field, time.Now().UnixNano())
+	if !exists {
+		return 0
+	}
+	return len(entry.Value.([]byte))
+}
+
+// HRandField returns random fields from a hash. A positive count returns up to
+// count distinct fields, a negative count returns exactly -count fields which
+// may repeat.
+func (ds *DataStore) HRandField(key string, count int) []string {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	fields := liveFields(ds.readHash(key), time.Now().UnixNano())
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if count < 0 {
+		// The reply may repeat fields, so it is as long as asked for: grow it
+		// as it is filled rather than trusting count with the allocation
+		result := make([]string, 0, min(-count, 1024))
+		for len(result) < -count {
+			result = append(result, fields[rand.Intn(len(fields))])
+		}
+		return result
+	}
+
+	rand.Shuffle(len(fields), func(i, j int) {
+		fields[i], fields[j] = fields[j], fields[i]
+	})
+	if count < len(fields) {
+		fields = fields[:count]
+	}
+	return fields
+}
+
+// HExpire sets the expiration of each field to the absolute Unix nano
+// timestamp at. The result holds one code per field: -2 if the field doesn't
+// exist, 0 if cond was not met, 1 if the expiration was set and 2 if the field
+// was deleted because at is already in the past.
+func (ds *DataStore) HExpire(key string, at int64, cond ExpireCondition, fields ...string) []int {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	results := make([]int, len(fields))
+	hash := ds.readHash(key)
+	now := time.Now().UnixNano()
+
+	for i, field := range fields {
+		entry, exists := ds.liveField(key, hash, field)
+		switch {
+		case !exists:
+			results[i] = -2
+		case !cond.allows(entry.Expiration, at):
+			results[i] = 0
+		case at <= now:
+			ds.deleteField(key, hash, field)
+			results[i] = 2
+		default:
+			entry.Expiration = at
+			ds.volatileMu.Lock()
+			ds.volatileHashes[key] = struct{}{}
+			ds.volatileMu.Unlock()
+			results[i] = 1
+		}
+	}
+
+	if slices.Contains(results, 1) {
+		ds.notify(EventHash, "hexpire", key)
+	}
+	if hash != nil {
+		ds.dropIfEmpty(key, hash)
+	}
+	if slices.Contains(results, 2) {
+		ds.notify(EventHash, "hexpired", key)
+		ds.hashChanged(key)
+	}
+	return results
+}
+
+// HExpireTime returns the absolute expiration (Unix nano) of each field, -1 if
+// the field has no expiration and -2 if it doesn't exist.
+func (ds *DataStore) HExpireTime(key string, fields ...string) []int64 {
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+
+	hash := ds.readHash(key)
+	now := time.Now().UnixNano()
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		entry, exists := fieldEntry(hash, field, now)
+		switch {
+		case !exists:
+			results[i] = -2
+		case entry.Expiration == 0:
+			results[i] = -1
+		default:
+			results[i] = entry.Expiration
+		}
+	}
+	return results
+}
+
+// HPersist removes the expiration of each field. The result holds -2 if the
+// field doesn't exist, -1 if it has no expiration and 1 if it was removed.
+func (ds *DataStore) HPersist(key string, fields ...string) []int {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	hash := ds.readHash(key)
+	results := make([]int, len(fields))
+	for i, field := range fields {
+		entry, exists := ds.liveField(key, hash, field)
+		switch {
+		case !exists:
+			results[i] = -2
+		case entry.Expiration == 0:
+			results[i] = -1
+		default:
+			entry.Expiration = 0
+			results[i] = 1
+		}
+	}
+
+	if slices.Contains(results, 1) {
+		ds.notify(EventHash, "hpersist", key)
+	}
+	if hash != nil {
+		ds.dropIfEmpty(key, hash)
+	}
+	return results
+}
+
+// readHash returns the hash stored at key or nil. Callers must hold the key
+// lock.
+func (ds *DataStore) readHash(key string) *collection[*Entry] {
 	existing, ok := ds.hashStore.Get(key)
 	if !ok {
 		return nil
 	}
+	return existing.(*collection[*Entry])
+}
+
+// writableHash returns the hash stored at key, creating an empty one if it
+// doesn't exist. Callers must hold the key lock for writing.
+func (ds *DataStore) writableHash(key string) *collection[*Entry] {
+	hash := ds.readHash(key)
+	if hash == nil {
+		hash = newCollection[*Entry](0)
+		ds.hashStore.Set(key, hash, 0)
+	}
+	return hash
+}
+
+// liveField looks up field and lazily deletes it if it has expired. Callers
+// must hold the key lock for writing.
+func (ds *DataStore) liveField(key string, hash *collection[*Entry], field string) (*Entry, bool) {
+	entry, exists := hash.get(field)
+	if !exists {
+		return nil, false
+	}
+	if entry.expired(time.Now().UnixNano()) {
+		ds.deleteField(key, hash, field)
+		ds.hashChanged(key)
+		ds.touch(key, 0)
+		return nil, false
+	}
+	return entry, true
+}
+
+// putField stores field in the hash at key, keeping the key's memory estimate
+// up to date. Callers must hold the key lock for writing.
+func (ds *DataStore) putField(key string, hash *collection[*Entry], field string, entry *Entry) {
+	delta := fieldSize(field, entry)
+	if old, exists := hash.get(field); exists {
+		delta -= fieldSize(field, old)
+	}
+	hash.put(field, entry)
+	ds.hashStore.Update(key, hash, delta)
+}
+
+// deleteField removes field from the hash at key, keeping the key's memory
+// estimate up to date. Callers must hold the key lock for writing and call
+// dropIfEmpty afterwards.
+func (ds *DataStore) deleteField(key string, hash *collection[*Entry], field string) {
+	if old, exists := hash.remove(field); exists {
+		ds.hashStore.Update(key, hash, -fieldSize(field, old))
+	}
+}
+
+// dropIfEmpty deletes the key once its last field is gone. Callers must hold
+// the key lock for writing.
+func (ds *DataStore) dropIfEmpty(key string, hash *collection[*Entry]) {
+	if hash.len() == 0 {
+		ds.hashStore.Delete(key)
+		ds.volatileMu.Lock()
+		delete(ds.volatileHashes, key)
+		ds.volatileMu.Unlock()
+	}
+}
+
+func fieldEntry(hash *collection[*Entry], field string, now int64) (*Entry, bool) {
+	entry, exists := hash.get(field)
+	if !exists || entry.expired(now) {
+		return nil, false
+	}
+	return entry, true
+}
+
+func liveFields(hash *collection[*Entry], now int64) []string {
+	fields := make([]string, 0, hash.len())
+	for field, entry := range hash.all() {
+		if !entry.expired(now) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// setFieldValue updates a field in place so that its expiration is kept
+func (ds *DataStore) setFieldValue(key string, hash *collection[*Entry], field string, entry *Entry, value []byte) {
+	if entry == nil {
+		ds.putField(key, hash, field, &Entry{Value: value})
+		return
+	}
+	delta := int64(len(value) - len(entry.Value.([]byte)))
+	entry.Value = value
+	ds.hashStore.Update(key, hash, delta)
+}
+
+// removeExpiredFields actively reclaims expired hash fields. Only hashes that
+// have had a field expiration set are visited. It returns the number of hash
+// keys deleted because all of their fields expired.
+func (ds *DataStore) removeExpiredFields() int {
+	ds.volatileMu.Lock()
+	keys := make([]string, 0, len(ds.volatileHashes))
+	for key := range ds.volatileHashes {
+		keys = append(keys, key)
+	}
+	ds.volatileMu.Unlock()
+
+	removed := 0
+	for _, key := range keys {
+		if ds.removeExpiredFieldsOf(key) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// removeExpiredFieldsOf drops the expired fields of one hash and reports
+// whether the whole key was deleted
+func (ds *DataStore) removeExpiredFieldsOf(key string) bool {
+	ds.lockKey(key)
+	defer ds.unlockKey(key)
+
+	now := time.Now().UnixNano()
+	hash := ds.readHash(key)
+	if hash == nil {
+		ds.volatileMu.Lock()
+		delete(ds.volatileHashes, key)
+		ds.volatileMu.Unlock()
+		return false
+	}
+
+	volatile := false
+	var expired []string
+	for field, entry := range hash.all() {
+		if entry.expired(now) {
+			expired = append(expired, field)
+		} else if entry.Expiration > 0 {
+			volatile = true
+		}
+	}
+	for _, field := range expired {
+		ds.deleteField(key, hash, field)
+	}
+
+	if !volatile {
+		ds.volatileMu.Lock()
+		delete(ds.volatileHashes, key)
+		ds.volatileMu.Unlock()
+	}
+	deleted := false
+	if hash.len() == 0 {
+		deleted = ds.hashStore.Delete(key)
+	}
+	if len(expired) > 0 {
+		ds.notify(EventHash, "hexpired", key)
+		ds.hashChanged(key)
+	}
+	return deleted
+}
+
+// ActiveExpire reclaims expired keys and hash fields by sampling, spending at
+// most roughly budget. It is meant to run frequently; RemoveExpired does a
+// full sweep instead. It returns the number of keys deleted.
+func (ds *DataStore) ActiveExpire(budget time.Duration) int {
+	deadline := time.Now().Add(budget)
+
+	// Like the shards of a table, the tables take turns starting a cycle
+	removed := 0
+	tables := ds.tables()
+	start := int(ds.expireNext.Load())
+	for i := range tables {
+		index := (start + i) % len(tables)
+		removed += tables[index].ActiveExpire(deadline)
+		if time.Now().After(deadline) {
+			// The table resumes from its next shard
+			ds.expireNext.Store(int64(index))
+			break
+		}
+	}
+
+	// Field expiry visits a random sample of the volatile hashes
+	ds.volatileMu.Lock()
+	keys := make([]string, 0, activeExpireSamples)
+	for key := range ds.volatileHashes {
+		if len(keys) == activeExpireSamples {
+			break
+		}
+		keys = append(keys, key)
+	}
+	ds.volatileMu.Unlock()
 
-	return existing.(map[string]interface{})
+	for _, key := range keys {
+		if time.Now().After(deadline) {
+			break
+		}
+		if ds.removeExpiredFieldsOf(key) {
+			removed++
+		}
+	}
+	ds.flushExpiredHashes()
+	return removed
 }
 
 func (ds *DataStore) RemoveExpired() int {
@@ -313,15 +1281,143 @@ func (ds *DataStore) RemoveExpired() int {
 	removed += ds.listStore.RemoveExpired()
 	removed += ds.setStore.RemoveExpired()
 	removed += ds.hashStore.RemoveExpired()
+	removed += ds.removeExpiredFields()
+	ds.flushExpiredHashes()
 	return removed
 }
 
+// Snapshot returns a point-in-time copy of every live key. Collections are
+// copied so the snapshot can be encoded while writes continue, sets and hashes
+// as plain maps.
+func (ds *DataStore) Snapshot() Snapshot {
+	unlock := ds.lockAll(false)
+	defer unlock()
+
+	functions, _ := ds.FunctionLibraries()
+	return Snapshot{
+		StringData: ds.stringStore.Entries(),
+		ListData:   cloneEntries(ds.listStore.Entries()),
+		SetData:    cloneEntries(ds.setStore.Entries()),
+		HashData:   cloneEntries(ds.hashStore.Entries()),
+		Functions:  functions,
+	}
+}
+
+// Restore loads the keys and function libraries of a snapshot, keeping the
+// keys' original expirations. Keys that expired while the server was down are
+// skipped.
+func (ds *DataStore) Restore(snapshot Snapshot) {
+	unlock := ds.lockAll(true)
+	defer unlock()
+
+	now := time.Now().UnixNano()
+	restore := func(table *HashTable, data map[string]Entry) {
+		for key, entry := range data {
+			if !entry.expired(now) {
+				table.SetWithExpiration(key, restoreValue(entry.Value), entry.Expiration)
+			}
+		}
+	}
+
+	restore(ds.stringStore, snapshot.StringData)
+	restore(ds.listStore, snapshot.ListData)
+	restore(ds.setStore, snapshot.SetData)
+	restore(ds.hashStore, snapshot.HashData)
+	for key := range snapshot.HashData {
+		ds.hashChanged(key)
+	}
+	ds.touchAll()
+	for name, code := range snapshot.Functions {
+		ds.SetFunctionLibrary(name, code)
+	}
+
+	ds.volatileMu.Lock()
+	defer ds.volatileMu.Unlock()
+	for key, entry := range snapshot.HashData {
+		for _, field := range entry.Value.(map[string]*Entry) {
+			if field.Expiration > 0 {
+				ds.volatileHashes[key] = struct{}{}
+				break
+			}
+		}
+	}
+}
+
+func cloneEntries(entries map[string]Entry) map[string]Entry {
+	for key, entry := range entries {
+		entry.Value = cloneValue(entry.Value)
+		entries[key] = entry
+	}
+	return entries
+}
+
+func cloneValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case [][]byte:
+		return append([][]byte(nil), v...)
+	case *collection[struct{}]:
+		set := make(map[string]struct{}, v.len())
+		for member := range v.keys() {
+			set[member] = struct{}{}
+		}
+		return set
+	case *collection[*Entry]:
+		hash := make(map[string]*Entry, v.len())
+		for field, entry := range v.all() {
+			copied := *entry
+			hash[field] = &copied
+		}
+		return hash
+	default:
+		return value
+	}
+}
+
+// restoreValue turns the maps a snapshot holds sets and hashes in back into
+// collections
+func restoreValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]struct{}:
+		set := newCollection[struct{}](len(v))
+		for member := range v {
+			set.put(member, struct{}{})
+		}
+		return set
+	case map[string]*Entry:
+		hash := newCollection[*Entry](len(v))
+		for field, entry := range v {
+			hash.put(field, entry)
+		}
+		return hash
+	default:
+		return value
+	}
+}
+
+// Rehash spends up to budget on each table's incremental rehashing so tables
+// that are not receiving writes still finish resizing
+func (ds *DataStore) Rehash(budget time.Duration) {
+	ds.stringStore.RehashFor(budget)
+	ds.listStore.RehashFor(budget)
+	ds.setStore.RehashFor(budget)
+	ds.hashStore.RehashFor(budget)
+}
+
 func (ds *DataStore) FlushAll() {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+	unlock := ds.lockAll(true)
+	defer unlock()
+
+	ds.stringStore.Clear()
+	ds.listStore.Clear()
+	ds.setStore.Clear()
+	ds.hashStore.Clear()
 
-	ds.stringStore = NewHashTable(1024)
-	ds.listStore = NewHashTable(512)
-	ds.setStore = NewHashTable(512)
-	ds.hashStore = NewHashTable(512)
+	ds.volatileMu.Lock()
+	ds.volatileHashes = make(map[string]struct{})
+	ds.volatileMu.Unlock()
+
+	if ds.hashObserver != nil {
+		ds.hashObserver.HashesCleared()
+	}
+	ds.touchAll()
 }
@@ -0,0 +1,106 @@
+package store
+
+import "time"
+
+// Watch records the version of a key when a client started watching it
+// (WATCH). A transaction of the client is aborted if the key was modified
+// since.
+//
+// Only watched keys have a version: every write bumps the version of its key
+// if someone watches it, which costs a single atomic load when nobody does.
+type Watch struct {
+	key     string
+	version uint64
+	// expiration is the Unix nano expiration the key had when the watch
+	// began, 0 if it had none. Reaching it counts as a modification even
+	// before the key is actually deleted.
+	expiration int64
+}
+
+// watchedKey is the version of a watched key and the number of watches on it
+type watchedKey struct {
+	version  uint64
+	watchers int
+}
+
+// WatchKey starts watching key
+func (ds *DataStore) WatchKey(key string) Watch {
+	// Writes hold the key's lock, so the expiration can't change before the
+	// version is recorded
+	ds.rlockKey(key)
+	defer ds.runlockKey(key)
+	expiration := max(ds.ExpireTime(key), 0)
+
+	ds.watchMu.Lock()
+	defer ds.watchMu.Unlock()
+
+	w := ds.watched[key]
+	if w == nil {
+		w = &watchedKey{}
+		ds.watched[key] = w
+		ds.watching.Add(1)
+	}
+	w.watchers++
+	return Watch{key: key, version: w.version, expiration: expiration}
+}
+
+// Unwatch releases a watch returned by WatchKey
+func (ds *DataStore) Unwatch(watch Watch) {
+	ds.watchMu.Lock()
+	defer ds.watchMu.Unlock()
+
+	w := ds.watched[watch.key]
+	if w == nil {
+		return
+	}
+	w.watchers--
+	if w.watchers == 0 {
+		delete(ds.watched, watch.key)
+		ds.watching.Add(-1)
+	}
+}
+
+// Modified reports whether the watched key was written or expired since the
+// watch began
+func (ds *DataStore) Modified(watch Watch) bool {
+	if watch.expiration > 0 && time.Now().UnixNano() > watch.expiration {
+		return true
+	}
+
+	ds.watchMu.Lock()
+	defer ds.watchMu.Unlock()
+
+	w := ds.watched[watch.key]
+	return w == nil || w.version != watch.version
+}
+
+// touch marks key as modified by writer for its watchers and the
+// invalidator. Every write reaches it through notify.
+func (ds *DataStore) touch(key string, writer int64) {
+	if ds.invalidator != nil {
+		ds.invalidator.KeyModified(key, writer)
+	}
+	if ds.watching.Load() == 0 {
+		return
+	}
+
+	ds.watchMu.Lock()
+	defer ds.watchMu.Unlock()
+	if w := ds.watched[key]; w != nil {
+		w.version++
+	}
+}
+
+// touchAll marks every key as modified, for operations replacing the whole
+// keyspace
+func (ds *DataStore) touchAll() {
+	if ds.invalidator != nil {
+		ds.invalidator.KeysFlushed()
+	}
+
+	ds.watchMu.Lock()
+	defer ds.watchMu.Unlock()
+	for _, w := range ds.watched {
+		w.version++
+	}
+}